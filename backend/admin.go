@@ -0,0 +1,387 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+)
+
+type adminUserJSON struct {
+	ID                int32              `json:"id"`
+	Name              string             `json:"name"`
+	Email             string             `json:"email"`
+	EmailVerified     bool               `json:"emailVerified"`
+	IsAdmin           bool               `json:"isAdmin"`
+	Disabled          bool               `json:"disabled"`
+	SubscriptionCount int64              `json:"subscriptionCount"`
+	SessionCount      int64              `json:"sessionCount"`
+	LastSeenTime      pgtype.Timestamptz `json:"lastSeenTime"`
+}
+
+func newAdminUserJSON(u *data.UserListing) adminUserJSON {
+	return adminUserJSON{
+		ID:                u.ID,
+		Name:              u.Name,
+		Email:             u.Email.String,
+		EmailVerified:     u.EmailVerified,
+		IsAdmin:           u.IsAdmin,
+		Disabled:          u.Disabled,
+		SubscriptionCount: u.SubscriptionCount,
+		SessionCount:      u.SessionCount,
+		LastSeenTime:      u.LastSeenTime,
+	}
+}
+
+// adminUserID returns the user ID in the URL. It responds with 404 and returns false if the ID is not an integer.
+func adminUserID(w http.ResponseWriter, req *http.Request) (int32, bool) {
+	userID, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 32)
+	if err != nil {
+		http.NotFound(w, req)
+		return 0, false
+	}
+	return int32(userID), true
+}
+
+// writeAdminUser responds with the user with userID.
+func writeAdminUser(w http.ResponseWriter, req *http.Request, env *environment, userID int32, status int) {
+	user, err := data.SelectUserListingByPK(context.Background(), env.pool, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectUserListingByPK failed", "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newAdminUserJSON(user))
+}
+
+func GetAdminUsersHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	users, err := data.SelectUserListings(context.Background(), env.pool)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectUserListings failed", "error", err)
+		return
+	}
+
+	response := make([]adminUserJSON, len(users))
+	for i, u := range users {
+		response[i] = newAdminUserJSON(u)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateAdminUserHandler creates a user. Unlike registration it does not log in as the new user.
+func CreateAdminUserHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+		IsAdmin  bool   `json:"isAdmin"`
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if request.Name == "" {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `Request must include the attribute "name"`)
+		return
+	}
+
+	if len(request.Name) > 30 {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `"name" must be less than 30 characters`)
+		return
+	}
+
+	if err := validatePassword(request.Password); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	user := &data.User{
+		Name:    pgtype.Text{String: request.Name, Valid: true},
+		Email:   newStringFallback(request.Email),
+		IsAdmin: request.IsAdmin,
+	}
+	SetPassword(user, request.Password)
+
+	userID, err := data.CreateUser(context.Background(), env.pool, user)
+	if err != nil {
+		var dupErr data.DuplicationError
+		if errors.As(err, &dupErr) {
+			w.WriteHeader(422)
+			fmt.Fprintf(w, `"%s" is already taken`, dupErr.Field)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("CreateUser failed", "error", err)
+		return
+	}
+
+	auditLog(req, env, "admin_user_created", env.user.ID.Int32, map[string]any{"userID": userID, "name": request.Name, "isAdmin": request.IsAdmin})
+
+	if user.Email.Valid && env.mailer != nil {
+		err = requestEmailVerification(req, env, userID, user.Email.String)
+		if err != nil {
+			env.logger.Error("requestEmailVerification failed", "error", err)
+		}
+	}
+
+	writeAdminUser(w, req, env, userID, http.StatusCreated)
+}
+
+// UpdateAdminUserHandler changes whether a user is an administrator and whether they are disabled. Attributes that are
+// not in the request are unchanged. Disabling a user revokes their sessions. Administrators cannot change these for
+// themselves so there is always at least one enabled administrator.
+func UpdateAdminUserHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	userID, ok := adminUserID(w, req)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		IsAdmin  *bool `json:"isAdmin"`
+		Disabled *bool `json:"disabled"`
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if userID == env.user.ID.Int32 {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "You cannot change your own administrator role or disable yourself")
+		return
+	}
+
+	err := pgx.BeginFunc(context.Background(), env.pool, func(tx pgx.Tx) error {
+		if request.IsAdmin != nil {
+			if err := data.UpdateUserAdmin(context.Background(), tx, userID, *request.IsAdmin); err != nil {
+				return err
+			}
+		}
+
+		if request.Disabled != nil {
+			if err := data.UpdateUserDisabled(context.Background(), tx, userID, *request.Disabled); err != nil {
+				return err
+			}
+			if *request.Disabled {
+				if _, err := data.DeleteSessionsByUserID(context.Background(), tx, userID, nil); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("UpdateAdminUser failed", "error", err)
+		return
+	}
+
+	if request.IsAdmin != nil {
+		event := "admin_role_revoked"
+		if *request.IsAdmin {
+			event = "admin_role_granted"
+		}
+		auditLog(req, env, event, env.user.ID.Int32, map[string]any{"userID": userID})
+	}
+	if request.Disabled != nil {
+		event := "admin_user_enabled"
+		if *request.Disabled {
+			event = "admin_user_disabled"
+		}
+		auditLog(req, env, event, env.user.ID.Int32, map[string]any{"userID": userID})
+	}
+
+	writeAdminUser(w, req, env, userID, http.StatusOK)
+}
+
+// DeleteAdminUserHandler deletes a user and all of their data. Administrators cannot delete themselves.
+func DeleteAdminUserHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	userID, ok := adminUserID(w, req)
+	if !ok {
+		return
+	}
+
+	if userID == env.user.ID.Int32 {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "You cannot delete yourself")
+		return
+	}
+
+	user, err := data.SelectUserByPK(context.Background(), env.pool, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectUserByPK failed", "error", err)
+		return
+	}
+
+	if err := data.DeleteUser(context.Background(), env.pool, userID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("DeleteUser failed", "error", err)
+		return
+	}
+
+	// The audit log entry belongs to the administrator since the deleted user's ID is cleared from the log.
+	auditLog(req, env, "admin_user_deleted", env.user.ID.Int32, map[string]any{"userID": userID, "name": user.Name.String})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetAdminUserPasswordHandler sets a user's password and revokes their sessions.
+func SetAdminUserPasswordHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	userID, ok := adminUserID(w, req)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if err := validatePassword(request.Password); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	err := pgx.BeginFunc(context.Background(), env.pool, func(tx pgx.Tx) error {
+		user, err := data.SelectUserByPK(context.Background(), tx, userID)
+		if err != nil {
+			return err
+		}
+
+		if err := SetPassword(user, request.Password); err != nil {
+			return err
+		}
+
+		if err := data.UpdateUser(context.Background(), tx, userID, user); err != nil {
+			return err
+		}
+
+		// An administrator setting their own password keeps the session making the request like an account update.
+		_, err = data.DeleteSessionsByUserID(context.Background(), tx, userID, env.sessionID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SetAdminUserPassword failed", "error", err)
+		return
+	}
+
+	auditLog(req, env, "admin_password_set", env.user.ID.Int32, map[string]any{"userID": userID})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteAdminUserSessionsHandler revokes all of a user's sessions. The session making the request is kept.
+func DeleteAdminUserSessionsHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	userID, ok := adminUserID(w, req)
+	if !ok {
+		return
+	}
+
+	count, err := data.DeleteSessionsByUserID(context.Background(), env.pool, userID, env.sessionID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("DeleteSessionsByUserID failed", "error", err)
+		return
+	}
+
+	auditLog(req, env, "admin_sessions_revoked", env.user.ID.Int32, map[string]any{"userID": userID, "count": count})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminFeedJSON struct {
+	ID              int32              `json:"id"`
+	Name            string             `json:"name"`
+	URL             string             `json:"url"`
+	LastFetchTime   pgtype.Timestamptz `json:"lastFetchTime"`
+	LastFailure     string             `json:"lastFailure,omitempty"`
+	LastFailureTime pgtype.Timestamptz `json:"lastFailureTime"`
+	FailureCount    int32              `json:"failureCount"`
+	CreationTime    time.Time          `json:"creationTime"`
+	SubscriberCount int64              `json:"subscriberCount"`
+}
+
+// GetAdminFeedsHandler responds with the fetch status of all feeds with the most failing first. With the query
+// parameter failing=true only feeds whose last fetch failed are included.
+func GetAdminFeedsHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	failingOnly := req.URL.Query().Get("failing") == "true"
+
+	feeds, err := data.SelectFeedHealth(context.Background(), env.pool, failingOnly)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectFeedHealth failed", "error", err)
+		return
+	}
+
+	response := make([]adminFeedJSON, len(feeds))
+	for i, f := range feeds {
+		response[i] = adminFeedJSON{
+			ID:              f.ID,
+			Name:            f.Name,
+			URL:             f.URL,
+			LastFetchTime:   f.LastFetchTime,
+			LastFailure:     f.LastFailure.String,
+			LastFailureTime: f.LastFailureTime,
+			FailureCount:    f.FailureCount,
+			CreationTime:    f.CreationTime,
+			SubscriberCount: f.SubscriberCount,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,167 @@
+package backend
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	createUser := func(name string, isAdmin bool) int32 {
+		user := &data.User{Name: pgtype.Text{String: name, Valid: true}, IsAdmin: isAdmin}
+		SetPassword(user, "password")
+		userID, err := data.CreateUser(ctx, pool, user)
+		require.NoError(t, err)
+		err = data.InsertSession(ctx, pool, &data.Session{ID: []byte(name), UserID: userID})
+		require.NoError(t, err)
+		return userID
+	}
+	adminID := createUser("admin", true)
+	joeID := createUser("joe", false)
+
+	router := NewAPIHandler(pool, &testMailer{}, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	do := func(session, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		req.Header.Set("X-Authentication", hex.EncodeToString([]byte(session)))
+		req.RemoteAddr = "127.0.0.1:54678"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("joe", "GET", "/admin/users", "")
+	require.Equal(t, http.StatusForbidden, w.Code, "non-administrators are rejected")
+
+	w = do("admin", "GET", "/admin/users", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var users []adminUserJSON
+	err := json.Unmarshal(w.Body.Bytes(), &users)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, "admin", users[0].Name)
+	require.True(t, users[0].IsAdmin)
+	require.Equal(t, "joe", users[1].Name)
+	require.EqualValues(t, 1, users[1].SessionCount)
+
+	w = do("admin", "POST", "/admin/users", `{"name": "sue", "password": "short"}`)
+	require.Equal(t, 422, w.Code)
+	w = do("admin", "POST", "/admin/users", `{"name": "joe", "password": "correct horse battery staple"}`)
+	require.Equal(t, 422, w.Code)
+	w = do("admin", "POST", "/admin/users", `{"name": "sue", "email": "sue@example.com", "password": "correct horse battery staple"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var sue adminUserJSON
+	err = json.Unmarshal(w.Body.Bytes(), &sue)
+	require.NoError(t, err)
+	require.Equal(t, "sue", sue.Name)
+	require.False(t, sue.IsAdmin)
+	require.False(t, sue.EmailVerified)
+
+	// Administrators cannot lock themselves out.
+	w = do("admin", "PATCH", fmt.Sprintf("/admin/users/%d", adminID), `{"disabled": true}`)
+	require.Equal(t, 422, w.Code)
+	w = do("admin", "DELETE", fmt.Sprintf("/admin/users/%d", adminID), "")
+	require.Equal(t, 422, w.Code)
+
+	w = do("admin", "PATCH", "/admin/users/-1", `{"disabled": true}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do("admin", "PATCH", fmt.Sprintf("/admin/users/%d", joeID), `{"disabled": true}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var joe adminUserJSON
+	err = json.Unmarshal(w.Body.Bytes(), &joe)
+	require.NoError(t, err)
+	require.True(t, joe.Disabled)
+	require.EqualValues(t, 0, joe.SessionCount, "disabling revokes sessions")
+
+	w = do("", "POST", "/sessions", `{"name": "joe", "password": "password"}`)
+	require.Equal(t, http.StatusForbidden, w.Code, "disabled users cannot log in")
+
+	w = do("admin", "PATCH", fmt.Sprintf("/admin/users/%d", joeID), `{"disabled": false, "isAdmin": true}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	err = json.Unmarshal(w.Body.Bytes(), &joe)
+	require.NoError(t, err)
+	require.False(t, joe.Disabled)
+	require.True(t, joe.IsAdmin)
+
+	w = do("", "POST", "/sessions", `{"name": "joe", "password": "password"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = do("admin", "PUT", fmt.Sprintf("/admin/users/%d/password", joeID), `{"password": "short"}`)
+	require.Equal(t, 422, w.Code)
+	w = do("admin", "PUT", fmt.Sprintf("/admin/users/%d/password", joeID), `{"password": "correct horse battery staple"}`)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	user, err := data.SelectUserByPK(ctx, pool, joeID)
+	require.NoError(t, err)
+	require.True(t, IsPassword(user, "correct horse battery staple"))
+	count, err := data.DeleteSessionsByUserID(ctx, pool, joeID, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, count, "setting the password revokes sessions")
+
+	err = data.InsertSession(ctx, pool, &data.Session{ID: []byte("joe"), UserID: joeID})
+	require.NoError(t, err)
+	w = do("admin", "DELETE", fmt.Sprintf("/admin/users/%d/sessions", joeID), "")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	w = do("joe", "GET", "/account", "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	err = data.InsertSubscription(ctx, pool, sue.ID, "http://news")
+	require.NoError(t, err)
+	_, err = pool.Exec(ctx, `update feeds set failure_count=3, last_failure='connection refused', last_failure_time=now() where url='http://news'`)
+	require.NoError(t, err)
+	err = data.InsertSubscription(ctx, pool, adminID, "http://sports")
+	require.NoError(t, err)
+
+	w = do("admin", "GET", "/admin/feeds?failing=true", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var feeds []adminFeedJSON
+	err = json.Unmarshal(w.Body.Bytes(), &feeds)
+	require.NoError(t, err)
+	require.Len(t, feeds, 1)
+	require.Equal(t, "http://news", feeds[0].URL)
+	require.EqualValues(t, 3, feeds[0].FailureCount)
+	require.Equal(t, "connection refused", feeds[0].LastFailure)
+	require.EqualValues(t, 1, feeds[0].SubscriberCount)
+
+	w = do("admin", "GET", "/admin/feeds", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	err = json.Unmarshal(w.Body.Bytes(), &feeds)
+	require.NoError(t, err)
+	require.Len(t, feeds, 2)
+
+	w = do("admin", "DELETE", fmt.Sprintf("/admin/users/%d", sue.ID), "")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	_, err = data.SelectUserByPK(ctx, pool, sue.ID)
+	require.Error(t, err)
+	w = do("admin", "DELETE", fmt.Sprintf("/admin/users/%d", sue.ID), "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	var events []string
+	rows, _ := pool.Query(ctx, `select event from audit_log where user_id=$1 order by id`, adminID)
+	for rows.Next() {
+		var event string
+		require.NoError(t, rows.Scan(&event))
+		events = append(events, event)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{
+		"admin_user_created",
+		"admin_user_disabled",
+		"admin_role_granted",
+		"admin_user_enabled",
+		"admin_password_set",
+		"admin_sessions_revoked",
+		"admin_user_deleted",
+	}, events)
+}
@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/tpr/backend/data"
+)
+
+// apiTokenPrefix marks API tokens so they are recognizable in configuration files and by secret scanners.
+const apiTokenPrefix = "tpr_"
+
+func genAPIToken() (string, error) {
+	token, err := genRandToken(32)
+	if err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + token, nil
+}
+
+// bearerToken returns the token from the request's Authorization header.
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// getUserFromAPIToken returns the user and API token for token. It returns nil for both if token does not exist.
+func getUserFromAPIToken(env *environment, token string) (*data.User, *data.APIToken) {
+	apiToken, err := data.SelectAPITokenByDigest(context.Background(), env.pool, tokenDigest(token))
+	if err != nil {
+		return nil, nil
+	}
+
+	user, err := data.SelectUserByPK(context.Background(), env.pool, apiToken.UserID)
+	if err != nil || user.Disabled {
+		return nil, nil
+	}
+
+	// Failing to record use only makes the last used time less accurate so the error is ignored.
+	data.TouchAPIToken(context.Background(), env.pool, apiToken.ID, time.Now())
+
+	return user, apiToken
+}
+
+// apiTokenAllows reports whether a request with method is within the scope of apiToken.
+func apiTokenAllows(apiToken *data.APIToken, method string) bool {
+	if apiToken.Scope == data.APITokenScopeReadWrite {
+		return true
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
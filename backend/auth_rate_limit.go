@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/tpr/backend/data"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// authRateLimit limits attempts from one IP address or for one account.
+type authRateLimit struct {
+	// FreeAttempts is the number of attempts allowed without delay.
+	FreeAttempts int64
+
+	// BaseDelay is the delay required after the first attempt beyond FreeAttempts. It doubles with each further attempt.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay. Once it is reached the IP address or account is effectively locked out until attempts
+	// fall out of the window.
+	MaxDelay time.Duration
+}
+
+// retryAfter returns how long after now to wait before another attempt is allowed given count attempts with the most
+// recent at last.
+func (l authRateLimit) retryAfter(count int64, last pgtype.Timestamptz, now time.Time) time.Duration {
+	if count < l.FreeAttempts || !last.Valid {
+		return 0
+	}
+
+	delay := l.MaxDelay
+	if shift := count - l.FreeAttempts; shift < 32 {
+		delay = min(l.BaseDelay<<shift, l.MaxDelay)
+	}
+
+	return max(last.Time.Add(delay).Sub(now), 0)
+}
+
+// authRateLimits are the limits for one action.
+type authRateLimits struct {
+	// Window is how long an attempt counts toward the limits.
+	Window time.Duration
+
+	IP      authRateLimit
+	Account authRateLimit
+}
+
+var defaultAuthRateLimits = map[string]authRateLimits{
+	// Failed logins.
+	data.AuthActionLogin: {
+		Window:  24 * time.Hour,
+		IP:      authRateLimit{FreeAttempts: 20, BaseDelay: time.Second, MaxDelay: 15 * time.Minute},
+		Account: authRateLimit{FreeAttempts: 5, BaseDelay: time.Second, MaxDelay: 15 * time.Minute},
+	},
+	// All password reset requests as each one sends an email.
+	data.AuthActionPasswordReset: {
+		Window:  24 * time.Hour,
+		IP:      authRateLimit{FreeAttempts: 10, BaseDelay: time.Minute, MaxDelay: time.Hour},
+		Account: authRateLimit{FreeAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour},
+	},
+	// All email verification requests as each one sends an email.
+	data.AuthActionEmailVerification: {
+		Window:  24 * time.Hour,
+		IP:      authRateLimit{FreeAttempts: 10, BaseDelay: time.Minute, MaxDelay: time.Hour},
+		Account: authRateLimit{FreeAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour},
+	},
+	// Fever API requests with an unknown api_key. The key does not identify an account so only the IP address is limited.
+	data.AuthActionFever: {
+		Window: 24 * time.Hour,
+		IP:     authRateLimit{FreeAttempts: 20, BaseDelay: time.Second, MaxDelay: 15 * time.Minute},
+	},
+	// All passkey login ceremonies as each one is stored until it expires. The account is not known until the ceremony
+	// finishes so only the IP address is limited.
+	data.AuthActionPasskeyLogin: {
+		Window: time.Hour,
+		IP:     authRateLimit{FreeAttempts: 30, BaseDelay: time.Second, MaxDelay: 15 * time.Minute},
+	},
+}
+
+// authRateLimiter throttles logins, requests that send email, Fever API key guesses, and passkey login ceremonies by
+// IP address and by account. Attempts are stored in PostgreSQL so limits apply across all server processes. A nil
+// *authRateLimiter does not limit anything.
+type authRateLimiter struct {
+	pool   *pgxpool.Pool
+	logger log.Logger
+	limits map[string]authRateLimits
+}
+
+func newAuthRateLimiter(pool *pgxpool.Pool, logger log.Logger) *authRateLimiter {
+	return &authRateLimiter{pool: pool, logger: logger, limits: defaultAuthRateLimits}
+}
+
+// normalizeAccount returns the form of a user name or email under which attempts are counted.
+func normalizeAccount(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
+
+// retryAfter returns how long to wait before action may be attempted from ip for account. It returns 0 if the attempt
+// is allowed now.
+func (l *authRateLimiter) retryAfter(ctx context.Context, action string, ip netip.Addr, account string) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+
+	limits := l.limits[action]
+	now := time.Now()
+	stats, err := data.SelectAuthAttemptStats(ctx, l.pool, action, ip, normalizeAccount(account), now.Add(-limits.Window))
+	if err != nil {
+		return 0, err
+	}
+
+	return max(
+		limits.IP.retryAfter(stats.IPCount, stats.IPLastTime, now),
+		limits.Account.retryAfter(stats.AccountCount, stats.AccountLastTime, now),
+	), nil
+}
+
+// record counts an attempt of action from ip for account.
+func (l *authRateLimiter) record(ctx context.Context, action string, ip netip.Addr, account string) error {
+	if l == nil {
+		return nil
+	}
+	return data.InsertAuthAttempt(ctx, l.pool, action, ip, normalizeAccount(account), time.Now())
+}
+
+// forgive removes the attempts of action for account.
+func (l *authRateLimiter) forgive(ctx context.Context, action string, account string) error {
+	if l == nil {
+		return nil
+	}
+	return data.DeleteAuthAttemptsByAccount(ctx, l.pool, action, normalizeAccount(account))
+}
+
+// allow checks whether action may be attempted now by req for account. If not, it responds with 429 Too Many Requests
+// and a Retry-After header, records the blocked attempt in the audit log, and returns false.
+func (l *authRateLimiter) allow(w http.ResponseWriter, req *http.Request, env *environment, action string, account string) bool {
+	ip := remoteIP(req)
+	retryAfter, err := l.retryAfter(req.Context(), action, ip, account)
+	if err != nil {
+		// Failing open keeps users able to log in when the limit cannot be checked. The error is logged so it is noticed.
+		env.logger.Error("authRateLimiter.retryAfter failed", "action", action, "error", err)
+		return true
+	}
+	if retryAfter == 0 {
+		return true
+	}
+
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, "Too many attempts. Try again in %d seconds.", seconds)
+
+	env.logger.Warn("Authentication attempt blocked", "action", action, "ip", ip, "account", account, "retryAfter", seconds)
+	err = data.InsertAuditLogEntry(context.Background(), env.pool, &data.AuditLogEntry{
+		Event:     action + "_blocked",
+		IP:        ip,
+		Details:   map[string]any{"account": normalizeAccount(account), "retry_after": seconds},
+		EventTime: time.Now(),
+	})
+	if err != nil {
+		env.logger.Error("InsertAuditLogEntry failed", "error", err)
+	}
+
+	return false
+}
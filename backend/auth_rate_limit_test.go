@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthRateLimitRetryAfter(t *testing.T) {
+	limit := authRateLimit{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute}
+	now := time.Now()
+	last := pgtype.Timestamptz{Time: now, Valid: true}
+
+	tests := []struct {
+		count    int64
+		last     pgtype.Timestamptz
+		expected time.Duration
+	}{
+		{count: 0, last: pgtype.Timestamptz{}, expected: 0},
+		{count: 2, last: last, expected: 0},
+		{count: 3, last: last, expected: time.Second},
+		{count: 4, last: last, expected: 2 * time.Second},
+		{count: 6, last: last, expected: 8 * time.Second},
+		{count: 9, last: last, expected: time.Minute},
+		{count: 100, last: last, expected: time.Minute},
+		{count: 4, last: pgtype.Timestamptz{Time: now.Add(-time.Second), Valid: true}, expected: time.Second},
+		{count: 4, last: pgtype.Timestamptz{Time: now.Add(-time.Hour), Valid: true}, expected: 0},
+	}
+
+	for i, tt := range tests {
+		require.Equalf(t, tt.expected, limit.retryAfter(tt.count, tt.last, now), "%d", i)
+	}
+}
+
+func TestAuthRateLimiter(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := newUser()
+	user.Email = pgtype.Text{String: "test@example.com", Valid: true}
+	SetPassword(user, "password")
+	_, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	router := NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	do := func(path, remoteAddr, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://example.com"+path, strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	login := func(remoteAddr, password string) *httptest.ResponseRecorder {
+		return do("/sessions", remoteAddr, `{"name": "test", "password": "`+password+`"}`)
+	}
+
+	retryAfter := func(w *httptest.ResponseRecorder) int {
+		n, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		require.NoError(t, err)
+		return n
+	}
+	attemptCount := func() int {
+		var n int
+		err := pool.QueryRow(ctx, `select count(*) from auth_attempts where action='login' and account='test'`).Scan(&n)
+		require.NoError(t, err)
+		return n
+	}
+
+	for i := 0; i < 4; i++ {
+		require.Equal(t, 422, login("192.0.2.1:1234", "wrong").Code)
+	}
+	require.Equal(t, 4, attemptCount())
+
+	// A successful login forgives earlier failures.
+	require.Equal(t, http.StatusCreated, login("192.0.2.1:1234", "password").Code)
+	require.Equal(t, 0, attemptCount())
+
+	for i := 0; i < 10; i++ {
+		err := data.InsertAuthAttempt(ctx, pool, data.AuthActionLogin, netip.MustParseAddr("192.0.2.2"), "test", time.Now())
+		require.NoError(t, err)
+	}
+
+	// The account is now throttled from any IP address, even with the correct password.
+	w := login("198.51.100.1:1234", "password")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.InDelta(t, 32, retryAfter(w), 2)
+
+	var event, account string
+	err = pool.QueryRow(ctx, `select event, details->>'account' from audit_log where ip='198.51.100.1'`).Scan(&event, &account)
+	require.NoError(t, err)
+	require.Equal(t, "login_blocked", event)
+	require.Equal(t, "test", account)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, do("/request_password_reset", "192.0.2.3:1234", `{"email": "Missing@example.com"}`).Code)
+	}
+	w = do("/request_password_reset", "192.0.2.4:1234", `{"email": "missing@example.com"}`)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.InDelta(t, 60, retryAfter(w), 2)
+
+	require.Equal(t, http.StatusOK, do("/request_password_reset", "192.0.2.4:1234", `{"email": "other@example.com"}`).Code)
+}
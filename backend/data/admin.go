@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+// UserListing is a user with the details an administrator needs to manage them.
+type UserListing struct {
+	ID                int32
+	Name              string
+	Email             pgtype.Text
+	EmailVerified     bool
+	IsAdmin           bool
+	Disabled          bool
+	SubscriptionCount int64
+	SessionCount      int64
+	LastSeenTime      pgtype.Timestamptz
+}
+
+const selectUserListingSQL = `select users.id, users.name, users.email, users.email_verified, users.is_admin, users.disabled,
+  (select count(*) from subscriptions where subscriptions.user_id=users.id),
+  (select count(*) from sessions where sessions.user_id=users.id),
+  (select max(last_seen_time) from sessions where sessions.user_id=users.id)
+from users`
+
+func RowToAddrOfUserListing(row pgx.CollectableRow) (*UserListing, error) {
+	u := &UserListing{}
+	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.EmailVerified, &u.IsAdmin, &u.Disabled, &u.SubscriptionCount, &u.SessionCount, &u.LastSeenTime)
+	return u, err
+}
+
+func SelectUserListings(ctx context.Context, db pgxutil.DB) ([]*UserListing, error) {
+	rows, _ := db.Query(ctx, selectUserListingSQL+` order by lower(users.name)`)
+	return pgx.CollectRows(rows, RowToAddrOfUserListing)
+}
+
+func SelectUserListingByPK(ctx context.Context, db pgxutil.DB, id int32) (*UserListing, error) {
+	rows, _ := db.Query(ctx, selectUserListingSQL+` where users.id=$1`, id)
+	return pgx.CollectOneRow(rows, RowToAddrOfUserListing)
+}
+
+// UpdateUserAdmin grants or revokes the administrator role of the user with id. It returns pgx.ErrNoRows if the user
+// does not exist.
+func UpdateUserAdmin(ctx context.Context, db pgxutil.DB, id int32, isAdmin bool) error {
+	_, err := pgxutil.ExecRow(ctx, db, `update users set is_admin=$2 where id=$1`, id, isAdmin)
+	return err
+}
+
+// UpdateUserDisabled disables or enables the user with id. It returns pgx.ErrNoRows if the user does not exist.
+func UpdateUserDisabled(ctx context.Context, db pgxutil.DB, id int32, disabled bool) error {
+	_, err := pgxutil.ExecRow(ctx, db, `update users set disabled=$2 where id=$1`, id, disabled)
+	return err
+}
+
+// DeleteUser deletes the user with id and all of their data. It returns pgx.ErrNoRows if the user does not exist.
+func DeleteUser(ctx context.Context, db pgxutil.DB, id int32) error {
+	_, err := pgxutil.ExecRow(ctx, db, `delete from users where id=$1`, id)
+	return err
+}
+
+// FeedHealth is a feed with its fetch status and how many users it affects.
+type FeedHealth struct {
+	Feed
+	SubscriberCount int64
+}
+
+const selectFeedHealthSQL = `select id, name, url, last_fetch_time, etag, last_failure, last_failure_time, failure_count, creation_time,
+  (select count(*) from subscriptions where subscriptions.feed_id=feeds.id)
+from feeds
+where not $1::boolean or failure_count > 0
+order by failure_count desc, last_failure_time desc nulls last, lower(name), id`
+
+// SelectFeedHealth selects all feeds with the most failing feeds first. If failingOnly is true only feeds whose last
+// fetch failed are selected.
+func SelectFeedHealth(ctx context.Context, db pgxutil.DB, failingOnly bool) ([]*FeedHealth, error) {
+	rows, _ := db.Query(ctx, selectFeedHealthSQL, failingOnly)
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*FeedHealth, error) {
+		f := &FeedHealth{}
+		err := row.Scan(&f.ID, &f.Name, &f.URL, &f.LastFetchTime, &f.ETag, &f.LastFailure, &f.LastFailureTime, &f.FailureCount, &f.CreationTime,
+			&f.SubscriberCount)
+		return f, err
+	})
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+const (
+	APITokenScopeReadOnly  = "read_only"
+	APITokenScopeReadWrite = "read_write"
+)
+
+// APIToken is a named credential a user creates for scripts and other clients. Only the digest of the token is stored.
+type APIToken struct {
+	ID           int32
+	UserID       int32
+	Name         string
+	TokenDigest  []byte
+	Scope        string
+	CreationTime time.Time
+	LastUsedTime pgtype.Timestamptz
+}
+
+const selectAPITokenSQL = `select id, user_id, name, token_digest, scope, creation_time, last_used_time from api_tokens`
+const selectAPITokensByUserIDSQL = selectAPITokenSQL + ` where user_id=$1 order by name, id`
+const selectAPITokenByDigestSQL = selectAPITokenSQL + ` where token_digest=$1`
+
+func RowToAddrOfAPIToken(row pgx.CollectableRow) (*APIToken, error) {
+	t := &APIToken{}
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.TokenDigest, &t.Scope, &t.CreationTime, &t.LastUsedTime)
+	return t, err
+}
+
+func SelectAPITokensByUserID(ctx context.Context, db pgxutil.DB, userID int32) ([]*APIToken, error) {
+	rows, _ := db.Query(ctx, selectAPITokensByUserIDSQL, userID)
+	return pgx.CollectRows(rows, RowToAddrOfAPIToken)
+}
+
+func SelectAPITokenByDigest(ctx context.Context, db pgxutil.DB, digest []byte) (*APIToken, error) {
+	rows, _ := db.Query(ctx, selectAPITokenByDigestSQL, digest)
+	return pgx.CollectOneRow(rows, RowToAddrOfAPIToken)
+}
+
+const insertAPITokenSQL = `insert into api_tokens(user_id, name, token_digest, scope)
+values($1, $2, $3, $4)
+returning id, creation_time`
+
+func InsertAPIToken(ctx context.Context, db pgxutil.DB, token *APIToken) error {
+	return db.QueryRow(ctx, insertAPITokenSQL,
+		token.UserID,
+		token.Name,
+		token.TokenDigest,
+		token.Scope,
+	).Scan(&token.ID, &token.CreationTime)
+}
+
+// DeleteAPIToken deletes the token with id. It returns pgx.ErrNoRows if the token does not exist or does not belong
+// to userID.
+func DeleteAPIToken(ctx context.Context, db pgxutil.DB, userID, id int32) error {
+	_, err := pgxutil.ExecRow(ctx, db, `delete from api_tokens where user_id=$1 and id=$2`, userID, id)
+	return err
+}
+
+// TouchAPIToken records that the token with id was used at lastUsedTime. Like TouchSession it only writes when the
+// previous use was more than a minute earlier.
+func TouchAPIToken(ctx context.Context, db pgxutil.DB, id int32, lastUsedTime time.Time) error {
+	_, err := db.Exec(ctx, `update api_tokens
+set last_used_time=$2
+where id=$1
+  and (last_used_time is null or last_used_time < $2 - interval '1 minute')`, id, lastUsedTime)
+	return err
+}
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+const (
+	AuthActionLogin             = "login"
+	AuthActionPasswordReset     = "password_reset"
+	AuthActionEmailVerification = "email_verification"
+	AuthActionFever             = "fever"
+	AuthActionPasskeyLogin      = "passkey_login"
+)
+
+func InsertAuthAttempt(ctx context.Context, db pgxutil.DB, action string, ip netip.Addr, account string, attemptTime time.Time) error {
+	_, err := db.Exec(ctx, `insert into auth_attempts(action, ip, account, attempt_time) values($1, $2, $3, $4)`, action, ip, account, attemptTime)
+	return err
+}
+
+// AuthAttemptStats counts the attempts made from an IP address and for an account.
+type AuthAttemptStats struct {
+	IPCount         int64
+	IPLastTime      pgtype.Timestamptz
+	AccountCount    int64
+	AccountLastTime pgtype.Timestamptz
+}
+
+const selectAuthAttemptStatsSQL = `select
+  count(*) filter (where ip=$2),
+  max(attempt_time) filter (where ip=$2),
+  count(*) filter (where account=$3),
+  max(attempt_time) filter (where account=$3)
+from auth_attempts
+where action=$1
+  and attempt_time >= $4
+  and (ip=$2 or account=$3)`
+
+// SelectAuthAttemptStats counts the action attempts from ip and for account made at or after since.
+func SelectAuthAttemptStats(ctx context.Context, db pgxutil.DB, action string, ip netip.Addr, account string, since time.Time) (*AuthAttemptStats, error) {
+	stats := &AuthAttemptStats{}
+	err := db.QueryRow(ctx, selectAuthAttemptStatsSQL, action, ip, account, since).Scan(
+		&stats.IPCount,
+		&stats.IPLastTime,
+		&stats.AccountCount,
+		&stats.AccountLastTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// DeleteAuthAttemptsByAccount deletes the action attempts for account. It is used to forgive failed logins after a
+// successful one.
+func DeleteAuthAttemptsByAccount(ctx context.Context, db pgxutil.DB, action string, account string) error {
+	_, err := db.Exec(ctx, `delete from auth_attempts where action=$1 and account=$2`, action, account)
+	return err
+}
+
+// AuditLogEntry records a security relevant event.
+type AuditLogEntry struct {
+	Event     string
+	UserID    pgtype.Int4
+	IP        netip.Addr
+	Details   map[string]any
+	EventTime time.Time
+}
+
+func InsertAuditLogEntry(ctx context.Context, db pgxutil.DB, entry *AuditLogEntry) error {
+	details := entry.Details
+	if details == nil {
+		details = map[string]any{}
+	}
+	_, err := db.Exec(ctx, `insert into audit_log(event, user_id, ip, details, event_time) values($1, $2, $3, $4, $5)`,
+		entry.Event,
+		entry.UserID,
+		entry.IP,
+		details,
+		entry.EventTime,
+	)
+	return err
+}
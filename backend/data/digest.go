@@ -0,0 +1,150 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+const (
+	DigestFrequencyDaily  = "daily"
+	DigestFrequencyWeekly = "weekly"
+)
+
+// DigestSetting is when and how a user receives an email digest of unread items.
+type DigestSetting struct {
+	UserID       int32
+	Frequency    string
+	Weekday      int16 // day weekly digests are sent, 0 is Sunday
+	Hour         int16
+	TimeZone     string
+	MaxItems     int32
+	FeedIDs      []int32 // nil includes all subscribed feeds
+	MarkRead     bool
+	NextSendTime time.Time
+	LastSendTime pgtype.Timestamptz
+}
+
+const selectDigestSettingSQL = `select user_id, frequency, weekday, hour, time_zone, max_items, feed_ids, mark_read, next_send_time, last_send_time from digest_settings`
+
+func RowToAddrOfDigestSetting(row pgx.CollectableRow) (*DigestSetting, error) {
+	s := &DigestSetting{}
+	err := row.Scan(&s.UserID, &s.Frequency, &s.Weekday, &s.Hour, &s.TimeZone, &s.MaxItems, &s.FeedIDs, &s.MarkRead, &s.NextSendTime, &s.LastSendTime)
+	return s, err
+}
+
+func SelectDigestSettingByUserID(ctx context.Context, db pgxutil.DB, userID int32) (*DigestSetting, error) {
+	rows, _ := db.Query(ctx, selectDigestSettingSQL+` where user_id=$1`, userID)
+	return pgx.CollectOneRow(rows, RowToAddrOfDigestSetting)
+}
+
+// claimDueDigestSettingsSQL claims due digests by moving their next_send_time to the claim expiration. Like
+// claimFeedsUncheckedSinceSQL it uses for update skip locked so concurrent senders never claim the same digest. A
+// digest claimed by a sender that died is due again once the claim expires.
+const claimDueDigestSettingsSQL = `update digest_settings
+set next_send_time=$2
+where user_id in (
+  select user_id
+  from digest_settings
+  where next_send_time <= $1
+  order by next_send_time
+  for update skip locked
+)
+returning user_id, frequency, weekday, hour, time_zone, max_items, feed_ids, mark_read, next_send_time, last_send_time`
+
+// ClaimDueDigestSettings claims the settings of all digests due to be sent at now until claimExpiration.
+func ClaimDueDigestSettings(ctx context.Context, db pgxutil.DB, now, claimExpiration time.Time) ([]*DigestSetting, error) {
+	rows, _ := db.Query(ctx, claimDueDigestSettingsSQL, now, claimExpiration)
+	return pgx.CollectRows(rows, RowToAddrOfDigestSetting)
+}
+
+// UpsertDigestSetting inserts s or replaces the existing setting of s.UserID. LastSendTime is kept.
+func UpsertDigestSetting(ctx context.Context, db pgxutil.DB, s *DigestSetting) error {
+	_, err := db.Exec(ctx, `insert into digest_settings(user_id, frequency, weekday, hour, time_zone, max_items, feed_ids, mark_read, next_send_time)
+values($1, $2, $3, $4, $5, $6, $7, $8, $9)
+on conflict (user_id) do update set
+  frequency=excluded.frequency,
+  weekday=excluded.weekday,
+  hour=excluded.hour,
+  time_zone=excluded.time_zone,
+  max_items=excluded.max_items,
+  feed_ids=excluded.feed_ids,
+  mark_read=excluded.mark_read,
+  next_send_time=excluded.next_send_time`,
+		s.UserID, s.Frequency, s.Weekday, s.Hour, s.TimeZone, s.MaxItems, s.FeedIDs, s.MarkRead, s.NextSendTime)
+	return err
+}
+
+func DeleteDigestSetting(ctx context.Context, db pgxutil.DB, userID int32) error {
+	_, err := db.Exec(ctx, `delete from digest_settings where user_id=$1`, userID)
+	return err
+}
+
+// UpdateDigestSendTimes records that userID's digest was last sent at lastSendTime and is next due at nextSendTime.
+// lastSendTime is null when the digest was skipped.
+func UpdateDigestSendTimes(ctx context.Context, db pgxutil.DB, userID int32, lastSendTime pgtype.Timestamptz, nextSendTime time.Time) error {
+	_, err := pgxutil.ExecRow(ctx, db, `update digest_settings
+set last_send_time=coalesce($2, last_send_time), next_send_time=$3
+where user_id=$1`, userID, lastSendTime, nextSendTime)
+	return err
+}
+
+// DigestItem is an unread item listed in a digest.
+type DigestItem struct {
+	ID              int32
+	FeedName        string
+	Title           string
+	URL             string
+	PublicationTime time.Time
+}
+
+// SelectDigestItems selects up to limit of userID's oldest unread items in feedIDs or in all feeds if feedIDs is nil.
+// It also returns the number of unread items in those feeds including those over the limit.
+func SelectDigestItems(ctx context.Context, db pgxutil.DB, userID int32, feedIDs []int32, limit int32) ([]*DigestItem, int64, error) {
+	rows, _ := db.Query(ctx, `select
+  items.id,
+  feeds.name,
+  items.title,
+  items.url,
+  coalesce(items.publication_time, items.creation_time) as publication_time,
+  count(*) over ()
+from feeds
+  join items on feeds.id=items.feed_id
+  join unread_items on items.id=unread_items.item_id
+where unread_items.user_id=$1
+  and ($2::integer[] is null or unread_items.feed_id=any($2))
+order by publication_time asc, items.id
+limit $3`, userID, feedIDs, limit)
+
+	var unreadCount int64
+	items, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*DigestItem, error) {
+		item := &DigestItem{}
+		err := row.Scan(&item.ID, &item.FeedName, &item.Title, &item.URL, &item.PublicationTime, &unreadCount)
+		return item, err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return items, unreadCount, nil
+}
+
+const markItemsReadSQL = `with deleted as (
+  delete from unread_items
+  where user_id=$1
+    and item_id=any($2)
+  returning user_id, item_id
+), item_events as (
+  ` + notifyItemsReadSQL + `
+)
+select (select count(*) from deleted), (select count(*) from item_events)`
+
+// MarkItemsRead marks itemIDs read for userID. It returns the number of items that were unread.
+func MarkItemsRead(ctx context.Context, db pgxutil.DB, userID int32, itemIDs []int32) (int64, error) {
+	var n int64
+	err := db.QueryRow(ctx, markItemsReadSQL, userID, itemIDs).Scan(&n, nil)
+	return n, err
+}
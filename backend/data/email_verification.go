@@ -0,0 +1,83 @@
+package data
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+// EmailVerification is a request for a user to confirm Email. The token sent in the verification mail is only stored as
+// TokenDigest.
+type EmailVerification struct {
+	TokenDigest    []byte
+	UserID         int32
+	Email          string
+	RequestIP      netip.Addr
+	RequestTime    time.Time
+	CompletionIP   netip.Addr
+	CompletionTime pgtype.Timestamptz
+}
+
+const selectEmailVerificationSQL = `select token_digest, user_id, email, request_ip, request_time, completion_ip, completion_time from email_verifications`
+
+func RowToAddrOfEmailVerification(row pgx.CollectableRow) (*EmailVerification, error) {
+	ev := &EmailVerification{}
+	err := row.Scan(&ev.TokenDigest, &ev.UserID, &ev.Email, &ev.RequestIP, &ev.RequestTime, &ev.CompletionIP, &ev.CompletionTime)
+	return ev, err
+}
+
+// InsertEmailVerification inserts ev. Any of the user's verifications that have not been completed are deleted so only
+// the most recently requested address can be confirmed.
+func InsertEmailVerification(ctx context.Context, db pgxutil.DB, ev *EmailVerification) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `delete from email_verifications where user_id=$1 and completion_time is null`, ev.UserID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `insert into email_verifications(token_digest, user_id, email, request_ip, request_time)
+values($1, $2, $3, $4, $5)`,
+			ev.TokenDigest, ev.UserID, ev.Email, ev.RequestIP, ev.RequestTime)
+		return err
+	})
+}
+
+// SelectPendingEmailVerification selects userID's verification that has not been completed if it was requested after
+// requestedAfter.
+func SelectPendingEmailVerification(ctx context.Context, db pgxutil.DB, userID int32, requestedAfter time.Time) (*EmailVerification, error) {
+	rows, _ := db.Query(ctx, selectEmailVerificationSQL+` where user_id=$1 and completion_time is null and request_time > $2`, userID, requestedAfter)
+	return pgx.CollectOneRow(rows, RowToAddrOfEmailVerification)
+}
+
+// CompleteEmailVerification marks the verification with tokenDigest requested after requestedAfter as completed and
+// returns it. It returns pgx.ErrNoRows if there is no such verification or it was already completed.
+func CompleteEmailVerification(ctx context.Context, db pgxutil.DB, tokenDigest []byte, requestedAfter time.Time, completionIP netip.Addr, completionTime time.Time) (*EmailVerification, error) {
+	rows, _ := db.Query(ctx, `update email_verifications
+set completion_ip=$3, completion_time=$4
+where token_digest=$1
+  and request_time > $2
+  and completion_time is null
+returning token_digest, user_id, email, request_ip, request_time, completion_ip, completion_time`,
+		tokenDigest, requestedAfter, completionIP, completionTime)
+	return pgx.CollectOneRow(rows, RowToAddrOfEmailVerification)
+}
+
+// DeletePendingEmailVerifications deletes userID's verifications that have not been completed.
+func DeletePendingEmailVerifications(ctx context.Context, db pgxutil.DB, userID int32) error {
+	_, err := db.Exec(ctx, `delete from email_verifications where user_id=$1 and completion_time is null`, userID)
+	return err
+}
+
+// SetVerifiedEmail sets userID's email to the confirmed address email.
+func SetVerifiedEmail(ctx context.Context, db pgxutil.DB, userID int32, email string) error {
+	_, err := pgxutil.ExecRow(ctx, db, `update users set email=$2, email_verified=true where id=$1`, userID, email)
+	if err != nil && strings.Contains(err.Error(), "users_email_key") {
+		return DuplicationError{Field: "email"}
+	}
+	return err
+}
@@ -1,9 +1,12 @@
 package data
 
 import (
+	"context"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
 )
 
 type Feed struct {
@@ -17,3 +20,30 @@ type Feed struct {
 	FailureCount    int32
 	CreationTime    time.Time
 }
+
+const selectFeedSQL = `select id, name, url, last_fetch_time, etag, last_failure, last_failure_time, failure_count, creation_time from feeds`
+const selectFeedByPKSQL = selectFeedSQL + ` where id=$1`
+const selectFeedByURLSQL = selectFeedSQL + ` where url=$1`
+const selectSubscribedFeedSQL = selectFeedSQL + ` where id=$2 and exists(select 1 from subscriptions where user_id=$1 and feed_id=feeds.id)`
+
+func RowToAddrOfFeed(row pgx.CollectableRow) (*Feed, error) {
+	f := &Feed{}
+	err := row.Scan(&f.ID, &f.Name, &f.URL, &f.LastFetchTime, &f.ETag, &f.LastFailure, &f.LastFailureTime, &f.FailureCount, &f.CreationTime)
+	return f, err
+}
+
+func SelectFeedByPK(ctx context.Context, db pgxutil.DB, id int32) (*Feed, error) {
+	rows, _ := db.Query(ctx, selectFeedByPKSQL, id)
+	return pgx.CollectOneRow(rows, RowToAddrOfFeed)
+}
+
+func SelectFeedByURL(ctx context.Context, db pgxutil.DB, url string) (*Feed, error) {
+	rows, _ := db.Query(ctx, selectFeedByURLSQL, url)
+	return pgx.CollectOneRow(rows, RowToAddrOfFeed)
+}
+
+// SelectSubscribedFeed selects the feed with id feedID only if userID is subscribed to it.
+func SelectSubscribedFeed(ctx context.Context, db pgxutil.DB, userID, feedID int32) (*Feed, error) {
+	rows, _ := db.Query(ctx, selectSubscribedFeedSQL, userID, feedID)
+	return pgx.CollectOneRow(rows, RowToAddrOfFeed)
+}
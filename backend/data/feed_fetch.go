@@ -0,0 +1,80 @@
+package data
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+// FeedFetch is a record of a single attempt to fetch a feed.
+type FeedFetch struct {
+	FeedID       int32
+	FetchTime    time.Time
+	HTTPStatus   pgtype.Int4
+	Duration     time.Duration
+	ByteCount    pgtype.Int4
+	ETagHit      bool
+	NewItemCount pgtype.Int4
+	Error        pgtype.Text
+}
+
+const insertFeedFetchSQL = `insert into feed_fetches(feed_id, fetch_time, http_status, duration_ms, byte_count, etag_hit, new_item_count, error)
+values($1, $2, $3, $4, $5, $6, $7, $8)`
+
+const pruneFeedFetchesSQL = `delete from feed_fetches
+where id in (
+  select id
+  from feed_fetches
+  where feed_id=$1
+  order by fetch_time desc
+  offset $2
+)`
+
+// InsertFeedFetch records fetch and deletes all but the most recent retainCount fetches of the feed.
+func InsertFeedFetch(ctx context.Context, db pgxutil.DB, fetch *FeedFetch, retainCount int) error {
+	_, err := db.Exec(ctx, insertFeedFetchSQL,
+		fetch.FeedID,
+		fetch.FetchTime,
+		fetch.HTTPStatus,
+		fetch.Duration.Milliseconds(),
+		fetch.ByteCount,
+		fetch.ETagHit,
+		fetch.NewItemCount,
+		fetch.Error,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(ctx, pruneFeedFetchesSQL, fetch.FeedID, retainCount)
+	return err
+}
+
+const getFeedFetchesSQL = `select coalesce(json_agg(row_to_json(t)), '[]'::json)
+from (
+  select
+    extract(epoch from fetch_time::timestamptz(0)) as fetch_time,
+    http_status,
+    duration_ms,
+    byte_count,
+    etag_hit,
+    new_item_count,
+    error
+  from feed_fetches
+  where feed_id=$1
+  order by fetch_time desc
+) t`
+
+func CopyFeedFetchesAsJSON(ctx context.Context, db pgxutil.DB, w io.Writer, feedID int32) error {
+	var b []byte
+	err := db.QueryRow(ctx, getFeedFetchesSQL, feedID).Scan(&b)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,148 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+// SetFeverAPIKeyDigest sets the digest of userID's Fever API key. A nil digest disables the Fever API for the user.
+func SetFeverAPIKeyDigest(ctx context.Context, db pgxutil.DB, userID int32, digest []byte) error {
+	_, err := pgxutil.ExecRow(ctx, db, `update users set fever_api_key_digest=$2 where id=$1`, userID, digest)
+	return err
+}
+
+const getUserByFeverAPIKeyDigestSQL = `select id, name, email, email_verified, password_hash, is_admin, disabled from users where fever_api_key_digest=$1`
+
+func SelectUserByFeverAPIKeyDigest(ctx context.Context, db pgxutil.DB, digest []byte) (*User, error) {
+	return selectUser(ctx, db, "getUserByFeverAPIKeyDigest", getUserByFeverAPIKeyDigestSQL, digest)
+}
+
+// FeverItem is an item in one of a user's subscribed feeds along with the user's read and saved state.
+type FeverItem struct {
+	ID              int32
+	FeedID          int32
+	Title           string
+	Author          pgtype.Text
+	Content         pgtype.Text
+	URL             string
+	PublicationTime pgtype.Timestamptz
+	CreationTime    time.Time
+	Read            bool
+	Saved           bool
+}
+
+const selectFeverItemsSQL = `select items.id,
+  items.feed_id,
+  items.title,
+  items.author,
+  items.content,
+  items.url,
+  items.publication_time,
+  items.creation_time,
+  not exists(select 1 from unread_items where user_id=$1 and item_id=items.id),
+  exists(select 1 from starred_items where user_id=$1 and item_id=items.id)
+from items
+  join subscriptions on subscriptions.feed_id=items.feed_id and subscriptions.user_id=$1`
+
+func RowToAddrOfFeverItem(row pgx.CollectableRow) (*FeverItem, error) {
+	i := &FeverItem{}
+	err := row.Scan(&i.ID, &i.FeedID, &i.Title, &i.Author, &i.Content, &i.URL, &i.PublicationTime, &i.CreationTime, &i.Read, &i.Saved)
+	return i, err
+}
+
+// SelectFeverItemsSinceID selects up to limit of userID's items with an ID greater than sinceID in ascending order.
+func SelectFeverItemsSinceID(ctx context.Context, db pgxutil.DB, userID, sinceID int32, limit int) ([]*FeverItem, error) {
+	rows, _ := db.Query(ctx, selectFeverItemsSQL+` where items.id > $2 order by items.id limit $3`, userID, sinceID, limit)
+	return pgx.CollectRows(rows, RowToAddrOfFeverItem)
+}
+
+// SelectFeverItemsBeforeID selects up to limit of userID's items with an ID less than maxID in descending order.
+func SelectFeverItemsBeforeID(ctx context.Context, db pgxutil.DB, userID, maxID int32, limit int) ([]*FeverItem, error) {
+	rows, _ := db.Query(ctx, selectFeverItemsSQL+` where items.id < $2 order by items.id desc limit $3`, userID, maxID, limit)
+	return pgx.CollectRows(rows, RowToAddrOfFeverItem)
+}
+
+// SelectFeverItemsByIDs selects userID's items with ids. Items in feeds userID is not subscribed to are omitted.
+func SelectFeverItemsByIDs(ctx context.Context, db pgxutil.DB, userID int32, ids []int32) ([]*FeverItem, error) {
+	rows, _ := db.Query(ctx, selectFeverItemsSQL+` where items.id = any($2) order by items.id`, userID, ids)
+	return pgx.CollectRows(rows, RowToAddrOfFeverItem)
+}
+
+// SelectItemCountByUserID returns the number of items in userID's subscribed feeds.
+func SelectItemCountByUserID(ctx context.Context, db pgxutil.DB, userID int32) (int64, error) {
+	var n int64
+	err := db.QueryRow(ctx, `select count(*) from items join subscriptions on subscriptions.feed_id=items.feed_id where subscriptions.user_id=$1`, userID).Scan(&n)
+	return n, err
+}
+
+func SelectUnreadItemIDsByUserID(ctx context.Context, db pgxutil.DB, userID int32) ([]int32, error) {
+	rows, _ := db.Query(ctx, `select item_id from unread_items where user_id=$1 order by item_id`, userID)
+	return pgx.CollectRows(rows, pgx.RowTo[int32])
+}
+
+func SelectStarredItemIDsByUserID(ctx context.Context, db pgxutil.DB, userID int32) ([]int32, error) {
+	rows, _ := db.Query(ctx, `select item_id from starred_items where user_id=$1 order by item_id`, userID)
+	return pgx.CollectRows(rows, pgx.RowTo[int32])
+}
+
+const markItemUnreadSQL = `with inserted as (
+  insert into unread_items(user_id, feed_id, item_id)
+  select subscriptions.user_id, items.feed_id, items.id
+  from items
+    join subscriptions on subscriptions.feed_id=items.feed_id
+  where subscriptions.user_id=$1
+    and items.id=$2
+  on conflict do nothing
+  returning user_id, feed_id
+)
+select pg_notify('item_events', json_build_object('type', 'items_created', 'user_id', user_id, 'feed_id', feed_id, 'count', 1)::text)
+from inserted`
+
+// MarkItemUnread marks itemID unread for userID. It returns pgx.ErrNoRows if the item is already unread or is not in
+// one of userID's subscribed feeds.
+func MarkItemUnread(ctx context.Context, db pgxutil.DB, userID, itemID int32) error {
+	_, err := pgxutil.ExecRow(ctx, db, markItemUnreadSQL, userID, itemID)
+	return err
+}
+
+const markItemsReadCreatedBeforeSQL = `with deleted as (
+  delete from unread_items
+  using items
+  where unread_items.user_id=$1
+    and ($2::integer is null or unread_items.feed_id=$2)
+    and items.id=unread_items.item_id
+    and items.creation_time < $3
+  returning unread_items.user_id, unread_items.item_id
+), item_events as (
+  ` + notifyItemsReadSQL + `
+)
+select (select count(*) from deleted), (select count(*) from item_events)`
+
+// MarkItemsReadCreatedBefore marks all of userID's unread items in feedID that were created before the given time as
+// read. A null feedID marks items in all feeds. It returns the number of items marked read.
+func MarkItemsReadCreatedBefore(ctx context.Context, db pgxutil.DB, userID int32, feedID pgtype.Int4, before time.Time) (int64, error) {
+	var n int64
+	err := db.QueryRow(ctx, markItemsReadCreatedBeforeSQL, userID, feedID, before).Scan(&n, nil)
+	return n, err
+}
+
+// StarItem stars itemID for userID if it is in one of userID's subscribed feeds.
+func StarItem(ctx context.Context, db pgxutil.DB, userID, itemID int32) error {
+	_, err := db.Exec(ctx, `insert into starred_items(user_id, item_id)
+select $1, items.id
+from items
+  join subscriptions on subscriptions.feed_id=items.feed_id
+where subscriptions.user_id=$1
+  and items.id=$2
+on conflict do nothing`, userID, itemID)
+	return err
+}
+
+func UnstarItem(ctx context.Context, db pgxutil.DB, userID, itemID int32) error {
+	_, err := db.Exec(ctx, `delete from starred_items where user_id=$1 and item_id=$2`, userID, itemID)
+	return err
+}
@@ -12,9 +12,14 @@ import (
 	"github.com/jackc/pgxutil"
 )
 
-const markItemReadSQL = `delete from unread_items
-where user_id=$1
-  and item_id=$2`
+const markItemReadSQL = `with deleted as (
+  delete from unread_items
+  where user_id=$1
+    and item_id=$2
+  returning user_id, item_id
+)
+select pg_notify('item_events', json_build_object('type', 'items_read', 'user_id', user_id, 'item_ids', json_build_array(item_id))::text)
+from deleted`
 
 func MarkItemRead(ctx context.Context, db pgxutil.DB, userID, itemID int32) error {
 	_, err := pgxutil.ExecRow(ctx, db, markItemReadSQL, userID, itemID)
@@ -59,6 +64,9 @@ from (
     feeds.name as feed_name,
     items.title,
     items.url,
+    items.author,
+    exists(select 1 from starred_items where starred_items.user_id=$1 and starred_items.item_id=items.id) as starred,
+    array(select tag from item_tags where item_tags.user_id=$1 and item_tags.item_id=items.id order by tag) as tags,
     extract(epoch from coalesce(publication_time, items.creation_time)::timestamptz(0)) as publication_time
   from feeds
     join items on feeds.id=items.feed_id
@@ -86,6 +94,9 @@ from (
     feeds.name as feed_name,
     items.title,
     items.url,
+    items.author,
+    exists(select 1 from starred_items where starred_items.user_id=$1 and starred_items.item_id=items.id) as starred,
+    array(select tag from item_tags where item_tags.user_id=$1 and item_tags.item_id=items.id order by tag) as tags,
     extract(epoch from coalesce(publication_time, items.creation_time)::timestamptz(0)) as publication_time
   from feeds
     join subscriptions on feeds.id=subscriptions.feed_id
@@ -109,6 +120,8 @@ func CopyArchivedItemsAsJSONByUserID(ctx context.Context, db pgxutil.DB, w io.Wr
 type ParsedItem struct {
 	URL             string
 	Title           string
+	Author          string
+	Content         string // plain text
 	PublicationTime pgtype.Timestamptz
 }
 
@@ -119,6 +132,14 @@ func (i *ParsedItem) IsValid() bool {
 type ParsedFeed struct {
 	Name  string
 	Items []ParsedItem
+
+	// Partial is set when Items may not be every item in the feed document. e.g. WebSub content distribution may only
+	// include new items.
+	Partial bool
+
+	// HubURL and SelfURL are advertised by feeds that support WebSub.
+	HubURL  string
+	SelfURL string
 }
 
 func (f *ParsedFeed) IsValid() bool {
@@ -142,13 +163,27 @@ const updateFeedWithFetchSuccessSQL = `
         etag=$3,
         last_failure=null,
         last_failure_time=null,
-        failure_count=0
+        failure_count=0,
+        claim_expiration_time=null
       where id=$4`
 
-func UpdateFeedWithFetchSuccess(ctx context.Context, db *pgxpool.Pool, feedID int32, update *ParsedFeed, etag pgtype.Text, fetchTime time.Time) error {
+const markItemsInFeedDocumentSQL = `update items
+set in_feed_document=(url = any($2))
+where feed_id=$1
+  and in_feed_document <> (url = any($2))`
+
+const markPartialItemsInFeedDocumentSQL = `update items
+set in_feed_document=true
+where feed_id=$1
+  and url = any($2)
+  and not in_feed_document`
+
+// UpdateFeedWithFetchSuccess updates the feed and inserts any items that are not already known. It returns the number
+// of new items.
+func UpdateFeedWithFetchSuccess(ctx context.Context, db *pgxpool.Pool, feedID int32, update *ParsedFeed, etag pgtype.Text, fetchTime time.Time) (int, error) {
 	tx, err := db.Begin(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer tx.Rollback(ctx)
 
@@ -159,25 +194,45 @@ func UpdateFeedWithFetchSuccess(ctx context.Context, db *pgxpool.Pool, feedID in
 		&etag,
 		feedID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	urls := make([]string, len(update.Items))
+	for i := range update.Items {
+		urls[i] = update.Items[i].URL
+	}
+	markSQL := markItemsInFeedDocumentSQL
+	if update.Partial {
+		markSQL = markPartialItemsInFeedDocumentSQL
+	}
+	_, err = tx.Exec(ctx, markSQL, feedID, urls)
+	if err != nil {
+		return 0, err
+	}
+
+	var newItemCount int
 	if len(update.Items) > 0 {
 		insertSQL, insertArgs := buildNewItemsSQL(feedID, update.Items)
-		_, err = tx.Exec(ctx, insertSQL, insertArgs...)
+		err = tx.QueryRow(ctx, insertSQL, insertArgs...).Scan(&newItemCount, nil)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
 
-	return tx.Commit(ctx)
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return newItemCount, nil
 }
 
 const updateFeedWithFetchUnchangedSQL = `update feeds
 set last_fetch_time=$1,
   last_failure=null,
   last_failure_time=null,
-  failure_count=0
+  failure_count=0,
+  claim_expiration_time=null
 where id=$2`
 
 func UpdateFeedWithFetchUnchanged(ctx context.Context, db pgxutil.DB, feedID int32, fetchTime time.Time) (err error) {
@@ -188,7 +243,8 @@ func UpdateFeedWithFetchUnchanged(ctx context.Context, db pgxutil.DB, feedID int
 const updateFeedWithFetchFailureSQL = `update feeds
 set last_failure=$1,
   last_failure_time=$2,
-  failure_count=failure_count+1
+  failure_count=failure_count+1,
+  claim_expiration_time=null
 where id=$3`
 
 func UpdateFeedWithFetchFailure(ctx context.Context, db pgxutil.DB, feedID int32, failure string, fetchTime time.Time) (err error) {
@@ -202,8 +258,8 @@ func buildNewItemsSQL(feedID int32, items []ParsedItem) (sql string, args []inte
 
 	buf.WriteString(`
       with new_items as (
-        insert into items(feed_id, url, title, publication_time)
-        select $1, url, title, publication_time
+        insert into items(feed_id, url, title, author, content, publication_time)
+        select $1, url, title, author, content, publication_time
         from (values
     `)
 
@@ -220,6 +276,16 @@ func buildNewItemsSQL(feedID int32, items []ParsedItem) (sql string, args []inte
 		args = append(args, item.Title)
 		buf.WriteString(strconv.FormatInt(int64(len(args)), 10))
 
+		buf.WriteString(",$")
+		args = append(args, pgtype.Text{String: item.Author, Valid: item.Author != ""})
+		buf.WriteString(strconv.FormatInt(int64(len(args)), 10))
+		buf.WriteString("::varchar")
+
+		buf.WriteString(",$")
+		args = append(args, pgtype.Text{String: item.Content, Valid: item.Content != ""})
+		buf.WriteString(strconv.FormatInt(int64(len(args)), 10))
+		buf.WriteString("::text")
+
 		buf.WriteString(",$")
 		if item.PublicationTime.Valid {
 			args = append(args, item.PublicationTime.Time)
@@ -231,20 +297,51 @@ func buildNewItemsSQL(feedID int32, items []ParsedItem) (sql string, args []inte
 	}
 
 	buf.WriteString(`
-      ) t(url, title, publication_time)
+      ) t(url, title, author, content, publication_time)
       where not exists(
         select 1
         from items
         where feed_id=$1
           and url=t.url
       )
-      returning id
+      returning id, feed_id, title, author, content
+    ), rule_matches as (
+      select item_rules.user_id, items.id as item_id, item_rules.action, item_rules.tag
+      from new_items items
+        join subscriptions on subscriptions.feed_id=items.feed_id
+        join item_rules on item_rules.user_id=subscriptions.user_id
+      where ` + itemRuleMatchSQL + `
+    ), new_unread_items as (
+      insert into unread_items(user_id, feed_id, item_id)
+      select user_id, $1, new_items.id
+      from subscriptions
+        cross join new_items
+      where subscriptions.feed_id=$1
+        and not exists(
+          select 1
+          from rule_matches
+          where rule_matches.user_id=subscriptions.user_id
+            and rule_matches.item_id=new_items.id
+            and rule_matches.action='skip_unread'
+        )
+      returning user_id
+    ), new_starred_items as (
+      insert into starred_items(user_id, item_id)
+      select distinct user_id, item_id
+      from rule_matches
+      where action='star'
+    ), new_item_tags as (
+      insert into item_tags(user_id, item_id, tag)
+      select distinct user_id, item_id, tag
+      from rule_matches
+      where action='tag'
+    ), item_events as (
+      select pg_notify('item_events', json_build_object('type', 'items_created', 'user_id', user_id, 'feed_id', $1::integer, 'count', count(*))::text)
+      from new_unread_items
+      group by user_id
     )
-    insert into unread_items(user_id, feed_id, item_id)
-    select user_id, $1, new_items.id
-    from subscriptions
-      cross join new_items
-    where subscriptions.feed_id=$1
+    -- item_events is only evaluated if it is referenced.
+    select (select count(*) from new_items), (select count(*) from item_events)
   `)
 
 	return buf.String(), args
@@ -266,3 +363,65 @@ func GetFeedsUncheckedSince(ctx context.Context, db pgxutil.DB, since time.Time)
 
 	return feeds, rows.Err()
 }
+
+const claimFeedSQL = `update feeds
+set claim_expiration_time=$2
+where id=$1
+  and (claim_expiration_time is null or claim_expiration_time < now())`
+
+// ClaimFeed claims the feed with id feedID until claimExpiration. It returns false if the feed is already claimed by
+// another process.
+func ClaimFeed(ctx context.Context, db pgxutil.DB, feedID int32, claimExpiration time.Time) (bool, error) {
+	ct, err := db.Exec(ctx, claimFeedSQL, feedID, claimExpiration)
+	if err != nil {
+		return false, err
+	}
+
+	return ct.RowsAffected() == 1, nil
+}
+
+// ReleaseFeedClaim releases the claim on the feed with id feedID so it can be refreshed again without waiting for the
+// claim to expire.
+func ReleaseFeedClaim(ctx context.Context, db pgxutil.DB, feedID int32) error {
+	_, err := db.Exec(ctx, `update feeds set claim_expiration_time=null where id=$1`, feedID)
+	return err
+}
+
+// claimFeedsUncheckedSinceSQL uses for update skip locked so concurrent feed updater processes never claim the same
+// feed. A claim is only honored until claim_expiration_time so feeds claimed by a process that died are eventually
+// picked up by another. Feeds with an active WebSub lease receive updates by push so they are polled much less often.
+const claimFeedsUncheckedSinceSQL = `update feeds
+set claim_expiration_time=$3
+where id in (
+  select id
+  from feeds
+  where greatest(last_fetch_time, last_failure_time, '-Infinity'::timestamptz) < (
+      case when exists(
+        select 1
+        from websub_subscriptions
+        where feed_id=feeds.id
+          and lease_expiration_time > now()
+      ) then $2::timestamptz else $1::timestamptz end
+    )
+    and (claim_expiration_time is null or claim_expiration_time < now())
+  order by greatest(last_fetch_time, last_failure_time, '-Infinity'::timestamptz)
+  limit $4
+  for update skip locked
+)
+returning id, url, etag`
+
+// ClaimFeedsUncheckedSince claims up to limit feeds that have not been checked since since, or since pushedSince for
+// feeds with an active WebSub subscription. The claim lasts until claimExpiration or until the feed is updated with
+// the fetch result.
+func ClaimFeedsUncheckedSince(ctx context.Context, db pgxutil.DB, since, pushedSince time.Time, claimExpiration time.Time, limit int) ([]Feed, error) {
+	feeds := make([]Feed, 0, limit)
+	rows, _ := db.Query(ctx, claimFeedsUncheckedSinceSQL, since, pushedSince, claimExpiration, limit)
+
+	for rows.Next() {
+		var feed Feed
+		rows.Scan(&feed.ID, &feed.URL, &feed.ETag)
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
+}
@@ -0,0 +1,29 @@
+package data
+
+// ItemEventsChannel is the PostgreSQL notification channel on which changes to users' unread items are announced.
+// Notifications are sent by the statements that insert and delete unread items so they are delivered only when the
+// change is committed.
+const ItemEventsChannel = "item_events"
+
+const (
+	ItemEventCreated = "items_created"
+	ItemEventRead    = "items_read"
+)
+
+// notifyItemsReadSQL sends items_read notifications for the rows of a deleted CTE returning user_id and item_id. The
+// item IDs are sent in chunks of 500 as PostgreSQL rejects notification payloads of 8000 bytes or more.
+const notifyItemsReadSQL = `select pg_notify('item_events', json_build_object('type', 'items_read', 'user_id', user_id, 'item_ids', json_agg(item_id))::text)
+  from (
+    select user_id, item_id, (row_number() over (partition by user_id order by item_id) - 1) / 500 as chunk
+    from deleted
+  ) chunks
+  group by user_id, chunk`
+
+// ItemEvent is the payload of a notification on ItemEventsChannel.
+type ItemEvent struct {
+	Type    string  `json:"type"`
+	UserID  int32   `json:"user_id"`
+	FeedID  int32   `json:"feed_id"`
+	Count   int     `json:"count"`
+	ItemIDs []int32 `json:"item_ids"`
+}
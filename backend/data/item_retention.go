@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgxutil"
+)
+
+// RetentionPolicy determines which items are pruned. An item is kept if it is one of the newest MaxItemsPerFeed items
+// in its feed or if it was first seen less than MaxAge ago. Zero disables a limit. Unread items, starred items, and
+// items still in the feed document are always kept.
+type RetentionPolicy struct {
+	MaxItemsPerFeed int
+	MaxAge          time.Duration
+}
+
+// Enabled returns true if the policy would prune anything.
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxItemsPerFeed > 0 || p.MaxAge > 0
+}
+
+// PrunedFeed is the number of items pruned from a feed.
+type PrunedFeed struct {
+	FeedID    int32
+	FeedURL   string
+	ItemCount int64
+}
+
+// prunableItemsSQL selects the ids of items the policy allows to be deleted. $1 is MaxItemsPerFeed or 0 and $2 is the
+// creation time before which items are old enough to prune or null.
+const prunableItemsSQL = `select items.id
+  from (
+    select id, creation_time, in_feed_document,
+      row_number() over (partition by feed_id order by coalesce(publication_time, creation_time) desc, id desc) as rank
+    from items
+  ) items
+  where ($1 = 0 or items.rank > $1)
+    and ($2::timestamptz is null or items.creation_time < $2)
+    and not items.in_feed_document
+    and not exists(select 1 from unread_items where unread_items.item_id=items.id)
+    and not exists(select 1 from starred_items where starred_items.item_id=items.id)`
+
+const countPrunableItemsSQL = `select feeds.id, feeds.url, count(*)
+from items
+  join feeds on items.feed_id=feeds.id
+where items.id in (` + prunableItemsSQL + `)
+group by feeds.id
+order by feeds.url`
+
+const pruneItemsSQL = `with deleted as (
+  delete from items
+  where id in (` + prunableItemsSQL + `)
+  returning feed_id
+)
+select feeds.id, feeds.url, count(*)
+from deleted
+  join feeds on deleted.feed_id=feeds.id
+group by feeds.id
+order by feeds.url`
+
+// PruneItems deletes the items that policy allows to be deleted and returns the number deleted from each feed. If
+// dryRun is true nothing is deleted and the number that would have been deleted is returned.
+func PruneItems(ctx context.Context, db pgxutil.DB, policy RetentionPolicy, now time.Time, dryRun bool) ([]PrunedFeed, error) {
+	if !policy.Enabled() {
+		return nil, nil
+	}
+
+	var before *time.Time
+	if policy.MaxAge > 0 {
+		t := now.Add(-policy.MaxAge)
+		before = &t
+	}
+
+	sql := pruneItemsSQL
+	if dryRun {
+		sql = countPrunableItemsSQL
+	}
+
+	rows, _ := db.Query(ctx, sql, policy.MaxItemsPerFeed, before)
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (PrunedFeed, error) {
+		var pf PrunedFeed
+		err := row.Scan(&pf.FeedID, &pf.FeedURL, &pf.ItemCount)
+		return pf, err
+	})
+}
@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+const (
+	ItemRuleFieldTitle          = "title"
+	ItemRuleFieldContent        = "content"
+	ItemRuleFieldTitleOrContent = "title_or_content"
+	ItemRuleFieldAuthor         = "author"
+
+	ItemRuleMatchKeywords = "keywords"
+	ItemRuleMatchRegex    = "regex"
+
+	ItemRuleActionSkipUnread = "skip_unread"
+	ItemRuleActionStar       = "star"
+	ItemRuleActionTag        = "tag"
+)
+
+// ItemRule is a user defined rule that is applied to new items as they are distributed to subscribers.
+type ItemRule struct {
+	ID           int32
+	UserID       int32
+	Name         string
+	FeedID       pgtype.Int4 // null matches all feeds
+	Field        string
+	MatchType    string
+	Pattern      string
+	Regex        string // case insensitive PostgreSQL regular expression built from MatchType and Pattern
+	Action       string
+	Tag          pgtype.Text
+	CreationTime time.Time
+}
+
+const selectItemRuleSQL = `select id, user_id, name, feed_id, field, match_type, pattern, regex, action, tag, creation_time from item_rules`
+const selectItemRulesByUserIDSQL = selectItemRuleSQL + ` where user_id=$1 order by name, id`
+const selectItemRuleByPKSQL = selectItemRuleSQL + ` where user_id=$1 and id=$2`
+
+func RowToAddrOfItemRule(row pgx.CollectableRow) (*ItemRule, error) {
+	r := &ItemRule{}
+	err := row.Scan(&r.ID, &r.UserID, &r.Name, &r.FeedID, &r.Field, &r.MatchType, &r.Pattern, &r.Regex, &r.Action, &r.Tag, &r.CreationTime)
+	return r, err
+}
+
+func SelectItemRulesByUserID(ctx context.Context, db pgxutil.DB, userID int32) ([]*ItemRule, error) {
+	rows, _ := db.Query(ctx, selectItemRulesByUserIDSQL, userID)
+	return pgx.CollectRows(rows, RowToAddrOfItemRule)
+}
+
+// SelectItemRuleByPK selects the rule with id only if it belongs to userID.
+func SelectItemRuleByPK(ctx context.Context, db pgxutil.DB, userID, id int32) (*ItemRule, error) {
+	rows, _ := db.Query(ctx, selectItemRuleByPKSQL, userID, id)
+	return pgx.CollectOneRow(rows, RowToAddrOfItemRule)
+}
+
+const insertItemRuleSQL = `insert into item_rules(user_id, name, feed_id, field, match_type, pattern, regex, action, tag)
+values($1, $2, $3, $4, $5, $6, $7, $8, $9)
+returning id, creation_time`
+
+func InsertItemRule(ctx context.Context, db pgxutil.DB, rule *ItemRule) error {
+	return db.QueryRow(ctx, insertItemRuleSQL,
+		rule.UserID,
+		rule.Name,
+		rule.FeedID,
+		rule.Field,
+		rule.MatchType,
+		rule.Pattern,
+		rule.Regex,
+		rule.Action,
+		rule.Tag,
+	).Scan(&rule.ID, &rule.CreationTime)
+}
+
+const updateItemRuleSQL = `update item_rules
+set name=$3,
+  feed_id=$4,
+  field=$5,
+  match_type=$6,
+  pattern=$7,
+  regex=$8,
+  action=$9,
+  tag=$10
+where user_id=$1
+  and id=$2`
+
+// UpdateItemRule updates rule. It returns pgx.ErrNoRows if rule does not exist or does not belong to rule.UserID.
+func UpdateItemRule(ctx context.Context, db pgxutil.DB, rule *ItemRule) error {
+	_, err := pgxutil.ExecRow(ctx, db, updateItemRuleSQL,
+		rule.UserID,
+		rule.ID,
+		rule.Name,
+		rule.FeedID,
+		rule.Field,
+		rule.MatchType,
+		rule.Pattern,
+		rule.Regex,
+		rule.Action,
+		rule.Tag,
+	)
+	return err
+}
+
+// DeleteItemRule deletes the rule with id. It returns pgx.ErrNoRows if the rule does not exist or does not belong to
+// userID.
+func DeleteItemRule(ctx context.Context, db pgxutil.DB, userID, id int32) error {
+	_, err := pgxutil.ExecRow(ctx, db, `delete from item_rules where user_id=$1 and id=$2`, userID, id)
+	return err
+}
+
+var ErrInvalidRegex = errors.New("invalid regular expression")
+
+// ValidateRegex checks that regex is a valid PostgreSQL regular expression. It returns an error wrapping
+// ErrInvalidRegex if it is not.
+func ValidateRegex(ctx context.Context, db pgxutil.DB, regex string) error {
+	_, err := db.Exec(ctx, `select '' ~* $1`, regex)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "2201B" {
+		return errors.Join(ErrInvalidRegex, err)
+	}
+	return err
+}
+
+// itemRuleMatchSQL is the condition for the item_rules row matching the items row. It is shared by the rule preview
+// and by buildNewItemsSQL so a preview matches exactly what the rule will do to new items.
+const itemRuleMatchSQL = `case item_rules.field
+      when 'title' then items.title ~* item_rules.regex
+      when 'content' then coalesce(items.content, '') ~* item_rules.regex
+      when 'title_or_content' then concat_ws(' ', items.title, items.content) ~* item_rules.regex
+      when 'author' then coalesce(items.author, '') ~* item_rules.regex
+    end
+    and (item_rules.feed_id is null or item_rules.feed_id=items.feed_id)`
+
+const copyItemRuleMatchesAsJSONSQL = `select coalesce(json_agg(row_to_json(t)), '[]'::json)
+from (
+  select
+    items.id,
+    feeds.id as feed_id,
+    feeds.name as feed_name,
+    items.title,
+    items.url,
+    items.author,
+    extract(epoch from coalesce(publication_time, items.creation_time)::timestamptz(0)) as publication_time
+  from (select $2::integer as feed_id, $3::varchar as field, $4::varchar as regex) item_rules
+    cross join (
+      select items.*
+      from items
+        join subscriptions on items.feed_id=subscriptions.feed_id
+      where subscriptions.user_id=$1
+      order by coalesce(items.publication_time, items.creation_time) desc
+      limit $5
+    ) items
+    join feeds on feeds.id=items.feed_id
+  where ` + itemRuleMatchSQL + `
+  order by publication_time desc
+) t`
+
+// CopyItemRuleMatchesAsJSON writes the items that rule matches out of the limit most recent items from userID's
+// subscriptions. rule does not need to have been saved.
+func CopyItemRuleMatchesAsJSON(ctx context.Context, db pgxutil.DB, w io.Writer, userID int32, rule *ItemRule, limit int) error {
+	var b []byte
+	err := db.QueryRow(ctx, copyItemRuleMatchesAsJSONSQL, userID, rule.FeedID, rule.Field, rule.Regex, limit).Scan(&b)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
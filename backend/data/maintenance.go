@@ -0,0 +1,82 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+// execOrCount executes deleteSQL and returns the number of rows deleted. If dryRun is true it instead returns the
+// result of countSQL which must count the rows deleteSQL would delete.
+func execOrCount(ctx context.Context, db pgxutil.DB, dryRun bool, deleteSQL, countSQL string, args ...any) (int64, error) {
+	if dryRun {
+		var n int64
+		err := db.QueryRow(ctx, countSQL, args...).Scan(&n)
+		return n, err
+	}
+
+	ct, err := db.Exec(ctx, deleteSQL, args...)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+const expiredSessionsWhereSQL = ` where last_seen_time < $1 or start_time < $2`
+
+// DeleteExpiredSessions deletes sessions last seen before idleBefore or started before startedBefore. A null time
+// disables that check.
+func DeleteExpiredSessions(ctx context.Context, db pgxutil.DB, idleBefore, startedBefore pgtype.Timestamptz, dryRun bool) (int64, error) {
+	return execOrCount(ctx, db, dryRun,
+		`delete from sessions`+expiredSessionsWhereSQL,
+		`select count(*) from sessions`+expiredSessionsWhereSQL,
+		idleBefore, startedBefore,
+	)
+}
+
+const orphanedFeedsWhereSQL = ` where not exists(select 1 from subscriptions where feed_id=feeds.id)`
+
+// DeleteOrphanedFeeds deletes feeds that have no subscribers. DeleteSubscription does this when a user unsubscribes
+// but feeds can also be orphaned by deleting users.
+func DeleteOrphanedFeeds(ctx context.Context, db pgxutil.DB, dryRun bool) (int64, error) {
+	return execOrCount(ctx, db, dryRun,
+		`delete from feeds`+orphanedFeedsWhereSQL,
+		`select count(*) from feeds`+orphanedFeedsWhereSQL,
+	)
+}
+
+const oldPasswordResetsWhereSQL = ` where request_time < $1`
+
+// DeleteOldPasswordResets deletes password resets requested before requestedBefore. They have been completed or have
+// expired.
+func DeleteOldPasswordResets(ctx context.Context, db pgxutil.DB, requestedBefore time.Time, dryRun bool) (int64, error) {
+	return execOrCount(ctx, db, dryRun,
+		`delete from password_resets`+oldPasswordResetsWhereSQL,
+		`select count(*) from password_resets`+oldPasswordResetsWhereSQL,
+		requestedBefore,
+	)
+}
+
+const oldEmailVerificationsWhereSQL = ` where request_time < $1`
+
+// DeleteOldEmailVerifications deletes email verifications requested before requestedBefore. They have been completed or
+// have expired.
+func DeleteOldEmailVerifications(ctx context.Context, db pgxutil.DB, requestedBefore time.Time, dryRun bool) (int64, error) {
+	return execOrCount(ctx, db, dryRun,
+		`delete from email_verifications`+oldEmailVerificationsWhereSQL,
+		`select count(*) from email_verifications`+oldEmailVerificationsWhereSQL,
+		requestedBefore,
+	)
+}
+
+// DeleteAuthAttemptsBefore deletes authentication attempts made before the given time. They no longer count toward
+// any rate limit.
+func DeleteAuthAttemptsBefore(ctx context.Context, db pgxutil.DB, before time.Time, dryRun bool) (int64, error) {
+	return execOrCount(ctx, db, dryRun,
+		`delete from auth_attempts where attempt_time < $1`,
+		`select count(*) from auth_attempts where attempt_time < $1`,
+		before,
+	)
+}
@@ -0,0 +1,32 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgxutil"
+)
+
+const getUserByOIDCIdentitySQL = `select users.id, name, email, email_verified, password_hash, is_admin, disabled
+from oidc_identities
+  join users on oidc_identities.user_id=users.id
+where issuer=$1
+  and subject=$2`
+
+// SelectUserByOIDCIdentity selects the user linked to the subject at the OpenID Connect provider issuer.
+func SelectUserByOIDCIdentity(ctx context.Context, db pgxutil.DB, issuer, subject string) (*User, error) {
+	return selectUser(ctx, db, "getUserByOIDCIdentity", getUserByOIDCIdentitySQL, issuer, subject)
+}
+
+// InsertOIDCIdentity links the subject at the OpenID Connect provider issuer to userID.
+func InsertOIDCIdentity(ctx context.Context, db pgxutil.DB, issuer, subject string, userID int32, loginTime time.Time) error {
+	_, err := db.Exec(ctx, `insert into oidc_identities(issuer, subject, user_id, last_login_time) values($1, $2, $3, $4)`,
+		issuer, subject, userID, loginTime)
+	return err
+}
+
+// TouchOIDCIdentity records a login by the subject at the OpenID Connect provider issuer.
+func TouchOIDCIdentity(ctx context.Context, db pgxutil.DB, issuer, subject string, loginTime time.Time) error {
+	_, err := db.Exec(ctx, `update oidc_identities set last_login_time=$3 where issuer=$1 and subject=$2`, issuer, subject, loginTime)
+	return err
+}
@@ -10,8 +10,10 @@ import (
 	"github.com/jackc/pgxutil"
 )
 
+// PasswordReset is a request to reset the password of the user with Email. The token sent in the password reset mail is
+// only stored as TokenDigest.
 type PasswordReset struct {
-	Token          string
+	TokenDigest    []byte
 	Email          string
 	RequestIP      netip.Addr
 	RequestTime    time.Time
@@ -20,21 +22,21 @@ type PasswordReset struct {
 	CompletionTime pgtype.Timestamptz
 }
 
-const selectPasswordResetSQL = `select token, email, request_ip, request_time, user_id, completion_ip, completion_time from password_resets`
-const selectPasswordResetByPKSQL = selectPasswordResetSQL + ` where token = $1`
+const selectPasswordResetSQL = `select token_digest, email, request_ip, request_time, user_id, completion_ip, completion_time from password_resets`
+const selectPasswordResetByPKSQL = selectPasswordResetSQL + ` where token_digest = $1`
 
 func RowToAddrOfPasswordReset(row pgx.CollectableRow) (*PasswordReset, error) {
 	pr := &PasswordReset{}
-	err := row.Scan(&pr.Token, &pr.Email, &pr.RequestIP, &pr.RequestTime, &pr.UserID, &pr.CompletionIP, &pr.CompletionTime)
+	err := row.Scan(&pr.TokenDigest, &pr.Email, &pr.RequestIP, &pr.RequestTime, &pr.UserID, &pr.CompletionIP, &pr.CompletionTime)
 	return pr, err
 }
 
 func SelectPasswordResetByPK(
 	ctx context.Context,
 	db pgxutil.DB,
-	token string,
+	tokenDigest []byte,
 ) (*PasswordReset, error) {
-	rows, _ := db.Query(ctx, selectPasswordResetByPKSQL, token)
+	rows, _ := db.Query(ctx, selectPasswordResetByPKSQL, tokenDigest)
 	pr, err := pgx.CollectOneRow(rows, RowToAddrOfPasswordReset)
 	if err != nil {
 		return nil, err
@@ -42,3 +44,35 @@ func SelectPasswordResetByPK(
 
 	return pr, nil
 }
+
+// InsertPasswordReset inserts pr. Any earlier password resets of the same user that have not been completed are deleted
+// so only the token in the most recent mail works.
+func InsertPasswordReset(ctx context.Context, db pgxutil.DB, pr *PasswordReset) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if pr.UserID.Valid {
+			_, err := tx.Exec(ctx, `delete from password_resets where user_id=$1 and completion_time is null`, pr.UserID)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(ctx, `insert into password_resets(token_digest, email, request_ip, request_time, user_id)
+values($1, $2, $3, $4, $5)`,
+			pr.TokenDigest, pr.Email, pr.RequestIP, pr.RequestTime, pr.UserID)
+		return err
+	})
+}
+
+// CompletePasswordReset marks the password reset with tokenDigest requested after requestedAfter as completed and
+// returns it. It returns pgx.ErrNoRows if there is no such password reset for a user or it was already completed.
+func CompletePasswordReset(ctx context.Context, db pgxutil.DB, tokenDigest []byte, requestedAfter time.Time, completionIP netip.Addr, completionTime time.Time) (*PasswordReset, error) {
+	rows, _ := db.Query(ctx, `update password_resets
+set completion_ip=$3, completion_time=$4
+where token_digest=$1
+  and request_time > $2
+  and user_id is not null
+  and completion_time is null
+returning token_digest, email, request_ip, request_time, user_id, completion_ip, completion_time`,
+		tokenDigest, requestedAfter, completionIP, completionTime)
+	return pgx.CollectOneRow(rows, RowToAddrOfPasswordReset)
+}
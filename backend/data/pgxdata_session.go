@@ -2,27 +2,106 @@ package data
 
 import (
 	"context"
+	"net/netip"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgxutil"
 )
 
 type Session struct {
-	ID     []byte
-	UserID int32
+	ID           []byte
+	UserID       int32
+	StartTime    time.Time
+	LastSeenTime time.Time
+	UserAgent    pgtype.Text
+	IP           netip.Addr
 }
 
 func InsertSession(ctx context.Context, db pgxutil.DB, row *Session) error {
-	_, err := db.Exec(ctx, `insert into sessions (id, user_id) values ($1, $2)`, row.ID, row.UserID)
+	_, err := db.Exec(ctx, `insert into sessions (id, user_id, user_agent, ip) values ($1, $2, $3, $4)`, row.ID, row.UserID, row.UserAgent, row.IP)
 	return err
 }
 
+// DeleteSession deletes userID's session id. It returns pgx.ErrNoRows if userID has no such session.
 func DeleteSession(ctx context.Context, db pgxutil.DB,
+	userID int32,
 	id []byte,
 ) error {
-	_, err := pgxutil.ExecRow(ctx, db, `delete from sessions where id = $1`, id)
+	_, err := pgxutil.ExecRow(ctx, db, `delete from sessions where id = $1 and user_id = $2`, id, userID)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// DeleteSessionsByUserID deletes all of userID's sessions except exceptID. exceptID may be nil to delete all sessions.
+// It returns the number of sessions deleted.
+func DeleteSessionsByUserID(ctx context.Context, db pgxutil.DB, userID int32, exceptID []byte) (int64, error) {
+	ct, err := db.Exec(ctx, `delete from sessions where user_id=$1 and ($2::bytea is null or id <> $2)`, userID, exceptID)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+const selectActiveSessionsByUserIDSQL = `select id, user_id, start_time, last_seen_time, user_agent, ip
+from sessions
+where user_id=$1
+  and ($2::timestamptz is null or last_seen_time >= $2)
+  and ($3::timestamptz is null or start_time >= $3)
+order by last_seen_time desc`
+
+// SelectActiveSessionsByUserID selects userID's sessions that were last seen at or after idleCutoff and started at or
+// after absoluteCutoff. A null cutoff disables that check.
+func SelectActiveSessionsByUserID(ctx context.Context, db pgxutil.DB, userID int32, idleCutoff, absoluteCutoff pgtype.Timestamptz) ([]*Session, error) {
+	rows, _ := db.Query(ctx, selectActiveSessionsByUserIDSQL, userID, idleCutoff, absoluteCutoff)
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Session, error) {
+		s := &Session{}
+		err := row.Scan(&s.ID, &s.UserID, &s.StartTime, &s.LastSeenTime, &s.UserAgent, &s.IP)
+		return s, err
+	})
+}
+
+const selectLatestSessionIDByUserAgentSQL = `select id
+from sessions
+where user_id=$1
+  and user_agent is not distinct from $2
+  and ($3::timestamptz is null or last_seen_time >= $3)
+  and ($4::timestamptz is null or start_time >= $4)
+order by last_seen_time desc
+limit 1`
+
+// SelectLatestSessionIDByUserAgent selects the ID of userID's most recently used session from userAgent that was last
+// seen at or after idleCutoff and started at or after absoluteCutoff. A null cutoff disables that check.
+func SelectLatestSessionIDByUserAgent(ctx context.Context, db pgxutil.DB, userID int32, userAgent pgtype.Text, idleCutoff, absoluteCutoff pgtype.Timestamptz) ([]byte, error) {
+	var id []byte
+	err := db.QueryRow(ctx, selectLatestSessionIDByUserAgentSQL, userID, userAgent, idleCutoff, absoluteCutoff).Scan(&id)
+	return id, err
+}
+
+// SelectSessionStartTime selects when the session with id started.
+func SelectSessionStartTime(ctx context.Context, db pgxutil.DB, id []byte) (time.Time, error) {
+	var startTime time.Time
+	err := db.QueryRow(ctx, `select start_time from sessions where id=$1`, id).Scan(&startTime)
+	return startTime, err
+}
+
+// TouchSession records that the session was used at lastSeenTime by userAgent from ip. The session is only written to
+// when the previous use was more than a minute earlier or the user agent or IP address changed so each request does
+// not cause a write.
+func TouchSession(ctx context.Context, db pgxutil.DB, id []byte, lastSeenTime time.Time, userAgent pgtype.Text, ip netip.Addr) error {
+	_, err := db.Exec(ctx, `update sessions
+set last_seen_time=$2,
+  user_agent=$3,
+  ip=$4
+where id=$1
+  and (
+    last_seen_time < $2 - interval '1 minute'
+    or user_agent is distinct from $3
+    or ip is distinct from $4
+  )`, id, lastSeenTime, userAgent, ip)
+	return err
+}
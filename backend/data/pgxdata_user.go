@@ -9,19 +9,29 @@ import (
 )
 
 type User struct {
-	ID             pgtype.Int4
-	Name           pgtype.Text
-	PasswordDigest []byte
-	PasswordSalt   []byte
-	Email          pgtype.Text
+	ID           pgtype.Int4
+	Name         pgtype.Text
+	PasswordHash string
+	Email        pgtype.Text
+
+	// EmailVerified is true once the owner of Email has confirmed it.
+	EmailVerified bool
+
+	// IsAdmin allows the user to manage other users.
+	IsAdmin bool
+
+	// Disabled users cannot log in or use existing sessions and API tokens.
+	Disabled bool
 }
 
 const selectUserByPKSQL = `select
   "id",
   "name",
-  "password_digest",
-  "password_salt",
-  "email"
+  "password_hash",
+  "email",
+  "email_verified",
+  "is_admin",
+  "disabled"
 from "users"
 where "id"=$1`
 
@@ -34,9 +44,11 @@ func SelectUserByPK(
 	err := db.QueryRow(ctx, selectUserByPKSQL, id).Scan(
 		&row.ID,
 		&row.Name,
-		&row.PasswordDigest,
-		&row.PasswordSalt,
+		&row.PasswordHash,
 		&row.Email,
+		&row.EmailVerified,
+		&row.IsAdmin,
+		&row.Disabled,
 	)
 	if err != nil {
 		return nil, err
@@ -50,10 +62,10 @@ func UpdateUser(ctx context.Context, db pgxutil.DB,
 	row *User,
 ) error {
 	return pgxutil.UpdateRow(ctx, db, pgx.Identifier{"users"}, map[string]any{
-		"name":            row.Name,
-		"password_digest": row.PasswordDigest,
-		"password_salt":   row.PasswordSalt,
-		"email":           row.Email,
+		"name":           row.Name,
+		"password_hash":  row.PasswordHash,
+		"email":          row.Email,
+		"email_verified": row.EmailVerified,
 	}, map[string]any{
 		"id": id,
 	})
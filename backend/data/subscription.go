@@ -57,6 +57,7 @@ func SelectSubscriptions(ctx context.Context, db pgxutil.DB, userID int32) ([]Su
 }
 
 const deleteSubscriptionSQL = `delete from subscriptions where user_id=$1 and feed_id=$2`
+const deleteFeedItemRulesSQL = `delete from item_rules where user_id=$1 and feed_id=$2`
 const deleteFeedIfOrphanedSQL = `delete from feeds
 where id=$1
   and not exists(select 1 from subscriptions where feed_id=id)`
@@ -73,6 +74,11 @@ func DeleteSubscription(ctx context.Context, db *pgxpool.Pool, userID, feedID in
 		return err
 	}
 
+	_, err = tx.Exec(ctx, deleteFeedItemRulesSQL, userID, feedID)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.Exec(ctx, deleteFeedIfOrphanedSQL, feedID)
 	if err != nil {
 		return err
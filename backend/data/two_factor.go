@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+// TOTPCredential is a user's TOTP secret. Two-factor authentication is enabled once the secret is confirmed.
+type TOTPCredential struct {
+	UserID           int32
+	Secret           []byte
+	CreationTime     time.Time
+	ConfirmationTime pgtype.Timestamptz
+	LastUsedStep     pgtype.Int8
+}
+
+// Enabled reports whether the credential has been confirmed and is required to log in.
+func (c *TOTPCredential) Enabled() bool {
+	return c != nil && c.ConfirmationTime.Valid
+}
+
+const selectTOTPCredentialSQL = `select user_id, secret, creation_time, confirmation_time, last_used_step
+from totp_credentials
+where user_id=$1`
+
+func SelectTOTPCredential(ctx context.Context, db pgxutil.DB, userID int32) (*TOTPCredential, error) {
+	c := &TOTPCredential{}
+	err := db.QueryRow(ctx, selectTOTPCredentialSQL, userID).Scan(&c.UserID, &c.Secret, &c.CreationTime, &c.ConfirmationTime, &c.LastUsedStep)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+const insertPendingTOTPCredentialSQL = `insert into totp_credentials(user_id, secret)
+values($1, $2)
+on conflict (user_id) do update
+set secret=excluded.secret,
+  creation_time=now(),
+  last_used_step=null
+where totp_credentials.confirmation_time is null`
+
+// InsertPendingTOTPCredential stores secret as userID's unconfirmed TOTP secret, replacing any earlier unconfirmed
+// secret. It returns pgx.ErrNoRows if userID already has two-factor authentication enabled.
+func InsertPendingTOTPCredential(ctx context.Context, db pgxutil.DB, userID int32, secret []byte) error {
+	_, err := pgxutil.ExecRow(ctx, db, insertPendingTOTPCredentialSQL, userID, secret)
+	return err
+}
+
+// UseTOTPStep records that a code for step was accepted for userID. It returns pgx.ErrNoRows if a code for step or a
+// later step was already accepted so each code can only be used once.
+func UseTOTPStep(ctx context.Context, db pgxutil.DB, userID int32, step int64) error {
+	_, err := pgxutil.ExecRow(ctx, db, `update totp_credentials
+set last_used_step=$2
+where user_id=$1
+  and (last_used_step is null or last_used_step < $2)`, userID, step)
+	return err
+}
+
+// ConfirmTOTPCredential enables two-factor authentication for userID and replaces any recovery codes with codeDigests.
+func ConfirmTOTPCredential(ctx context.Context, db pgxutil.DB, userID int32, codeDigests [][]byte) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		_, err := pgxutil.ExecRow(ctx, tx, `update totp_credentials set confirmation_time=now() where user_id=$1`, userID)
+		if err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(ctx, tx, userID, codeDigests)
+	})
+}
+
+// DeleteTwoFactor disables two-factor authentication for userID and deletes its recovery codes.
+func DeleteTwoFactor(ctx context.Context, db pgxutil.DB, userID int32) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `delete from recovery_codes where user_id=$1`, userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `delete from totp_credentials where user_id=$1`, userID)
+		return err
+	})
+}
+
+// ReplaceRecoveryCodes deletes userID's recovery codes and inserts codeDigests.
+func ReplaceRecoveryCodes(ctx context.Context, db pgxutil.DB, userID int32, codeDigests [][]byte) error {
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		return replaceRecoveryCodes(ctx, tx, userID, codeDigests)
+	})
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID int32, codeDigests [][]byte) error {
+	_, err := tx.Exec(ctx, `delete from recovery_codes where user_id=$1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `insert into recovery_codes(user_id, code_digest)
+select $1, unnest($2::bytea[])`, userID, codeDigests)
+	return err
+}
+
+// UseRecoveryCode marks userID's recovery code with codeDigest as used. It returns pgx.ErrNoRows if there is no such
+// unused code.
+func UseRecoveryCode(ctx context.Context, db pgxutil.DB, userID int32, codeDigest []byte) error {
+	_, err := pgxutil.ExecRow(ctx, db, `update recovery_codes
+set used_time=now()
+where user_id=$1
+  and code_digest=$2
+  and used_time is null`, userID, codeDigest)
+	return err
+}
+
+func SelectUnusedRecoveryCodeCount(ctx context.Context, db pgxutil.DB, userID int32) (int64, error) {
+	var n int64
+	err := db.QueryRow(ctx, `select count(*) from recovery_codes where user_id=$1 and used_time is null`, userID).Scan(&n)
+	return n, err
+}
@@ -18,10 +18,10 @@ func (e DuplicationError) Error() string {
 	return fmt.Sprintf("%s is already taken", e.Field)
 }
 
-func selectUser(ctx context.Context, db pgxutil.DB, name, sql string, arg interface{}) (*User, error) {
+func selectUser(ctx context.Context, db pgxutil.DB, name, sql string, args ...interface{}) (*User, error) {
 	user := User{}
 
-	err := db.QueryRow(ctx, sql, arg).Scan(&user.ID, &user.Name, &user.Email, &user.PasswordDigest, &user.PasswordSalt)
+	err := db.QueryRow(ctx, sql, args...).Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &user.PasswordHash, &user.IsAdmin, &user.Disabled)
 	if err != nil {
 		return nil, err
 	}
@@ -29,34 +29,47 @@ func selectUser(ctx context.Context, db pgxutil.DB, name, sql string, arg interf
 	return &user, nil
 }
 
-const getUserByNameSQL = `select id, name, email, password_digest, password_salt from users where name=$1`
+const getUserByNameSQL = `select id, name, email, email_verified, password_hash, is_admin, disabled from users where name=$1`
 
 func SelectUserByName(ctx context.Context, db pgxutil.DB, name string) (*User, error) {
 	return selectUser(ctx, db, "getUserByName", getUserByNameSQL, name)
 }
 
-const getUserByEmailSQL = `select id, name, email, password_digest, password_salt from users where email=$1`
+// UserNameExists reports whether a user has name. Names are compared case-insensitively as they are unique without
+// regard to case.
+func UserNameExists(ctx context.Context, db pgxutil.DB, name string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(ctx, `select exists(select 1 from users where lower(name)=lower($1))`, name).Scan(&exists)
+	return exists, err
+}
+
+const getUserByEmailSQL = `select id, name, email, email_verified, password_hash, is_admin, disabled from users where email=$1`
 
 func SelectUserByEmail(ctx context.Context, db pgxutil.DB, email string) (*User, error) {
 	return selectUser(ctx, db, "getUserByEmail", getUserByEmailSQL, email)
 }
 
-const getUserBySessionIDSQL = `select users.id, name, email, password_digest, password_salt
+const getUserBySessionIDSQL = `select users.id, name, email, email_verified, password_hash, is_admin, disabled
 from sessions
   join users on sessions.user_id=users.id
-where sessions.id=$1`
+where sessions.id=$1
+  and ($2::timestamptz is null or sessions.last_seen_time >= $2)
+  and ($3::timestamptz is null or sessions.start_time >= $3)`
 
-func SelectUserBySessionID(ctx context.Context, db pgxutil.DB, id []byte) (*User, error) {
-	return selectUser(ctx, db, "getUserBySessionID", getUserBySessionIDSQL, id)
+// SelectUserBySessionID selects the user for the session with id if the session was last seen at or after idleCutoff
+// and started at or after absoluteCutoff. A null cutoff disables that check.
+func SelectUserBySessionID(ctx context.Context, db pgxutil.DB, id []byte, idleCutoff, absoluteCutoff pgtype.Timestamptz) (*User, error) {
+	return selectUser(ctx, db, "getUserBySessionID", getUserBySessionIDSQL, id, idleCutoff, absoluteCutoff)
 }
 
 func CreateUser(ctx context.Context, db pgxutil.DB, user *User) (int32, error) {
 	var err error
 	user.ID, err = pgxutil.InsertRowReturning(ctx, db, pgx.Identifier{"users"}, map[string]any{
-		"name":            &user.Name,
-		"password_digest": &user.PasswordDigest,
-		"password_salt":   &user.PasswordSalt,
-		"email":           &user.Email,
+		"name":           &user.Name,
+		"password_hash":  &user.PasswordHash,
+		"email":          &user.Email,
+		"email_verified": user.EmailVerified,
+		"is_admin":       user.IsAdmin,
 	}, "id", pgx.RowTo[pgtype.Int4])
 	if err != nil {
 		if strings.Contains(err.Error(), "users_name_unq") {
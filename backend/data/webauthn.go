@@ -0,0 +1,114 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+// WebAuthnCredential is a passkey or security key registered by a user. Credential is the JSON encoded credential
+// record the WebAuthn library verifies logins with.
+type WebAuthnCredential struct {
+	ID           int32
+	UserID       int32
+	Name         string
+	CredentialID []byte
+	Credential   []byte
+	CreationTime time.Time
+	LastUsedTime pgtype.Timestamptz
+}
+
+const selectWebAuthnCredentialsByUserIDSQL = `select id, user_id, name, credential_id, credential, creation_time, last_used_time
+from webauthn_credentials
+where user_id=$1
+order by name, id`
+
+func RowToAddrOfWebAuthnCredential(row pgx.CollectableRow) (*WebAuthnCredential, error) {
+	c := &WebAuthnCredential{}
+	err := row.Scan(&c.ID, &c.UserID, &c.Name, &c.CredentialID, &c.Credential, &c.CreationTime, &c.LastUsedTime)
+	return c, err
+}
+
+func SelectWebAuthnCredentialsByUserID(ctx context.Context, db pgxutil.DB, userID int32) ([]*WebAuthnCredential, error) {
+	rows, _ := db.Query(ctx, selectWebAuthnCredentialsByUserIDSQL, userID)
+	return pgx.CollectRows(rows, RowToAddrOfWebAuthnCredential)
+}
+
+const insertWebAuthnCredentialSQL = `insert into webauthn_credentials(user_id, name, credential_id, credential)
+values($1, $2, $3, $4)
+returning id, creation_time`
+
+func InsertWebAuthnCredential(ctx context.Context, db pgxutil.DB, c *WebAuthnCredential) error {
+	return db.QueryRow(ctx, insertWebAuthnCredentialSQL,
+		c.UserID,
+		c.Name,
+		c.CredentialID,
+		c.Credential,
+	).Scan(&c.ID, &c.CreationTime)
+}
+
+// UpdateWebAuthnCredentialUse stores credential, which has the sign count from a login at lastUsedTime, for the
+// credential with id.
+func UpdateWebAuthnCredentialUse(ctx context.Context, db pgxutil.DB, id int32, credential []byte, lastUsedTime time.Time) error {
+	_, err := pgxutil.ExecRow(ctx, db, `update webauthn_credentials set credential=$2, last_used_time=$3 where id=$1`, id, credential, lastUsedTime)
+	return err
+}
+
+// DeleteWebAuthnCredential deletes the credential with id. It returns pgx.ErrNoRows if the credential does not exist or
+// does not belong to userID.
+func DeleteWebAuthnCredential(ctx context.Context, db pgxutil.DB, userID, id int32) error {
+	_, err := pgxutil.ExecRow(ctx, db, `delete from webauthn_credentials where user_id=$1 and id=$2`, userID, id)
+	return err
+}
+
+// SelectWebAuthnUserHandle returns userID's WebAuthn user handle. It is nil if the user has never registered a
+// credential.
+func SelectWebAuthnUserHandle(ctx context.Context, db pgxutil.DB, userID int32) ([]byte, error) {
+	var handle []byte
+	err := db.QueryRow(ctx, `select webauthn_user_handle from users where id=$1`, userID).Scan(&handle)
+	return handle, err
+}
+
+// SetWebAuthnUserHandle sets userID's WebAuthn user handle to handle unless it already has one. It returns the user's
+// handle.
+func SetWebAuthnUserHandle(ctx context.Context, db pgxutil.DB, userID int32, handle []byte) ([]byte, error) {
+	err := db.QueryRow(ctx, `update users
+set webauthn_user_handle=coalesce(webauthn_user_handle, $2)
+where id=$1
+returning webauthn_user_handle`, userID, handle).Scan(&handle)
+	return handle, err
+}
+
+const getUserByWebAuthnUserHandleSQL = `select id, name, email, email_verified, password_hash, is_admin, disabled from users where webauthn_user_handle=$1`
+
+func SelectUserByWebAuthnUserHandle(ctx context.Context, db pgxutil.DB, handle []byte) (*User, error) {
+	return selectUser(ctx, db, "getUserByWebAuthnUserHandle", getUserByWebAuthnUserHandleSQL, handle)
+}
+
+// InsertWebAuthnCeremony stores the state of a WebAuthn registration or login that has begun. Expired ceremonies that
+// were never finished are deleted at the same time.
+func InsertWebAuthnCeremony(ctx context.Context, db pgxutil.DB, id []byte, userID pgtype.Int4, sessionData []byte, expirationTime time.Time) error {
+	_, err := db.Exec(ctx, `delete from webauthn_ceremonies where expiration_time < now()`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(ctx, `insert into webauthn_ceremonies(id, user_id, session_data, expiration_time) values($1, $2, $3, $4)`,
+		id, userID, sessionData, expirationTime)
+	return err
+}
+
+// DeleteWebAuthnCeremony deletes and returns the user ID and state of the unexpired ceremony with id so each challenge
+// can be used at most once. It returns pgx.ErrNoRows if there is no such ceremony.
+func DeleteWebAuthnCeremony(ctx context.Context, db pgxutil.DB, id []byte) (pgtype.Int4, []byte, error) {
+	var userID pgtype.Int4
+	var sessionData []byte
+	err := db.QueryRow(ctx, `delete from webauthn_ceremonies
+where id=$1
+  and expiration_time > now()
+returning user_id, session_data`, id).Scan(&userID, &sessionData)
+	return userID, sessionData, err
+}
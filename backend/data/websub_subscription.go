@@ -0,0 +1,94 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgxutil"
+)
+
+type WebSubSubscription struct {
+	FeedID               int32
+	HubURL               string
+	TopicURL             string
+	Secret               string
+	CallbackToken        string
+	SubscribeRequestTime pgtype.Timestamptz
+	LeaseSeconds         pgtype.Int4
+	VerificationTime     pgtype.Timestamptz
+	LeaseExpirationTime  pgtype.Timestamptz
+}
+
+const selectWebSubSubscriptionSQL = `select feed_id, hub_url, topic_url, secret, callback_token, subscribe_request_time, lease_seconds, verification_time, lease_expiration_time from websub_subscriptions`
+const selectWebSubSubscriptionByFeedIDSQL = selectWebSubSubscriptionSQL + ` where feed_id=$1`
+
+func RowToAddrOfWebSubSubscription(row pgx.CollectableRow) (*WebSubSubscription, error) {
+	s := &WebSubSubscription{}
+	err := row.Scan(&s.FeedID, &s.HubURL, &s.TopicURL, &s.Secret, &s.CallbackToken, &s.SubscribeRequestTime, &s.LeaseSeconds, &s.VerificationTime, &s.LeaseExpirationTime)
+	return s, err
+}
+
+func SelectWebSubSubscriptionByFeedID(ctx context.Context, db pgxutil.DB, feedID int32) (*WebSubSubscription, error) {
+	rows, _ := db.Query(ctx, selectWebSubSubscriptionByFeedIDSQL, feedID)
+	return pgx.CollectOneRow(rows, RowToAddrOfWebSubSubscription)
+}
+
+const upsertWebSubSubscriptionRequestSQL = `insert into websub_subscriptions(feed_id, hub_url, topic_url, secret, callback_token, subscribe_request_time)
+values($1, $2, $3, $4, $5, $6)
+on conflict (feed_id) do update
+set hub_url=excluded.hub_url,
+  topic_url=excluded.topic_url,
+  secret=excluded.secret,
+  callback_token=excluded.callback_token,
+  subscribe_request_time=excluded.subscribe_request_time`
+
+// UpsertWebSubSubscriptionRequest records that a subscription request is being sent to a hub. An existing lease is
+// kept until the hub verifies the new request.
+func UpsertWebSubSubscriptionRequest(ctx context.Context, db pgxutil.DB, sub *WebSubSubscription) error {
+	_, err := db.Exec(ctx, upsertWebSubSubscriptionRequestSQL, sub.FeedID, sub.HubURL, sub.TopicURL, sub.Secret, sub.CallbackToken, sub.SubscribeRequestTime)
+	return err
+}
+
+const verifyWebSubSubscriptionSQL = `update websub_subscriptions
+set lease_seconds=$2,
+  verification_time=$3,
+  lease_expiration_time=$3 + make_interval(secs => $2::integer)
+where feed_id=$1
+  and subscribe_request_time >= $4
+  and (verification_time is null or verification_time < subscribe_request_time)`
+
+// VerifyWebSubSubscription records that the hub verified the subscription with a lease of leaseSeconds. Only a
+// subscription request sent at or after requestedAfter that has not been verified yet can be verified. It returns
+// pgx.ErrNoRows if there is no such request.
+func VerifyWebSubSubscription(ctx context.Context, db pgxutil.DB, feedID int32, leaseSeconds int32, verificationTime, requestedAfter time.Time) error {
+	_, err := pgxutil.ExecRow(ctx, db, verifyWebSubSubscriptionSQL, feedID, leaseSeconds, verificationTime, requestedAfter)
+	return err
+}
+
+func DeleteWebSubSubscription(ctx context.Context, db pgxutil.DB, feedID int32) error {
+	_, err := db.Exec(ctx, `delete from websub_subscriptions where feed_id=$1`, feedID)
+	return err
+}
+
+// claimWebSubSubscriptionsForRenewalSQL selects subscriptions whose lease has less than a tenth of its duration
+// remaining and that have not had a subscription request sent in the last hour. Claiming works the same as
+// claimFeedsUncheckedSinceSQL so only one process renews each subscription.
+const claimWebSubSubscriptionsForRenewalSQL = `update websub_subscriptions
+set subscribe_request_time=$1
+where feed_id in (
+  select feed_id
+  from websub_subscriptions
+  where lease_expiration_time - make_interval(secs => lease_seconds / 10) < $1
+    and subscribe_request_time < $1 - interval '1 hour'
+  limit $2
+  for update skip locked
+)
+returning feed_id, hub_url, topic_url, secret, callback_token, subscribe_request_time, lease_seconds, verification_time, lease_expiration_time`
+
+// ClaimWebSubSubscriptionsForRenewal claims up to limit subscriptions that need to be renewed.
+func ClaimWebSubSubscriptionsForRenewal(ctx context.Context, db pgxutil.DB, now time.Time, limit int) ([]*WebSubSubscription, error) {
+	rows, _ := db.Query(ctx, claimWebSubSubscriptionsForRenewalSQL, now, limit)
+	return pgx.CollectRows(rows, RowToAddrOfWebSubSubscription)
+}
@@ -6,6 +6,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"net/netip"
 	"testing"
 	"time"
 
@@ -17,9 +19,8 @@ import (
 
 func newUser() *data.User {
 	return &data.User{
-		Name:           pgtype.Text{String: "test", Valid: true},
-		PasswordDigest: []byte("digest"),
-		PasswordSalt:   []byte("salt"),
+		Name:         pgtype.Text{String: "test", Valid: true},
+		PasswordHash: "$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$ZGlnZXN0",
 	}
 }
 
@@ -27,10 +28,9 @@ func TestDataUsersLifeCycle(t *testing.T) {
 	pool := newConnPool(t)
 
 	input := &data.User{
-		Name:           pgtype.Text{String: "test", Valid: true},
-		Email:          pgtype.Text{String: "test@example.com", Valid: true},
-		PasswordDigest: []byte("digest"),
-		PasswordSalt:   []byte("salt"),
+		Name:         pgtype.Text{String: "test", Valid: true},
+		Email:        pgtype.Text{String: "test@example.com", Valid: true},
+		PasswordHash: "$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$ZGlnZXN0",
 	}
 	userID, err := data.CreateUser(context.Background(), pool, input)
 	require.NoError(t, err)
@@ -46,11 +46,8 @@ func TestDataUsersLifeCycle(t *testing.T) {
 	if user.Email != input.Email {
 		t.Errorf("Expected %v, got %v", input.Email, user.Email)
 	}
-	if bytes.Compare(user.PasswordDigest, input.PasswordDigest) != 0 {
-		t.Errorf("Expected user (%v) and input (%v) PasswordDigest to match, but they did not", user.PasswordDigest, input.PasswordDigest)
-	}
-	if bytes.Compare(user.PasswordSalt, input.PasswordSalt) != 0 {
-		t.Errorf("Expected user (%v), and input (%v) PasswordSalt to match, but they did not", user.PasswordSalt, input.PasswordSalt)
+	if user.PasswordHash != input.PasswordHash {
+		t.Errorf("Expected %v, got %v", input.PasswordHash, user.PasswordHash)
 	}
 
 	user, err = data.SelectUserByEmail(context.Background(), pool, input.Email.String)
@@ -64,11 +61,8 @@ func TestDataUsersLifeCycle(t *testing.T) {
 	if user.Email != input.Email {
 		t.Errorf("Expected %v, got %v", input.Email, user.Email)
 	}
-	if bytes.Compare(user.PasswordDigest, input.PasswordDigest) != 0 {
-		t.Errorf("Expected user (%v) and input (%v) PasswordDigest to match, but they did not", user.PasswordDigest, input.PasswordDigest)
-	}
-	if bytes.Compare(user.PasswordSalt, input.PasswordSalt) != 0 {
-		t.Errorf("Expected user (%v), and input (%v) PasswordSalt to match, but they did not", user.PasswordSalt, input.PasswordSalt)
+	if user.PasswordHash != input.PasswordHash {
+		t.Errorf("Expected %v, got %v", input.PasswordHash, user.PasswordHash)
 	}
 
 	user, err = data.SelectUserByPK(context.Background(), pool, userID)
@@ -82,11 +76,8 @@ func TestDataUsersLifeCycle(t *testing.T) {
 	if user.Email != input.Email {
 		t.Errorf("Expected %v, got %v", input.Email, user.Email)
 	}
-	if bytes.Compare(user.PasswordDigest, input.PasswordDigest) != 0 {
-		t.Errorf("Expected user (%v) and input (%v) PasswordDigest to match, but they did not", user.PasswordDigest, input.PasswordDigest)
-	}
-	if bytes.Compare(user.PasswordSalt, input.PasswordSalt) != 0 {
-		t.Errorf("Expected user (%v), and input (%v) PasswordSalt to match, but they did not", user.PasswordSalt, input.PasswordSalt)
+	if user.PasswordHash != input.PasswordHash {
+		t.Errorf("Expected %v, got %v", input.PasswordHash, user.PasswordHash)
 	}
 }
 
@@ -188,7 +179,7 @@ func TestDataFeeds(t *testing.T) {
 	nullString := pgtype.Text{}
 
 	// Update feed as of now
-	err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
+	_, err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
 	require.NoError(t, err)
 
 	// feed should no longer be stale
@@ -199,7 +190,7 @@ func TestDataFeeds(t *testing.T) {
 	}
 
 	// Update feed to be old enough to need refresh
-	err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, fifteenMinutesAgo)
+	_, err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, fifteenMinutesAgo)
 	require.NoError(t, err)
 
 	// It should now need fetching
@@ -224,6 +215,100 @@ func TestDataFeeds(t *testing.T) {
 	}
 }
 
+func TestDataClaimFeedsUncheckedSince(t *testing.T) {
+	pool := newConnPool(t)
+
+	userID, err := data.CreateUser(context.Background(), pool, newUser())
+	require.NoError(t, err)
+
+	now := time.Now()
+	tenMinutesAgo := now.Add(-10 * time.Minute)
+	claimExpiration := now.Add(5 * time.Minute)
+
+	for _, url := range []string{"http://foo", "http://bar", "http://baz"} {
+		err = data.InsertSubscription(context.Background(), pool, userID, url)
+		require.NoError(t, err)
+	}
+
+	claimedFeeds, err := data.ClaimFeedsUncheckedSince(context.Background(), pool, tenMinutesAgo, tenMinutesAgo, claimExpiration, 2)
+	require.NoError(t, err)
+	require.Len(t, claimedFeeds, 2)
+
+	// Only the unclaimed feed remains
+	otherClaimedFeeds, err := data.ClaimFeedsUncheckedSince(context.Background(), pool, tenMinutesAgo, tenMinutesAgo, claimExpiration, 2)
+	require.NoError(t, err)
+	require.Len(t, otherClaimedFeeds, 1)
+	for _, f := range claimedFeeds {
+		require.NotEqual(t, f.ID, otherClaimedFeeds[0].ID)
+	}
+
+	// All feeds are claimed
+	otherClaimedFeeds, err = data.ClaimFeedsUncheckedSince(context.Background(), pool, tenMinutesAgo, tenMinutesAgo, claimExpiration, 2)
+	require.NoError(t, err)
+	require.Len(t, otherClaimedFeeds, 0)
+
+	// Failed fetch releases the claim but the feed is no longer stale
+	err = data.UpdateFeedWithFetchFailure(context.Background(), pool, claimedFeeds[0].ID, "something went wrong", now)
+	require.NoError(t, err)
+
+	otherClaimedFeeds, err = data.ClaimFeedsUncheckedSince(context.Background(), pool, tenMinutesAgo, tenMinutesAgo, claimExpiration, 2)
+	require.NoError(t, err)
+	require.Len(t, otherClaimedFeeds, 0)
+
+	// Expired claims can be reclaimed
+	_, err = pool.Exec(context.Background(), "update feeds set claim_expiration_time=$1 where id=$2", tenMinutesAgo, claimedFeeds[1].ID)
+	require.NoError(t, err)
+
+	otherClaimedFeeds, err = data.ClaimFeedsUncheckedSince(context.Background(), pool, tenMinutesAgo, tenMinutesAgo, claimExpiration, 2)
+	require.NoError(t, err)
+	require.Len(t, otherClaimedFeeds, 1)
+	require.Equal(t, claimedFeeds[1].ID, otherClaimedFeeds[0].ID)
+}
+
+func TestDataInsertFeedFetch(t *testing.T) {
+	pool := newConnPool(t)
+
+	userID, err := data.CreateUser(context.Background(), pool, newUser())
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(context.Background(), pool, userID, "http://foo")
+	require.NoError(t, err)
+
+	feed, err := data.SelectFeedByURL(context.Background(), pool, "http://foo")
+	require.NoError(t, err)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		err = data.InsertFeedFetch(context.Background(), pool, &data.FeedFetch{
+			FeedID:     feed.ID,
+			FetchTime:  now.Add(time.Duration(i) * time.Minute),
+			HTTPStatus: pgtype.Int4{Int32: 500, Valid: true},
+			Duration:   time.Second,
+			Error:      pgtype.Text{String: fmt.Sprintf("failure %d", i), Valid: true},
+		}, 3)
+		require.NoError(t, err)
+	}
+
+	buffer := &bytes.Buffer{}
+	err = data.CopyFeedFetchesAsJSON(context.Background(), pool, buffer, feed.ID)
+	require.NoError(t, err)
+
+	var fetches []struct {
+		HTTPStatus int32  `json:"http_status"`
+		DurationMS int32  `json:"duration_ms"`
+		Error      string `json:"error"`
+	}
+	err = json.Unmarshal(buffer.Bytes(), &fetches)
+	require.NoError(t, err)
+
+	// Only the most recent fetches are retained
+	require.Len(t, fetches, 3)
+	require.Equal(t, "failure 4", fetches[0].Error)
+	require.Equal(t, "failure 2", fetches[2].Error)
+	require.EqualValues(t, 500, fetches[0].HTTPStatus)
+	require.EqualValues(t, 1000, fetches[0].DurationMS)
+}
+
 func TestDataUpdateFeedWithFetchSuccess(t *testing.T) {
 	pool := newConnPool(t)
 
@@ -253,8 +338,9 @@ func TestDataUpdateFeedWithFetchSuccess(t *testing.T) {
 
 	nullString := pgtype.Text{}
 
-	err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
+	newItemCount, err := data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
 	require.NoError(t, err)
+	require.Equal(t, 1, newItemCount)
 
 	buffer := &bytes.Buffer{}
 	err = data.CopyUnreadItemsAsJSONByUserID(context.Background(), pool, buffer, userID)
@@ -272,8 +358,9 @@ func TestDataUpdateFeedWithFetchSuccess(t *testing.T) {
 	}
 
 	// Update again and ensure item does not get created again
-	err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
+	newItemCount, err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
 	require.NoError(t, err)
+	require.Equal(t, 0, newItemCount)
 
 	buffer.Reset()
 	err = data.CopyUnreadItemsAsJSONByUserID(context.Background(), pool, buffer, userID)
@@ -313,7 +400,7 @@ func TestDataUpdateFeedWithFetchSuccessWithoutPublicationTime(t *testing.T) {
 
 	nullString := pgtype.Text{}
 
-	err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
+	_, err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
 	require.NoError(t, err)
 
 	buffer := &bytes.Buffer{}
@@ -332,7 +419,7 @@ func TestDataUpdateFeedWithFetchSuccessWithoutPublicationTime(t *testing.T) {
 	}
 
 	// Update again and ensure item does not get created again
-	err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
+	_, err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, now)
 	require.NoError(t, err)
 
 	buffer.Reset()
@@ -346,6 +433,252 @@ func TestDataUpdateFeedWithFetchSuccessWithoutPublicationTime(t *testing.T) {
 	}
 }
 
+func TestDataAPITokens(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	userID, err := data.CreateUser(ctx, pool, newUser())
+	require.NoError(t, err)
+
+	otherUser := newUser()
+	otherUser.Name = pgtype.Text{String: "other", Valid: true}
+	otherUserID, err := data.CreateUser(ctx, pool, otherUser)
+	require.NoError(t, err)
+
+	token := &data.APIToken{UserID: userID, Name: "script", TokenDigest: []byte("digest"), Scope: data.APITokenScopeReadOnly}
+	err = data.InsertAPIToken(ctx, pool, token)
+	require.NoError(t, err)
+	require.NotZero(t, token.ID)
+
+	err = data.InsertAPIToken(ctx, pool, &data.APIToken{UserID: userID, Name: "bad", TokenDigest: []byte("other digest"), Scope: "admin"})
+	require.Error(t, err)
+
+	selected, err := data.SelectAPITokenByDigest(ctx, pool, []byte("digest"))
+	require.NoError(t, err)
+	require.Equal(t, token.ID, selected.ID)
+	require.False(t, selected.LastUsedTime.Valid)
+
+	now := time.Now()
+	err = data.TouchAPIToken(ctx, pool, token.ID, now)
+	require.NoError(t, err)
+
+	tokens, err := data.SelectAPITokensByUserID(ctx, pool, userID)
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.True(t, tokens[0].LastUsedTime.Valid)
+
+	err = data.DeleteAPIToken(ctx, pool, otherUserID, token.ID)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	err = data.DeleteAPIToken(ctx, pool, userID, token.ID)
+	require.NoError(t, err)
+
+	_, err = data.SelectAPITokenByDigest(ctx, pool, []byte("digest"))
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+}
+
+func TestDataItemRules(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	userID, err := data.CreateUser(ctx, pool, newUser())
+	require.NoError(t, err)
+
+	otherUser := newUser()
+	otherUser.Name = pgtype.Text{String: "other", Valid: true}
+	otherUserID, err := data.CreateUser(ctx, pool, otherUser)
+	require.NoError(t, err)
+
+	for _, url := range []string{"http://news", "http://other"} {
+		err = data.InsertSubscription(ctx, pool, userID, url)
+		require.NoError(t, err)
+		err = data.InsertSubscription(ctx, pool, otherUserID, url)
+		require.NoError(t, err)
+	}
+
+	newsFeed, err := data.SelectFeedByURL(ctx, pool, "http://news")
+	require.NoError(t, err)
+	otherFeed, err := data.SelectFeedByURL(ctx, pool, "http://other")
+	require.NoError(t, err)
+
+	rules := []*data.ItemRule{
+		{Name: "No ads", Field: data.ItemRuleFieldTitle, MatchType: data.ItemRuleMatchKeywords, Pattern: "sponsored", Regex: `(^|\W)(sponsored)(\W|$)`, Action: data.ItemRuleActionSkipUnread},
+		{Name: "Jack", Field: data.ItemRuleFieldAuthor, MatchType: data.ItemRuleMatchRegex, Pattern: "^jack$", Regex: "^jack$", Action: data.ItemRuleActionStar},
+		{Name: "Go", Field: data.ItemRuleFieldTitleOrContent, MatchType: data.ItemRuleMatchRegex, Pattern: "golang", Regex: "golang", Action: data.ItemRuleActionTag, Tag: pgtype.Text{String: "go", Valid: true}},
+		{Name: "Other feed only", FeedID: pgtype.Int4{Int32: otherFeed.ID, Valid: true}, Field: data.ItemRuleFieldTitle, MatchType: data.ItemRuleMatchRegex, Pattern: ".", Regex: ".", Action: data.ItemRuleActionSkipUnread},
+	}
+	for _, rule := range rules {
+		rule.UserID = userID
+		err = data.InsertItemRule(ctx, pool, rule)
+		require.NoError(t, err)
+	}
+
+	selectedRules, err := data.SelectItemRulesByUserID(ctx, pool, userID)
+	require.NoError(t, err)
+	require.Len(t, selectedRules, 4)
+
+	update := &data.ParsedFeed{Name: "News", Items: []data.ParsedItem{
+		{URL: "http://news/1", Title: "Sponsored: buy things"},
+		{URL: "http://news/2", Title: "Release notes", Author: "Jack"},
+		{URL: "http://news/3", Title: "Tips", Content: "Writing Golang servers"},
+	}}
+	newItemCount, err := data.UpdateFeedWithFetchSuccess(ctx, pool, newsFeed.ID, update, pgtype.Text{}, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 3, newItemCount)
+
+	type unreadItem struct {
+		URL     string   `json:"url"`
+		Author  *string  `json:"author"`
+		Starred bool     `json:"starred"`
+		Tags    []string `json:"tags"`
+	}
+
+	unreadItems := func(userID int32) map[string]unreadItem {
+		buffer := &bytes.Buffer{}
+		err := data.CopyUnreadItemsAsJSONByUserID(ctx, pool, buffer, userID)
+		require.NoError(t, err)
+
+		var items []unreadItem
+		err = json.Unmarshal(buffer.Bytes(), &items)
+		require.NoError(t, err)
+
+		m := make(map[string]unreadItem)
+		for _, item := range items {
+			m[item.URL] = item
+		}
+		return m
+	}
+
+	items := unreadItems(userID)
+	require.Len(t, items, 2)
+	require.NotContains(t, items, "http://news/1")
+	require.True(t, items["http://news/2"].Starred)
+	require.Equal(t, "Jack", *items["http://news/2"].Author)
+	require.Empty(t, items["http://news/2"].Tags)
+	require.False(t, items["http://news/3"].Starred)
+	require.Equal(t, []string{"go"}, items["http://news/3"].Tags)
+
+	// Rules only apply to the user that owns them.
+	items = unreadItems(otherUserID)
+	require.Len(t, items, 3)
+	require.False(t, items["http://news/2"].Starred)
+
+	update = &data.ParsedFeed{Name: "Other", Items: []data.ParsedItem{{URL: "http://other/1", Title: "Anything"}}}
+	_, err = data.UpdateFeedWithFetchSuccess(ctx, pool, otherFeed.ID, update, pgtype.Text{}, time.Now())
+	require.NoError(t, err)
+	require.Len(t, unreadItems(userID), 2)
+	require.Len(t, unreadItems(otherUserID), 4)
+
+	rule := rules[0]
+	rule.Pattern = "buy"
+	rule.Regex = "buy"
+	rule.Field = data.ItemRuleFieldTitle
+	buffer := &bytes.Buffer{}
+	err = data.CopyItemRuleMatchesAsJSON(ctx, pool, buffer, userID, rule, 100)
+	require.NoError(t, err)
+	var matches []unreadItem
+	err = json.Unmarshal(buffer.Bytes(), &matches)
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	require.Equal(t, "http://news/1", matches[0].URL)
+
+	err = data.UpdateItemRule(ctx, pool, rule)
+	require.NoError(t, err)
+
+	rule.UserID = otherUserID
+	err = data.UpdateItemRule(ctx, pool, rule)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+	err = data.DeleteItemRule(ctx, pool, otherUserID, rule.ID)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	err = data.DeleteItemRule(ctx, pool, userID, rule.ID)
+	require.NoError(t, err)
+
+	err = data.ValidateRegex(ctx, pool, "(unclosed")
+	require.ErrorIs(t, err, data.ErrInvalidRegex)
+	err = data.ValidateRegex(ctx, pool, "^ok$")
+	require.NoError(t, err)
+}
+
+func TestDataPruneItems(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	userID, err := data.CreateUser(ctx, pool, newUser())
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(ctx, pool, userID, "http://news")
+	require.NoError(t, err)
+	feed, err := data.SelectFeedByURL(ctx, pool, "http://news")
+	require.NoError(t, err)
+
+	now := time.Now()
+	var items []data.ParsedItem
+	for i := 0; i < 6; i++ {
+		items = append(items, data.ParsedItem{
+			URL:             fmt.Sprintf("http://news/%d", i),
+			Title:           fmt.Sprintf("Item %d", i),
+			PublicationTime: pgtype.Timestamptz{Time: now.Add(time.Duration(i) * time.Hour), Valid: true},
+		})
+	}
+	_, err = data.UpdateFeedWithFetchSuccess(ctx, pool, feed.ID, &data.ParsedFeed{Name: "News", Items: items}, pgtype.Text{}, now)
+	require.NoError(t, err)
+
+	itemID := func(url string) int32 {
+		var id int32
+		err := pool.QueryRow(ctx, "select id from items where url=$1", url).Scan(&id)
+		require.NoError(t, err)
+		return id
+	}
+
+	// Read everything but item 1 and star item 0.
+	for i := 0; i < 6; i++ {
+		if i != 1 {
+			err = data.MarkItemRead(ctx, pool, userID, itemID(fmt.Sprintf("http://news/%d", i)))
+			require.NoError(t, err)
+		}
+	}
+	_, err = pool.Exec(ctx, "insert into starred_items(user_id, item_id) values($1, $2)", userID, itemID("http://news/0"))
+	require.NoError(t, err)
+
+	policy := data.RetentionPolicy{MaxItemsPerFeed: 2}
+
+	// Everything is still in the feed document.
+	pruned, err := data.PruneItems(ctx, pool, policy, now, false)
+	require.NoError(t, err)
+	require.Empty(t, pruned)
+
+	// Items 0-2 are no longer in the feed. A partial update does not change that.
+	_, err = data.UpdateFeedWithFetchSuccess(ctx, pool, feed.ID, &data.ParsedFeed{Name: "News", Items: items[3:]}, pgtype.Text{}, now)
+	require.NoError(t, err)
+	_, err = data.UpdateFeedWithFetchSuccess(ctx, pool, feed.ID, &data.ParsedFeed{Name: "News", Items: items[5:], Partial: true}, pgtype.Text{}, now)
+	require.NoError(t, err)
+
+	pruned, err = data.PruneItems(ctx, pool, data.RetentionPolicy{}, now, false)
+	require.NoError(t, err)
+	require.Empty(t, pruned)
+
+	// Item 2 is kept by max age.
+	pruned, err = data.PruneItems(ctx, pool, data.RetentionPolicy{MaxItemsPerFeed: 2, MaxAge: time.Hour}, now, false)
+	require.NoError(t, err)
+	require.Empty(t, pruned)
+
+	pruned, err = data.PruneItems(ctx, pool, policy, now, true)
+	require.NoError(t, err)
+	require.Equal(t, []data.PrunedFeed{{FeedID: feed.ID, FeedURL: "http://news", ItemCount: 1}}, pruned)
+
+	pruned, err = data.PruneItems(ctx, pool, policy, now, false)
+	require.NoError(t, err)
+	require.Equal(t, []data.PrunedFeed{{FeedID: feed.ID, FeedURL: "http://news", ItemCount: 1}}, pruned)
+
+	// Only item 2 was deleted. Item 0 is starred and item 1 is unread.
+	var urls []string
+	rows, _ := pool.Query(ctx, "select url from items order by url")
+	urls, err = pgx.CollectRows(rows, pgx.RowTo[string])
+	require.NoError(t, err)
+	require.Equal(t, []string{"http://news/0", "http://news/1", "http://news/3", "http://news/4", "http://news/5"}, urls)
+}
+
 func TestDataSubscriptions(t *testing.T) {
 	pool := newConnPool(t)
 
@@ -391,7 +724,7 @@ func TestDataDeleteSubscription(t *testing.T) {
 
 	nullString := pgtype.Text{}
 
-	err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, time.Now().Add(-20*time.Minute))
+	_, err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feedID, update, nullString, time.Now().Add(-20*time.Minute))
 	require.NoError(t, err)
 
 	err = data.DeleteSubscription(context.Background(), pool, userID, feedID)
@@ -450,18 +783,74 @@ func TestDataSessions(t *testing.T) {
 	)
 	require.NoError(t, err)
 
-	user, err := data.SelectUserBySessionID(context.Background(), pool, sessionID)
+	user, err := data.SelectUserBySessionID(context.Background(), pool, sessionID, pgtype.Timestamptz{}, pgtype.Timestamptz{})
 	require.NoError(t, err)
 	if user.ID.Int32 != userID {
 		t.Errorf("Expected %v, got %v", userID, user.ID)
 	}
 
-	err = data.DeleteSession(context.Background(), pool, sessionID)
+	// Only the user's own sessions can be deleted.
+	err = data.DeleteSession(context.Background(), pool, userID+1, sessionID)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	err = data.DeleteSession(context.Background(), pool, userID, sessionID)
 	require.NoError(t, err)
 
-	_, err = data.SelectUserBySessionID(context.Background(), pool, sessionID)
+	_, err = data.SelectUserBySessionID(context.Background(), pool, sessionID, pgtype.Timestamptz{}, pgtype.Timestamptz{})
 	require.ErrorIs(t, err, pgx.ErrNoRows)
 
-	err = data.DeleteSession(context.Background(), pool, sessionID)
+	err = data.DeleteSession(context.Background(), pool, userID, sessionID)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+}
+
+func TestDataSessionExpiration(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	userID, err := data.CreateUser(ctx, pool, newUser())
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = pool.Exec(ctx, `insert into sessions (id, user_id, start_time, last_seen_time) values
+('active', $1, $2, $3), ('idle', $1, $2, $4), ('old', $1, $4, $3)`,
+		userID, now.Add(-2*24*time.Hour), now.Add(-time.Hour), now.Add(-10*24*time.Hour))
+	require.NoError(t, err)
+
+	idleCutoff := pgtype.Timestamptz{Time: now.Add(-24 * time.Hour), Valid: true}
+	absoluteCutoff := pgtype.Timestamptz{Time: now.Add(-7 * 24 * time.Hour), Valid: true}
+
+	_, err = data.SelectUserBySessionID(ctx, pool, []byte("active"), idleCutoff, absoluteCutoff)
+	require.NoError(t, err)
+	_, err = data.SelectUserBySessionID(ctx, pool, []byte("idle"), idleCutoff, absoluteCutoff)
 	require.ErrorIs(t, err, pgx.ErrNoRows)
+	_, err = data.SelectUserBySessionID(ctx, pool, []byte("old"), idleCutoff, absoluteCutoff)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	sessions, err := data.SelectActiveSessionsByUserID(ctx, pool, userID, idleCutoff, absoluteCutoff)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, []byte("active"), sessions[0].ID)
+
+	sessions, err = data.SelectActiveSessionsByUserID(ctx, pool, userID, pgtype.Timestamptz{}, pgtype.Timestamptz{})
+	require.NoError(t, err)
+	require.Len(t, sessions, 3)
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	err = data.TouchSession(ctx, pool, []byte("idle"), now, pgtype.Text{String: "Test Agent", Valid: true}, ip)
+	require.NoError(t, err)
+
+	sessions, err = data.SelectActiveSessionsByUserID(ctx, pool, userID, idleCutoff, absoluteCutoff)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	require.Equal(t, []byte("idle"), sessions[0].ID)
+	require.Equal(t, "Test Agent", sessions[0].UserAgent.String)
+	require.Equal(t, ip, sessions[0].IP)
+
+	n, err := data.DeleteSessionsByUserID(ctx, pool, userID, []byte("active"))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, n)
+
+	n, err = data.DeleteSessionsByUserID(ctx, pool, userID, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
 }
@@ -1,41 +1,47 @@
 package backend
 
 import (
-	"bytes"
-	"crypto/rand"
+	"context"
 	"errors"
 
+	"github.com/jackc/pgxutil"
 	"github.com/jackc/tpr/backend/data"
-	"golang.org/x/crypto/scrypt"
+	"github.com/jackc/tpr/backend/pwhash"
 )
 
 var notFound = errors.New("not found")
 
+// SetPassword sets u's password hash to a hash of password.
 func SetPassword(u *data.User, password string) error {
-	salt := make([]byte, 8)
-	_, err := rand.Read(salt)
+	hash, err := pwhash.Hash(password)
 	if err != nil {
 		return err
 	}
 
-	digest, err := scrypt.Key([]byte(password), salt, 16384, 8, 1, 32)
-	if err != nil {
-		return err
-	}
-
-	u.PasswordDigest = digest
-	u.PasswordSalt = salt
+	u.PasswordHash = hash
 
 	return nil
 }
 
+// IsPassword reports whether password is u's password.
 func IsPassword(u *data.User, password string) bool {
-	digest, err := scrypt.Key([]byte(password), u.PasswordSalt, 16384, 8, 1, 32)
-	if err != nil {
-		return false
+	ok, err := pwhash.Verify(u.PasswordHash, password)
+	return err == nil && ok
+}
+
+// rehashPasswordIfNeeded rehashes password, which must already have been verified as user's password, if user's hash
+// uses an outdated algorithm or parameters. This upgrades hashes as users log in since the password is not otherwise
+// available.
+func rehashPasswordIfNeeded(ctx context.Context, db pgxutil.DB, user *data.User, password string) error {
+	if !pwhash.NeedsRehash(user.PasswordHash) {
+		return nil
+	}
+
+	if err := SetPassword(user, password); err != nil {
+		return err
 	}
 
-	return bytes.Equal(digest, u.PasswordDigest)
+	return data.UpdateUser(ctx, db, user.ID.Int32, user)
 }
 
 type staleFeed struct {
@@ -0,0 +1,305 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/tpr/backend/data"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// Digest is an email summary of a user's unread items.
+type Digest struct {
+	Items []*data.DigestItem
+
+	// UnreadCount is the number of unread items in the digest's feeds including those not in Items.
+	UnreadCount int64
+
+	// MarkedRead is true when Items are marked read by sending the digest.
+	MarkedRead bool
+}
+
+// nextDigestTime returns the first time after now that the digest with setting is due. Digests are sent at the start of
+// setting.Hour in setting.TimeZone.
+func nextDigestTime(setting *data.DigestSetting, now time.Time) (time.Time, error) {
+	loc, err := time.LoadLocation(setting.TimeZone)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	local := now.In(loc)
+	t := time.Date(local.Year(), local.Month(), local.Day(), int(setting.Hour), 0, 0, 0, loc)
+	for !t.After(now) || (setting.Frequency == data.DigestFrequencyWeekly && t.Weekday() != time.Weekday(setting.Weekday)) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, int(setting.Hour), 0, 0, 0, loc)
+	}
+
+	return t, nil
+}
+
+// digestClaimDuration is how long a DigestSender has to send a claimed digest before another sender may claim it.
+const digestClaimDuration = 15 * time.Minute
+
+// DigestSender periodically mails users their digests. Any number of senders may run at once.
+type DigestSender struct {
+	pool   *pgxpool.Pool
+	mailer Mailer
+	logger log.Logger
+
+	// Interval is how often KeepSending checks for due digests.
+	Interval time.Duration
+}
+
+func NewDigestSender(pool *pgxpool.Pool, mailer Mailer, logger log.Logger) *DigestSender {
+	return &DigestSender{
+		pool:     pool,
+		mailer:   mailer,
+		logger:   logger,
+		Interval: 5 * time.Minute,
+	}
+}
+
+// Run sends all due digests and returns the number sent. Digests without unread items or for users who are disabled or
+// do not have a verified email address are skipped until their next time. A digest that fails to send is retried once
+// its claim expires. Users are independent so a failure for one does not prevent the others from receiving their
+// digests. The first error is returned.
+func (s *DigestSender) Run() (int, error) {
+	ctx := context.Background()
+	now := time.Now()
+
+	settings, err := data.ClaimDueDigestSettings(ctx, s.pool, now, now.Add(digestClaimDuration))
+	if err != nil {
+		s.logger.Error("ClaimDueDigestSettings failed", "error", err)
+		return 0, err
+	}
+
+	var sentCount int
+	var firstErr error
+	for _, setting := range settings {
+		sent, err := s.send(ctx, setting, now)
+		if sent {
+			sentCount++
+		}
+		if err != nil {
+			s.logger.Error("Send digest failed", "userID", setting.UserID, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if len(settings) > 0 {
+		s.logger.Info("Sent digests", "dueCount", len(settings), "sentCount", sentCount)
+	}
+
+	return sentCount, firstErr
+}
+
+func (s *DigestSender) send(ctx context.Context, setting *data.DigestSetting, now time.Time) (bool, error) {
+	nextSendTime, err := nextDigestTime(setting, now)
+	if err != nil {
+		return false, err
+	}
+
+	user, err := data.SelectUserByPK(ctx, s.pool, setting.UserID)
+	if err != nil {
+		return false, err
+	}
+
+	var items []*data.DigestItem
+	var unreadCount int64
+	if user.Email.Valid && user.EmailVerified && !user.Disabled {
+		items, unreadCount, err = data.SelectDigestItems(ctx, s.pool, setting.UserID, setting.FeedIDs, setting.MaxItems)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if len(items) == 0 {
+		return false, data.UpdateDigestSendTimes(ctx, s.pool, setting.UserID, pgtype.Timestamptz{}, nextSendTime)
+	}
+
+	err = s.mailer.SendDigestMail(user.Email.String, &Digest{Items: items, UnreadCount: unreadCount, MarkedRead: setting.MarkRead})
+	if err != nil {
+		return false, err
+	}
+
+	// The mail is gone so the send times are recorded first. Otherwise any later failure would send it again.
+	err = data.UpdateDigestSendTimes(ctx, s.pool, setting.UserID, pgtype.Timestamptz{Time: now, Valid: true}, nextSendTime)
+	if err != nil {
+		return true, err
+	}
+
+	if setting.MarkRead {
+		itemIDs := make([]int32, len(items))
+		for i, item := range items {
+			itemIDs[i] = item.ID
+		}
+		if _, err := data.MarkItemsRead(ctx, s.pool, setting.UserID, itemIDs); err != nil {
+			s.logger.Error("MarkItemsRead failed", "userID", setting.UserID, "error", err)
+		}
+	}
+
+	return true, nil
+}
+
+// KeepSending sends due digests every Interval forever.
+func (s *DigestSender) KeepSending() {
+	for {
+		startTime := time.Now()
+		s.Run()
+		sleepUntil(startTime.Add(s.Interval))
+	}
+}
+
+type digestSettingJSON struct {
+	Enabled      bool       `json:"enabled"`
+	Frequency    string     `json:"frequency"`
+	Weekday      int16      `json:"weekday"`
+	Hour         int16      `json:"hour"`
+	TimeZone     string     `json:"timeZone"`
+	MaxItems     int32      `json:"maxItems"`
+	FeedIDs      []int32    `json:"feedIDs"`
+	MarkRead     bool       `json:"markRead"`
+	NextSendTime *time.Time `json:"nextSendTime,omitempty"`
+}
+
+func GetDigestSettingHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	response := digestSettingJSON{
+		Frequency: data.DigestFrequencyDaily,
+		Weekday:   int16(time.Monday),
+		Hour:      7,
+		TimeZone:  "UTC",
+		MaxItems:  50,
+	}
+
+	setting, err := data.SelectDigestSettingByUserID(context.Background(), env.pool, env.user.ID.Int32)
+	switch {
+	case err == nil:
+		response = digestSettingJSON{
+			Enabled:      true,
+			Frequency:    setting.Frequency,
+			Weekday:      setting.Weekday,
+			Hour:         setting.Hour,
+			TimeZone:     setting.TimeZone,
+			MaxItems:     setting.MaxItems,
+			FeedIDs:      setting.FeedIDs,
+			MarkRead:     setting.MarkRead,
+			NextSendTime: &setting.NextSendTime,
+		}
+	case errors.Is(err, pgx.ErrNoRows):
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectDigestSettingByUserID failed", "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// UpdateDigestSettingHandler saves the user's digest setting. Digests are only sent to a verified email address.
+func UpdateDigestSettingHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request digestSettingJSON
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if !request.Enabled {
+		if err := data.DeleteDigestSetting(context.Background(), env.pool, env.user.ID.Int32); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("DeleteDigestSetting failed", "error", err)
+			return
+		}
+		GetDigestSettingHandler(w, req, env)
+		return
+	}
+
+	if !env.user.Email.Valid || !env.user.EmailVerified {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Confirm an email address before enabling digests")
+		return
+	}
+
+	setting := &data.DigestSetting{
+		UserID:    env.user.ID.Int32,
+		Frequency: request.Frequency,
+		Weekday:   request.Weekday,
+		Hour:      request.Hour,
+		TimeZone:  request.TimeZone,
+		MaxItems:  request.MaxItems,
+		FeedIDs:   request.FeedIDs,
+		MarkRead:  request.MarkRead,
+	}
+	if setting.TimeZone == "" {
+		setting.TimeZone = "UTC"
+	}
+	if len(setting.FeedIDs) == 0 {
+		setting.FeedIDs = nil
+	}
+
+	switch setting.Frequency {
+	case data.DigestFrequencyDaily, data.DigestFrequencyWeekly:
+	default:
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `"frequency" must be one of "daily" or "weekly"`)
+		return
+	}
+
+	if setting.Weekday < 0 || setting.Weekday > 6 {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `"weekday" must be from 0 (Sunday) to 6 (Saturday)`)
+		return
+	}
+
+	if setting.Hour < 0 || setting.Hour > 23 {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `"hour" must be from 0 to 23`)
+		return
+	}
+
+	if setting.MaxItems < 1 || setting.MaxItems > 500 {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `"maxItems" must be from 1 to 500`)
+		return
+	}
+
+	var err error
+	setting.NextSendTime, err = nextDigestTime(setting, time.Now())
+	if err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, `Invalid "timeZone": %v`, err)
+		return
+	}
+
+	for _, feedID := range setting.FeedIDs {
+		_, err := data.SelectSubscribedFeed(context.Background(), env.pool, env.user.ID.Int32, feedID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				w.WriteHeader(422)
+				fmt.Fprintln(w, `"feedIDs" must be subscribed feeds`)
+				return
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("SelectSubscribedFeed failed", "error", err)
+			return
+		}
+	}
+
+	if err := data.UpsertDigestSetting(context.Background(), env.pool, setting); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("UpsertDigestSetting failed", "error", err)
+		return
+	}
+
+	GetDigestSettingHandler(w, req, env)
+}
@@ -0,0 +1,246 @@
+package backend
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextDigestTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	// 2024-03-06 is a Wednesday.
+	now := time.Date(2024, 3, 6, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		descr    string
+		setting  data.DigestSetting
+		expected time.Time
+	}{
+		{
+			descr:    "Daily later today",
+			setting:  data.DigestSetting{Frequency: data.DigestFrequencyDaily, Hour: 18, TimeZone: "UTC"},
+			expected: time.Date(2024, 3, 6, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			descr:    "Daily already passed today",
+			setting:  data.DigestSetting{Frequency: data.DigestFrequencyDaily, Hour: 12, TimeZone: "UTC"},
+			expected: time.Date(2024, 3, 7, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			descr:    "Daily in another time zone",
+			setting:  data.DigestSetting{Frequency: data.DigestFrequencyDaily, Hour: 7, TimeZone: "America/New_York"},
+			expected: time.Date(2024, 3, 7, 7, 0, 0, 0, newYork),
+		},
+		{
+			descr:    "Weekly later this week",
+			setting:  data.DigestSetting{Frequency: data.DigestFrequencyWeekly, Weekday: int16(time.Friday), Hour: 7, TimeZone: "UTC"},
+			expected: time.Date(2024, 3, 8, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			descr:    "Weekly already passed today",
+			setting:  data.DigestSetting{Frequency: data.DigestFrequencyWeekly, Weekday: int16(time.Wednesday), Hour: 7, TimeZone: "UTC"},
+			expected: time.Date(2024, 3, 13, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			descr:    "Weekly across daylight saving time change",
+			setting:  data.DigestSetting{Frequency: data.DigestFrequencyWeekly, Weekday: int16(time.Monday), Hour: 7, TimeZone: "America/New_York"},
+			expected: time.Date(2024, 3, 11, 7, 0, 0, 0, newYork),
+		},
+	}
+
+	for _, tt := range tests {
+		actual, err := nextDigestTime(&tt.setting, now)
+		require.NoError(t, err, tt.descr)
+		require.True(t, tt.expected.Equal(actual), "%s: expected %v, got %v", tt.descr, tt.expected, actual)
+	}
+
+	_, err = nextDigestTime(&data.DigestSetting{Frequency: data.DigestFrequencyDaily, TimeZone: "Nowhere/Special"}, now)
+	require.Error(t, err)
+}
+
+func TestDigests(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := &data.User{
+		Name:          pgtype.Text{String: "test", Valid: true},
+		Email:         pgtype.Text{String: "test@example.com", Valid: true},
+		EmailVerified: true,
+	}
+	SetPassword(user, "password")
+	userID, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	var feedIDs []int32
+	for _, name := range []string{"News", "Sports"} {
+		url := "http://" + strings.ToLower(name)
+		err = data.InsertSubscription(ctx, pool, userID, url)
+		require.NoError(t, err)
+		feed, err := data.SelectFeedByURL(ctx, pool, url)
+		require.NoError(t, err)
+		feedIDs = append(feedIDs, feed.ID)
+
+		now := time.Now()
+		var items []data.ParsedItem
+		for i := 0; i < 3; i++ {
+			items = append(items, data.ParsedItem{
+				URL:             fmt.Sprintf("%s/%d", url, i),
+				Title:           fmt.Sprintf("%s %d", name, i),
+				PublicationTime: pgtype.Timestamptz{Time: now.Add(time.Duration(i-10) * time.Hour), Valid: true},
+			})
+		}
+		_, err = data.UpdateFeedWithFetchSuccess(ctx, pool, feed.ID, &data.ParsedFeed{Name: name, Items: items}, pgtype.Text{}, now)
+		require.NoError(t, err)
+	}
+
+	mailer := &testMailer{}
+	router := NewAPIHandler(pool, mailer, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	err = data.InsertSession(ctx, pool, &data.Session{ID: []byte("session"), UserID: userID})
+	require.NoError(t, err)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		req.Header.Set("X-Authentication", hex.EncodeToString([]byte("session")))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "/account/digest", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"enabled":false`)
+
+	for _, body := range []string{
+		`{"enabled": true, "frequency": "hourly", "hour": 7, "maxItems": 10}`,
+		`{"enabled": true, "frequency": "daily", "hour": 24, "maxItems": 10}`,
+		`{"enabled": true, "frequency": "daily", "hour": 7, "maxItems": 0}`,
+		`{"enabled": true, "frequency": "daily", "hour": 7, "maxItems": 10, "timeZone": "Nowhere/Special"}`,
+		`{"enabled": true, "frequency": "daily", "hour": 7, "maxItems": 10, "feedIDs": [-1]}`,
+	} {
+		w = do("PUT", "/account/digest", body)
+		require.Equal(t, 422, w.Code, body)
+	}
+
+	w = do("PUT", "/account/digest", fmt.Sprintf(`{"enabled": true, "frequency": "daily", "hour": 7, "timeZone": "America/New_York", "maxItems": 2, "feedIDs": [%d], "markRead": true}`, feedIDs[0]))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var setting struct {
+		Enabled      bool      `json:"enabled"`
+		FeedIDs      []int32   `json:"feedIDs"`
+		NextSendTime time.Time `json:"nextSendTime"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &setting)
+	require.NoError(t, err)
+	require.True(t, setting.Enabled)
+	require.Equal(t, []int32{feedIDs[0]}, setting.FeedIDs)
+	require.True(t, setting.NextSendTime.After(time.Now()))
+
+	digestSender := NewDigestSender(pool, mailer, getLogger(t))
+
+	n, err := digestSender.Run()
+	require.NoError(t, err)
+	require.Equal(t, 0, n, "not due yet")
+
+	makeDue := func() {
+		_, err := pool.Exec(ctx, `update digest_settings set next_send_time = now() - interval '1 minute'`)
+		require.NoError(t, err)
+	}
+
+	makeDue()
+	n, err = digestSender.Run()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Len(t, mailer.sentDigestMails, 1)
+	mail := mailer.sentDigestMails[0]
+	require.Equal(t, "test@example.com", mail.to)
+	require.EqualValues(t, 3, mail.digest.UnreadCount)
+	require.True(t, mail.digest.MarkedRead)
+	require.Len(t, mail.digest.Items, 2)
+	require.Equal(t, "News 0", mail.digest.Items[0].Title)
+	require.Equal(t, "News 1", mail.digest.Items[1].Title)
+
+	s, err := data.SelectDigestSettingByUserID(ctx, pool, userID)
+	require.NoError(t, err)
+	require.True(t, s.LastSendTime.Valid)
+	require.True(t, s.NextSendTime.After(time.Now()))
+
+	// The items in the digest were marked read.
+	items, unreadCount, err := data.SelectDigestItems(ctx, pool, userID, nil, 10)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, unreadCount)
+	require.Len(t, items, 4)
+
+	makeDue()
+	n, err = digestSender.Run()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Len(t, mailer.sentDigestMails, 2)
+	require.Len(t, mailer.sentDigestMails[1].digest.Items, 1)
+
+	// No mail is sent without unread items.
+	makeDue()
+	n, err = digestSender.Run()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Len(t, mailer.sentDigestMails, 2)
+	s, err = data.SelectDigestSettingByUserID(ctx, pool, userID)
+	require.NoError(t, err)
+	require.True(t, s.NextSendTime.After(time.Now()))
+
+	// Disabled users do not receive digests.
+	_, err = pool.Exec(ctx, `insert into unread_items(user_id, feed_id, item_id) select $1, feed_id, id from items where feed_id=$2`, userID, feedIDs[0])
+	require.NoError(t, err)
+	err = data.UpdateUserDisabled(ctx, pool, userID, true)
+	require.NoError(t, err)
+	makeDue()
+	n, err = digestSender.Run()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Len(t, mailer.sentDigestMails, 2)
+	err = data.UpdateUserDisabled(ctx, pool, userID, false)
+	require.NoError(t, err)
+
+	w = do("PUT", "/account/digest", `{"enabled": false}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, err = data.SelectDigestSettingByUserID(ctx, pool, userID)
+	require.Error(t, err)
+}
+
+func TestMarkManyItemsRead(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	userID, err := data.CreateUser(ctx, pool, newUser())
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(ctx, pool, userID, "http://example.com/feed")
+	require.NoError(t, err)
+	feed, err := data.SelectFeedByURL(ctx, pool, "http://example.com/feed")
+	require.NoError(t, err)
+
+	// The items_read notification must stay under the PostgreSQL payload limit no matter how many items are marked.
+	items := make([]data.ParsedItem, 3000)
+	for i := range items {
+		items[i] = data.ParsedItem{URL: fmt.Sprintf("http://example.com/%d", i), Title: fmt.Sprint(i)}
+	}
+	_, err = data.UpdateFeedWithFetchSuccess(ctx, pool, feed.ID, &data.ParsedFeed{Name: "Many", Items: items}, pgtype.Text{}, time.Now())
+	require.NoError(t, err)
+
+	itemIDs, err := data.SelectUnreadItemIDsByUserID(ctx, pool, userID)
+	require.NoError(t, err)
+	require.Len(t, itemIDs, 3000)
+
+	n, err := data.MarkItemsRead(ctx, pool, userID, itemIDs)
+	require.NoError(t, err)
+	require.EqualValues(t, 3000, n)
+}
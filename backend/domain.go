@@ -2,9 +2,12 @@ package backend
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io"
+	"regexp"
+	"strings"
 
 	log "gopkg.in/inconshreveable/log15.v2"
 )
@@ -25,6 +28,13 @@ func genLostPasswordToken() (string, error) {
 	return genRandToken(24)
 }
 
+// tokenDigest returns the digest under which a random token is stored. This includes tokens mailed to users, API
+// tokens, and recovery codes. Tokens are random so a fast hash is sufficient.
+func tokenDigest(token string) []byte {
+	digest := sha256.Sum256([]byte(token))
+	return digest[:]
+}
+
 func genRandToken(byteCount int) (string, error) {
 	pwBytes := make([]byte, byteCount)
 	_, err := rand.Read(pwBytes)
@@ -44,3 +54,14 @@ func genSessionID() ([]byte, error) {
 
 	return sessionID, err
 }
+
+// keywordsRegex returns a regular expression that matches any of the whitespace separated keywords as a whole word. The
+// result has the same meaning in PostgreSQL and Go regular expression syntax.
+func keywordsRegex(keywords string) string {
+	words := strings.Fields(keywords)
+	for i := range words {
+		words[i] = regexp.QuoteMeta(words[i])
+	}
+
+	return `(^|\W)(` + strings.Join(words, "|") + `)(\W|$)`
+}
@@ -0,0 +1,30 @@
+package backend
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeywordsRegex(t *testing.T) {
+	tests := []struct {
+		keywords string
+		text     string
+		match    bool
+	}{
+		{"go", "Go 1.25 released", true},
+		{"go", "Going further", false},
+		{"go", "Let's go", true},
+		{"rust go", "Rust in production", true},
+		{"c++", "Modern C++ tips", true},
+		{"c++", "C tips", false},
+		{"a.b", "axb", false},
+		{"a.b", "see a.b.", true},
+	}
+
+	for i, tt := range tests {
+		re := regexp.MustCompile("(?i)" + keywordsRegex(tt.keywords))
+		require.Equalf(t, tt.match, re.MatchString(tt.text), "%d. %s %s", i, tt.keywords, tt.text)
+	}
+}
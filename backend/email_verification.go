@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/tpr/backend/data"
+)
+
+// emailVerificationLifetime is how long the link in a verification mail works.
+const emailVerificationLifetime = 24 * time.Hour
+
+var errMailNotConfigured = errors.New("mail is not configured")
+
+// requestEmailVerification mails a link to email that sets it as userID's verified address when followed. It replaces
+// any earlier verification requested for userID.
+func requestEmailVerification(req *http.Request, env *environment, userID int32, email string) error {
+	if env.mailer == nil {
+		return errMailNotConfigured
+	}
+
+	token, err := genRandToken(24)
+	if err != nil {
+		return err
+	}
+
+	err = data.InsertEmailVerification(context.Background(), env.pool, &data.EmailVerification{
+		TokenDigest: tokenDigest(token),
+		UserID:      userID,
+		Email:       email,
+		RequestIP:   remoteIP(req),
+		RequestTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return env.mailer.SendEmailVerificationMail(email, token)
+}
+
+// allowEmailVerification applies the rate limit on verification mails for the current user. It responds and returns
+// false if the limit has been reached.
+func allowEmailVerification(w http.ResponseWriter, req *http.Request, env *environment) bool {
+	if !env.authRateLimiter.allow(w, req, env, data.AuthActionEmailVerification, env.user.Name.String) {
+		return false
+	}
+	if err := env.authRateLimiter.record(context.Background(), data.AuthActionEmailVerification, remoteIP(req), env.user.Name.String); err != nil {
+		env.logger.Error("authRateLimiter.record failed", "error", err)
+	}
+	return true
+}
+
+// CreateEmailVerificationHandler sends another verification mail for the pending email change or, if there is none, the
+// user's unverified address.
+func CreateEmailVerificationHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var email string
+	pending, err := data.SelectPendingEmailVerification(context.Background(), env.pool, env.user.ID.Int32, time.Now().Add(-emailVerificationLifetime))
+	switch {
+	case err == nil:
+		email = pending.Email
+	case errors.Is(err, pgx.ErrNoRows):
+		if env.user.Email.Valid && !env.user.EmailVerified {
+			email = env.user.Email.String
+		}
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectPendingEmailVerification failed", "error", err)
+		return
+	}
+
+	if email == "" {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "There is no email address to verify")
+		return
+	}
+
+	if env.mailer == nil {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Mail is not configured on this server")
+		return
+	}
+
+	if !allowEmailVerification(w, req, env) {
+		return
+	}
+
+	err = requestEmailVerification(req, env, env.user.ID.Int32, email)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("requestEmailVerification failed", "error", err)
+		return
+	}
+}
+
+// VerifyEmailHandler sets the address of the email verification with the token in the request as the user's verified
+// email. The token is the only authentication needed since it proves access to the address.
+func VerifyEmailHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	var ev *data.EmailVerification
+	err := pgx.BeginFunc(context.Background(), env.pool, func(tx pgx.Tx) error {
+		var err error
+		now := time.Now()
+		ev, err = data.CompleteEmailVerification(context.Background(), tx, tokenDigest(request.Token), now.Add(-emailVerificationLifetime), remoteIP(req), now)
+		if err != nil {
+			return err
+		}
+
+		return data.SetVerifiedEmail(context.Background(), tx, ev.UserID, ev.Email)
+	})
+	if err != nil {
+		var dupErr data.DuplicationError
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "Email verification link is invalid or expired")
+		case errors.As(err, &dupErr):
+			w.WriteHeader(422)
+			fmt.Fprintf(w, `"%s" is already taken`, dupErr.Field)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("VerifyEmail failed", "error", err)
+		}
+		return
+	}
+
+	auditLog(req, env, "email_verified", ev.UserID, map[string]any{"email": ev.Email})
+}
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailVerificationHandlers(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	mailer := &testMailer{}
+	router := NewAPIHandler(pool, mailer, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	do := func(method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	type account struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"emailVerified"`
+		PendingEmail  string `json:"pendingEmail"`
+	}
+	getAccount := func(header http.Header) account {
+		w := do("GET", "/account", header, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var a account
+		err := json.Unmarshal(w.Body.Bytes(), &a)
+		require.NoError(t, err)
+		return a
+	}
+
+	w := do("POST", "/register", nil, `{"name": "test", "email": "test@example.com", "password": "password"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var session struct {
+		SessionID string `json:"sessionID"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &session)
+	require.NoError(t, err)
+	sessionHeader := http.Header{"X-Authentication": []string{session.SessionID}}
+
+	require.Len(t, mailer.sentEmailVerificationMails, 1)
+	require.Equal(t, "test@example.com", mailer.sentEmailVerificationMails[0].to)
+	require.Equal(t, account{Email: "test@example.com"}, getAccount(sessionHeader))
+
+	// Resending replaces the earlier link.
+	w = do("POST", "/account/email_verification", sessionHeader, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Len(t, mailer.sentEmailVerificationMails, 2)
+
+	w = do("POST", "/verify_email", nil, `{"token": "`+mailer.sentEmailVerificationMails[0].token+`"}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	token := mailer.sentEmailVerificationMails[1].token
+	w = do("POST", "/verify_email", nil, `{"token": "`+token+`"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, account{Email: "test@example.com", EmailVerified: true}, getAccount(sessionHeader))
+
+	w = do("POST", "/verify_email", nil, `{"token": "`+token+`"}`)
+	require.Equal(t, http.StatusNotFound, w.Code, "token already used")
+
+	w = do("POST", "/account/email_verification", sessionHeader, "")
+	require.Equal(t, 422, w.Code, "nothing to verify")
+
+	w = do("PATCH", "/account", sessionHeader, `{"email": "new@example.com", "existingPassword": "password"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, account{Email: "test@example.com", EmailVerified: true, PendingEmail: "new@example.com"}, getAccount(sessionHeader))
+	require.Len(t, mailer.sentEmailVerificationMails, 3)
+	token = mailer.sentEmailVerificationMails[2].token
+
+	// Another user confirms the address first.
+	other := &data.User{
+		Name:          pgtype.Text{String: "other", Valid: true},
+		Email:         pgtype.Text{String: "new@example.com", Valid: true},
+		EmailVerified: true,
+	}
+	SetPassword(other, "password")
+	otherID, err := data.CreateUser(ctx, pool, other)
+	require.NoError(t, err)
+
+	w = do("POST", "/verify_email", nil, `{"token": "`+token+`"}`)
+	require.Equal(t, 422, w.Code)
+	require.Equal(t, account{Email: "test@example.com", EmailVerified: true, PendingEmail: "new@example.com"}, getAccount(sessionHeader))
+
+	_, err = pool.Exec(ctx, `delete from users where id=$1`, otherID)
+	require.NoError(t, err)
+
+	w = do("POST", "/verify_email", nil, `{"token": "`+token+`"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, account{Email: "new@example.com", EmailVerified: true}, getAccount(sessionHeader))
+
+	// Expired links do not work.
+	w = do("PATCH", "/account", sessionHeader, `{"email": "expired@example.com", "existingPassword": "password"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, err = pool.Exec(ctx, `update email_verifications set request_time = request_time - interval '2 days'`)
+	require.NoError(t, err)
+	w = do("POST", "/verify_email", nil, `{"token": "`+mailer.sentEmailVerificationMails[3].token+`"}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, account{Email: "new@example.com", EmailVerified: true}, getAccount(sessionHeader))
+}
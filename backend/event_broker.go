@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/tpr/backend/data"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// event is a server-sent event.
+type event struct {
+	name string
+	data []byte
+}
+
+// resyncEvent tells clients that events may have been missed and they should reload their unread items. It is sent
+// whenever the listener (re)connects.
+var resyncEvent = &event{name: "resync", data: []byte("{}")}
+
+// eventSubscriberBufferSize is the number of events that may be queued for a subscriber before events are dropped.
+const eventSubscriberBufferSize = 32
+
+// eventBroker listens for item events from PostgreSQL and fans them out to the subscribers for each user. It uses a
+// dedicated connection rather than one from the pool as LISTEN holds the connection for the life of the process.
+type eventBroker struct {
+	pool   *pgxpool.Pool
+	logger log.Logger
+
+	mutex       sync.Mutex
+	listening   bool
+	subscribers map[int32]map[chan *event]struct{}
+}
+
+func newEventBroker(pool *pgxpool.Pool, logger log.Logger) *eventBroker {
+	return &eventBroker{
+		pool:        pool,
+		logger:      logger,
+		subscribers: make(map[int32]map[chan *event]struct{}),
+	}
+}
+
+// subscribe returns a channel that receives events for userID. The listener is started on the first subscription.
+// The returned function must be called to unsubscribe.
+func (b *eventBroker) subscribe(userID int32) (<-chan *event, func()) {
+	ch := make(chan *event, eventSubscriberBufferSize)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.listening {
+		b.listening = true
+		go b.listen()
+	}
+
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan *event]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+
+	unsubscribe := func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		delete(b.subscribers[userID], ch)
+		if len(b.subscribers[userID]) == 0 {
+			delete(b.subscribers, userID)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+// publish sends e to the subscribers of userID. Subscribers that are not keeping up miss the event.
+func (b *eventBroker) publish(userID int32, e *event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ch := range b.subscribers[userID] {
+		select {
+		case ch <- e:
+		default:
+			b.logger.Warn("event dropped for slow subscriber", "userID", userID, "event", e.name)
+		}
+	}
+}
+
+// publishAll sends e to every subscriber.
+func (b *eventBroker) publishAll(e *event) {
+	b.mutex.Lock()
+	userIDs := make([]int32, 0, len(b.subscribers))
+	for userID := range b.subscribers {
+		userIDs = append(userIDs, userID)
+	}
+	b.mutex.Unlock()
+
+	for _, userID := range userIDs {
+		b.publish(userID, e)
+	}
+}
+
+// listen receives notifications forever. It reconnects after errors.
+func (b *eventBroker) listen() {
+	for {
+		err := b.listenOnce()
+		b.logger.Error("event listener failed", "error", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (b *eventBroker) listenOnce() error {
+	ctx := context.Background()
+
+	conn, err := pgx.ConnectConfig(ctx, b.pool.Config().ConnConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, "listen "+data.ItemEventsChannel)
+	if err != nil {
+		return err
+	}
+
+	// Events committed before listening started were missed.
+	b.publishAll(resyncEvent)
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var itemEvent data.ItemEvent
+		err = json.Unmarshal([]byte(notification.Payload), &itemEvent)
+		if err != nil {
+			b.logger.Error("bad item event", "payload", notification.Payload, "error", err)
+			continue
+		}
+
+		e, err := newItemEvent(&itemEvent)
+		if err != nil {
+			b.logger.Error("newItemEvent failed", "error", err)
+			continue
+		}
+
+		b.publish(itemEvent.UserID, e)
+	}
+}
+
+// newItemEvent converts an item event notification into the event sent to clients.
+func newItemEvent(itemEvent *data.ItemEvent) (*event, error) {
+	var payload any
+	switch itemEvent.Type {
+	case data.ItemEventCreated:
+		payload = struct {
+			FeedID int32 `json:"feedID"`
+			Count  int   `json:"count"`
+		}{itemEvent.FeedID, itemEvent.Count}
+	case data.ItemEventRead:
+		payload = struct {
+			ItemIDs []int32 `json:"itemIDs"`
+		}{itemEvent.ItemIDs}
+	default:
+		payload = struct{}{}
+	}
+
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event{name: itemEvent.Type, data: buf}, nil
+}
@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+func TestNewItemEvent(t *testing.T) {
+	e, err := newItemEvent(&data.ItemEvent{Type: data.ItemEventCreated, UserID: 1, FeedID: 2, Count: 3})
+	require.NoError(t, err)
+	require.Equal(t, "items_created", e.name)
+	require.JSONEq(t, `{"feedID": 2, "count": 3}`, string(e.data))
+
+	e, err = newItemEvent(&data.ItemEvent{Type: data.ItemEventRead, UserID: 1, ItemIDs: []int32{4, 5}})
+	require.NoError(t, err)
+	require.Equal(t, "items_read", e.name)
+	require.JSONEq(t, `{"itemIDs": [4, 5]}`, string(e.data))
+}
+
+func TestEventBroker(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	b := newEventBroker(nil, logger)
+	b.listening = true // no database listener
+
+	user1a, unsubscribe1a := b.subscribe(1)
+	user1b, unsubscribe1b := b.subscribe(1)
+	user2, unsubscribe2 := b.subscribe(2)
+	defer unsubscribe2()
+
+	e := &event{name: "items_read", data: []byte(`{"itemIDs":[1]}`)}
+	b.publish(1, e)
+	require.Equal(t, e, <-user1a)
+	require.Equal(t, e, <-user1b)
+	require.Len(t, user2, 0)
+
+	unsubscribe1a()
+	b.publish(1, e)
+	require.Len(t, user1a, 0)
+	require.Equal(t, e, <-user1b)
+
+	b.publishAll(resyncEvent)
+	require.Equal(t, resyncEvent, <-user1b)
+	require.Equal(t, resyncEvent, <-user2)
+
+	unsubscribe1b()
+	require.NotContains(t, b.subscribers, int32(1))
+
+	// A subscriber that is not reading does not block publishing.
+	for i := 0; i < eventSubscriberBufferSize+1; i++ {
+		b.publish(2, e)
+	}
+	require.Len(t, user2, eventSubscriberBufferSize)
+}
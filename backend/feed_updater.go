@@ -1,18 +1,28 @@
 package backend
 
 import (
-	"bytes"
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/tpr/backend/data"
+	"golang.org/x/net/html"
 	"golang.org/x/net/html/charset"
 	log "gopkg.in/inconshreveable/log15.v2"
 )
@@ -20,55 +30,112 @@ import (
 type FeedUpdater struct {
 	client                   *http.Client
 	maxConcurrentFeedFetches int
+	claimDuration            time.Duration
 	pool                     *pgxpool.Pool
 	logger                   log.Logger
+
+	// FetchHistorySize is the number of fetch attempts retained per feed.
+	FetchHistorySize int
+
+	// MaxBodySize is the maximum number of decoded bytes read from a feed response.
+	MaxBodySize int64
+
+	// AllowedNetworks may be connected to even though they are loopback, private, or otherwise blocked.
+	AllowedNetworks []netip.Prefix
+
+	// BlockedNetworks may not be connected to in addition to the default blocked networks.
+	BlockedNetworks []netip.Prefix
+
+	// WebSubRootURL is the public URL of this server. WebSub hubs deliver content to callbacks under it. WebSub is
+	// disabled when it is empty.
+	WebSubRootURL string
 }
 
 func NewFeedUpdater(pool *pgxpool.Pool, logger log.Logger) *FeedUpdater {
 	feedUpdater := &FeedUpdater{}
 	feedUpdater.pool = pool
 	feedUpdater.logger = logger
-	feedUpdater.client = &http.Client{Timeout: 60 * time.Second}
+
+	// Feed URLs are supplied by users. Restrict where they may connect to prevent them from reaching internal services.
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			filter := &networkFilter{allowed: feedUpdater.AllowedNetworks, blocked: feedUpdater.BlockedNetworks}
+			return filter.dialControl(network, address, c)
+		},
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	feedUpdater.client = &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkFeedRedirect,
+		Timeout:       60 * time.Second,
+	}
 	feedUpdater.maxConcurrentFeedFetches = 25
+	feedUpdater.claimDuration = 5 * time.Minute
+	feedUpdater.FetchHistorySize = 100
+	feedUpdater.MaxBodySize = 20 * 1024 * 1024
 	return feedUpdater
 }
 
+// KeepFeedsFresh refreshes stale feeds once a minute forever. Multiple processes may run KeepFeedsFresh against the
+// same database. Feeds are claimed before they are fetched so each feed is only fetched by one process.
 func (u *FeedUpdater) KeepFeedsFresh() {
-
 	for {
 		startTime := time.Now()
+		u.RefreshStaleFeeds()
+		u.RenewWebSubSubscriptions()
+		sleepUntil(startTime.Add(time.Minute))
+	}
+}
 
-		if staleFeeds, err := data.GetFeedsUncheckedSince(context.Background(), u.pool, startTime.Add(-10*time.Minute)); err == nil {
-			u.logger.Info("GetFeedsUncheckedSince succeeded", "n", len(staleFeeds))
-
-			staleFeedChan := make(chan data.Feed)
-			finishChan := make(chan bool)
+// RefreshStaleFeeds claims and refreshes feeds that have not been checked in the last 10 minutes until there are no
+// unclaimed stale feeds remaining. Feeds with an active WebSub subscription are only polled every webSubPollInterval.
+func (u *FeedUpdater) RefreshStaleFeeds() {
+	staleFeedChan := make(chan data.Feed)
+	finishChan := make(chan bool)
 
-			worker := func() {
-				for feed := range staleFeedChan {
-					u.RefreshFeed(feed)
-				}
-				finishChan <- true
-			}
+	worker := func() {
+		for feed := range staleFeedChan {
+			u.RefreshFeed(feed)
+		}
+		finishChan <- true
+	}
 
-			for i := 0; i < u.maxConcurrentFeedFetches; i++ {
-				go worker()
-			}
+	for i := 0; i < u.maxConcurrentFeedFetches; i++ {
+		go worker()
+	}
 
-			for _, sf := range staleFeeds {
-				staleFeedChan <- sf
-			}
-			close(staleFeedChan)
+	since := time.Now().Add(-10 * time.Minute)
+	pushedSince := time.Now().Add(-webSubPollInterval)
+	for {
+		claimExpiration := time.Now().Add(u.claimDuration)
+		staleFeeds, err := data.ClaimFeedsUncheckedSince(context.Background(), u.pool, since, pushedSince, claimExpiration, u.maxConcurrentFeedFetches)
+		if err != nil {
+			u.logger.Error("ClaimFeedsUncheckedSince failed", "error", err)
+			break
+		}
+		u.logger.Info("ClaimFeedsUncheckedSince succeeded", "n", len(staleFeeds))
 
-			for i := 0; i < u.maxConcurrentFeedFetches; i++ {
-				<-finishChan
-			}
+		if len(staleFeeds) == 0 {
+			break
+		}
 
-		} else {
-			u.logger.Error("GetFeedsUncheckedSince failed", "error", err)
+		for _, sf := range staleFeeds {
+			staleFeedChan <- sf
 		}
+	}
+	close(staleFeedChan)
 
-		sleepUntil(startTime.Add(time.Minute))
+	for i := 0; i < u.maxConcurrentFeedFetches; i++ {
+		<-finishChan
 	}
 }
 
@@ -78,88 +145,285 @@ func sleepUntil(t time.Time) {
 }
 
 type rawFeed struct {
-	url  string
-	body []byte
-	etag pgtype.Text
+	url    string
+	status int
+	body   *limitedReader // decoded body -- only set for 200 responses
+	etag   pgtype.Text
+	closer io.Closer
+
+	// hubURL and selfURL are WebSub discovery links from the HTTP Link header.
+	hubURL  string
+	selfURL string
+}
+
+func (f *rawFeed) Close() error {
+	return f.closer.Close()
+}
+
+var errBodyTooLarge = errors.New("body too large")
+
+// limitedReader reads from r until more than max bytes have been read and then returns errBodyTooLarge.
+type limitedReader struct {
+	r     io.Reader
+	max   int64
+	count int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.count > l.max {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.max-l.count+1 {
+		p = p[:l.max-l.count+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.count += int64(n)
+	if l.count > l.max {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// decodeContentEncoding wraps body in a decompressor for contentEncoding.
+func decodeContentEncoding(body io.Reader, contentEncoding string) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		// deflate should be zlib wrapped but some servers send raw deflate data.
+		br := bufio.NewReader(body)
+		header, err := br.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return brotli.NewReader(body), nil
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Encoding: %s", contentEncoding)
+	}
+}
+
+// validateFeedURL returns an error if feedURL is not an absolute http or https URL.
+func validateFeedURL(feedURL string) error {
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("URL scheme must be http or https")
+	}
+
+	if u.Host == "" {
+		return errors.New("URL must include a host")
+	}
+
+	return nil
+}
+
+func checkFeedRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	if err := validateFeedURL(req.URL.String()); err != nil {
+		return fmt.Errorf("bad redirect: %v", err)
+	}
+
+	return nil
 }
 
+// fetchFeed fetches feedURL. The returned rawFeed is non-nil whenever a response was received even if an error is
+// also returned. The caller must close a non-nil rawFeed. The body is streamed from the response rather than read
+// into memory.
 func (u *FeedUpdater) fetchFeed(feedURL string, etag pgtype.Text) (*rawFeed, error) {
 	feed := &rawFeed{url: feedURL}
 
+	if err := validateFeedURL(feedURL); err != nil {
+		return nil, err
+	}
+
 	req, err := http.NewRequest("GET", feed.url, nil)
+	if err != nil {
+		return nil, err
+	}
 	if etag.Valid {
 		req.Header.Add("If-None-Match", etag.String)
 	}
+	// Explicitly setting Accept-Encoding disables the transparent gzip handling of http.Transport so all encodings are
+	// decoded by decodeContentEncoding.
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
 
 	resp, err := u.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+
+	feed.status = resp.StatusCode
+	feed.closer = resp.Body
 
 	switch resp.StatusCode {
 	case 200:
-		feed.body, err = ioutil.ReadAll(resp.Body)
+		body, err := decodeContentEncoding(resp.Body, resp.Header.Get("Content-Encoding"))
 		if err != nil {
-			return nil, fmt.Errorf("Unable to read response body: %v", err)
+			return feed, fmt.Errorf("Unable to read response body: %v", err)
 		}
+		feed.body = &limitedReader{r: body, max: u.MaxBodySize}
 
 		feed.etag = newStringFallback(resp.Header.Get("Etag"))
+		feed.hubURL, feed.selfURL = parseLinkHeader(strings.Join(resp.Header.Values("Link"), ","))
 
 		return feed, nil
 	case 304:
-		return nil, nil
+		return feed, nil
 	default:
-		return nil, fmt.Errorf("Bad HTTP response: %s", resp.Status)
+		return feed, fmt.Errorf("Bad HTTP response: %s", resp.Status)
+	}
+}
+
+const (
+	FeedRefreshSuccess   = "success"
+	FeedRefreshUnchanged = "unchanged"
+	FeedRefreshFailure   = "failure"
+)
+
+// FeedRefreshResult is the outcome of refreshing a single feed.
+type FeedRefreshResult struct {
+	Status       string `json:"status"`
+	NewItemCount int    `json:"newItemCount"`
+	Error        string `json:"error,omitempty"`
+}
+
+var errFeedClaimed = errors.New("feed is already being refreshed")
+
+// RefreshFeedNow refreshes feed immediately regardless of when it was last fetched. It returns errFeedClaimed if the
+// feed is currently being refreshed by another process.
+func (u *FeedUpdater) RefreshFeedNow(feed data.Feed) (*FeedRefreshResult, error) {
+	claimed, err := data.ClaimFeed(context.Background(), u.pool, feed.ID, time.Now().Add(u.claimDuration))
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, errFeedClaimed
+	}
+
+	return u.RefreshFeed(feed), nil
+}
+
+// RefreshFeed fetches staleFeed, saves the result, and records the attempt in the feed's fetch history.
+func (u *FeedUpdater) RefreshFeed(staleFeed data.Feed) *FeedRefreshResult {
+	fetch := &data.FeedFetch{FeedID: staleFeed.ID, FetchTime: time.Now()}
+	result := u.refreshFeed(staleFeed, fetch)
+	if result.Error != "" {
+		fetch.Error = newStringFallback(result.Error)
+	}
+
+	err := data.InsertFeedFetch(context.Background(), u.pool, fetch, u.FetchHistorySize)
+	if err != nil {
+		u.logger.Error("InsertFeedFetch failed", "url", staleFeed.URL, "id", staleFeed.ID, "error", err)
 	}
+
+	return result
 }
 
-func (u *FeedUpdater) RefreshFeed(staleFeed data.Feed) {
+func (u *FeedUpdater) refreshFeed(staleFeed data.Feed, fetch *data.FeedFetch) *FeedRefreshResult {
 	rawFeed, err := u.fetchFeed(staleFeed.URL, staleFeed.ETag)
+	if rawFeed != nil {
+		defer rawFeed.Close()
+		fetch.HTTPStatus = pgtype.Int4{Int32: int32(rawFeed.status), Valid: true}
+	}
 	if err != nil {
+		fetch.Duration = time.Since(fetch.FetchTime)
 		u.logger.Error("fetchFeed failed", "url", staleFeed.URL, "error", err)
 		data.UpdateFeedWithFetchFailure(context.Background(), u.pool, staleFeed.ID, err.Error(), time.Now())
-		return
+		return &FeedRefreshResult{Status: FeedRefreshFailure, Error: err.Error()}
 	}
-	// 304 unchanged
-	if rawFeed == nil {
+	if rawFeed.status == http.StatusNotModified {
+		fetch.Duration = time.Since(fetch.FetchTime)
 		u.logger.Info("fetchFeed 304 unchanged", "url", staleFeed.URL)
+		fetch.ETagHit = true
 		data.UpdateFeedWithFetchUnchanged(context.Background(), u.pool, staleFeed.ID, time.Now())
-		return
+		return &FeedRefreshResult{Status: FeedRefreshUnchanged}
 	}
 
+	// The body is parsed as it is read so the fetch is not complete until parsing is.
 	feed, err := parseFeed(rawFeed.body)
+	fetch.Duration = time.Since(fetch.FetchTime)
+	fetch.ByteCount = pgtype.Int4{Int32: int32(rawFeed.body.count), Valid: true}
 	if err != nil {
+		var failure string
+		if errors.Is(err, errBodyTooLarge) {
+			failure = fmt.Sprintf("Feed is larger than the maximum size of %d bytes", u.MaxBodySize)
+		} else {
+			failure = fmt.Sprintf("Unable to parse feed: %v", err)
+		}
 		u.logger.Error("parseFeed failed", "url", staleFeed.URL, "error", err)
-		data.UpdateFeedWithFetchFailure(context.Background(), u.pool, staleFeed.ID, fmt.Sprintf("Unable to parse feed: %v", err), time.Now())
-		return
+		data.UpdateFeedWithFetchFailure(context.Background(), u.pool, staleFeed.ID, failure, time.Now())
+		return &FeedRefreshResult{Status: FeedRefreshFailure, Error: failure}
 	}
 
-	u.logger.Info("refreshFeed succeeded", "url", staleFeed.URL, "id", staleFeed.ID)
-	data.UpdateFeedWithFetchSuccess(context.Background(), u.pool, staleFeed.ID, feed, rawFeed.etag, time.Now())
-}
+	newItemCount, err := data.UpdateFeedWithFetchSuccess(context.Background(), u.pool, staleFeed.ID, feed, rawFeed.etag, time.Now())
+	if err != nil {
+		u.logger.Error("UpdateFeedWithFetchSuccess failed", "url", staleFeed.URL, "id", staleFeed.ID, "error", err)
+		if err := data.ReleaseFeedClaim(context.Background(), u.pool, staleFeed.ID); err != nil {
+			u.logger.Error("ReleaseFeedClaim failed", "url", staleFeed.URL, "id", staleFeed.ID, "error", err)
+		}
+		return &FeedRefreshResult{Status: FeedRefreshFailure, Error: "Unable to save feed"}
+	}
+	fetch.NewItemCount = pgtype.Int4{Int32: int32(newItemCount), Valid: true}
 
-func parseFeed(body []byte) (f *data.ParsedFeed, err error) {
-	f, err = parseRSS(body)
-	if err == nil {
-		return f, nil
+	// Link headers take precedence over links in the document.
+	hubURL, selfURL := feed.HubURL, feed.SelfURL
+	if rawFeed.hubURL != "" {
+		hubURL, selfURL = rawFeed.hubURL, rawFeed.selfURL
 	}
+	u.ensureWebSubSubscription(staleFeed.ID, staleFeed.URL, hubURL, selfURL)
 
-	return parseAtom(body)
+	u.logger.Info("refreshFeed succeeded", "url", staleFeed.URL, "id", staleFeed.ID, "newItemCount", newItemCount)
+	return &FeedRefreshResult{Status: FeedRefreshSuccess, NewItemCount: newItemCount}
 }
 
-func parseRSS(body []byte) (*data.ParsedFeed, error) {
-	type Item struct {
-		Link    string `xml:"link"`
-		Title   string `xml:"title"`
-		Date    string `xml:"date"`
-		PubDate string `xml:"pubDate"`
+// parseFeed decodes an RSS or Atom document from r. The format is determined by the root element so the document is
+// only read once.
+func parseFeed(r io.Reader) (*data.ParsedFeed, error) {
+	decoder := newXMLDecoder(r)
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if start, ok := token.(xml.StartElement); ok {
+			if start.Name.Local == "feed" {
+				return parseAtom(decoder, &start)
+			}
+			return parseRSS(decoder, &start)
+		}
 	}
+}
 
-	type Channel struct {
+func parseRSS(decoder *xml.Decoder, start *xml.StartElement) (*data.ParsedFeed, error) {
+	type Item struct {
+		Link        string `xml:"link"`
 		Title       string `xml:"title"`
+		Date        string `xml:"date"`
+		PubDate     string `xml:"pubDate"`
+		Author      string `xml:"author"`
+		Creator     string `xml:"creator"`
 		Description string `xml:"description"`
-		Item        []Item `xml:"item"`
+		Encoded     string `xml:"encoded"`
+	}
+
+	type Channel struct {
+		Title       string    `xml:"title"`
+		Description string    `xml:"description"`
+		AtomLinks   []xmlLink `xml:"http://www.w3.org/2005/Atom link"`
+		Item        []Item    `xml:"item"`
 	}
 
 	var rss struct {
@@ -167,7 +431,7 @@ func parseRSS(body []byte) (*data.ParsedFeed, error) {
 		Item    []Item  `xml:"item"`
 	}
 
-	err := parseXML(body, &rss)
+	err := decoder.DecodeElement(&rss, start)
 	if err != nil {
 		return nil, err
 	}
@@ -178,6 +442,7 @@ func parseRSS(body []byte) (*data.ParsedFeed, error) {
 	} else {
 		feed.Name = rss.Channel.Description
 	}
+	feed.HubURL, feed.SelfURL = findHubLinks(rss.Channel.AtomLinks)
 
 	var items []Item
 	if len(rss.Item) > 0 {
@@ -190,6 +455,15 @@ func parseRSS(body []byte) (*data.ParsedFeed, error) {
 	for i, item := range items {
 		feed.Items[i].URL = item.Link
 		feed.Items[i].Title = item.Title
+		feed.Items[i].Author = strings.TrimSpace(item.Author)
+		if feed.Items[i].Author == "" {
+			feed.Items[i].Author = strings.TrimSpace(item.Creator)
+		}
+		if item.Encoded != "" {
+			feed.Items[i].Content = htmlToText(item.Encoded)
+		} else {
+			feed.Items[i].Content = htmlToText(item.Description)
+		}
 		if item.Date != "" {
 			feed.Items[i].PublicationTime, _ = parseTime(item.Date)
 		}
@@ -205,34 +479,48 @@ func parseRSS(body []byte) (*data.ParsedFeed, error) {
 	return &feed, nil
 }
 
-func parseAtom(body []byte) (*data.ParsedFeed, error) {
+func parseAtom(decoder *xml.Decoder, start *xml.StartElement) (*data.ParsedFeed, error) {
 	type Link struct {
 		Href string `xml:"href,attr"`
 	}
 
+	type Author struct {
+		Name string `xml:"name"`
+	}
+
 	type Entry struct {
-		Link      Link   `xml:"link"`
-		Title     string `xml:"title"`
-		Published string `xml:"published"`
-		Updated   string `xml:"updated"`
+		Link      Link     `xml:"link"`
+		Title     string   `xml:"title"`
+		Published string   `xml:"published"`
+		Updated   string   `xml:"updated"`
+		Author    Author   `xml:"author"`
+		Summary   atomText `xml:"summary"`
+		Content   atomText `xml:"content"`
 	}
 
 	var atom struct {
-		Title string  `xml:"title"`
-		Entry []Entry `xml:"entry"`
+		Title string    `xml:"title"`
+		Links []xmlLink `xml:"link"`
+		Entry []Entry   `xml:"entry"`
 	}
 
-	err := parseXML(body, &atom)
+	err := decoder.DecodeElement(&atom, start)
 	if err != nil {
 		return nil, err
 	}
 
 	var feed data.ParsedFeed
 	feed.Name = atom.Title
+	feed.HubURL, feed.SelfURL = findHubLinks(atom.Links)
 	feed.Items = make([]data.ParsedItem, len(atom.Entry))
 	for i, entry := range atom.Entry {
 		feed.Items[i].URL = entry.Link.Href
 		feed.Items[i].Title = entry.Title
+		feed.Items[i].Author = strings.TrimSpace(entry.Author.Name)
+		feed.Items[i].Content = entry.Content.PlainText()
+		if feed.Items[i].Content == "" {
+			feed.Items[i].Content = entry.Summary.PlainText()
+		}
 		if entry.Published != "" {
 			feed.Items[i].PublicationTime, _ = parseTime(entry.Published)
 		}
@@ -248,15 +536,60 @@ func parseAtom(body []byte) (*data.ParsedFeed, error) {
 	return &feed, nil
 }
 
-// Parse XML laxly
-func parseXML(body []byte, doc interface{}) error {
-	buf := bytes.NewBuffer(body)
-	decoder := xml.NewDecoder(buf)
+// atomText is an Atom text construct such as summary or content.
+type atomText struct {
+	Type     string `xml:"type,attr"`
+	Text     string `xml:",chardata"`
+	InnerXML string `xml:",innerxml"`
+}
+
+func (t atomText) PlainText() string {
+	switch t.Type {
+	case "html":
+		return htmlToText(t.Text)
+	case "xhtml":
+		return htmlToText(t.InnerXML)
+	default:
+		return strings.Join(strings.Fields(t.Text), " ")
+	}
+}
+
+// htmlToText returns the text of an HTML fragment with whitespace collapsed. It is used for matching item rules so it
+// does not need to preserve formatting.
+func htmlToText(s string) string {
+	var sb strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(s))
+	skip := 0
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(sb.String()), " ")
+		case html.StartTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				sb.Write(tokenizer.Text())
+				sb.WriteByte(' ')
+			}
+		}
+	}
+}
+
+// newXMLDecoder returns a decoder that parses XML laxly
+func newXMLDecoder(r io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(r)
 	decoder.CharsetReader = charset.NewReaderLabel
 
 	decoder.Entity = xml.HTMLEntity
 
-	return decoder.Decode(doc)
+	return decoder
 }
 
 // Try multiple time formats one after another until one works or all fail
@@ -2,16 +2,32 @@ package backend
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
 	log "gopkg.in/inconshreveable/log15.v2"
 )
 
+// newTestFeedUpdater returns a FeedUpdater that may connect to the loopback addresses httptest servers listen on.
+func newTestFeedUpdater(pool *pgxpool.Pool, logger log.Logger) *FeedUpdater {
+	u := NewFeedUpdater(pool, logger)
+	u.AllowedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	return u
+}
+
 var feedParsingTests = []struct {
 	name       string
 	body       []byte
@@ -248,7 +264,7 @@ var feedParsingTests = []struct {
 
 func TestParseFeed(t *testing.T) {
 	for i, tt := range feedParsingTests {
-		actual, err := parseFeed(tt.body)
+		actual, err := parseFeed(bytes.NewReader(tt.body))
 		if err != nil && err.Error() != tt.errMsg {
 			t.Errorf("%d. %s: Unexpected error: %v", i, tt.name, err)
 		}
@@ -288,6 +304,59 @@ func TestParseFeed(t *testing.T) {
 	}
 }
 
+func TestParseFeedAuthorAndContent(t *testing.T) {
+	rss := `<?xml version='1.0' encoding='UTF-8'?>
+<rss xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:content="http://purl.org/rss/1.0/modules/content/">
+  <channel>
+    <title>News</title>
+    <item>
+      <title>Snow Storm</title>
+      <link>http://example.org/snow-storm</link>
+      <dc:creator>Jack</dc:creator>
+      <description>Summary</description>
+      <content:encoded><![CDATA[<p>Heavy <b>snow</b> &amp; wind</p><script>alert(1)</script>]]></content:encoded>
+    </item>
+    <item>
+      <title>Blizzard</title>
+      <link>http://example.org/blizzard</link>
+      <author>jill@example.org (Jill)</author>
+      <description>&lt;p&gt;Cold&lt;/p&gt;</description>
+    </item>
+  </channel>
+</rss>`
+
+	feed, err := parseFeed(strings.NewReader(rss))
+	require.NoError(t, err)
+	require.Equal(t, "Jack", feed.Items[0].Author)
+	require.Equal(t, "Heavy snow & wind", feed.Items[0].Content)
+	require.Equal(t, "jill@example.org (Jill)", feed.Items[1].Author)
+	require.Equal(t, "Cold", feed.Items[1].Content)
+
+	atom := `<?xml version='1.0' encoding='UTF-8'?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>News</title>
+  <entry>
+    <title>Snow Storm</title>
+    <link href="http://example.org/snow-storm" />
+    <author><name>Jack</name></author>
+    <summary>Summary</summary>
+    <content type="xhtml"><div xmlns="http://www.w3.org/1999/xhtml"><p>Heavy snow</p></div></content>
+  </entry>
+  <entry>
+    <title>Blizzard</title>
+    <link href="http://example.org/blizzard" />
+    <summary type="html">&lt;p&gt;Cold&lt;/p&gt;</summary>
+  </entry>
+</feed>`
+
+	feed, err = parseFeed(strings.NewReader(atom))
+	require.NoError(t, err)
+	require.Equal(t, "Jack", feed.Items[0].Author)
+	require.Equal(t, "Heavy snow", feed.Items[0].Content)
+	require.Equal(t, "", feed.Items[1].Author)
+	require.Equal(t, "Cold", feed.Items[1].Content)
+}
+
 var timeParsingTests = []struct {
 	unparsed string
 	expected time.Time
@@ -342,18 +411,136 @@ func TestFetchFeed(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	u := NewFeedUpdater(pool, log.Root())
+	u := newTestFeedUpdater(pool, log.Root())
 	rawFeed, err := u.fetchFeed(ts.URL, pgtype.Text{})
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
+	defer rawFeed.Close()
 	if rawFeed.url != ts.URL {
 		t.Errorf("rawFeed.url should match requested url but instead it was: %v", rawFeed.url)
 	}
-	if bytes.Compare(rssBody, rawFeed.body) != 0 {
-		t.Errorf("rawFeed body should match returned body but instead it was: %v", rawFeed.body)
+	body, err := io.ReadAll(rawFeed.body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if bytes.Compare(rssBody, body) != 0 {
+		t.Errorf("rawFeed body should match returned body but instead it was: %v", body)
 	}
 	if rawFeed.etag.Valid {
 		t.Errorf("Expected no ETag to be null but instead it was: %v", rawFeed.etag)
 	}
 }
+
+func TestFetchFeedContentEncodings(t *testing.T) {
+	rssBody := []byte(`<?xml version='1.0' encoding='UTF-8'?>
+<rss>
+  <channel>
+    <title>News</title>
+    <item>
+      <title>Snow Storm</title>
+      <link>http://example.org/snow-storm</link>
+    </item>
+  </channel>
+</rss>`)
+
+	tests := []struct {
+		contentEncoding string
+		encoder         func(io.Writer) io.WriteCloser
+	}{
+		{"", nil},
+		{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+		// Some servers send raw deflate data instead of zlib wrapped.
+		{"deflate", func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		}},
+		{"br", func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }},
+	}
+
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "gzip, deflate, br", r.Header.Get("Accept-Encoding"))
+			if tt.encoder == nil {
+				w.Write(rssBody)
+				return
+			}
+			w.Header().Set("Content-Encoding", tt.contentEncoding)
+			ew := tt.encoder(w)
+			ew.Write(rssBody)
+			ew.Close()
+		}))
+
+		u := newTestFeedUpdater(nil, log.Root())
+		rawFeed, err := u.fetchFeed(ts.URL, pgtype.Text{})
+		require.NoErrorf(t, err, "Content-Encoding: %s", tt.contentEncoding)
+
+		feed, err := parseFeed(rawFeed.body)
+		require.NoErrorf(t, err, "Content-Encoding: %s", tt.contentEncoding)
+		require.Equal(t, "News", feed.Name)
+		require.Len(t, feed.Items, 1)
+		require.EqualValues(t, len(rssBody), rawFeed.body.count)
+
+		rawFeed.Close()
+		ts.Close()
+	}
+}
+
+func TestFetchFeedMaxBodySize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?><rss><channel><title>`))
+		gw.Write([]byte(strings.Repeat("a", 1024*1024)))
+		gw.Write([]byte(`</title></channel></rss>`))
+		gw.Close()
+	}))
+	defer ts.Close()
+
+	u := newTestFeedUpdater(nil, log.Root())
+	u.MaxBodySize = 64 * 1024
+	rawFeed, err := u.fetchFeed(ts.URL, pgtype.Text{})
+	require.NoError(t, err)
+	defer rawFeed.Close()
+
+	_, err = parseFeed(rawFeed.body)
+	require.ErrorIs(t, err, errBodyTooLarge)
+	require.EqualValues(t, u.MaxBodySize+1, rawFeed.body.count)
+}
+
+func TestFetchFeedBlocksInternalAddresses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not have reached server")
+	}))
+	defer ts.Close()
+
+	u := NewFeedUpdater(nil, log.Root())
+	_, err := u.fetchFeed(ts.URL, pgtype.Text{})
+	require.ErrorContains(t, err, "connecting to 127.0.0.1 is not allowed")
+
+	_, err = u.fetchFeed("file:///etc/passwd", pgtype.Text{})
+	require.ErrorContains(t, err, "URL scheme must be http or https")
+}
+
+func TestFetchFeedBlocksRedirectsToInternalAddresses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal":
+			http.Redirect(w, r, "http://127.0.0.2:5432/", http.StatusFound)
+		case "/scheme":
+			http.Redirect(w, r, "gopher://example.com/", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+
+	// Allow only the address the test server listens on.
+	u := NewFeedUpdater(nil, log.Root())
+	u.AllowedNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+
+	_, err := u.fetchFeed(ts.URL+"/internal", pgtype.Text{})
+	require.ErrorContains(t, err, "connecting to 127.0.0.2 is not allowed")
+
+	_, err = u.fetchFeed(ts.URL+"/scheme", pgtype.Text{})
+	require.ErrorContains(t, err, "URL scheme must be http or https")
+}
@@ -0,0 +1,341 @@
+package backend
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/tpr/backend/data"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// The Fever API (https://feedafever.com/api) is spoken by many third-party reader apps. Clients authenticate every
+// request with api_key, the hex MD5 of "name:password", and select what to return with query parameters on a single
+// endpoint.
+
+const (
+	feverAPIVersion = 3
+
+	// feverItemLimit is the maximum number of items returned by one request as specified by the Fever API.
+	feverItemLimit = 50
+
+	// feverGroupID is the ID of the single group containing all feeds. tpr does not have folders but many clients
+	// expect every feed to be in a group.
+	feverGroupID = 1
+)
+
+// feverAPIKey returns the Fever API key for name and password.
+func feverAPIKey(name, password string) string {
+	sum := md5.Sum([]byte(name + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// feverAPIKeyDigest returns the digest under which apiKey is stored.
+func feverAPIKeyDigest(apiKey string) []byte {
+	digest := sha256.Sum256([]byte(strings.ToLower(apiKey)))
+	return digest[:]
+}
+
+func NewFeverHandler(pool *pgxpool.Pool, logger log.Logger) chi.Router {
+	router := chi.NewRouter()
+
+	env := &environment{
+		pool:   pool,
+		logger: logger,
+
+		authRateLimiter: newAuthRateLimiter(pool, logger),
+	}
+
+	router.Handle("/", EnvHandler(env, FeverHandler))
+
+	return router
+}
+
+type feverFeed struct {
+	ID                int32  `json:"id"`
+	FaviconID         int32  `json:"favicon_id"`
+	Title             string `json:"title"`
+	URL               string `json:"url"`
+	SiteURL           string `json:"site_url"`
+	IsSpark           int    `json:"is_spark"`
+	LastUpdatedOnTime int64  `json:"last_updated_on_time"`
+}
+
+type feverGroup struct {
+	ID    int32  `json:"id"`
+	Title string `json:"title"`
+}
+
+type feverFeedsGroup struct {
+	GroupID int32  `json:"group_id"`
+	FeedIDs string `json:"feed_ids"`
+}
+
+type feverItem struct {
+	ID            int32  `json:"id"`
+	FeedID        int32  `json:"feed_id"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	HTML          string `json:"html"`
+	URL           string `json:"url"`
+	IsSaved       int    `json:"is_saved"`
+	IsRead        int    `json:"is_read"`
+	CreatedOnTime int64  `json:"created_on_time"`
+}
+
+func newFeverItem(i *data.FeverItem) feverItem {
+	fi := feverItem{
+		ID:            i.ID,
+		FeedID:        i.FeedID,
+		Title:         i.Title,
+		Author:        i.Author.String,
+		URL:           i.URL,
+		CreatedOnTime: i.CreationTime.Unix(),
+	}
+	// Content is stored as plain text.
+	if i.Content.Valid {
+		fi.HTML = strings.ReplaceAll(html.EscapeString(i.Content.String), "\n", "<br>")
+	}
+	if i.PublicationTime.Valid {
+		fi.CreatedOnTime = i.PublicationTime.Time.Unix()
+	}
+	if i.Read {
+		fi.IsRead = 1
+	}
+	if i.Saved {
+		fi.IsSaved = 1
+	}
+	return fi
+}
+
+// joinIDs returns ids as the comma separated string the Fever API uses for lists of IDs.
+func joinIDs(ids []int32) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatInt(int64(id), 10)
+	}
+	return strings.Join(s, ",")
+}
+
+// parseIDs parses a comma separated list of IDs. Invalid IDs are ignored.
+func parseIDs(s string) []int32 {
+	var ids []int32
+	for _, f := range strings.Split(s, ",") {
+		if id, err := strconv.ParseInt(strings.TrimSpace(f), 10, 32); err == nil {
+			ids = append(ids, int32(id))
+		}
+	}
+	return ids
+}
+
+// FeverHandler handles all Fever API requests. The Fever API always responds with 200 and reports failed
+// authentication with "auth": 0. Unknown API keys count toward a per IP address rate limit so keys cannot be guessed.
+func FeverHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	ctx := context.Background()
+
+	if !env.authRateLimiter.allow(w, req, env, data.AuthActionFever, "") {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	response := map[string]any{
+		"api_version": feverAPIVersion,
+		"auth":        0,
+	}
+
+	user, err := data.SelectUserByFeverAPIKeyDigest(ctx, env.pool, feverAPIKeyDigest(req.FormValue("api_key")))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("SelectUserByFeverAPIKeyDigest failed", "error", err)
+			return
+		}
+		if err := env.authRateLimiter.record(ctx, data.AuthActionFever, remoteIP(req), ""); err != nil {
+			env.logger.Error("authRateLimiter.record failed", "error", err)
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if user.Disabled {
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	userID := user.ID.Int32
+	response["auth"] = 1
+
+	if err := feverMark(ctx, req, env, userID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("Fever mark failed", "error", err)
+		return
+	}
+
+	subscriptions, err := data.SelectSubscriptions(ctx, env.pool, userID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectSubscriptions failed", "error", err)
+		return
+	}
+
+	var lastRefreshedOnTime int64
+	feeds := make([]feverFeed, len(subscriptions))
+	feedIDs := make([]int32, len(subscriptions))
+	for i, s := range subscriptions {
+		feeds[i] = feverFeed{
+			ID:      s.FeedID.Int32,
+			Title:   s.Name.String,
+			URL:     s.URL.String,
+			SiteURL: s.URL.String,
+		}
+		if s.LastPublicationTime.Valid {
+			feeds[i].LastUpdatedOnTime = s.LastPublicationTime.Time.Unix()
+		}
+		if s.LastFetchTime.Valid && s.LastFetchTime.Time.Unix() > lastRefreshedOnTime {
+			lastRefreshedOnTime = s.LastFetchTime.Time.Unix()
+		}
+		feedIDs[i] = s.FeedID.Int32
+	}
+	response["last_refreshed_on_time"] = lastRefreshedOnTime
+
+	// Clients put the parameters selecting what to return in the query string or the body so req.Form, which has both,
+	// is used instead of the query.
+	query := req.Form
+	feedsGroups := []feverFeedsGroup{{GroupID: feverGroupID, FeedIDs: joinIDs(feedIDs)}}
+
+	if query.Has("groups") {
+		response["groups"] = []feverGroup{{ID: feverGroupID, Title: "All"}}
+		response["feeds_groups"] = feedsGroups
+	}
+
+	if query.Has("feeds") {
+		response["feeds"] = feeds
+		response["feeds_groups"] = feedsGroups
+	}
+
+	if query.Has("favicons") {
+		response["favicons"] = []any{}
+	}
+
+	if query.Has("links") {
+		response["links"] = []any{}
+	}
+
+	if query.Has("items") {
+		var items []*data.FeverItem
+		if withIDs := parseIDs(query.Get("with_ids")); len(withIDs) > 0 {
+			if len(withIDs) > feverItemLimit {
+				withIDs = withIDs[:feverItemLimit]
+			}
+			items, err = data.SelectFeverItemsByIDs(ctx, env.pool, userID, withIDs)
+		} else if maxID, err2 := strconv.ParseInt(query.Get("max_id"), 10, 32); err2 == nil {
+			items, err = data.SelectFeverItemsBeforeID(ctx, env.pool, userID, int32(maxID), feverItemLimit)
+		} else {
+			sinceID, _ := strconv.ParseInt(query.Get("since_id"), 10, 32)
+			items, err = data.SelectFeverItemsSinceID(ctx, env.pool, userID, int32(sinceID), feverItemLimit)
+		}
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("SelectFeverItems failed", "error", err)
+			return
+		}
+
+		totalItems, err := data.SelectItemCountByUserID(ctx, env.pool, userID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("SelectItemCountByUserID failed", "error", err)
+			return
+		}
+
+		feverItems := make([]feverItem, len(items))
+		for i, item := range items {
+			feverItems[i] = newFeverItem(item)
+		}
+		response["items"] = feverItems
+		response["total_items"] = totalItems
+	}
+
+	if query.Has("unread_item_ids") || req.FormValue("mark") != "" {
+		ids, err := data.SelectUnreadItemIDsByUserID(ctx, env.pool, userID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("SelectUnreadItemIDsByUserID failed", "error", err)
+			return
+		}
+		response["unread_item_ids"] = joinIDs(ids)
+	}
+
+	if query.Has("saved_item_ids") || req.FormValue("mark") != "" {
+		ids, err := data.SelectStarredItemIDsByUserID(ctx, env.pool, userID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("SelectStarredItemIDsByUserID failed", "error", err)
+			return
+		}
+		response["saved_item_ids"] = joinIDs(ids)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// feverMark applies the mark, as, id, and before parameters of a Fever API write request. Requests for items that do
+// not exist or are already in the requested state are ignored.
+func feverMark(ctx context.Context, req *http.Request, env *environment, userID int32) error {
+	mark := req.FormValue("mark")
+	if mark == "" {
+		return nil
+	}
+
+	id, err := strconv.ParseInt(req.FormValue("id"), 10, 32)
+	if err != nil {
+		return nil
+	}
+	as := req.FormValue("as")
+
+	switch mark {
+	case "item":
+		switch as {
+		case "read":
+			err = data.MarkItemRead(ctx, env.pool, userID, int32(id))
+		case "unread":
+			err = data.MarkItemUnread(ctx, env.pool, userID, int32(id))
+		case "saved":
+			err = data.StarItem(ctx, env.pool, userID, int32(id))
+		case "unsaved":
+			err = data.UnstarItem(ctx, env.pool, userID, int32(id))
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = nil
+		}
+		return err
+	case "feed", "group":
+		if as != "read" {
+			return nil
+		}
+		before := time.Now()
+		if n, err := strconv.ParseInt(req.FormValue("before"), 10, 64); err == nil {
+			before = time.Unix(n, 0)
+		}
+		// Every feed is in the one group and group 0 is the Fever "Kindling" super group of all feeds so marking any
+		// group marks all feeds.
+		var feedID pgtype.Int4
+		if mark == "feed" {
+			feedID = pgtype.Int4{Int32: int32(id), Valid: true}
+		}
+		_, err = data.MarkItemsReadCreatedBefore(ctx, env.pool, userID, feedID, before)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package backend
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeverAPIKey(t *testing.T) {
+	// md5 -s "test:password"
+	require.Equal(t, "8dfcff0c6ef3ab7855c8aabc3f2be2d9", feverAPIKey("test", "password"))
+	require.Equal(t, feverAPIKeyDigest("8dfcff0c6ef3ab7855c8aabc3f2be2d9"), feverAPIKeyDigest("8DFCFF0C6EF3AB7855C8AABC3F2BE2D9"))
+}
+
+func TestFeverHandler(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	userID, err := data.CreateUser(ctx, pool, newUser())
+	require.NoError(t, err)
+
+	otherUser := newUser()
+	otherUser.Name = pgtype.Text{String: "other", Valid: true}
+	otherUserID, err := data.CreateUser(ctx, pool, otherUser)
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(ctx, pool, userID, "http://example.com/feed")
+	require.NoError(t, err)
+	feed, err := data.SelectFeedByURL(ctx, pool, "http://example.com/feed")
+	require.NoError(t, err)
+	_, err = data.UpdateFeedWithFetchSuccess(ctx, pool, feed.ID, &data.ParsedFeed{Name: "Weather", Items: []data.ParsedItem{
+		{URL: "http://example.com/rain", Title: "Rain", Author: "Alice", Content: "Wet <and> cold"},
+		{URL: "http://example.com/snow", Title: "Snow"},
+		{URL: "http://example.com/hail", Title: "Hail"},
+	}}, pgtype.Text{}, time.Now())
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(ctx, pool, otherUserID, "http://example.com/other")
+	require.NoError(t, err)
+	otherFeed, err := data.SelectFeedByURL(ctx, pool, "http://example.com/other")
+	require.NoError(t, err)
+	_, err = data.UpdateFeedWithFetchSuccess(ctx, pool, otherFeed.ID, &data.ParsedFeed{Name: "Other", Items: []data.ParsedItem{
+		{URL: "http://example.com/private", Title: "Private"},
+	}}, pgtype.Text{}, time.Now())
+	require.NoError(t, err)
+
+	var itemIDs []int32
+	rows, _ := pool.Query(ctx, `select id from items where feed_id=$1 order by id`, feed.ID)
+	for rows.Next() {
+		var id int32
+		require.NoError(t, rows.Scan(&id))
+		itemIDs = append(itemIDs, id)
+	}
+	require.NoError(t, rows.Err())
+	require.Len(t, itemIDs, 3)
+
+	// Enable the Fever API through the account endpoint.
+	err = data.InsertSession(ctx, pool, &data.Session{ID: []byte("session"), UserID: userID})
+	require.NoError(t, err)
+	apiRouter := NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	setFeverPassword := func(body string) int {
+		req := httptest.NewRequest("PUT", "http://example.com/account/fever", strings.NewReader(body))
+		req.Header.Set("X-Authentication", hex.EncodeToString([]byte("session")))
+		w := httptest.NewRecorder()
+		apiRouter.ServeHTTP(w, req)
+		return w.Code
+	}
+	require.Equal(t, 422, setFeverPassword(`{"password": "short"}`))
+	require.Equal(t, http.StatusNoContent, setFeverPassword(`{"password": "feverpassword"}`))
+
+	apiKey := feverAPIKey("test", "feverpassword")
+	router := NewFeverHandler(pool, getLogger(t))
+	fever := func(apiKey, query string, form url.Values) map[string]any {
+		if form == nil {
+			form = url.Values{}
+		}
+		form.Set("api_key", apiKey)
+		req := httptest.NewRequest("POST", "http://example.com/?api"+query, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var response map[string]any
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		require.NoError(t, err)
+		require.EqualValues(t, 3, response["api_version"])
+		return response
+	}
+
+	response := fever("wrong", "", nil)
+	require.EqualValues(t, 0, response["auth"])
+	require.NotContains(t, response, "last_refreshed_on_time")
+
+	response = fever(strings.ToUpper(apiKey), "", nil)
+	require.EqualValues(t, 1, response["auth"])
+	require.Contains(t, response, "last_refreshed_on_time")
+
+	response = fever(apiKey, "&groups", nil)
+	require.Equal(t, []any{map[string]any{"id": float64(1), "title": "All"}}, response["groups"])
+	require.Equal(t, []any{map[string]any{"group_id": float64(1), "feed_ids": fmt.Sprint(feed.ID)}}, response["feeds_groups"])
+
+	response = fever(apiKey, "&feeds", nil)
+	feeds := response["feeds"].([]any)
+	require.Len(t, feeds, 1)
+	require.EqualValues(t, feed.ID, feeds[0].(map[string]any)["id"])
+	require.Equal(t, "Weather", feeds[0].(map[string]any)["title"])
+	require.Equal(t, "http://example.com/feed", feeds[0].(map[string]any)["url"])
+
+	itemIDsOf := func(response map[string]any) []int32 {
+		var ids []int32
+		for _, item := range response["items"].([]any) {
+			ids = append(ids, int32(item.(map[string]any)["id"].(float64)))
+		}
+		return ids
+	}
+
+	response = fever(apiKey, "&items", nil)
+	require.Equal(t, itemIDs, itemIDsOf(response))
+	require.EqualValues(t, 3, response["total_items"])
+	rain := response["items"].([]any)[0].(map[string]any)
+	require.EqualValues(t, feed.ID, rain["feed_id"])
+	require.Equal(t, "Rain", rain["title"])
+	require.Equal(t, "Alice", rain["author"])
+	require.Equal(t, "Wet &lt;and&gt; cold", rain["html"])
+	require.Equal(t, "http://example.com/rain", rain["url"])
+	require.EqualValues(t, 0, rain["is_read"])
+	require.EqualValues(t, 0, rain["is_saved"])
+
+	response = fever(apiKey, fmt.Sprintf("&items&since_id=%d", itemIDs[0]), nil)
+	require.Equal(t, itemIDs[1:], itemIDsOf(response))
+
+	response = fever(apiKey, fmt.Sprintf("&items&max_id=%d", itemIDs[2]), nil)
+	require.Equal(t, []int32{itemIDs[1], itemIDs[0]}, itemIDsOf(response))
+
+	response = fever(apiKey, fmt.Sprintf("&items&with_ids=%d,%d", itemIDs[2], itemIDs[0]), nil)
+	require.Equal(t, []int32{itemIDs[0], itemIDs[2]}, itemIDsOf(response))
+
+	response = fever(apiKey, "&unread_item_ids&saved_item_ids", nil)
+	require.Equal(t, joinIDs(itemIDs), response["unread_item_ids"])
+	require.Equal(t, "", response["saved_item_ids"])
+
+	mark := func(mark, as string, id int32) map[string]any {
+		return fever(apiKey, "", url.Values{"mark": {mark}, "as": {as}, "id": {fmt.Sprint(id)}})
+	}
+
+	response = mark("item", "read", itemIDs[0])
+	require.Equal(t, joinIDs(itemIDs[1:]), response["unread_item_ids"])
+
+	// Marking an item that is already read is not an error.
+	response = mark("item", "read", itemIDs[0])
+	require.Equal(t, joinIDs(itemIDs[1:]), response["unread_item_ids"])
+
+	response = mark("item", "unread", itemIDs[0])
+	require.Equal(t, joinIDs(itemIDs), response["unread_item_ids"])
+
+	response = mark("item", "saved", itemIDs[1])
+	require.Equal(t, joinIDs(itemIDs[1:2]), response["saved_item_ids"])
+
+	response = fever(apiKey, fmt.Sprintf("&items&with_ids=%d", itemIDs[1]), nil)
+	require.EqualValues(t, 1, response["items"].([]any)[0].(map[string]any)["is_saved"])
+
+	response = mark("item", "unsaved", itemIDs[1])
+	require.Equal(t, "", response["saved_item_ids"])
+
+	// The other user's items can be neither read nor changed.
+	var privateID int32
+	err = pool.QueryRow(ctx, `select id from items where feed_id=$1`, otherFeed.ID).Scan(&privateID)
+	require.NoError(t, err)
+	response = fever(apiKey, fmt.Sprintf("&items&with_ids=%d", privateID), nil)
+	require.Empty(t, response["items"])
+	mark("item", "saved", privateID)
+	starred, err := data.SelectStarredItemIDsByUserID(ctx, pool, userID)
+	require.NoError(t, err)
+	require.Empty(t, starred)
+
+	// Items created after before are not marked read.
+	response = fever(apiKey, "", url.Values{"mark": {"feed"}, "as": {"read"}, "id": {fmt.Sprint(feed.ID)}, "before": {fmt.Sprint(time.Now().Add(-time.Hour).Unix())}})
+	require.Equal(t, joinIDs(itemIDs), response["unread_item_ids"])
+
+	response = fever(apiKey, "", url.Values{"mark": {"group"}, "as": {"read"}, "id": {"0"}, "before": {fmt.Sprint(time.Now().Add(time.Hour).Unix())}})
+	require.Equal(t, "", response["unread_item_ids"])
+
+	otherUnread, err := data.SelectUnreadItemIDsByUserID(ctx, pool, otherUserID)
+	require.NoError(t, err)
+	require.Equal(t, []int32{privateID}, otherUnread)
+}
+
+func TestFeverMarkManyItemsRead(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	userID, err := data.CreateUser(ctx, pool, newUser())
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(ctx, pool, userID, "http://example.com/feed")
+	require.NoError(t, err)
+	feed, err := data.SelectFeedByURL(ctx, pool, "http://example.com/feed")
+	require.NoError(t, err)
+
+	// The items_read notification must stay under the PostgreSQL payload limit no matter how many items are marked.
+	items := make([]data.ParsedItem, 3000)
+	for i := range items {
+		items[i] = data.ParsedItem{URL: fmt.Sprintf("http://example.com/%d", i), Title: fmt.Sprint(i)}
+	}
+	_, err = data.UpdateFeedWithFetchSuccess(ctx, pool, feed.ID, &data.ParsedFeed{Name: "Many", Items: items}, pgtype.Text{}, time.Now())
+	require.NoError(t, err)
+
+	n, err := data.MarkItemsReadCreatedBefore(ctx, pool, userID, pgtype.Int4{}, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.EqualValues(t, 3000, n)
+
+	unread, err := data.SelectUnreadItemIDsByUserID(ctx, pool, userID)
+	require.NoError(t, err)
+	require.Empty(t, unread)
+}
@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"encoding/json"
@@ -14,13 +15,14 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/jackc/pgxutil"
 	"github.com/jackc/tpr/backend/data"
 	log "gopkg.in/inconshreveable/log15.v2"
 )
@@ -29,15 +31,51 @@ type HTTPConfig struct {
 	ListenAddress string
 	ListenPort    string
 	StaticURL     string
+	SessionPolicy SessionPolicy
+
+	// SecureCookies restricts session cookies to HTTPS.
+	SecureCookies bool
+
+	// WebAuthn enables passkey login when not nil.
+	WebAuthn *webauthn.WebAuthn
+
+	// OIDC enables single sign-on with an OpenID Connect provider when not nil.
+	OIDC *OIDCAuthenticator
+
+	// ProxyAuth enables authentication by a reverse proxy when not nil.
+	ProxyAuth *ProxyAuthConfig
+
+	// PasswordResetLifetime is how long the token in a password reset mail works. DefaultPasswordResetLifetime is used
+	// when 0.
+	PasswordResetLifetime time.Duration
 }
 
+// DefaultPasswordResetLifetime is how long a password reset token works when HTTPConfig.PasswordResetLifetime is 0.
+const DefaultPasswordResetLifetime = time.Hour
+
 type EnvHandlerFunc func(w http.ResponseWriter, req *http.Request, env *environment)
 
-func EnvHandler(pool *pgxpool.Pool, mailer Mailer, logger log.Logger, f EnvHandlerFunc) http.Handler {
+// EnvHandler builds a per request environment from baseEnv and the requesting user. The user is authenticated by an
+// API token in the Authorization header or otherwise by a session or trusted proxy.
+func EnvHandler(baseEnv *environment, f EnvHandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		user := getUserFromSession(req, pool)
-		env := &environment{user: user, pool: pool, mailer: mailer, logger: logger}
-		f(w, req, env)
+		env := *baseEnv
+		if token, ok := bearerToken(req); ok {
+			env.user, env.apiToken = getUserFromAPIToken(&env, token)
+			if env.user != nil && !apiTokenAllows(env.apiToken, req.Method) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, "API token is read-only")
+				return
+			}
+		} else {
+			env.user, env.sessionID = getUserFromSession(w, req, &env)
+			if env.user != nil && !checkCSRF(req, env.sessionID) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, "Bad or missing X-CSRF-Token header")
+				return
+			}
+		}
+		f(w, req, &env)
 	})
 }
 
@@ -45,7 +83,32 @@ func AuthenticatedHandler(f EnvHandlerFunc) EnvHandlerFunc {
 	return EnvHandlerFunc(func(w http.ResponseWriter, req *http.Request, env *environment) {
 		if env.user == nil {
 			w.WriteHeader(http.StatusForbidden)
-			fmt.Fprint(w, "Bad or missing X-Authentication header")
+			fmt.Fprint(w, "Bad or missing session")
+			return
+		}
+		f(w, req, env)
+	})
+}
+
+// SessionAuthenticatedHandler only allows requests authenticated by a session. It protects account management from
+// API tokens.
+func SessionAuthenticatedHandler(f EnvHandlerFunc) EnvHandlerFunc {
+	return AuthenticatedHandler(func(w http.ResponseWriter, req *http.Request, env *environment) {
+		if env.sessionID == nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "API tokens cannot be used for this request")
+			return
+		}
+		f(w, req, env)
+	})
+}
+
+// AdminHandler only allows requests from administrators authenticated by a session.
+func AdminHandler(f EnvHandlerFunc) EnvHandlerFunc {
+	return SessionAuthenticatedHandler(func(w http.ResponseWriter, req *http.Request, env *environment) {
+		if !env.user.IsAdmin {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "Administrator role required")
 			return
 		}
 		f(w, req, env)
@@ -58,7 +121,7 @@ type AppServer struct {
 	server     *http.Server
 }
 
-func NewAppServer(httpConfig HTTPConfig, pool *pgxpool.Pool, mailer Mailer, logger log.Logger) (*AppServer, error) {
+func NewAppServer(httpConfig HTTPConfig, pool *pgxpool.Pool, mailer Mailer, feedUpdater *FeedUpdater, logger log.Logger) (*AppServer, error) {
 	r := chi.NewRouter()
 
 	if httpConfig.StaticURL != "" {
@@ -69,9 +132,15 @@ func NewAppServer(httpConfig HTTPConfig, pool *pgxpool.Pool, mailer Mailer, logg
 		r.Handle("/*", httputil.NewSingleHostReverseProxy(staticURL))
 	}
 
-	apiHandler := NewAPIHandler(pool, mailer, logger.New("module", "http"))
+	apiHandler := NewAPIHandler(pool, mailer, feedUpdater, httpConfig, logger.New("module", "http"))
 	r.Mount("/api", apiHandler)
 
+	webSubHandler := NewWebSubHandler(pool, feedUpdater, logger.New("module", "websub"))
+	r.Mount("/websub", webSubHandler)
+
+	feverHandler := NewFeverHandler(pool, logger.New("module", "fever"))
+	r.Mount("/fever", feverHandler)
+
 	return &AppServer{
 		handler:    r,
 		httpConfig: httpConfig,
@@ -84,10 +153,14 @@ func (s *AppServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (s *AppServer) Serve() error {
 	listenAt := fmt.Sprintf("%s:%s", s.httpConfig.ListenAddress, s.httpConfig.ListenPort)
+	// Request contexts are canceled on shutdown so long-lived event streams do not hold up a graceful shutdown.
+	baseCtx, cancel := context.WithCancel(context.Background())
 	s.server = &http.Server{
-		Addr:    listenAt,
-		Handler: s.handler,
+		Addr:        listenAt,
+		Handler:     s.handler,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
 	}
+	s.server.RegisterOnShutdown(cancel)
 
 	fmt.Printf("Starting to listen on: %s\n", listenAt)
 
@@ -110,31 +183,110 @@ func (s *AppServer) Shutdown(ctx context.Context) error {
 }
 
 type environment struct {
-	user   *data.User
-	pool   *pgxpool.Pool
-	logger log.Logger
-	mailer Mailer
+	user           *data.User
+	sessionID      []byte
+	apiToken       *data.APIToken
+	sessionPolicy  SessionPolicy
+	secureCookies  bool
+	pool           *pgxpool.Pool
+	logger         log.Logger
+	mailer         Mailer
+	feedUpdater    *FeedUpdater
+	refreshLimiter *refreshLimiter
+	eventBroker    *eventBroker
+
+	authRateLimiter *authRateLimiter
+	webAuthn        *webauthn.WebAuthn
+	oidc            *OIDCAuthenticator
+	proxyAuth       *ProxyAuthConfig
+
+	passwordResetLifetime time.Duration
 }
 
-func NewAPIHandler(pool *pgxpool.Pool, mailer Mailer, logger log.Logger) chi.Router {
+func NewAPIHandler(pool *pgxpool.Pool, mailer Mailer, feedUpdater *FeedUpdater, httpConfig HTTPConfig, logger log.Logger) chi.Router {
 	router := chi.NewRouter()
 
-	router.Method("POST", "/register", EnvHandler(pool, mailer, logger, RegisterHandler))
-	router.Method("POST", "/sessions", EnvHandler(pool, mailer, logger, CreateSessionHandler))
-	router.Method("DELETE", "/sessions/{id}", EnvHandler(pool, mailer, logger, AuthenticatedHandler(DeleteSessionHandler)))
-	router.Method("POST", "/subscriptions", EnvHandler(pool, mailer, logger, AuthenticatedHandler(CreateSubscriptionHandler)))
-	router.Method("DELETE", "/subscriptions/{id}", EnvHandler(pool, mailer, logger, AuthenticatedHandler(DeleteSubscriptionHandler)))
-	router.Method("POST", "/request_password_reset", EnvHandler(pool, mailer, logger, RequestPasswordResetHandler))
-	router.Method("POST", "/reset_password", EnvHandler(pool, mailer, logger, ResetPasswordHandler))
-	router.Method("GET", "/feeds", EnvHandler(pool, mailer, logger, AuthenticatedHandler(GetFeedsHandler)))
-	router.Method("POST", "/feeds/import", EnvHandler(pool, mailer, logger, AuthenticatedHandler(ImportFeedsHandler)))
-	router.Method("GET", "/feeds.xml", EnvHandler(pool, mailer, logger, AuthenticatedHandler(ExportFeedsHandler)))
-	router.Method("GET", "/items/unread", EnvHandler(pool, mailer, logger, AuthenticatedHandler(GetUnreadItemsHandler)))
-	router.Method("POST", "/items/unread/mark_multiple_read", EnvHandler(pool, mailer, logger, AuthenticatedHandler(MarkMultipleItemsReadHandler)))
-	router.Method("DELETE", "/items/unread/{id}", EnvHandler(pool, mailer, logger, AuthenticatedHandler(MarkItemReadHandler)))
-	router.Method("GET", "/items/archived", EnvHandler(pool, mailer, logger, AuthenticatedHandler(GetArchivedItemsHandler)))
-	router.Method("GET", "/account", EnvHandler(pool, mailer, logger, AuthenticatedHandler(GetAccountHandler)))
-	router.Method("PATCH", "/account", EnvHandler(pool, mailer, logger, AuthenticatedHandler(UpdateAccountHandler)))
+	env := &environment{
+		sessionPolicy:  httpConfig.SessionPolicy,
+		secureCookies:  httpConfig.SecureCookies,
+		pool:           pool,
+		mailer:         mailer,
+		logger:         logger,
+		feedUpdater:    feedUpdater,
+		refreshLimiter: newRefreshLimiter(time.Minute),
+		eventBroker:    newEventBroker(pool, logger),
+
+		authRateLimiter: newAuthRateLimiter(pool, logger),
+		webAuthn:        httpConfig.WebAuthn,
+		oidc:            httpConfig.OIDC,
+		proxyAuth:       httpConfig.ProxyAuth,
+	}
+	env.passwordResetLifetime = httpConfig.PasswordResetLifetime
+	if env.passwordResetLifetime == 0 {
+		env.passwordResetLifetime = DefaultPasswordResetLifetime
+	}
+
+	router.Method("POST", "/register", EnvHandler(env, RegisterHandler))
+	router.Method("GET", "/sessions", EnvHandler(env, SessionAuthenticatedHandler(GetSessionsHandler)))
+	router.Method("POST", "/sessions", EnvHandler(env, CreateSessionHandler))
+	router.Method("DELETE", "/sessions", EnvHandler(env, SessionAuthenticatedHandler(DeleteOtherSessionsHandler)))
+	router.Method("DELETE", "/sessions/{id}", EnvHandler(env, SessionAuthenticatedHandler(DeleteSessionHandler)))
+	router.Method("POST", "/subscriptions", EnvHandler(env, AuthenticatedHandler(CreateSubscriptionHandler)))
+	router.Method("DELETE", "/subscriptions/{id}", EnvHandler(env, AuthenticatedHandler(DeleteSubscriptionHandler)))
+	router.Method("POST", "/request_password_reset", EnvHandler(env, RequestPasswordResetHandler))
+	router.Method("POST", "/reset_password", EnvHandler(env, ResetPasswordHandler))
+	router.Method("POST", "/verify_email", EnvHandler(env, VerifyEmailHandler))
+	router.Method("GET", "/feeds", EnvHandler(env, AuthenticatedHandler(GetFeedsHandler)))
+	router.Method("GET", "/feeds/{id}/fetches", EnvHandler(env, AuthenticatedHandler(GetFeedFetchesHandler)))
+	router.Method("POST", "/feeds/{id}/refresh", EnvHandler(env, AuthenticatedHandler(RefreshFeedHandler)))
+	router.Method("POST", "/feeds/import", EnvHandler(env, AuthenticatedHandler(ImportFeedsHandler)))
+	router.Method("GET", "/feeds.xml", EnvHandler(env, AuthenticatedHandler(ExportFeedsHandler)))
+	router.Method("GET", "/items/unread", EnvHandler(env, AuthenticatedHandler(GetUnreadItemsHandler)))
+	router.Method("POST", "/items/unread/mark_multiple_read", EnvHandler(env, AuthenticatedHandler(MarkMultipleItemsReadHandler)))
+	router.Method("DELETE", "/items/unread/{id}", EnvHandler(env, AuthenticatedHandler(MarkItemReadHandler)))
+	router.Method("GET", "/items/archived", EnvHandler(env, AuthenticatedHandler(GetArchivedItemsHandler)))
+	router.Method("GET", "/events", EnvHandler(env, AuthenticatedHandler(GetEventsHandler)))
+	router.Method("GET", "/account/digest", EnvHandler(env, AuthenticatedHandler(GetDigestSettingHandler)))
+	router.Method("PUT", "/account/digest", EnvHandler(env, AuthenticatedHandler(UpdateDigestSettingHandler)))
+	router.Method("GET", "/rules", EnvHandler(env, AuthenticatedHandler(GetItemRulesHandler)))
+	router.Method("POST", "/rules", EnvHandler(env, AuthenticatedHandler(CreateItemRuleHandler)))
+	router.Method("POST", "/rules/preview", EnvHandler(env, AuthenticatedHandler(PreviewItemRuleHandler)))
+	router.Method("PUT", "/rules/{id}", EnvHandler(env, AuthenticatedHandler(UpdateItemRuleHandler)))
+	router.Method("DELETE", "/rules/{id}", EnvHandler(env, AuthenticatedHandler(DeleteItemRuleHandler)))
+	router.Method("GET", "/account", EnvHandler(env, AuthenticatedHandler(GetAccountHandler)))
+	router.Method("PATCH", "/account", EnvHandler(env, SessionAuthenticatedHandler(UpdateAccountHandler)))
+	router.Method("POST", "/account/email_verification", EnvHandler(env, SessionAuthenticatedHandler(CreateEmailVerificationHandler)))
+	router.Method("PUT", "/account/fever", EnvHandler(env, SessionAuthenticatedHandler(SetFeverPasswordHandler)))
+	router.Method("DELETE", "/account/fever", EnvHandler(env, SessionAuthenticatedHandler(DeleteFeverPasswordHandler)))
+	router.Method("GET", "/account/two_factor", EnvHandler(env, SessionAuthenticatedHandler(GetTwoFactorHandler)))
+	router.Method("DELETE", "/account/two_factor", EnvHandler(env, SessionAuthenticatedHandler(DeleteTwoFactorHandler)))
+	router.Method("POST", "/account/two_factor/totp", EnvHandler(env, SessionAuthenticatedHandler(CreateTOTPHandler)))
+	router.Method("POST", "/account/two_factor/totp/confirm", EnvHandler(env, SessionAuthenticatedHandler(ConfirmTOTPHandler)))
+	router.Method("POST", "/account/two_factor/recovery_codes", EnvHandler(env, SessionAuthenticatedHandler(CreateRecoveryCodesHandler)))
+	router.Method("GET", "/account/tokens", EnvHandler(env, SessionAuthenticatedHandler(GetAPITokensHandler)))
+	router.Method("POST", "/account/tokens", EnvHandler(env, SessionAuthenticatedHandler(CreateAPITokenHandler)))
+	router.Method("DELETE", "/account/tokens/{id}", EnvHandler(env, SessionAuthenticatedHandler(DeleteAPITokenHandler)))
+	router.Method("GET", "/admin/users", EnvHandler(env, AdminHandler(GetAdminUsersHandler)))
+	router.Method("POST", "/admin/users", EnvHandler(env, AdminHandler(CreateAdminUserHandler)))
+	router.Method("PATCH", "/admin/users/{id}", EnvHandler(env, AdminHandler(UpdateAdminUserHandler)))
+	router.Method("DELETE", "/admin/users/{id}", EnvHandler(env, AdminHandler(DeleteAdminUserHandler)))
+	router.Method("PUT", "/admin/users/{id}/password", EnvHandler(env, AdminHandler(SetAdminUserPasswordHandler)))
+	router.Method("DELETE", "/admin/users/{id}/sessions", EnvHandler(env, AdminHandler(DeleteAdminUserSessionsHandler)))
+	router.Method("GET", "/admin/feeds", EnvHandler(env, AdminHandler(GetAdminFeedsHandler)))
+
+	if env.webAuthn != nil {
+		router.Method("POST", "/webauthn/registration/begin", EnvHandler(env, SessionAuthenticatedHandler(BeginWebAuthnRegistrationHandler)))
+		router.Method("POST", "/webauthn/registration/finish", EnvHandler(env, SessionAuthenticatedHandler(FinishWebAuthnRegistrationHandler)))
+		router.Method("POST", "/webauthn/login/begin", EnvHandler(env, BeginWebAuthnLoginHandler))
+		router.Method("POST", "/webauthn/login/finish", EnvHandler(env, FinishWebAuthnLoginHandler))
+		router.Method("GET", "/account/passkeys", EnvHandler(env, SessionAuthenticatedHandler(GetWebAuthnCredentialsHandler)))
+		router.Method("DELETE", "/account/passkeys/{id}", EnvHandler(env, SessionAuthenticatedHandler(DeleteWebAuthnCredentialHandler)))
+	}
+	if env.oidc != nil {
+		router.Method("GET", "/oidc", EnvHandler(env, GetOIDCHandler))
+		router.Method("GET", "/oidc/login", EnvHandler(env, OIDCLoginHandler))
+		router.Method("GET", "/oidc/callback", EnvHandler(env, OIDCCallbackHandler))
+	}
 
 	// Register test endpoints if TEST_ENDPOINTS environment variable is set
 	if os.Getenv("TEST_ENDPOINTS") == "true" {
@@ -144,25 +296,117 @@ func NewAPIHandler(pool *pgxpool.Pool, mailer Mailer, logger log.Logger) chi.Rou
 	return router
 }
 
-func getUserFromSession(req *http.Request, pool *pgxpool.Pool) *data.User {
-	token := req.Header.Get("X-Authentication")
-	if token == "" {
-		token = req.FormValue("session")
+// getUserFromSession returns the user and session ID of the request's session. It returns nil for both if the request
+// does not have a session or the session has expired under env.sessionPolicy. When proxy authentication is enabled,
+// requests from a trusted proxy are instead authenticated by the user name the proxy sends.
+func getUserFromSession(w http.ResponseWriter, req *http.Request, env *environment) (*data.User, []byte) {
+	if name, ok := env.proxyAuth.remoteUser(req); ok {
+		return getUserFromProxy(w, req, env, name)
 	}
 
-	var sessionID []byte
-	sessionID, err := hex.DecodeString(token)
-	if err != nil {
-		return nil
+	return getUserFromSessionID(req, env)
+}
+
+// getUserFromSessionID returns the user and session ID of the session identified by the request.
+func getUserFromSessionID(req *http.Request, env *environment) (*data.User, []byte) {
+	sessionID, _ := sessionIDFromRequest(req)
+	if sessionID == nil {
+		return nil, nil
 	}
 
+	now := time.Now()
+	idleCutoff, absoluteCutoff := env.sessionPolicy.Cutoffs(now)
+
 	// TODO - this could be an error from no records found -- or the connection could be dead or we could have a syntax error...
-	user, err := data.SelectUserBySessionID(context.Background(), pool, sessionID)
+	user, err := data.SelectUserBySessionID(context.Background(), env.pool, sessionID, idleCutoff, absoluteCutoff)
+	if err != nil || user.Disabled {
+		return nil, nil
+	}
+
+	// Failing to record use only makes an idle session expire sooner so the error is ignored.
+	data.TouchSession(context.Background(), env.pool, sessionID, now, newStringFallback(req.UserAgent()), remoteIP(req))
+
+	return user, sessionID
+}
+
+// remoteIP returns the IP address req was made from. It returns the zero netip.Addr if req.RemoteAddr cannot be
+// parsed.
+func remoteIP(req *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
-		return nil
+		return netip.Addr{}
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	return addr
+}
+
+// auditLog records event for userID in the audit log. Failures are logged but otherwise ignored so they do not prevent
+// the action being audited.
+func auditLog(req *http.Request, env *environment, event string, userID int32, details map[string]any) {
+	err := data.InsertAuditLogEntry(context.Background(), env.pool, &data.AuditLogEntry{
+		Event:     event,
+		UserID:    pgtype.Int4{Int32: userID, Valid: true},
+		IP:        remoteIP(req),
+		Details:   details,
+		EventTime: time.Now(),
+	})
+	if err != nil {
+		env.logger.Error("InsertAuditLogEntry failed", "event", event, "error", err)
+	}
+}
+
+// createSession creates a new session for userID and returns its ID.
+func createSession(req *http.Request, env *environment, userID int32) ([]byte, error) {
+	sessionID, err := genSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	err = data.InsertSession(context.Background(),
+		env.pool,
+		&data.Session{
+			ID:        sessionID,
+			UserID:    userID,
+			UserAgent: newStringFallback(req.UserAgent()),
+			IP:        remoteIP(req),
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessionID, nil
+}
+
+// writeNewSession creates a session for user and responds with status, the session cookies, and the user name and
+// session ID.
+func writeNewSession(w http.ResponseWriter, req *http.Request, env *environment, user *data.User, status int) {
+	sessionID, err := createSession(req, env, user.ID.Int32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("createSession failed", "error", err)
+		return
+	}
+
+	setSessionCookies(w, env, sessionID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	var response struct {
+		Name      string `json:"name"`
+		SessionID string `json:"sessionID"`
 	}
 
-	return user
+	response.Name = user.Name.String
+	response.SessionID = hex.EncodeToString(sessionID)
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(response)
 }
 
 func newStringFallback(value string) pgtype.Text {
@@ -223,24 +467,23 @@ func RegisterHandler(w http.ResponseWriter, req *http.Request, env *environment)
 		}
 	}
 
-	sessionID, err := genSessionID()
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	// The account is usable before the address is confirmed. It just cannot receive password reset mail yet. Without mail
+	// the address stays unverified.
+	if user.Email.Valid && env.mailer != nil {
+		err = requestEmailVerification(req, env, userID, user.Email.String)
+		if err != nil {
+			env.logger.Error("requestEmailVerification failed", "error", err)
+		}
 	}
 
-	err = data.InsertSession(context.Background(),
-		env.pool,
-		&data.Session{
-			ID:     sessionID,
-			UserID: userID,
-		},
-	)
+	sessionID, err := createSession(req, env, userID)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("createSession failed", "error", err)
 		return
 	}
 
+	setSessionCookies(w, env, sessionID)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 
@@ -274,6 +517,12 @@ func CreateSubscriptionHandler(w http.ResponseWriter, req *http.Request, env *en
 		return
 	}
 
+	if err := validateFeedURL(subscription.URL); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, `Invalid "url": %v`, err)
+		return
+	}
+
 	if err := data.InsertSubscription(context.Background(), env.pool, env.user.ID.Int32, subscription.URL); err != nil {
 		w.WriteHeader(422)
 		fmt.Fprintln(w, `Bad user name or password`)
@@ -302,8 +551,10 @@ func DeleteSubscriptionHandler(w http.ResponseWriter, req *http.Request, env *en
 
 func CreateSessionHandler(w http.ResponseWriter, req *http.Request, env *environment) {
 	var credentials struct {
-		Name     string `json:"name"`
-		Password string `json:"password"`
+		Name         string `json:"name"`
+		Password     string `json:"password"`
+		TOTPCode     string `json:"totpCode"`
+		RecoveryCode string `json:"recoveryCode"`
 	}
 
 	decoder := json.NewDecoder(req.Body)
@@ -325,67 +576,136 @@ func CreateSessionHandler(w http.ResponseWriter, req *http.Request, env *environ
 		return
 	}
 
-	user, err := data.SelectUserByName(context.Background(), env.pool, credentials.Name)
-	if err != nil {
-		w.WriteHeader(422)
-		fmt.Fprintln(w, "Bad user name or password")
+	if !env.authRateLimiter.allow(w, req, env, data.AuthActionLogin, credentials.Name) {
 		return
 	}
 
-	if !IsPassword(user, credentials.Password) {
+	user, err := data.SelectUserByName(context.Background(), env.pool, credentials.Name)
+	if err != nil || !IsPassword(user, credentials.Password) {
+		if err := env.authRateLimiter.record(context.Background(), data.AuthActionLogin, remoteIP(req), credentials.Name); err != nil {
+			env.logger.Error("authRateLimiter.record failed", "error", err)
+		}
 		w.WriteHeader(422)
 		fmt.Fprintln(w, "Bad user name or password")
 		return
 	}
 
-	sessionID, err := genSessionID()
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if user.Disabled {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "Account is disabled")
 		return
 	}
 
-	err = data.InsertSession(context.Background(),
-		env.pool,
-		&data.Session{
-			ID:     sessionID,
-			UserID: user.ID.Int32,
-		},
-	)
+	totp, err := selectEnabledTOTPCredential(env, user.ID.Int32)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("selectEnabledTOTPCredential failed", "error", err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	if totp != nil {
+		if credentials.TOTPCode == "" && credentials.RecoveryCode == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Two-factor authentication code required")
+			return
+		}
 
-	var response struct {
-		Name      string `json:"name"`
-		SessionID string `json:"sessionID"`
+		ok, err := verifySecondFactor(req, env, totp, credentials.TOTPCode, credentials.RecoveryCode)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("verifySecondFactor failed", "error", err)
+			return
+		}
+		if !ok {
+			if err := env.authRateLimiter.record(context.Background(), data.AuthActionLogin, remoteIP(req), credentials.Name); err != nil {
+				env.logger.Error("authRateLimiter.record failed", "error", err)
+			}
+			w.WriteHeader(422)
+			fmt.Fprintln(w, "Bad two-factor authentication code")
+			return
+		}
 	}
 
-	response.Name = credentials.Name
-	response.SessionID = hex.EncodeToString(sessionID)
+	if err := env.authRateLimiter.forgive(context.Background(), data.AuthActionLogin, credentials.Name); err != nil {
+		env.logger.Error("authRateLimiter.forgive failed", "error", err)
+	}
 
-	encoder := json.NewEncoder(w)
-	encoder.Encode(response)
+	// A failed rehash leaves the old hash in place which still works so the login proceeds.
+	if err := rehashPasswordIfNeeded(context.Background(), env.pool, user, credentials.Password); err != nil {
+		env.logger.Error("rehashPasswordIfNeeded failed", "error", err)
+	}
 
+	writeNewSession(w, req, env, user, http.StatusCreated)
 }
 
+// DeleteSessionHandler deletes the session with the id in the URL. An id of "current" deletes the session making the
+// request. Clients authenticated by cookie do not know their session ID.
 func DeleteSessionHandler(w http.ResponseWriter, req *http.Request, env *environment) {
-	sessionID, err := hex.DecodeString(chi.URLParam(req, "id"))
+	sessionID := env.sessionID
+	if id := chi.URLParam(req, "id"); id != "current" {
+		var err error
+		sessionID, err = hex.DecodeString(id)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	err := data.DeleteSession(context.Background(), env.pool, env.user.ID.Int32, sessionID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	clearSessionCookies(w, env)
+}
+
+type sessionJSON struct {
+	Current      bool       `json:"current"`
+	StartTime    time.Time  `json:"startTime"`
+	LastSeenTime time.Time  `json:"lastSeenTime"`
+	UserAgent    string     `json:"userAgent"`
+	IPAddress    netip.Addr `json:"ipAddress"`
+}
+
+// GetSessionsHandler responds with the user's active sessions. Session IDs are credentials so they are not included.
+func GetSessionsHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	idleCutoff, absoluteCutoff := env.sessionPolicy.Cutoffs(time.Now())
+	sessions, err := data.SelectActiveSessionsByUserID(context.Background(), env.pool, env.user.ID.Int32, idleCutoff, absoluteCutoff)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectActiveSessionsByUserID failed", "error", err)
 		return
 	}
-	err = data.DeleteSession(context.Background(), env.pool, sessionID)
+
+	response := make([]sessionJSON, len(sessions))
+	for i, s := range sessions {
+		response[i] = sessionJSON{
+			Current:      bytes.Equal(s.ID, env.sessionID),
+			StartTime:    s.StartTime,
+			LastSeenTime: s.LastSeenTime,
+			UserAgent:    s.UserAgent.String,
+			IPAddress:    s.IP,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteOtherSessionsHandler revokes all of the user's sessions except the one making the request.
+func DeleteOtherSessionsHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	_, err := data.DeleteSessionsByUserID(context.Background(), env.pool, env.user.ID.Int32, env.sessionID)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("DeleteSessionsByUserID failed", "error", err)
 		return
 	}
 
-	cookie := &http.Cookie{Name: "sessionId", Value: "logged out", Expires: time.Unix(0, 0)}
-	http.SetCookie(w, cookie)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func GetUnreadItemsHandler(w http.ResponseWriter, req *http.Request, env *environment) {
@@ -433,6 +753,46 @@ func MarkMultipleItemsReadHandler(w http.ResponseWriter, req *http.Request, env
 	}
 }
 
+// eventHeartbeatInterval is how often a comment is sent on idle event streams so proxies do not close them.
+const eventHeartbeatInterval = 30 * time.Second
+
+// GetEventsHandler streams changes to the user's unread items as server-sent events until the client disconnects.
+func GetEventsHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	rc := http.NewResponseController(w)
+
+	events, unsubscribe := env.eventBroker.subscribe(env.user.ID.Int32)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 5000\n\n")
+	if err := rc.Flush(); err != nil {
+		env.logger.Error("event stream flush failed", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case e := <-events:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data)
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
 func GetArchivedItemsHandler(w http.ResponseWriter, req *http.Request, env *environment) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := data.CopyArchivedItemsAsJSONByUserID(context.Background(), env.pool, w, env.user.ID.Int32); err != nil {
@@ -469,7 +829,10 @@ func ImportFeedsHandler(w http.ResponseWriter, req *http.Request, env *environme
 	for _, outline := range doc.Body.Outlines {
 		go func(outline OpmlOutline) {
 			r := subscriptionResult{Title: outline.Title, URL: outline.URL}
-			err := data.InsertSubscription(context.Background(), env.pool, env.user.ID.Int32, outline.URL)
+			err := validateFeedURL(outline.URL)
+			if err == nil {
+				err = data.InsertSubscription(context.Background(), env.pool, env.user.ID.Int32, outline.URL)
+			}
 			r.Success = err == nil
 			resultsChan <- r
 		}(outline)
@@ -516,104 +879,471 @@ func GetFeedsHandler(w http.ResponseWriter, req *http.Request, env *environment)
 	}
 }
 
-func GetAccountHandler(w http.ResponseWriter, req *http.Request, env *environment) {
-	var user struct {
-		ID    int32  `json:"id"`
-		Name  string `json:"name"`
-		Email string `json:"email"`
-	}
-
-	user.ID = env.user.ID.Int32
-	user.Name = env.user.Name.String
-	user.Email = env.user.Email.String
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
-}
-
-func UpdateAccountHandler(w http.ResponseWriter, req *http.Request, env *environment) {
-	var update struct {
-		Email            string `json:"email"`
-		ExistingPassword string `json:"existingPassword"`
-		NewPassword      string `json:"newPassword"`
+func RefreshFeedHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	feedID, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 32)
+	if err != nil {
+		// If not an integer it clearly can't be found
+		http.NotFound(w, req)
+		return
 	}
 
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&update); err != nil {
-		w.WriteHeader(422)
-		fmt.Fprintf(w, "Error decoding request: %v", err)
+	feed, err := data.SelectSubscribedFeed(context.Background(), env.pool, env.user.ID.Int32, int32(feedID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectSubscribedFeed failed", "error", err)
 		return
 	}
 
-	if !IsPassword(env.user, update.ExistingPassword) {
-		w.WriteHeader(422)
-		fmt.Fprintln(w, "Bad existing password")
+	if allowed, retryAfter := env.refreshLimiter.allow(env.user.ID.Int32, feed.ID, time.Now()); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "Feed was refreshed too recently", http.StatusTooManyRequests)
 		return
 	}
 
-	user, err := data.SelectUserByPK(context.Background(), env.pool, env.user.ID.Int32)
+	result, err := env.feedUpdater.RefreshFeedNow(*feed)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintln(w, `Internal server error`)
-		env.logger.Error("SelectUserByPK", "err", err)
-	}
-
-	user.Email = newStringFallback(update.Email)
-
-	if update.NewPassword != "" {
-		err := SetPassword(user, update.NewPassword)
-		if err != nil {
-			w.WriteHeader(422)
-			fmt.Fprintln(w, err)
+		if errors.Is(err, errFeedClaimed) {
+			http.Error(w, "Feed is already being refreshed", http.StatusConflict)
 			return
 		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("RefreshFeedNow failed", "error", err)
+		return
 	}
+	// Only a refresh that claimed the feed counts toward the limit.
+	env.refreshLimiter.record(env.user.ID.Int32, feed.ID, time.Now())
 
-	err = data.UpdateUser(context.Background(), env.pool, env.user.ID.Int32, user)
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintln(w, `Internal server error`)
-		env.logger.Error("UpdateUser", "err", err)
-	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 
-func RequestPasswordResetHandler(w http.ResponseWriter, req *http.Request, env *environment) {
-	attrs := map[string]any{
-		"request_time": time.Now(),
+func GetFeedFetchesHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	feedID, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 32)
+	if err != nil {
+		// If not an integer it clearly can't be found
+		http.NotFound(w, req)
+		return
 	}
 
-	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		if addr, err := netip.ParseAddr(host); err == nil {
-			attrs["request_ip"] = addr
+	feed, err := data.SelectSubscribedFeed(context.Background(), env.pool, env.user.ID.Int32, int32(feedID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
 		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectSubscribedFeed failed", "error", err)
+		return
 	}
 
-	token, err := genLostPasswordToken()
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintln(w, `Internal server error`)
-		env.logger.Error("getLostPasswordToken failed", "error", err)
-		return
+	w.Header().Set("Content-Type", "application/json")
+	if err := data.CopyFeedFetchesAsJSON(context.Background(), env.pool, w, feed.ID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
-	attrs["token"] = token
+}
 
-	var reset struct {
-		Email string `json:"email"`
+type itemRuleJSON struct {
+	ID        int32       `json:"id"`
+	Name      string      `json:"name"`
+	FeedID    pgtype.Int4 `json:"feedID"`
+	Field     string      `json:"field"`
+	MatchType string      `json:"matchType"`
+	Pattern   string      `json:"pattern"`
+	Action    string      `json:"action"`
+	Tag       pgtype.Text `json:"tag"`
+}
+
+func newItemRuleJSON(rule *data.ItemRule) *itemRuleJSON {
+	return &itemRuleJSON{
+		ID:        rule.ID,
+		Name:      rule.Name,
+		FeedID:    rule.FeedID,
+		Field:     rule.Field,
+		MatchType: rule.MatchType,
+		Pattern:   rule.Pattern,
+		Action:    rule.Action,
+		Tag:       rule.Tag,
 	}
+}
 
+// decodeItemRule decodes and validates the rule in the request body. If the rule is invalid it writes the error
+// response and returns nil.
+func decodeItemRule(w http.ResponseWriter, req *http.Request, env *environment) *data.ItemRule {
+	var request itemRuleJSON
 	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&reset); err != nil {
+	if err := decoder.Decode(&request); err != nil {
 		w.WriteHeader(422)
 		fmt.Fprintf(w, "Error decoding request: %v", err)
-		return
+		return nil
 	}
-	if reset.Email == "" {
-		w.WriteHeader(422)
-		fmt.Fprint(w, "Error decoding request: missing email")
+
+	rule := &data.ItemRule{
+		UserID:    env.user.ID.Int32,
+		Name:      request.Name,
+		FeedID:    request.FeedID,
+		Field:     request.Field,
+		MatchType: request.MatchType,
+		Pattern:   request.Pattern,
+		Action:    request.Action,
+		Tag:       request.Tag,
+	}
+
+	if rule.Name == "" {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `Request must include the attribute "name"`)
+		return nil
+	}
+
+	switch rule.Field {
+	case data.ItemRuleFieldTitle, data.ItemRuleFieldContent, data.ItemRuleFieldTitleOrContent, data.ItemRuleFieldAuthor:
+	default:
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `"field" must be one of "title", "content", "title_or_content" or "author"`)
+		return nil
+	}
+
+	if strings.TrimSpace(rule.Pattern) == "" {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `Request must include the attribute "pattern"`)
+		return nil
+	}
+
+	switch rule.MatchType {
+	case data.ItemRuleMatchKeywords:
+		rule.Regex = keywordsRegex(rule.Pattern)
+	case data.ItemRuleMatchRegex:
+		rule.Regex = rule.Pattern
+	default:
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `"matchType" must be one of "keywords" or "regex"`)
+		return nil
+	}
+
+	switch rule.Action {
+	case data.ItemRuleActionSkipUnread, data.ItemRuleActionStar:
+		rule.Tag = pgtype.Text{}
+	case data.ItemRuleActionTag:
+		if !rule.Tag.Valid || strings.TrimSpace(rule.Tag.String) == "" {
+			w.WriteHeader(422)
+			fmt.Fprintln(w, `Request must include the attribute "tag" when "action" is "tag"`)
+			return nil
+		}
+		rule.Tag.String = strings.TrimSpace(rule.Tag.String)
+	default:
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `"action" must be one of "skip_unread", "star" or "tag"`)
+		return nil
+	}
+
+	if err := data.ValidateRegex(context.Background(), env.pool, rule.Regex); err != nil {
+		if errors.Is(err, data.ErrInvalidRegex) {
+			w.WriteHeader(422)
+			fmt.Fprintf(w, `Invalid "pattern": %v`, err)
+			return nil
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("ValidateRegex failed", "error", err)
+		return nil
+	}
+
+	if rule.FeedID.Valid {
+		_, err := data.SelectSubscribedFeed(context.Background(), env.pool, env.user.ID.Int32, rule.FeedID.Int32)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				w.WriteHeader(422)
+				fmt.Fprintln(w, `"feedID" must be a subscribed feed`)
+				return nil
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("SelectSubscribedFeed failed", "error", err)
+			return nil
+		}
+	}
+
+	return rule
+}
+
+func GetItemRulesHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	rules, err := data.SelectItemRulesByUserID(context.Background(), env.pool, env.user.ID.Int32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectItemRulesByUserID failed", "error", err)
+		return
+	}
+
+	response := make([]*itemRuleJSON, len(rules))
+	for i, rule := range rules {
+		response[i] = newItemRuleJSON(rule)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func CreateItemRuleHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	rule := decodeItemRule(w, req, env)
+	if rule == nil {
+		return
+	}
+
+	if err := data.InsertItemRule(context.Background(), env.pool, rule); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("InsertItemRule failed", "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newItemRuleJSON(rule))
+}
+
+func UpdateItemRuleHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	ruleID, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 32)
+	if err != nil {
+		// If not an integer it clearly can't be found
+		http.NotFound(w, req)
+		return
+	}
+
+	rule := decodeItemRule(w, req, env)
+	if rule == nil {
+		return
+	}
+	rule.ID = int32(ruleID)
+
+	if err := data.UpdateItemRule(context.Background(), env.pool, rule); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("UpdateItemRule failed", "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newItemRuleJSON(rule))
+}
+
+func DeleteItemRuleHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	ruleID, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 32)
+	if err != nil {
+		// If not an integer it clearly can't be found
+		http.NotFound(w, req)
+		return
+	}
+
+	if err := data.DeleteItemRule(context.Background(), env.pool, env.user.ID.Int32, int32(ruleID)); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("DeleteItemRule failed", "error", err)
+		return
+	}
+}
+
+// itemRulePreviewSize is the number of recent items a rule is tested against by PreviewItemRuleHandler.
+const itemRulePreviewSize = 500
+
+// PreviewItemRuleHandler responds with the recent items that the rule in the request body matches. The rule is not
+// saved.
+func PreviewItemRuleHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	rule := decodeItemRule(w, req, env)
+	if rule == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := data.CopyItemRuleMatchesAsJSON(context.Background(), env.pool, w, env.user.ID.Int32, rule, itemRulePreviewSize); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("CopyItemRuleMatchesAsJSON failed", "error", err)
+	}
+}
+
+func GetAccountHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	writeAccount(w, env, env.user)
+}
+
+// writeAccount responds with user's account. pendingEmail is the address of an email change that has not been
+// confirmed yet.
+func writeAccount(w http.ResponseWriter, env *environment, user *data.User) {
+	var account struct {
+		ID            int32  `json:"id"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"emailVerified"`
+		PendingEmail  string `json:"pendingEmail,omitempty"`
+		IsAdmin       bool   `json:"isAdmin"`
+	}
+
+	account.ID = user.ID.Int32
+	account.Name = user.Name.String
+	account.Email = user.Email.String
+	account.EmailVerified = user.EmailVerified
+	account.IsAdmin = user.IsAdmin
+
+	pending, err := data.SelectPendingEmailVerification(context.Background(), env.pool, user.ID.Int32, time.Now().Add(-emailVerificationLifetime))
+	if err == nil {
+		account.PendingEmail = pending.Email
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectPendingEmailVerification failed", "error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(account)
+}
+
+func UpdateAccountHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var update struct {
+		Email            string `json:"email"`
+		ExistingPassword string `json:"existingPassword"`
+		NewPassword      string `json:"newPassword"`
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&update); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if !IsPassword(env.user, update.ExistingPassword) {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Bad existing password")
+		return
+	}
+
+	user, err := data.SelectUserByPK(context.Background(), env.pool, env.user.ID.Int32)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, `Internal server error`)
+		env.logger.Error("SelectUserByPK", "err", err)
+		return
+	}
+
+	// A new address only takes effect once it is confirmed so a typo cannot redirect password reset mail. Removing the
+	// address needs no confirmation.
+	if update.Email != user.Email.String {
+		if update.Email == "" {
+			user.Email = pgtype.Text{}
+			user.EmailVerified = false
+			err = data.DeletePendingEmailVerifications(context.Background(), env.pool, user.ID.Int32)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintln(w, `Internal server error`)
+				env.logger.Error("DeletePendingEmailVerifications", "err", err)
+				return
+			}
+		} else {
+			if env.mailer == nil {
+				w.WriteHeader(422)
+				fmt.Fprintln(w, "Email address changes must be confirmed by mail, but mail is not configured on this server")
+				return
+			}
+
+			_, err := data.SelectUserByEmail(context.Background(), env.pool, update.Email)
+			if err == nil {
+				w.WriteHeader(422)
+				fmt.Fprint(w, `"email" is already taken`)
+				return
+			} else if !errors.Is(err, pgx.ErrNoRows) {
+				w.WriteHeader(500)
+				fmt.Fprintln(w, `Internal server error`)
+				env.logger.Error("SelectUserByEmail", "err", err)
+				return
+			}
+
+			if !allowEmailVerification(w, req, env) {
+				return
+			}
+
+			err = requestEmailVerification(req, env, user.ID.Int32, update.Email)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintln(w, `Internal server error`)
+				env.logger.Error("requestEmailVerification", "err", err)
+				return
+			}
+		}
+	}
+
+	if update.NewPassword != "" {
+		err := SetPassword(user, update.NewPassword)
+		if err != nil {
+			w.WriteHeader(422)
+			fmt.Fprintln(w, err)
+			return
+		}
+	}
+
+	err = data.UpdateUser(context.Background(), env.pool, env.user.ID.Int32, user)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, `Internal server error`)
+		env.logger.Error("UpdateUser", "err", err)
+		return
+	}
+
+	// A password change signs out everywhere else in case the old password was compromised.
+	if update.NewPassword != "" {
+		_, err = data.DeleteSessionsByUserID(context.Background(), env.pool, env.user.ID.Int32, env.sessionID)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintln(w, `Internal server error`)
+			env.logger.Error("DeleteSessionsByUserID", "err", err)
+			return
+		}
+	}
+
+	writeAccount(w, env, user)
+}
+
+func RequestPasswordResetHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	token, err := genLostPasswordToken()
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, `Internal server error`)
+		env.logger.Error("getLostPasswordToken failed", "error", err)
+		return
+	}
+
+	var reset struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&reset); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+	if reset.Email == "" {
+		w.WriteHeader(422)
+		fmt.Fprint(w, "Error decoding request: missing email")
+		return
+	}
+
+	if !env.authRateLimiter.allow(w, req, env, data.AuthActionPasswordReset, reset.Email) {
 		return
 	}
+	if err := env.authRateLimiter.record(context.Background(), data.AuthActionPasswordReset, remoteIP(req), reset.Email); err != nil {
+		env.logger.Error("authRateLimiter.record failed", "error", err)
+	}
 
-	attrs["email"] = reset.Email
+	pwr := &data.PasswordReset{
+		TokenDigest: tokenDigest(token),
+		Email:       reset.Email,
+		RequestIP:   remoteIP(req),
+		RequestTime: time.Now(),
+	}
 
 	user, err := data.SelectUserByEmail(context.Background(), env.pool, reset.Email)
 	if err != nil {
@@ -624,11 +1354,16 @@ func RequestPasswordResetHandler(w http.ResponseWriter, req *http.Request, env *
 		}
 	}
 
+	// Only addresses confirmed by their owner receive password reset mail.
+	if user != nil && !user.EmailVerified {
+		user = nil
+	}
+
 	if user != nil {
-		attrs["user_id"] = user.ID
+		pwr.UserID = user.ID
 	}
 
-	err = pgxutil.InsertRow(context.Background(), env.pool, "password_resets", attrs)
+	err = data.InsertPasswordReset(context.Background(), env.pool, pwr)
 	if err != nil {
 		w.WriteHeader(500)
 		fmt.Fprintln(w, `Internal server error`)
@@ -637,7 +1372,7 @@ func RequestPasswordResetHandler(w http.ResponseWriter, req *http.Request, env *
 	}
 
 	if user == nil {
-		env.logger.Warn("Password reset requested for missing email", "email", reset.Email)
+		env.logger.Warn("Password reset requested for missing or unverified email", "email", reset.Email)
 		return
 	}
 
@@ -657,10 +1392,14 @@ func RequestPasswordResetHandler(w http.ResponseWriter, req *http.Request, env *
 	}
 }
 
+// ResetPasswordHandler sets the password of the user the password reset token in the request was mailed to. A token
+// works once and only within env.passwordResetLifetime. All of the user's sessions are revoked.
 func ResetPasswordHandler(w http.ResponseWriter, req *http.Request, env *environment) {
 	var resetPassword struct {
-		Token    string `json:"token"`
-		Password string `json:"password"`
+		Token        string `json:"token"`
+		Password     string `json:"password"`
+		TOTPCode     string `json:"totpCode"`
+		RecoveryCode string `json:"recoveryCode"`
 	}
 
 	decoder := json.NewDecoder(req.Body)
@@ -670,66 +1409,119 @@ func ResetPasswordHandler(w http.ResponseWriter, req *http.Request, env *environ
 		return
 	}
 
-	pwr, err := data.SelectPasswordResetByPK(context.Background(), env.pool, resetPassword.Token)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			w.WriteHeader(404)
-			return
-		}
+	digest := tokenDigest(resetPassword.Token)
+	requestedAfter := time.Now().Add(-env.passwordResetLifetime)
 
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error decoding request: %v", err)
+	pwr, err := data.SelectPasswordResetByPK(context.Background(), env.pool, digest)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectPasswordResetByPK failed", "error", err)
 		return
 	}
 
-	if !pwr.UserID.Valid {
-		w.WriteHeader(404)
+	if pwr == nil || !pwr.UserID.Valid || pwr.CompletionTime.Valid || !pwr.RequestTime.After(requestedAfter) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "Password reset link is invalid or expired")
 		return
 	}
 
-	if pwr.CompletionTime.Valid {
-		w.WriteHeader(404)
+	if err := validatePassword(resetPassword.Password); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, err)
 		return
 	}
 
-	attrs, err := data.SelectUserByPK(context.Background(), env.pool, pwr.UserID.Int32)
+	user, err := data.SelectUserByPK(context.Background(), env.pool, pwr.UserID.Int32)
 	if err != nil {
 		w.WriteHeader(500)
 		fmt.Fprintln(w, `Internal server error`)
 		env.logger.Error("SelectUserByPK", "err", err)
+		return
 	}
-	SetPassword(attrs, resetPassword.Password)
 
-	err = data.UpdateUser(context.Background(), env.pool, pwr.UserID.Int32, attrs)
-	if err != nil {
-		w.WriteHeader(500)
+	if user.Disabled {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "Account is disabled")
 		return
 	}
 
-	user, err := data.SelectUserByPK(context.Background(), env.pool, pwr.UserID.Int32)
+	// Access to the user's email must not be enough to get past two-factor authentication. The reset token is kept so
+	// the request can be repeated with a code.
+	totp, err := selectEnabledTOTPCredential(env, user.ID.Int32)
 	if err != nil {
-		w.WriteHeader(500)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("selectEnabledTOTPCredential failed", "error", err)
 		return
 	}
 
-	sessionID, err := genSessionID()
+	if totp != nil {
+		if resetPassword.TOTPCode == "" && resetPassword.RecoveryCode == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Two-factor authentication code required")
+			return
+		}
+
+		if !env.authRateLimiter.allow(w, req, env, data.AuthActionLogin, user.Name.String) {
+			return
+		}
+
+		ok, err := verifySecondFactor(req, env, totp, resetPassword.TOTPCode, resetPassword.RecoveryCode)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("verifySecondFactor failed", "error", err)
+			return
+		}
+		if !ok {
+			if err := env.authRateLimiter.record(context.Background(), data.AuthActionLogin, remoteIP(req), user.Name.String); err != nil {
+				env.logger.Error("authRateLimiter.record failed", "error", err)
+			}
+			w.WriteHeader(422)
+			fmt.Fprintln(w, "Bad two-factor authentication code")
+			return
+		}
+	}
+
+	SetPassword(user, resetPassword.Password)
+
+	// Completing the reset in the same transaction as the update ensures a token cannot be used twice even by concurrent
+	// requests.
+	err = pgx.BeginFunc(context.Background(), env.pool, func(tx pgx.Tx) error {
+		_, err := data.CompletePasswordReset(context.Background(), tx, digest, requestedAfter, remoteIP(req), time.Now())
+		if err != nil {
+			return err
+		}
+
+		err = data.UpdateUser(context.Background(), tx, user.ID.Int32, user)
+		if err != nil {
+			return err
+		}
+
+		// Whoever knew the old password may still be signed in.
+		_, err = data.DeleteSessionsByUserID(context.Background(), tx, user.ID.Int32, nil)
+		return err
+	})
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "Password reset link is invalid or expired")
+			return
+		}
+
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("ResetPassword failed", "error", err)
 		return
 	}
 
-	err = data.InsertSession(context.Background(),
-		env.pool,
-		&data.Session{
-			ID:     sessionID,
-			UserID: user.ID.Int32,
-		},
-	)
+	auditLog(req, env, "password_reset", user.ID.Int32, nil)
+
+	sessionID, err := createSession(req, env, user.ID.Int32)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("createSession failed", "error", err)
 		return
 	}
 
+	setSessionCookies(w, env, sessionID)
 	w.Header().Set("Content-Type", "application/json")
 
 	var response struct {
@@ -743,3 +1535,409 @@ func ResetPasswordHandler(w http.ResponseWriter, req *http.Request, env *environ
 	encoder := json.NewEncoder(w)
 	encoder.Encode(response)
 }
+
+// SetFeverPasswordHandler enables the Fever API for the user with the password in the request. Fever clients log in
+// with the user name and this password. It may differ from the account password. The stored key is derived from the
+// current user name, so it must be set again if the name changes.
+func SetFeverPasswordHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if err := validatePassword(request.Password); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	digest := feverAPIKeyDigest(feverAPIKey(env.user.Name.String, request.Password))
+	if err := data.SetFeverAPIKeyDigest(context.Background(), env.pool, env.user.ID.Int32, digest); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SetFeverAPIKeyDigest failed", "error", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteFeverPasswordHandler disables the Fever API for the user.
+func DeleteFeverPasswordHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	if err := data.SetFeverAPIKeyDigest(context.Background(), env.pool, env.user.ID.Int32, nil); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SetFeverAPIKeyDigest failed", "error", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetTwoFactorHandler reports whether two-factor authentication is enabled and how many recovery codes remain.
+func GetTwoFactorHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	totp, err := selectEnabledTOTPCredential(env, env.user.ID.Int32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("selectEnabledTOTPCredential failed", "error", err)
+		return
+	}
+
+	var response struct {
+		Enabled                bool  `json:"enabled"`
+		RecoveryCodesRemaining int64 `json:"recoveryCodesRemaining"`
+	}
+
+	if totp != nil {
+		response.Enabled = true
+		response.RecoveryCodesRemaining, err = data.SelectUnusedRecoveryCodeCount(context.Background(), env.pool, env.user.ID.Int32)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("SelectUnusedRecoveryCodeCount failed", "error", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateTOTPHandler starts enrolling in TOTP two-factor authentication. It returns a new secret and its otpauth URI for
+// an authenticator app. Two-factor authentication is not enabled until a code is confirmed with ConfirmTOTPHandler.
+func CreateTOTPHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if !IsPassword(env.user, request.Password) {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Bad password")
+		return
+	}
+
+	secret, err := genTOTPSecret()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("genTOTPSecret failed", "error", err)
+		return
+	}
+
+	err = data.InsertPendingTOTPCredential(context.Background(), env.pool, env.user.ID.Int32, secret)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintln(w, "Two-factor authentication is already enabled")
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("InsertPendingTOTPCredential failed", "error", err)
+		return
+	}
+
+	var response struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	response.Secret = encodeTOTPSecret(secret)
+	response.URI = totpURI(env.user.Name.String, secret)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ConfirmTOTPHandler enables two-factor authentication when the request has a valid code for the pending secret. The
+// response is the only time the recovery codes are available.
+func ConfirmTOTPHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	totp, err := data.SelectTOTPCredential(context.Background(), env.pool, env.user.ID.Int32)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectTOTPCredential failed", "error", err)
+		return
+	}
+
+	if totp.Enabled() {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, "Two-factor authentication is already enabled")
+		return
+	}
+
+	ok, err := verifySecondFactor(req, env, totp, request.Code, "")
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("verifySecondFactor failed", "error", err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Bad two-factor authentication code")
+		return
+	}
+
+	codes, digests, err := genRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("genRecoveryCodes failed", "error", err)
+		return
+	}
+
+	err = data.ConfirmTOTPCredential(context.Background(), env.pool, env.user.ID.Int32, digests)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("ConfirmTOTPCredential failed", "error", err)
+		return
+	}
+
+	auditLog(req, env, "two_factor_enabled", env.user.ID.Int32, nil)
+
+	writeRecoveryCodes(w, codes)
+}
+
+// CreateRecoveryCodesHandler replaces the user's recovery codes with new ones. The response is the only time the codes
+// are available.
+func CreateRecoveryCodesHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if !IsPassword(env.user, request.Password) {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Bad password")
+		return
+	}
+
+	totp, err := selectEnabledTOTPCredential(env, env.user.ID.Int32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("selectEnabledTOTPCredential failed", "error", err)
+		return
+	}
+	if totp == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	codes, digests, err := genRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("genRecoveryCodes failed", "error", err)
+		return
+	}
+
+	err = data.ReplaceRecoveryCodes(context.Background(), env.pool, env.user.ID.Int32, digests)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("ReplaceRecoveryCodes failed", "error", err)
+		return
+	}
+
+	writeRecoveryCodes(w, codes)
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	var response struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+
+	response.RecoveryCodes = codes
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteTwoFactorHandler disables two-factor authentication. The request must include the password and a current code
+// or recovery code.
+func DeleteTwoFactorHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if !IsPassword(env.user, request.Password) {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Bad password")
+		return
+	}
+
+	totp, err := selectEnabledTOTPCredential(env, env.user.ID.Int32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("selectEnabledTOTPCredential failed", "error", err)
+		return
+	}
+
+	if totp != nil {
+		ok, err := verifySecondFactor(req, env, totp, request.Code, request.RecoveryCode)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("verifySecondFactor failed", "error", err)
+			return
+		}
+		if !ok {
+			w.WriteHeader(422)
+			fmt.Fprintln(w, "Bad two-factor authentication code")
+			return
+		}
+	}
+
+	err = data.DeleteTwoFactor(context.Background(), env.pool, env.user.ID.Int32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("DeleteTwoFactor failed", "error", err)
+		return
+	}
+
+	if totp != nil {
+		auditLog(req, env, "two_factor_disabled", env.user.ID.Int32, nil)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type apiTokenJSON struct {
+	ID           int32              `json:"id"`
+	Name         string             `json:"name"`
+	Scope        string             `json:"scope"`
+	CreationTime time.Time          `json:"creationTime"`
+	LastUsedTime pgtype.Timestamptz `json:"lastUsedTime"`
+	Token        string             `json:"token,omitempty"`
+}
+
+func newAPITokenJSON(t *data.APIToken) apiTokenJSON {
+	return apiTokenJSON{
+		ID:           t.ID,
+		Name:         t.Name,
+		Scope:        t.Scope,
+		CreationTime: t.CreationTime,
+		LastUsedTime: t.LastUsedTime,
+	}
+}
+
+func GetAPITokensHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	tokens, err := data.SelectAPITokensByUserID(context.Background(), env.pool, env.user.ID.Int32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectAPITokensByUserID failed", "error", err)
+		return
+	}
+
+	response := make([]apiTokenJSON, len(tokens))
+	for i, t := range tokens {
+		response[i] = newAPITokenJSON(t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateAPITokenHandler creates an API token. The response is the only time the token itself is available.
+func CreateAPITokenHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if request.Name == "" {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `Request must include the attribute "name"`)
+		return
+	}
+
+	switch request.Scope {
+	case data.APITokenScopeReadOnly, data.APITokenScopeReadWrite:
+	default:
+		w.WriteHeader(422)
+		fmt.Fprintf(w, `"scope" must be "%s" or "%s"`, data.APITokenScopeReadOnly, data.APITokenScopeReadWrite)
+		return
+	}
+
+	token, err := genAPIToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("genAPIToken failed", "error", err)
+		return
+	}
+
+	apiToken := &data.APIToken{
+		UserID:      env.user.ID.Int32,
+		Name:        request.Name,
+		TokenDigest: tokenDigest(token),
+		Scope:       request.Scope,
+	}
+	if err := data.InsertAPIToken(context.Background(), env.pool, apiToken); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("InsertAPIToken failed", "error", err)
+		return
+	}
+
+	response := newAPITokenJSON(apiToken)
+	response.Token = token
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func DeleteAPITokenHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	id, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 32)
+	if err != nil {
+		// If not an integer it clearly can't be found
+		http.NotFound(w, req)
+		return
+	}
+
+	err = data.DeleteAPIToken(context.Background(), env.pool, env.user.ID.Int32, int32(id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("DeleteAPIToken failed", "error", err)
+		return
+	}
+}
@@ -1,8 +1,10 @@
 package backend
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,17 +12,22 @@ import (
 	"net/http/httptest"
 	"net/netip"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	log15adapter "github.com/jackc/pgx-log15"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgx/v5/tracelog"
 	"github.com/jackc/tpr/backend/data"
+	"github.com/jackc/tpr/backend/pwhash"
 	"github.com/jackc/tpr/test/testdata"
 	"github.com/stretchr/testify/require"
 	"github.com/vaughan0/go-ini"
+	"golang.org/x/crypto/scrypt"
 	log "gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -127,7 +134,7 @@ func newConnPool(t testing.TB) *pgxpool.Pool {
 
 // Empty all data in the entire database
 func empty(pool *pgxpool.Pool) error {
-	tables := []string{"feeds", "items", "password_resets", "sessions", "subscriptions", "unread_items", "users"}
+	tables := []string{"api_tokens", "audit_log", "auth_attempts", "digest_settings", "email_verifications", "feeds", "feed_fetches", "item_rules", "item_tags", "items", "oidc_identities", "password_resets", "recovery_codes", "sessions", "starred_items", "subscriptions", "totp_credentials", "unread_items", "users", "webauthn_ceremonies", "webauthn_credentials", "websub_subscriptions"}
 	for _, table := range tables {
 		_, err := pool.Exec(context.Background(), fmt.Sprintf("delete from %s", table))
 		if err != nil {
@@ -141,10 +148,9 @@ func TestExportOPML(t *testing.T) {
 	pool := newConnPool(t)
 
 	userID, err := data.CreateUser(context.Background(), pool, &data.User{
-		Name:           pgtype.Text{String: "test", Valid: true},
-		Email:          pgtype.Text{String: "test@example.com", Valid: true},
-		PasswordDigest: []byte("digest"),
-		PasswordSalt:   []byte("salt"),
+		Name:         pgtype.Text{String: "test", Valid: true},
+		Email:        pgtype.Text{String: "test@example.com", Valid: true},
+		PasswordHash: "$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$ZGlnZXN0",
 	})
 	require.NoError(t, err)
 
@@ -173,6 +179,652 @@ func TestExportOPML(t *testing.T) {
 	}
 }
 
+func TestRefreshFeedHandler(t *testing.T) {
+	pool := newConnPool(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?>
+<rss>
+  <channel>
+    <title>News</title>
+    <item>
+      <title>Snow Storm</title>
+      <link>http://example.org/snow-storm</link>
+    </item>
+  </channel>
+</rss>`))
+	}))
+	defer ts.Close()
+
+	userID, err := data.CreateUser(context.Background(), pool, newUser())
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(context.Background(), pool, userID, ts.URL)
+	require.NoError(t, err)
+
+	feed, err := data.SelectFeedByURL(context.Background(), pool, ts.URL)
+	require.NoError(t, err)
+
+	env := &environment{
+		pool:           pool,
+		logger:         getLogger(t),
+		feedUpdater:    newTestFeedUpdater(pool, getLogger(t)),
+		refreshLimiter: newRefreshLimiter(time.Minute),
+	}
+	env.user = &data.User{ID: pgtype.Int4{Int32: userID, Valid: true}}
+
+	refresh := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://example.com/", nil)
+		require.NoError(t, err)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", strconv.FormatInt(int64(feed.ID), 10))
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+		w := httptest.NewRecorder()
+		RefreshFeedHandler(w, req, env)
+		return w
+	}
+
+	// A refresh that finds the feed already claimed does not count toward the limit.
+	claimed, err := data.ClaimFeed(context.Background(), pool, feed.ID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	w := refresh()
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	err = data.ReleaseFeedClaim(context.Background(), pool, feed.ID)
+	require.NoError(t, err)
+
+	w = refresh()
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var result FeedRefreshResult
+	err = json.NewDecoder(w.Body).Decode(&result)
+	require.NoError(t, err)
+	require.Equal(t, FeedRefreshSuccess, result.Status)
+	require.Equal(t, 1, result.NewItemCount)
+
+	w = refresh()
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	require.NoError(t, err)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", strconv.FormatInt(int64(feed.ID), 10))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	w = httptest.NewRecorder()
+	GetFeedFetchesHandler(w, req, env)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var fetches []struct {
+		HTTPStatus   int32  `json:"http_status"`
+		ETagHit      bool   `json:"etag_hit"`
+		NewItemCount int32  `json:"new_item_count"`
+		Error        string `json:"error"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&fetches)
+	require.NoError(t, err)
+	require.Len(t, fetches, 1)
+	require.EqualValues(t, 200, fetches[0].HTTPStatus)
+	require.False(t, fetches[0].ETagHit)
+	require.EqualValues(t, 1, fetches[0].NewItemCount)
+	require.Empty(t, fetches[0].Error)
+}
+
+func TestGetEventsHandler(t *testing.T) {
+	pool := newConnPool(t)
+
+	userID, err := data.CreateUser(context.Background(), pool, newUser())
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(context.Background(), pool, userID, "http://example.com/feed")
+	require.NoError(t, err)
+
+	feed, err := data.SelectFeedByURL(context.Background(), pool, "http://example.com/feed")
+	require.NoError(t, err)
+
+	env := &environment{
+		pool:        pool,
+		logger:      getLogger(t),
+		eventBroker: newEventBroker(pool, getLogger(t)),
+	}
+	env.user = &data.User{ID: pgtype.Int4{Int32: userID, Valid: true}}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		GetEventsHandler(w, req, env)
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	type sse struct {
+		name string
+		data string
+	}
+
+	events := make(chan sse)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		var e sse
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && e.name != "":
+				events <- e
+				e = sse{}
+			}
+		}
+		close(events)
+	}()
+
+	nextEvent := func() sse {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return sse{}
+		}
+	}
+
+	// The listener has started once resync is received.
+	require.Equal(t, "resync", nextEvent().name)
+
+	update := &data.ParsedFeed{Name: "News", Items: []data.ParsedItem{
+		{URL: "http://example.com/snow-storm", Title: "Snow Storm"},
+		{URL: "http://example.com/blizzard", Title: "Blizzard"},
+	}}
+	_, err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feed.ID, update, pgtype.Text{}, time.Now())
+	require.NoError(t, err)
+
+	e := nextEvent()
+	require.Equal(t, "items_created", e.name)
+	require.JSONEq(t, fmt.Sprintf(`{"feedID": %d, "count": 2}`, feed.ID), e.data)
+
+	var itemID int32
+	err = pool.QueryRow(context.Background(), "select id from items where url='http://example.com/blizzard'").Scan(&itemID)
+	require.NoError(t, err)
+
+	err = data.MarkItemRead(context.Background(), pool, userID, itemID)
+	require.NoError(t, err)
+
+	e = nextEvent()
+	require.Equal(t, "items_read", e.name)
+	require.JSONEq(t, fmt.Sprintf(`{"itemIDs": [%d]}`, itemID), e.data)
+}
+
+func TestItemRuleHandlers(t *testing.T) {
+	pool := newConnPool(t)
+
+	userID, err := data.CreateUser(context.Background(), pool, newUser())
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(context.Background(), pool, userID, "http://example.com/feed")
+	require.NoError(t, err)
+
+	feed, err := data.SelectFeedByURL(context.Background(), pool, "http://example.com/feed")
+	require.NoError(t, err)
+
+	update := &data.ParsedFeed{Name: "News", Items: []data.ParsedItem{
+		{URL: "http://example.com/snow-storm", Title: "Snow Storm"},
+		{URL: "http://example.com/blizzard", Title: "Blizzard"},
+	}}
+	_, err = data.UpdateFeedWithFetchSuccess(context.Background(), pool, feed.ID, update, pgtype.Text{}, time.Now())
+	require.NoError(t, err)
+
+	env := &environment{pool: pool, logger: getLogger(t)}
+	env.user = &data.User{ID: pgtype.Int4{Int32: userID, Valid: true}}
+
+	serve := func(handler EnvHandlerFunc, method, id, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://example.com/", strings.NewReader(body))
+		require.NoError(t, err)
+		if id != "" {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", id)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, req, env)
+		return w
+	}
+
+	invalidRules := []string{
+		`{"field": "title", "matchType": "keywords", "pattern": "snow", "action": "star"}`,
+		`{"name": "Snow", "field": "body", "matchType": "keywords", "pattern": "snow", "action": "star"}`,
+		`{"name": "Snow", "field": "title", "matchType": "glob", "pattern": "snow", "action": "star"}`,
+		`{"name": "Snow", "field": "title", "matchType": "regex", "pattern": "(snow", "action": "star"}`,
+		`{"name": "Snow", "field": "title", "matchType": "keywords", "pattern": "snow", "action": "delete"}`,
+		`{"name": "Snow", "field": "title", "matchType": "keywords", "pattern": "snow", "action": "tag"}`,
+		`{"name": "Snow", "feedID": -1, "field": "title", "matchType": "keywords", "pattern": "snow", "action": "star"}`,
+	}
+	for _, body := range invalidRules {
+		w := serve(CreateItemRuleHandler, "POST", "", body)
+		require.Equal(t, 422, w.Code, body)
+	}
+
+	w := serve(PreviewItemRuleHandler, "POST", "", `{"name": "Snow", "field": "title", "matchType": "keywords", "pattern": "snow", "action": "star"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var matches []struct {
+		URL string `json:"url"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&matches)
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	require.Equal(t, "http://example.com/snow-storm", matches[0].URL)
+
+	body := fmt.Sprintf(`{"name": "Snow", "feedID": %d, "field": "title", "matchType": "keywords", "pattern": "snow", "action": "tag", "tag": "weather"}`, feed.ID)
+	w = serve(CreateItemRuleHandler, "POST", "", body)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var rule itemRuleJSON
+	err = json.NewDecoder(w.Body).Decode(&rule)
+	require.NoError(t, err)
+	require.NotZero(t, rule.ID)
+	require.Equal(t, feed.ID, rule.FeedID.Int32)
+	require.Equal(t, "weather", rule.Tag.String)
+	ruleID := strconv.FormatInt(int64(rule.ID), 10)
+
+	w = serve(UpdateItemRuleHandler, "PUT", ruleID, `{"name": "Blizzard", "field": "title", "matchType": "regex", "pattern": "^bliz", "action": "skip_unread"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(UpdateItemRuleHandler, "PUT", "0", `{"name": "Blizzard", "field": "title", "matchType": "regex", "pattern": "^bliz", "action": "skip_unread"}`)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serve(GetItemRulesHandler, "GET", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var rules []itemRuleJSON
+	err = json.NewDecoder(w.Body).Decode(&rules)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	require.Equal(t, "Blizzard", rules[0].Name)
+	require.False(t, rules[0].FeedID.Valid)
+	require.Equal(t, "skip_unread", rules[0].Action)
+	require.False(t, rules[0].Tag.Valid)
+
+	w = serve(DeleteItemRuleHandler, "DELETE", ruleID, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(DeleteItemRuleHandler, "DELETE", ruleID, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestSessionHandlers(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := newUser()
+	SetPassword(user, "password")
+	userID, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = pool.Exec(ctx, `insert into sessions (id, user_id, start_time, last_seen_time, user_agent, ip) values
+('current', $1, $2, $2, null, null), ('other', $1, $2, $2, 'Other Agent', '198.51.100.1'), ('idle', $1, $3, $3, null, null)`,
+		userID, now.Add(-time.Hour), now.Add(-10*24*time.Hour))
+	require.NoError(t, err)
+
+	router := NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: SessionPolicy{IdleLifetime: 24 * time.Hour}}, getLogger(t))
+	do := func(method, path, sessionID, body string) *httptest.ResponseRecorder {
+		// httptest.NewRequest uses a RemoteAddr of 192.0.2.1:1234.
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		req.Header.Set("X-Authentication", hex.EncodeToString([]byte(sessionID)))
+		req.Header.Set("User-Agent", "Test Agent")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "/sessions", "idle", "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("GET", "/sessions", "current", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var sessions []struct {
+		Current   bool   `json:"current"`
+		UserAgent string `json:"userAgent"`
+		IPAddress string `json:"ipAddress"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &sessions)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	require.True(t, sessions[0].Current)
+	require.Equal(t, "Test Agent", sessions[0].UserAgent)
+	require.Equal(t, "192.0.2.1", sessions[0].IPAddress)
+	require.False(t, sessions[1].Current)
+	require.Equal(t, "Other Agent", sessions[1].UserAgent)
+	require.Equal(t, "198.51.100.1", sessions[1].IPAddress)
+
+	w = do("DELETE", "/sessions", "current", "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = do("GET", "/sessions", "other", "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("GET", "/sessions", "current", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &sessions)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+
+	_, err = pool.Exec(ctx, `insert into sessions (id, user_id) values ('other', $1)`, userID)
+	require.NoError(t, err)
+
+	w = do("PATCH", "/account", "current", `{"email": "test@example.com", "existingPassword": "password", "newPassword": "bigsecret"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = do("GET", "/sessions", "other", "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("GET", "/sessions", "current", "")
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestSessionCookies(t *testing.T) {
+	pool := newConnPool(t)
+
+	user := newUser()
+	SetPassword(user, "password")
+	_, err := data.CreateUser(context.Background(), pool, user)
+	require.NoError(t, err)
+
+	router := NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy, SecureCookies: true}, getLogger(t))
+	do := func(method, path string, cookies []*http.Cookie, csrf string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(`{"name": "test", "password": "password"}`))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if csrf != "" {
+			req.Header.Set("X-CSRF-Token", csrf)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/sessions", nil, "")
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 2)
+	sessionCookie, csrfCookie := cookies[0], cookies[1]
+	require.Equal(t, "sessionId", sessionCookie.Name)
+	require.True(t, sessionCookie.HttpOnly)
+	require.True(t, sessionCookie.Secure)
+	require.Equal(t, http.SameSiteLaxMode, sessionCookie.SameSite)
+	require.Equal(t, "csrfToken", csrfCookie.Name)
+	require.False(t, csrfCookie.HttpOnly)
+
+	w = do("GET", "/sessions", nil, "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("GET", "/sessions?session="+sessionCookie.Value, nil, "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("GET", "/sessions", []*http.Cookie{sessionCookie}, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = do("DELETE", "/sessions", []*http.Cookie{sessionCookie}, "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("DELETE", "/sessions", []*http.Cookie{sessionCookie}, "wrong")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("DELETE", "/sessions", []*http.Cookie{sessionCookie}, csrfCookie.Value)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = do("DELETE", "/sessions/current", []*http.Cookie{sessionCookie}, csrfCookie.Value)
+	require.Equal(t, http.StatusOK, w.Code)
+	for _, c := range w.Result().Cookies() {
+		require.True(t, c.MaxAge < 0, c.Name)
+	}
+
+	w = do("GET", "/sessions", []*http.Cookie{sessionCookie}, "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestCreateSessionRehashesLegacyPassword(t *testing.T) {
+	pool := newConnPool(t)
+
+	salt := []byte("salt")
+	key, err := scrypt.Key([]byte("password"), salt, 16384, 8, 1, 32)
+	require.NoError(t, err)
+
+	user := newUser()
+	user.PasswordHash = pwhash.EncodeScrypt(14, 8, 1, salt, key)
+	userID, err := data.CreateUser(context.Background(), pool, user)
+	require.NoError(t, err)
+
+	router := NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	req := httptest.NewRequest("POST", "http://example.com/sessions", strings.NewReader(`{"name": "test", "password": "password"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	user, err = data.SelectUserByPK(context.Background(), pool, userID)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(user.PasswordHash, "$argon2id$"), user.PasswordHash)
+	require.False(t, pwhash.NeedsRehash(user.PasswordHash))
+	require.True(t, IsPassword(user, "password"))
+}
+
+func TestAPITokenHandlers(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	userID, err := data.CreateUser(ctx, pool, newUser())
+	require.NoError(t, err)
+
+	err = data.InsertSession(ctx, pool, &data.Session{ID: []byte("session"), UserID: userID})
+	require.NoError(t, err)
+	sessionHeader := http.Header{"X-Authentication": []string{hex.EncodeToString([]byte("session"))}}
+
+	router := NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	do := func(method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/account/tokens", sessionHeader, `{"name": "backup", "scope": "everything"}`)
+	require.Equal(t, 422, w.Code)
+
+	createToken := func(name, scope string) (int32, http.Header) {
+		w := do("POST", "/account/tokens", sessionHeader, `{"name": "`+name+`", "scope": "`+scope+`"}`)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var response struct {
+			ID    int32  `json:"id"`
+			Token string `json:"token"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(response.Token, "tpr_"))
+		return response.ID, http.Header{"Authorization": []string{"Bearer " + response.Token}}
+	}
+
+	_, readOnlyHeader := createToken("reader", data.APITokenScopeReadOnly)
+	readWriteID, readWriteHeader := createToken("writer", data.APITokenScopeReadWrite)
+
+	w = do("GET", "/account/tokens", sessionHeader, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var tokens []map[string]any
+	err = json.Unmarshal(w.Body.Bytes(), &tokens)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	require.Equal(t, "reader", tokens[0]["name"])
+	require.Nil(t, tokens[0]["lastUsedTime"])
+	require.NotContains(t, tokens[0], "token")
+
+	w = do("GET", "/account", readOnlyHeader, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = do("POST", "/subscriptions", readOnlyHeader, `{"url": "http://example.com/feed"}`)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("POST", "/subscriptions", readWriteHeader, `{"url": "http://example.com/feed"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = do("GET", "/account/tokens", readWriteHeader, "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("DELETE", "/sessions/"+hex.EncodeToString([]byte("session")), readWriteHeader, "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("GET", "/account", http.Header{"Authorization": []string{"Bearer tpr_wrong"}}, "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("GET", "/account/tokens", sessionHeader, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &tokens)
+	require.NoError(t, err)
+	require.NotNil(t, tokens[0]["lastUsedTime"])
+
+	w = do("DELETE", fmt.Sprintf("/account/tokens/%d", readWriteID), sessionHeader, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = do("DELETE", fmt.Sprintf("/account/tokens/%d", readWriteID), sessionHeader, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do("GET", "/account", readWriteHeader, "")
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestTwoFactorHandlers(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := newUser()
+	user.Email = pgtype.Text{String: "test@example.com", Valid: true}
+	SetPassword(user, "password")
+	userID, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	err = data.InsertSession(ctx, pool, &data.Session{ID: []byte("session"), UserID: userID})
+	require.NoError(t, err)
+	sessionHeader := http.Header{"X-Authentication": []string{hex.EncodeToString([]byte("session"))}}
+
+	router := NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	do := func(method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/account/two_factor/totp", sessionHeader, `{"password": "wrong"}`)
+	require.Equal(t, 422, w.Code)
+
+	w = do("POST", "/account/two_factor/totp", sessionHeader, `{"password": "password"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &enrollment)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/"))
+	require.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+	cred, err := data.SelectTOTPCredential(ctx, pool, userID)
+	require.NoError(t, err)
+	require.False(t, cred.Enabled())
+	step := totpStep(time.Now())
+
+	// Two-factor authentication is not required until confirmed.
+	w = do("POST", "/sessions", nil, `{"name": "test", "password": "password"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = do("POST", "/account/two_factor/totp/confirm", sessionHeader, `{"code": "000000x"}`)
+	require.Equal(t, 422, w.Code)
+
+	w = do("POST", "/account/two_factor/totp/confirm", sessionHeader, `{"code": "`+totpCode(cred.Secret, step)+`"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var recovery struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &recovery)
+	require.NoError(t, err)
+	require.Len(t, recovery.RecoveryCodes, recoveryCodeCount)
+
+	w = do("POST", "/account/two_factor/totp", sessionHeader, `{"password": "password"}`)
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	w = do("GET", "/account/two_factor", sessionHeader, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, fmt.Sprintf(`{"enabled": true, "recoveryCodesRemaining": %d}`, recoveryCodeCount), w.Body.String())
+
+	w = do("POST", "/sessions", nil, `{"name": "test", "password": "password"}`)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = do("POST", "/sessions", nil, `{"name": "test", "password": "password", "totpCode": "`+totpCode(cred.Secret, step)+`"}`)
+	require.Equal(t, 422, w.Code, "code already used to confirm")
+
+	nextCode := totpCode(cred.Secret, step+1)
+	w = do("POST", "/sessions", nil, `{"name": "test", "password": "password", "totpCode": "`+nextCode+`"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = do("POST", "/sessions", nil, `{"name": "test", "password": "password", "totpCode": "`+nextCode+`"}`)
+	require.Equal(t, 422, w.Code, "replayed code")
+
+	w = do("POST", "/sessions", nil, `{"name": "test", "password": "password", "recoveryCode": "`+strings.ToUpper(recovery.RecoveryCodes[0])+`"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	w = do("POST", "/sessions", nil, `{"name": "test", "password": "password", "recoveryCode": "`+recovery.RecoveryCodes[0]+`"}`)
+	require.Equal(t, 422, w.Code, "used recovery code")
+
+	testdata.CreatePasswordReset(t, pool, ctx, map[string]any{
+		"token":        "0123456789abcdef",
+		"email":        "test@example.com",
+		"user_id":      userID,
+		"request_time": time.Now(),
+	})
+
+	w = do("POST", "/reset_password", nil, `{"token": "0123456789abcdef", "password": "bigsecret"}`)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = do("POST", "/reset_password", nil, `{"token": "0123456789abcdef", "password": "bigsecret", "recoveryCode": "`+recovery.RecoveryCodes[1]+`"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	user, err = data.SelectUserByPK(ctx, pool, userID)
+	require.NoError(t, err)
+	require.True(t, IsPassword(user, "bigsecret"))
+
+	// Resetting the password signed out all sessions.
+	err = data.InsertSession(ctx, pool, &data.Session{ID: []byte("session"), UserID: userID})
+	require.NoError(t, err)
+
+	w = do("DELETE", "/account/two_factor", sessionHeader, `{"password": "bigsecret"}`)
+	require.Equal(t, 422, w.Code)
+
+	w = do("DELETE", "/account/two_factor", sessionHeader, `{"password": "bigsecret", "recoveryCode": "`+recovery.RecoveryCodes[2]+`"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = do("POST", "/sessions", nil, `{"name": "test", "password": "bigsecret"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	rows, _ := pool.Query(ctx, `select event from audit_log where user_id=$1 order by id`, userID)
+	events, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	require.NoError(t, err)
+	require.Equal(t, []string{"two_factor_enabled", "recovery_code_used", "recovery_code_used", "recovery_code_used", "two_factor_disabled"}, events)
+}
+
 func TestGetAccountHandler(t *testing.T) {
 	pool := newConnPool(t)
 	user := &data.User{
@@ -232,6 +884,7 @@ func TestUpdateAccountHandler(t *testing.T) {
 		respCode            int
 		actualEmail         string
 		actualPassword      string
+		sentMailTo          string
 	}{
 		{
 			descr:               "Update email and password",
@@ -239,8 +892,9 @@ func TestUpdateAccountHandler(t *testing.T) {
 			reqExistingPassword: origPassword,
 			reqNewPassword:      "bigsecret",
 			respCode:            200,
-			actualEmail:         "new@example.com",
+			actualEmail:         origEmail,
 			actualPassword:      "bigsecret",
+			sentMailTo:          "new@example.com",
 		},
 		{
 			descr:               "Update email",
@@ -248,7 +902,17 @@ func TestUpdateAccountHandler(t *testing.T) {
 			reqExistingPassword: origPassword,
 			reqNewPassword:      "",
 			respCode:            200,
-			actualEmail:         "new@example.com",
+			actualEmail:         origEmail,
+			actualPassword:      origPassword,
+			sentMailTo:          "new@example.com",
+		},
+		{
+			descr:               "Remove email",
+			reqEmail:            "",
+			reqExistingPassword: origPassword,
+			reqNewPassword:      "",
+			respCode:            200,
+			actualEmail:         "",
 			actualPassword:      origPassword,
 		},
 		{
@@ -303,7 +967,8 @@ func TestUpdateAccountHandler(t *testing.T) {
 			continue
 		}
 
-		env := &environment{user: user, pool: pool, logger: getLogger(t)}
+		mailer := &testMailer{}
+		env := &environment{user: user, pool: pool, logger: getLogger(t), mailer: mailer}
 		w := httptest.NewRecorder()
 		UpdateAccountHandler(w, req, env)
 
@@ -325,15 +990,79 @@ func TestUpdateAccountHandler(t *testing.T) {
 		if !IsPassword(user, tt.actualPassword) {
 			t.Errorf("%s: Expected password to be %s, but it wasn't", tt.descr, tt.actualPassword)
 		}
+
+		// A new email address only takes effect once it is confirmed.
+		sentMails := mailer.sentEmailVerificationMails
+		if tt.sentMailTo == "" {
+			if len(sentMails) != 0 {
+				t.Errorf("%s: Expected to not send any verification mails, instead sent %d", tt.descr, len(sentMails))
+			}
+			continue
+		}
+
+		if len(sentMails) != 1 || sentMails[0].to != tt.sentMailTo {
+			t.Errorf("%s: Expected to send 1 verification mail to %s, instead sent %v", tt.descr, tt.sentMailTo, sentMails)
+			continue
+		}
+
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest("POST", "http://example.com/", strings.NewReader(`{"token": "`+sentMails[0].token+`"}`))
+		VerifyEmailHandler(w, req, env)
+		if w.Code != 200 {
+			t.Errorf("%s: Expected HTTP status %d, instead received %d", tt.descr, 200, w.Code)
+			continue
+		}
+
+		user, err = data.SelectUserByPK(context.Background(), pool, userID)
+		if err != nil {
+			t.Errorf("%s: repo.GetUser returned error: %v", tt.descr, err)
+			continue
+		}
+		if user.Email.String != tt.sentMailTo || !user.EmailVerified {
+			t.Errorf("%s: Expected verified email %s, instead received %s (verified: %v)", tt.descr, tt.sentMailTo, user.Email.String, user.EmailVerified)
+		}
 	}
 }
 
+func TestUpdateAccountHandlerWithoutMail(t *testing.T) {
+	pool := newConnPool(t)
+
+	user := &data.User{
+		Name:  pgtype.Text{String: "test", Valid: true},
+		Email: pgtype.Text{String: "test@example.com", Valid: true},
+	}
+	SetPassword(user, "password")
+	userID, err := data.CreateUser(context.Background(), pool, user)
+	require.NoError(t, err)
+	user, err = data.SelectUserByPK(context.Background(), pool, userID)
+	require.NoError(t, err)
+
+	env := &environment{user: user, pool: pool, logger: getLogger(t)}
+
+	req := httptest.NewRequest("PATCH", "http://example.com/", strings.NewReader(`{"email": "new@example.com", "existingPassword": "password"}`))
+	w := httptest.NewRecorder()
+	UpdateAccountHandler(w, req, env)
+	require.Equal(t, 422, w.Code)
+	require.Contains(t, w.Body.String(), "mail is not configured")
+
+	// Removing the address needs no confirmation so it still works.
+	req = httptest.NewRequest("PATCH", "http://example.com/", strings.NewReader(`{"email": "", "existingPassword": "password"}`))
+	w = httptest.NewRecorder()
+	UpdateAccountHandler(w, req, env)
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	user, err = data.SelectUserByPK(context.Background(), pool, userID)
+	require.NoError(t, err)
+	require.False(t, user.Email.Valid)
+}
+
 func TestRequestPasswordResetHandler(t *testing.T) {
 
 	var tests = []struct {
 		descr      string
 		mailer     *testMailer
 		userEmail  string
+		unverified bool
 		reqEmail   string
 		remoteAddr string
 		remoteHost string
@@ -356,13 +1085,23 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 			remoteHost: "192.168.0.1",
 			sentMailTo: "test@example.com",
 		},
+		{
+			descr:      "Email matches user but is unverified",
+			mailer:     &testMailer{},
+			userEmail:  "test@example.com",
+			unverified: true,
+			reqEmail:   "test@example.com",
+			remoteAddr: "192.168.0.1:54678",
+			remoteHost: "192.168.0.1",
+		},
 	}
 
 	for _, tt := range tests {
 		pool := newConnPool(t)
 		user := &data.User{
-			Name:  pgtype.Text{String: "test", Valid: true},
-			Email: pgtype.Text{String: tt.userEmail, Valid: true},
+			Name:          pgtype.Text{String: "test", Valid: true},
+			Email:         pgtype.Text{String: tt.userEmail, Valid: true},
+			EmailVerified: !tt.unverified,
 		}
 		SetPassword(user, "password")
 
@@ -392,13 +1131,13 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 
 		// Need to reach down pgx because repo interface doesn't need any get
 		// interface besides by token, but for this test we need to know the token
-		var token string
-		err = pool.QueryRow(context.Background(), "select token from password_resets").Scan(&token)
+		var digest []byte
+		err = pool.QueryRow(context.Background(), "select token_digest from password_resets").Scan(&digest)
 		if err != nil {
 			t.Errorf("%s: pool.QueryRow Scan returned error: %v", tt.descr, err)
 			continue
 		}
-		pwr, err := data.SelectPasswordResetByPK(context.Background(), env.pool, token)
+		pwr, err := data.SelectPasswordResetByPK(context.Background(), env.pool, digest)
 		if err != nil {
 			t.Errorf("%s: repo.GetPasswordReset returned error: %v", tt.descr, err)
 			continue
@@ -410,10 +1149,10 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 		if pwr.RequestIP.String() != tt.remoteHost {
 			t.Errorf("%s: PasswordReset.RequestIP should be %s, but instead is %v", tt.descr, tt.remoteHost, pwr.RequestIP.String())
 		}
-		if tt.reqEmail == tt.userEmail && userID != pwr.UserID.Int32 {
+		if tt.sentMailTo != "" && userID != pwr.UserID.Int32 {
 			t.Errorf("%s: PasswordReset.UserID should be %d, but instead is %v", tt.descr, userID, pwr.UserID)
 		}
-		if tt.reqEmail != tt.userEmail && pwr.UserID.Valid {
+		if tt.sentMailTo == "" && pwr.UserID.Valid {
 			t.Errorf("%s: PasswordReset.UserID should be nil, but instead is %v", tt.descr, pwr.UserID)
 		}
 
@@ -433,8 +1172,8 @@ func TestRequestPasswordResetHandler(t *testing.T) {
 		if sentMails[0].to != tt.sentMailTo {
 			t.Errorf("%s: Expected to send reset mail to %s, instead sent it to %s", tt.descr, tt.sentMailTo, sentMails[0].to)
 		}
-		if sentMails[0].token != pwr.Token {
-			t.Errorf("%s: Reset mail (%v) and password reset (%v) do not have the same token", tt.descr, sentMails[0].token, pwr.Token)
+		if !bytes.Equal(tokenDigest(sentMails[0].token), pwr.TokenDigest) {
+			t.Errorf("%s: Reset mail (%v) and password reset (%x) do not have the same token", tt.descr, sentMails[0].token, pwr.TokenDigest)
 		}
 	}
 }
@@ -462,14 +1201,18 @@ func TestResetPasswordHandlerTokenMatchestValidPasswordReset(t *testing.T) {
 		"request_ip":   requestIP,
 	})
 
+	err = data.InsertSession(context.Background(), pool, &data.Session{ID: []byte("existing"), UserID: userID})
+	require.NoError(t, err)
+
 	buf := bytes.NewBufferString(`{"token": "0123456789abcdef", "password": "bigsecret"}`)
 
 	req, err := http.NewRequest("POST", "http://example.com/", buf)
 	if err != nil {
 		t.Fatalf("http.NewRequest returned error: %v", err)
 	}
+	req.RemoteAddr = "127.0.0.1:54678"
 
-	env := &environment{pool: pool}
+	env := &environment{pool: pool, passwordResetLifetime: DefaultPasswordResetLifetime}
 	w := httptest.NewRecorder()
 	ResetPasswordHandler(w, req, env)
 
@@ -495,6 +1238,27 @@ func TestResetPasswordHandlerTokenMatchestValidPasswordReset(t *testing.T) {
 	if err := decoder.Decode(&response); err != nil {
 		t.Errorf("Unable to decode response: %v", err)
 	}
+
+	_, err = data.SelectUserBySessionID(context.Background(), pool, []byte("existing"), pgtype.Timestamptz{}, pgtype.Timestamptz{})
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+
+	sessionID, err := hex.DecodeString(response.SessionID)
+	require.NoError(t, err)
+	_, err = data.SelectUserBySessionID(context.Background(), pool, sessionID, pgtype.Timestamptz{}, pgtype.Timestamptz{})
+	require.NoError(t, err)
+
+	pwr, err := data.SelectPasswordResetByPK(context.Background(), pool, tokenDigest("0123456789abcdef"))
+	require.NoError(t, err)
+	require.True(t, pwr.CompletionTime.Valid)
+	require.True(t, pwr.CompletionIP.IsValid())
+
+	// The token only works once.
+	req, err = http.NewRequest("POST", "http://example.com/", strings.NewReader(`{"token": "0123456789abcdef", "password": "othersecret"}`))
+	require.NoError(t, err)
+	req.RemoteAddr = "127.0.0.1:54678"
+	w = httptest.NewRecorder()
+	ResetPasswordHandler(w, req, env)
+	require.Equal(t, http.StatusNotFound, w.Code)
 }
 
 func TestResetPasswordHandlerTokenMatchestUsedPasswordReset(t *testing.T) {
@@ -529,7 +1293,7 @@ func TestResetPasswordHandlerTokenMatchestUsedPasswordReset(t *testing.T) {
 		t.Fatalf("http.NewRequest returned error: %v", err)
 	}
 
-	env := &environment{pool: pool}
+	env := &environment{pool: pool, passwordResetLifetime: DefaultPasswordResetLifetime}
 	w := httptest.NewRecorder()
 	ResetPasswordHandler(w, req, env)
 
@@ -566,7 +1330,7 @@ func TestResetPasswordHandlerTokenMatchestInvalidPasswordReset(t *testing.T) {
 		t.Fatalf("http.NewRequest returned error: %v", err)
 	}
 
-	env := &environment{pool: pool}
+	env := &environment{pool: pool, passwordResetLifetime: DefaultPasswordResetLifetime}
 	w := httptest.NewRecorder()
 	ResetPasswordHandler(w, req, env)
 
@@ -585,7 +1349,7 @@ func TestResetPasswordHandlerTokenDoesNotMatchPasswordReset(t *testing.T) {
 		t.Fatalf("http.NewRequest returned error: %v", err)
 	}
 
-	env := &environment{pool: pool}
+	env := &environment{pool: pool, passwordResetLifetime: DefaultPasswordResetLifetime}
 	w := httptest.NewRecorder()
 	ResetPasswordHandler(w, req, env)
 
@@ -593,3 +1357,94 @@ func TestResetPasswordHandlerTokenDoesNotMatchPasswordReset(t *testing.T) {
 		t.Errorf("Expected HTTP status %d, instead received %d", 404, w.Code)
 	}
 }
+
+func TestResetPasswordHandlerExpiredPasswordReset(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := &data.User{Name: pgtype.Text{String: "test", Valid: true}}
+	SetPassword(user, "password")
+	userID, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	testdata.CreatePasswordReset(t, pool, ctx, map[string]any{
+		"token":        "0123456789abcdef",
+		"email":        "test@example.com",
+		"user_id":      userID,
+		"request_time": time.Now().Add(-2 * time.Hour),
+	})
+
+	req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader(`{"token": "0123456789abcdef", "password": "bigsecret"}`))
+	require.NoError(t, err)
+
+	env := &environment{pool: pool, passwordResetLifetime: time.Hour}
+	w := httptest.NewRecorder()
+	ResetPasswordHandler(w, req, env)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	user, err = data.SelectUserByPK(ctx, pool, userID)
+	require.NoError(t, err)
+	require.True(t, IsPassword(user, "password"))
+}
+
+func TestResetPasswordHandlerBadPassword(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := &data.User{Name: pgtype.Text{String: "test", Valid: true}}
+	SetPassword(user, "password")
+	userID, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	testdata.CreatePasswordReset(t, pool, ctx, map[string]any{
+		"token":   "0123456789abcdef",
+		"email":   "test@example.com",
+		"user_id": userID,
+	})
+
+	req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader(`{"token": "0123456789abcdef", "password": "short"}`))
+	require.NoError(t, err)
+
+	env := &environment{pool: pool, passwordResetLifetime: DefaultPasswordResetLifetime}
+	w := httptest.NewRecorder()
+	ResetPasswordHandler(w, req, env)
+	require.Equal(t, 422, w.Code)
+
+	pwr, err := data.SelectPasswordResetByPK(ctx, pool, tokenDigest("0123456789abcdef"))
+	require.NoError(t, err)
+	require.False(t, pwr.CompletionTime.Valid, "token is still usable")
+}
+
+func TestRequestPasswordResetHandlerInvalidatesEarlierResets(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := &data.User{
+		Name:          pgtype.Text{String: "test", Valid: true},
+		Email:         pgtype.Text{String: "test@example.com", Valid: true},
+		EmailVerified: true,
+	}
+	SetPassword(user, "password")
+	_, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	mailer := &testMailer{}
+	env := &environment{pool: pool, logger: getLogger(t), mailer: mailer, passwordResetLifetime: DefaultPasswordResetLifetime}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader(`{"email": "test@example.com"}`))
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		RequestPasswordResetHandler(w, req, env)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	require.Len(t, mailer.sentPasswordResetMails, 2)
+
+	for i, expected := range []int{http.StatusNotFound, http.StatusOK} {
+		req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader(`{"token": "`+mailer.sentPasswordResetMails[i].token+`", "password": "bigsecret"}`))
+		require.NoError(t, err)
+		req.RemoteAddr = "127.0.0.1:54678"
+		w := httptest.NewRecorder()
+		ResetPasswordHandler(w, req, env)
+		require.Equal(t, expected, w.Code)
+	}
+}
@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/tpr/backend/data"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// ItemPruner deletes items according to a retention policy. It is run periodically by Maintenance.
+type ItemPruner struct {
+	pool   *pgxpool.Pool
+	logger log.Logger
+
+	// Policy determines which items are deleted. Nothing is deleted if it is not enabled.
+	Policy data.RetentionPolicy
+}
+
+func NewItemPruner(pool *pgxpool.Pool, logger log.Logger) *ItemPruner {
+	return &ItemPruner{
+		pool:   pool,
+		logger: logger,
+	}
+}
+
+// Prune deletes the items allowed by the retention policy and returns the number deleted from each feed. If dryRun is
+// true nothing is deleted and the number that would be deleted is returned.
+func (p *ItemPruner) Prune(dryRun bool) ([]data.PrunedFeed, error) {
+	prunedFeeds, err := data.PruneItems(context.Background(), p.pool, p.Policy, time.Now(), dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.Policy.Enabled() {
+		return nil, nil
+	}
+
+	if !dryRun {
+		var itemCount int64
+		for _, pf := range prunedFeeds {
+			itemCount += pf.ItemCount
+		}
+		p.logger.Info("Prune succeeded", "feedCount", len(prunedFeeds), "itemCount", itemCount)
+	}
+
+	return prunedFeeds, nil
+}
@@ -0,0 +1,173 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SMTPTLSMode is how an SMTPTransport secures its connection.
+type SMTPTLSMode string
+
+const (
+	// SMTPTLSStartTLS upgrades the connection with STARTTLS. Mail is not sent if the server does not support it.
+	SMTPTLSStartTLS SMTPTLSMode = "starttls"
+
+	// SMTPTLSImplicit connects with TLS from the start. This is usually port 465.
+	SMTPTLSImplicit SMTPTLSMode = "implicit"
+
+	// SMTPTLSNone sends mail unencrypted. net/smtp refuses to authenticate this way except to localhost.
+	SMTPTLSNone SMTPTLSMode = "none"
+)
+
+// smtpTimeout limits how long delivering a message to an SMTP server may take.
+const smtpTimeout = 30 * time.Second
+
+// SMTPTransport delivers mail to an SMTP server.
+type SMTPTransport struct {
+	// Addr is the host:port of the server.
+	Addr string
+
+	// TLS defaults to SMTPTLSStartTLS.
+	TLS SMTPTLSMode
+
+	// TLSConfig may be nil to verify the server certificate against the host in Addr.
+	TLSConfig *tls.Config
+
+	// Auth may be nil to send without authenticating.
+	Auth smtp.Auth
+}
+
+func (t *SMTPTransport) Send(from string, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(t.Addr)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{ServerName: host}
+	if t.TLSConfig != nil {
+		tlsConfig = t.TLSConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	if t.TLS == SMTPTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", t.Addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", t.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if t.TLS == "" || t.TLS == SMTPTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if t.Auth != nil {
+		if err := c.Auth(t.Auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// SendmailTransport pipes mail to a sendmail compatible program.
+type SendmailTransport struct {
+	// Path of the program. e.g. /usr/sbin/sendmail
+	Path string
+}
+
+func (t *SendmailTransport) Send(from string, to []string, msg []byte) error {
+	args := append([]string{"-i", "-f", from, "--"}, to...)
+	cmd := exec.Command(t.Path, args...)
+	cmd.Stdin = bytes.NewReader(localLineEndings(msg))
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", t.Path, err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
+
+// MaildirTransport writes mail to a maildir instead of delivering it. It is intended for local development and testing.
+type MaildirTransport struct {
+	Dir string
+}
+
+var maildirDeliveryCount atomic.Int64
+
+func (t *MaildirTransport) Send(from string, to []string, msg []byte) error {
+	for _, subdir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.Dir, subdir), 0700); err != nil {
+			return err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	hostname = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(hostname)
+	name := fmt.Sprintf("%d.P%dQ%d.%s", time.Now().Unix(), os.Getpid(), maildirDeliveryCount.Add(1), hostname)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Return-Path: <%s>\n", from)
+	buf.Write(localLineEndings(msg))
+
+	tmpPath := filepath.Join(t.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(t.Dir, "new", name))
+}
+
+// localLineEndings converts msg to the LF line endings sendmail and maildir expect.
+func localLineEndings(msg []byte) []byte {
+	return bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+}
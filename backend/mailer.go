@@ -1,5 +1,234 @@
 package backend
 
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
 type Mailer interface {
 	SendPasswordResetMail(to, token string) error
+
+	// SendEmailVerificationMail asks the owner of to to confirm the address by following a link with token.
+	SendEmailVerificationMail(to, token string) error
+
+	// SendDigestMail mails digest to to.
+	SendDigestMail(to string, digest *Digest) error
+}
+
+// MailTransport delivers a complete RFC 5322 message with CRLF line endings.
+type MailTransport interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+//go:embed mail_templates
+var defaultMailTemplates embed.FS
+
+// mailTemplate renders one kind of mail. text must define a "subject" template.
+type mailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// MailTemplates are the templates for all mails sent by TemplateMailer.
+type MailTemplates struct {
+	templates map[string]mailTemplate
+}
+
+// LoadMailTemplates loads the built-in mail templates. Each <name>.txt and <name>.html file in dir replaces the
+// built-in template of the same name. dir may be empty to use only the built-in templates.
+func LoadMailTemplates(dir string) (*MailTemplates, error) {
+	readFile := func(name string) ([]byte, error) {
+		if dir != "" {
+			buf, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil || !errors.Is(err, fs.ErrNotExist) {
+				return buf, err
+			}
+		}
+		return defaultMailTemplates.ReadFile(path.Join("mail_templates", name))
+	}
+
+	names, err := fs.Glob(defaultMailTemplates, "mail_templates/*.txt")
+	if err != nil {
+		return nil, err
+	}
+
+	mt := &MailTemplates{templates: make(map[string]mailTemplate, len(names))}
+	for _, name := range names {
+		name = strings.TrimSuffix(path.Base(name), ".txt")
+
+		text, err := readFile(name + ".txt")
+		if err != nil {
+			return nil, err
+		}
+		textTmpl, err := texttemplate.New(name + ".txt").Parse(string(text))
+		if err != nil {
+			return nil, err
+		}
+		if textTmpl.Lookup("subject") == nil {
+			return nil, fmt.Errorf("%s.txt does not define subject", name)
+		}
+
+		html, err := readFile(name + ".html")
+		if err != nil {
+			return nil, err
+		}
+		htmlTmpl, err := htmltemplate.New(name + ".html").Parse(string(html))
+		if err != nil {
+			return nil, err
+		}
+
+		mt.templates[name] = mailTemplate{text: textTmpl, html: htmlTmpl}
+	}
+
+	return mt, nil
+}
+
+// render executes the templates of the mail name with data.
+func (mt *MailTemplates) render(name string, data any) (subject, text, html string, err error) {
+	tmpl, ok := mt.templates[name]
+	if !ok {
+		return "", "", "", fmt.Errorf("missing mail template %s", name)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.text.ExecuteTemplate(buf, "subject", data); err != nil {
+		return "", "", "", err
+	}
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := tmpl.text.Execute(buf, data); err != nil {
+		return "", "", "", err
+	}
+	text = buf.String()
+
+	buf.Reset()
+	if err := tmpl.html.Execute(buf, data); err != nil {
+		return "", "", "", err
+	}
+	html = buf.String()
+
+	return subject, text, html, nil
+}
+
+// TemplateMailer is a Mailer that renders MailTemplates into multipart text and HTML messages and hands them to
+// Transport.
+type TemplateMailer struct {
+	From      string
+	RootURL   string
+	Templates *MailTemplates
+	Transport MailTransport
+	Logger    log.Logger
+}
+
+func (m *TemplateMailer) SendPasswordResetMail(to, token string) error {
+	return m.send(to, "password_reset", map[string]any{"RootURL": m.RootURL, "To": to, "Token": token})
+}
+
+func (m *TemplateMailer) SendEmailVerificationMail(to, token string) error {
+	return m.send(to, "email_verification", map[string]any{"RootURL": m.RootURL, "To": to, "Token": token})
+}
+
+func (m *TemplateMailer) SendDigestMail(to string, digest *Digest) error {
+	return m.send(to, "digest", map[string]any{"RootURL": m.RootURL, "To": to, "Digest": digest})
+}
+
+func (m *TemplateMailer) send(to, name string, data any) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("bad from address: %w", err)
+	}
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("bad to address: %w", err)
+	}
+
+	subject, text, html, err := m.Templates.render(name, data)
+	if err != nil {
+		return err
+	}
+
+	msg, err := buildMailMessage(from, rcpt, subject, text, html, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = m.Transport.Send(from.Address, []string{rcpt.Address}, msg)
+	if err != nil {
+		m.Logger.Error("Send mail failed", "mail", name, "to", to, "error", err)
+		return err
+	}
+
+	m.Logger.Info("Sent mail", "mail", name, "to", to)
+	return nil
+}
+
+// buildMailMessage returns an RFC 5322 message with text and html as alternative parts.
+func buildMailMessage(from, to *mail.Address, subject, text, html string, now time.Time) ([]byte, error) {
+	domain := from.Address[strings.LastIndexByte(from.Address, '@')+1:]
+	messageID, err := genRandToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+
+	header := []string{
+		"Date: " + now.Format(time.RFC1123Z),
+		"From: " + from.String(),
+		"To: " + to.String(),
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Message-ID: <" + messageID + "@" + domain + ">",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/alternative; boundary="` + mw.Boundary() + `"`,
+	}
+	buf.WriteString(strings.Join(header, "\r\n") + "\r\n\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qpw := quotedprintable.NewWriter(w)
+		if _, err := qpw.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qpw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
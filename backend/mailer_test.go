@@ -0,0 +1,203 @@
+package backend
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+type recordingTransport struct {
+	from string
+	to   []string
+	msg  []byte
+}
+
+func (t *recordingTransport) Send(from string, to []string, msg []byte) error {
+	t.from = from
+	t.to = to
+	t.msg = msg
+	return nil
+}
+
+func newTestTemplateMailer(t *testing.T, templatesDir string) (*TemplateMailer, *recordingTransport) {
+	templates, err := LoadMailTemplates(templatesDir)
+	require.NoError(t, err)
+
+	transport := &recordingTransport{}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	return &TemplateMailer{
+		From:      "The Pithy Reader <tpr@example.com>",
+		RootURL:   "https://tpr.example.com",
+		Templates: templates,
+		Transport: transport,
+		Logger:    logger,
+	}, transport
+}
+
+// readMailParts returns the decoded bodies of msg's parts by content type.
+func readMailParts(t *testing.T, msg *mail.Message) map[string]string {
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+
+	parts := make(map[string]string)
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(part)
+		require.NoError(t, err)
+		parts[part.Header.Get("Content-Type")] = string(body)
+	}
+
+	return parts
+}
+
+func TestTemplateMailer(t *testing.T) {
+	mailer, transport := newTestTemplateMailer(t, "")
+
+	err := mailer.SendPasswordResetMail("joe@example.com", "0123456789abcdef")
+	require.NoError(t, err)
+	require.Equal(t, "tpr@example.com", transport.from)
+	require.Equal(t, []string{"joe@example.com"}, transport.to)
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(transport.msg)))
+	require.NoError(t, err)
+
+	_, err = msg.Header.Date()
+	require.NoError(t, err)
+	require.Regexp(t, `\A<[0-9a-f]+@example\.com>\z`, msg.Header.Get("Message-ID"))
+	require.Equal(t, `"The Pithy Reader" <tpr@example.com>`, msg.Header.Get("From"))
+	require.Equal(t, "<joe@example.com>", msg.Header.Get("To"))
+	require.Equal(t, "The Pithy Reader Password Reset", msg.Header.Get("Subject"))
+	require.Equal(t, "1.0", msg.Header.Get("MIME-Version"))
+
+	parts := readMailParts(t, msg)
+	require.Len(t, parts, 2)
+	require.Contains(t, parts["text/plain; charset=utf-8"], "https://tpr.example.com/#resetPassword?token=0123456789abcdef")
+	require.NotContains(t, parts["text/plain; charset=utf-8"], "subject")
+	require.Contains(t, parts["text/html; charset=utf-8"], `href="https://tpr.example.com/#resetPassword?token=0123456789abcdef"`)
+}
+
+func TestTemplateMailerRejectsBadAddress(t *testing.T) {
+	mailer, transport := newTestTemplateMailer(t, "")
+
+	err := mailer.SendEmailVerificationMail("joe@example.com\r\nBcc: eve@example.com", "0123456789abcdef")
+	require.Error(t, err)
+	require.Nil(t, transport.msg)
+}
+
+func TestLoadMailTemplatesOverride(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "email_verification.txt"), []byte(`{{define "subject"}}Bitte bestätigen{{end}}Link: {{.RootURL}}/#verifyEmail?token={{.Token}}`), 0600)
+	require.NoError(t, err)
+
+	mailer, transport := newTestTemplateMailer(t, dir)
+	err = mailer.SendEmailVerificationMail("joe@example.com", "0123456789abcdef")
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(transport.msg)))
+	require.NoError(t, err)
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	require.Equal(t, "Bitte bestätigen", subject)
+
+	parts := readMailParts(t, msg)
+	require.Equal(t, "Link: https://tpr.example.com/#verifyEmail?token=0123456789abcdef", parts["text/plain; charset=utf-8"])
+	require.Contains(t, parts["text/html; charset=utf-8"], "Confirm email address", "built-in HTML template is still used")
+
+	err = os.WriteFile(filepath.Join(dir, "email_verification.txt"), []byte(`no subject`), 0600)
+	require.NoError(t, err)
+	_, err = LoadMailTemplates(dir)
+	require.Error(t, err)
+}
+
+func TestMaildirTransport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "maildir")
+	transport := &MaildirTransport{Dir: dir}
+
+	err := transport.Send("tpr@example.com", []string{"joe@example.com"}, []byte("Subject: Test\r\n\r\nHello\r\n"))
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	buf, err := os.ReadFile(filepath.Join(dir, "new", entries[0].Name()))
+	require.NoError(t, err)
+	require.Equal(t, "Return-Path: <tpr@example.com>\nSubject: Test\n\nHello\n", string(buf))
+
+	entries, err = os.ReadDir(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestSendmailTransport(t *testing.T) {
+	dir := t.TempDir()
+	sendmailPath := filepath.Join(dir, "sendmail")
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\ncat > " + filepath.Join(dir, "msg") + "\n"
+	err := os.WriteFile(sendmailPath, []byte(script), 0700)
+	require.NoError(t, err)
+
+	transport := &SendmailTransport{Path: sendmailPath}
+	err = transport.Send("tpr@example.com", []string{"joe@example.com"}, []byte("Subject: Test\r\n\r\nHello\r\n"))
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Equal(t, "-i -f tpr@example.com -- joe@example.com\n", string(args))
+
+	msg, err := os.ReadFile(filepath.Join(dir, "msg"))
+	require.NoError(t, err)
+	require.Equal(t, "Subject: Test\n\nHello\n", string(msg))
+
+	transport = &SendmailTransport{Path: filepath.Join(dir, "missing")}
+	err = transport.Send("tpr@example.com", []string{"joe@example.com"}, []byte("Subject: Test\r\n\r\nHello\r\n"))
+	require.Error(t, err)
+}
+
+func TestTemplateMailerDigest(t *testing.T) {
+	mailer, transport := newTestTemplateMailer(t, "")
+
+	digest := &Digest{
+		Items: []*data.DigestItem{
+			{FeedName: "News", Title: "Rates <rise>", URL: "https://news.example.com/1", PublicationTime: time.Date(2024, 3, 6, 7, 0, 0, 0, time.UTC)},
+			{FeedName: "News", Title: "Evil", URL: "javascript:alert(1)", PublicationTime: time.Date(2024, 3, 6, 8, 0, 0, 0, time.UTC)},
+		},
+		UnreadCount: 5,
+		MarkedRead:  true,
+	}
+	err := mailer.SendDigestMail("joe@example.com", digest)
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(transport.msg)))
+	require.NoError(t, err)
+	require.Equal(t, "The Pithy Reader: 5 unread items", msg.Header.Get("Subject"))
+
+	parts := readMailParts(t, msg)
+	text := parts["text/plain; charset=utf-8"]
+	require.Contains(t, text, "Rates <rise>\r\nNews - Mar 6, 2024\r\nhttps://news.example.com/1\r\n")
+	require.Contains(t, text, "And 5 unread items in total.")
+	require.Contains(t, text, "These items have been marked read.")
+
+	html := parts["text/html; charset=utf-8"]
+	require.Contains(t, html, `<a href="https://news.example.com/1">Rates &lt;rise&gt;</a>`)
+	require.NotContains(t, html, "javascript:")
+}
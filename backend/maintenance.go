@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/tpr/backend/data"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// Maintenance periodically removes data that is no longer needed.
+type Maintenance struct {
+	pool       *pgxpool.Pool
+	logger     log.Logger
+	itemPruner *ItemPruner
+
+	// SessionPolicy determines which sessions have expired.
+	SessionPolicy SessionPolicy
+
+	// PasswordResetRetention is how long password resets and email verifications are kept. It must be longer than the
+	// password reset lifetime and emailVerificationLifetime.
+	PasswordResetRetention time.Duration
+
+	// AuthAttemptRetention is how long login and password reset attempts are kept for rate limiting. It must be at
+	// least as long as the longest rate limit window.
+	AuthAttemptRetention time.Duration
+
+	// Interval is how often KeepMaintaining runs maintenance.
+	Interval time.Duration
+}
+
+// MaintenanceReport is what a maintenance run removed.
+type MaintenanceReport struct {
+	ExpiredSessionCount    int64
+	OrphanedFeedCount      int64
+	PasswordResetCount     int64
+	EmailVerificationCount int64
+	AuthAttemptCount       int64
+	PrunedFeeds            []data.PrunedFeed
+}
+
+// PrunedItemCount returns the total number of items pruned from all feeds.
+func (r *MaintenanceReport) PrunedItemCount() int64 {
+	var n int64
+	for _, pf := range r.PrunedFeeds {
+		n += pf.ItemCount
+	}
+	return n
+}
+
+func NewMaintenance(pool *pgxpool.Pool, itemPruner *ItemPruner, logger log.Logger) *Maintenance {
+	return &Maintenance{
+		pool:                   pool,
+		logger:                 logger,
+		itemPruner:             itemPruner,
+		SessionPolicy:          DefaultSessionPolicy,
+		PasswordResetRetention: 30 * 24 * time.Hour,
+		AuthAttemptRetention:   24 * time.Hour,
+		Interval:               time.Hour,
+	}
+}
+
+// Run performs all maintenance tasks and reports what was removed. If dryRun is true nothing is removed and the report
+// is what would have been removed. Tasks are independent so a failed task does not prevent the others from running.
+// The first error is returned along with the report of the tasks that succeeded.
+func (m *Maintenance) Run(dryRun bool) (*MaintenanceReport, error) {
+	ctx := context.Background()
+	now := time.Now()
+	report := &MaintenanceReport{}
+	var firstErr error
+	check := func(task string, err error) {
+		if err != nil {
+			m.logger.Error("Maintenance task failed", "task", task, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	var err error
+	idleCutoff, absoluteCutoff := m.SessionPolicy.Cutoffs(now)
+	report.ExpiredSessionCount, err = data.DeleteExpiredSessions(ctx, m.pool, idleCutoff, absoluteCutoff, dryRun)
+	check("DeleteExpiredSessions", err)
+
+	report.OrphanedFeedCount, err = data.DeleteOrphanedFeeds(ctx, m.pool, dryRun)
+	check("DeleteOrphanedFeeds", err)
+
+	report.PasswordResetCount, err = data.DeleteOldPasswordResets(ctx, m.pool, now.Add(-m.PasswordResetRetention), dryRun)
+	check("DeleteOldPasswordResets", err)
+
+	report.EmailVerificationCount, err = data.DeleteOldEmailVerifications(ctx, m.pool, now.Add(-m.PasswordResetRetention), dryRun)
+	check("DeleteOldEmailVerifications", err)
+
+	report.AuthAttemptCount, err = data.DeleteAuthAttemptsBefore(ctx, m.pool, now.Add(-m.AuthAttemptRetention), dryRun)
+	check("DeleteAuthAttemptsBefore", err)
+
+	if m.itemPruner != nil {
+		report.PrunedFeeds, err = m.itemPruner.Prune(dryRun)
+		check("Prune", err)
+	}
+
+	if !dryRun {
+		m.logger.Info("Maintenance succeeded",
+			"expiredSessionCount", report.ExpiredSessionCount,
+			"orphanedFeedCount", report.OrphanedFeedCount,
+			"passwordResetCount", report.PasswordResetCount,
+			"emailVerificationCount", report.EmailVerificationCount,
+			"authAttemptCount", report.AuthAttemptCount,
+			"prunedItemCount", report.PrunedItemCount(),
+		)
+	}
+
+	return report, firstErr
+}
+
+// KeepMaintaining runs maintenance every Interval forever.
+func (m *Maintenance) KeepMaintaining() {
+	for {
+		startTime := time.Now()
+		m.Run(false)
+		sleepUntil(startTime.Add(m.Interval))
+	}
+}
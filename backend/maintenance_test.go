@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceRun(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	userID, err := data.CreateUser(ctx, pool, newUser())
+	require.NoError(t, err)
+
+	otherUser := newUser()
+	otherUser.Name.String = "other"
+	otherUserID, err := data.CreateUser(ctx, pool, otherUser)
+	require.NoError(t, err)
+
+	now := time.Now()
+	sessions := []struct {
+		id           string
+		startTime    time.Time
+		lastSeenTime time.Time
+	}{
+		{"active", now.Add(-48 * time.Hour), now.Add(-time.Hour)},
+		{"idle", now.Add(-48 * time.Hour), now.Add(-25 * time.Hour)},
+		{"old", now.Add(-8 * 24 * time.Hour), now.Add(-time.Hour)},
+	}
+	for _, s := range sessions {
+		_, err = pool.Exec(ctx, `insert into sessions(id, user_id, start_time, last_seen_time) values($1, $2, $3, $4)`, []byte(s.id), userID, s.startTime, s.lastSeenTime)
+		require.NoError(t, err)
+	}
+
+	_, err = pool.Exec(ctx, `insert into password_resets(token_digest, email, request_time, completion_ip, completion_time)
+values ('old', 'test@example.com', $1, '127.0.0.1', $1), ('recent', 'test@example.com', $2, '127.0.0.1', $2), ('pending', 'test@example.com', $1, null, null)`,
+		now.Add(-60*24*time.Hour), now.Add(-time.Hour))
+	require.NoError(t, err)
+
+	_, err = pool.Exec(ctx, `insert into email_verifications(token_digest, user_id, email, request_time)
+values ('old', $1, 'old@example.com', $2), ('recent', $1, 'recent@example.com', $3)`,
+		userID, now.Add(-60*24*time.Hour), now.Add(-time.Hour))
+	require.NoError(t, err)
+
+	err = data.InsertAuthAttempt(ctx, pool, data.AuthActionLogin, netip.MustParseAddr("192.0.2.1"), "test", now.Add(-25*time.Hour))
+	require.NoError(t, err)
+	err = data.InsertAuthAttempt(ctx, pool, data.AuthActionLogin, netip.MustParseAddr("192.0.2.1"), "test", now.Add(-time.Hour))
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(ctx, pool, userID, "http://kept")
+	require.NoError(t, err)
+	err = data.InsertSubscription(ctx, pool, otherUserID, "http://orphaned")
+	require.NoError(t, err)
+	_, err = pool.Exec(ctx, `delete from users where id=$1`, otherUserID)
+	require.NoError(t, err)
+
+	maintenance := NewMaintenance(pool, NewItemPruner(pool, getLogger(t)), getLogger(t))
+	maintenance.SessionPolicy = SessionPolicy{IdleLifetime: 24 * time.Hour, AbsoluteLifetime: 7 * 24 * time.Hour}
+
+	expected := &MaintenanceReport{
+		ExpiredSessionCount:    2,
+		OrphanedFeedCount:      1,
+		PasswordResetCount:     2,
+		EmailVerificationCount: 1,
+		AuthAttemptCount:       1,
+	}
+
+	report, err := maintenance.Run(true)
+	require.NoError(t, err)
+	require.Equal(t, expected, report)
+
+	report, err = maintenance.Run(false)
+	require.NoError(t, err)
+	require.Equal(t, expected, report)
+
+	report, err = maintenance.Run(false)
+	require.NoError(t, err)
+	require.Equal(t, &MaintenanceReport{}, report)
+
+	var sessionCount, feedCount, passwordResetCount int
+	err = pool.QueryRow(ctx, `select (select count(*) from sessions), (select count(*) from feeds), (select count(*) from password_resets)`).
+		Scan(&sessionCount, &feedCount, &passwordResetCount)
+	require.NoError(t, err)
+	require.Equal(t, 1, sessionCount)
+	require.Equal(t, 1, feedCount)
+	require.Equal(t, 1, passwordResetCount)
+}
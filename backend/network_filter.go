@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// defaultBlockedNetworks are special purpose networks that are blocked in addition to loopback, link-local, private,
+// multicast and unspecified addresses.
+var defaultBlockedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64 can reach any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments
+	netip.MustParsePrefix("2002::/16"),       // 6to4 can reach any IPv4 address
+	netip.MustParsePrefix("fec0::/10"),       // deprecated site-local
+	netip.MustParsePrefix("::ffff:0:0:0/96"), // IPv4-translated
+}
+
+// networkFilter decides which addresses the feed updater may connect to. It protects against server-side request
+// forgery where a user subscribes to a URL that resolves to an internal service.
+type networkFilter struct {
+	// allowed networks are permitted even if they are blocked.
+	allowed []netip.Prefix
+
+	// blocked networks are denied in addition to the default blocked addresses.
+	blocked []netip.Prefix
+}
+
+func (f *networkFilter) isAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	for _, p := range f.allowed {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	if addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() {
+		return false
+	}
+
+	for _, p := range defaultBlockedNetworks {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+
+	for _, p := range f.blocked {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dialControl is a net.Dialer Control function. It is called after DNS resolution with the actual address being
+// connected to, so it also applies to every redirect.
+func (f *networkFilter) dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+
+	if !f.isAllowed(addr) {
+		return fmt.Errorf("connecting to %s is not allowed", addr)
+	}
+
+	return nil
+}
+
+// ParseNetworks parses a comma separated list of CIDR networks or addresses.
+func ParseNetworks(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if strings.Contains(field, "/") {
+			p, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+		} else {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	return prefixes, nil
+}
@@ -0,0 +1,64 @@
+package backend
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkFilter(t *testing.T) {
+	filter := &networkFilter{
+		allowed: []netip.Prefix{netip.MustParsePrefix("10.1.2.0/24")},
+		blocked: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+	}
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"203.0.113.5", false},
+		{"10.1.2.3", true},
+	}
+
+	for _, tt := range tests {
+		require.Equalf(t, tt.allowed, filter.isAllowed(netip.MustParseAddr(tt.addr)), "%s", tt.addr)
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks("10.1.2.0/24, 192.168.1.5,fd00::/8")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.1.2.0/24"),
+		netip.MustParsePrefix("192.168.1.5/32"),
+		netip.MustParsePrefix("fd00::/8"),
+	}, networks)
+
+	_, err = ParseNetworks("not a network")
+	require.Error(t, err)
+}
+
+func TestValidateFeedURL(t *testing.T) {
+	require.NoError(t, validateFeedURL("http://example.com/feed.xml"))
+	require.NoError(t, validateFeedURL("https://example.com/feed.xml"))
+	require.Error(t, validateFeedURL("ftp://example.com/feed.xml"))
+	require.Error(t, validateFeedURL("file:///etc/passwd"))
+	require.Error(t, validateFeedURL("example.com/feed.xml"))
+}
@@ -0,0 +1,348 @@
+package backend
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcCookieName = "oidcLogin"
+
+	// oidcLoginLifetime is how long a user has to log in at the provider.
+	oidcLoginLifetime = 10 * time.Minute
+
+	// oidcLandingPath is the frontend page the callback redirects to. Failures are passed in the error query parameter.
+	oidcLandingPath = "/oidc"
+)
+
+// OIDCConfig configures logging in with an OpenID Connect provider.
+type OIDCConfig struct {
+	// Issuer is the URL of the provider. Its endpoints are discovered from <Issuer>/.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the public URL of the callback, https://<host>/api/oidc/callback. It must be registered with the
+	// provider.
+	RedirectURL string
+
+	// Name is shown on the login button.
+	Name string
+
+	// AutoProvision creates an account for provider users who do not match an existing user by email.
+	AutoProvision bool
+}
+
+// OIDCAuthenticator logs users in with an OpenID Connect provider using the authorization code flow with PKCE.
+type OIDCAuthenticator struct {
+	config   OIDCConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCAuthenticator discovers the provider configured by config.
+func NewOIDCAuthenticator(ctx context.Context, config OIDCConfig) (*OIDCAuthenticator, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Name == "" {
+		config.Name = "single sign-on"
+	}
+
+	return &OIDCAuthenticator{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+// oidcClaims are the claims of the ID token used to find or create the user.
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+var (
+	errOIDCNoVerifiedEmail = errors.New("the identity provider did not supply a verified email address")
+	errOIDCNoAccount       = errors.New("there is no account with your email address")
+	errOIDCUnverifiedEmail = errors.New("the account with your email address has not verified it")
+)
+
+// GetOIDCHandler describes the configured provider so the login page can offer it.
+func GetOIDCHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"name": %q}`, env.oidc.config.Name)
+}
+
+// OIDCLoginHandler redirects to the provider to log in. The state, nonce, and PKCE verifier are kept in a cookie so
+// the callback can only be completed by the browser that started the login.
+func OIDCLoginHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	state, err := genRandToken(16)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("genRandToken failed", "error", err)
+		return
+	}
+
+	nonce, err := genRandToken(16)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("genRandToken failed", "error", err)
+		return
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    state + "." + nonce + "." + verifier,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcLoginLifetime / time.Second),
+		Secure:   env.secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL := env.oidc.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, req, authURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler completes a login started by OIDCLoginHandler. It creates a session for the user linked to the
+// provider account and redirects to the frontend.
+func OIDCCallbackHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	fail := func(message string) {
+		http.Redirect(w, req, oidcLandingPath+"?error="+url.QueryEscape(message), http.StatusFound)
+	}
+
+	var state, nonce, verifier string
+	if cookie, err := req.Cookie(oidcCookieName); err == nil {
+		parts := strings.Split(cookie.Value, ".")
+		if len(parts) == 3 {
+			state, nonce, verifier = parts[0], parts[1], parts[2]
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/api/oidc", MaxAge: -1, Secure: env.secureCookies, HttpOnly: true})
+
+	query := req.URL.Query()
+	if errorCode := query.Get("error"); errorCode != "" {
+		env.logger.Warn("OIDC provider returned error", "error", errorCode, "description", query.Get("error_description"))
+		fail("Login was not completed at the identity provider")
+		return
+	}
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		fail("Login expired. Please try again.")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), 30*time.Second)
+	defer cancel()
+
+	token, err := env.oidc.oauth2.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		env.logger.Warn("OIDC code exchange failed", "error", err)
+		fail("Login failed at the identity provider")
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		env.logger.Warn("OIDC token response did not include an ID token")
+		fail("Login failed at the identity provider")
+		return
+	}
+
+	idToken, err := env.oidc.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		env.logger.Warn("OIDC ID token verification failed", "error", err)
+		fail("Login failed at the identity provider")
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		env.logger.Warn("OIDC ID token nonce mismatch")
+		fail("Login failed at the identity provider")
+		return
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		env.logger.Warn("OIDC ID token claims could not be decoded", "error", err)
+		fail("Login failed at the identity provider")
+		return
+	}
+
+	user, err := findOrCreateOIDCUser(ctx, env, idToken.Issuer, idToken.Subject, &claims)
+	if err != nil {
+		var dupErr data.DuplicationError
+		switch {
+		case errors.Is(err, errOIDCNoVerifiedEmail):
+			fail("The identity provider did not supply a verified email address")
+		case errors.Is(err, errOIDCNoAccount):
+			fail("There is no account with your email address")
+		case errors.Is(err, errOIDCUnverifiedEmail):
+			fail("Verify the email address of your account before logging in with single sign-on")
+		case errors.As(err, &dupErr):
+			fail(fmt.Sprintf("Cannot create an account because the %s is already taken", dupErr.Field))
+		default:
+			env.logger.Error("findOrCreateOIDCUser failed", "error", err)
+			fail("Internal server error")
+		}
+		return
+	}
+
+	if user.Disabled {
+		fail("Account is disabled")
+		return
+	}
+
+	sessionID, err := createSession(req, env, user.ID.Int32)
+	if err != nil {
+		env.logger.Error("createSession failed", "error", err)
+		fail("Internal server error")
+		return
+	}
+
+	auditLog(req, env, "oidc_login", user.ID.Int32, map[string]any{"issuer": idToken.Issuer, "subject": idToken.Subject})
+
+	setSessionCookies(w, env, sessionID)
+	http.Redirect(w, req, oidcLandingPath, http.StatusFound)
+}
+
+// findOrCreateOIDCUser returns the user linked to subject at issuer. A provider account that is not yet linked is
+// linked to the user with the same verified email address or, if env.oidc allows it, to a new user.
+func findOrCreateOIDCUser(ctx context.Context, env *environment, issuer, subject string, claims *oidcClaims) (*data.User, error) {
+	now := time.Now()
+
+	user, err := data.SelectUserByOIDCIdentity(ctx, env.pool, issuer, subject)
+	if err == nil {
+		return user, data.TouchOIDCIdentity(ctx, env.pool, issuer, subject, now)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	// Email addresses are only trusted to identify the user when the provider has verified them.
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errOIDCNoVerifiedEmail
+	}
+
+	err = pgx.BeginFunc(ctx, env.pool, func(tx pgx.Tx) error {
+		user, err = data.SelectUserByEmail(ctx, tx, claims.Email)
+		if errors.Is(err, pgx.ErrNoRows) {
+			if !env.oidc.config.AutoProvision {
+				return errOIDCNoAccount
+			}
+			user, err = createOIDCUser(ctx, tx, claims)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Anyone can enter an address they do not own when registering so only a confirmed address is trusted to link
+		// the provider account.
+		if !user.EmailVerified {
+			return errOIDCUnverifiedEmail
+		}
+
+		return data.InsertOIDCIdentity(ctx, tx, issuer, subject, user.ID.Int32, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// oidcUserName returns a valid user name derived from the provider's preferred user name or else the email address.
+func oidcUserName(claims *oidcClaims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	// User names are limited to 30 letters and digits.
+	name = strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return -1
+	}, name)
+	if len(name) > 30 {
+		name = name[:30]
+	}
+	if name == "" {
+		name = "user"
+	}
+
+	return name
+}
+
+// uniqueOIDCUserName returns name or, if it is taken, name with the lowest numeric suffix that is free. name is
+// shortened as needed to keep the result within 30 characters.
+func uniqueOIDCUserName(ctx context.Context, tx pgx.Tx, name string) (string, error) {
+	candidate := name
+	for i := 2; ; i++ {
+		exists, err := data.UserNameExists(ctx, tx, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+
+		suffix := strconv.Itoa(i)
+		candidate = name[:min(len(name), 30-len(suffix))] + suffix
+	}
+}
+
+// createOIDCUser creates a user named by oidcUserName with a numeric suffix if the name is already taken. The user
+// gets a random password which can be changed with a password reset.
+func createOIDCUser(ctx context.Context, tx pgx.Tx, claims *oidcClaims) (*data.User, error) {
+	name, err := uniqueOIDCUserName(ctx, tx, oidcUserName(claims))
+	if err != nil {
+		return nil, err
+	}
+
+	user := &data.User{
+		Name:          pgtype.Text{String: name, Valid: true},
+		Email:         pgtype.Text{String: claims.Email, Valid: true},
+		EmailVerified: true,
+	}
+
+	password, err := genRandToken(32)
+	if err != nil {
+		return nil, err
+	}
+	if err := SetPassword(user, password); err != nil {
+		return nil, err
+	}
+
+	if _, err := data.CreateUser(ctx, tx, user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
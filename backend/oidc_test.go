@@ -0,0 +1,303 @@
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+// mockOIDCProvider is an OpenID Connect provider that issues RS256 signed ID tokens. Tests stand in for the user's
+// browser at the authorization endpoint by calling authorize directly.
+type mockOIDCProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockOIDCAuthorization
+}
+
+type mockOIDCAuthorization struct {
+	codeChallenge string
+	claims        map[string]any
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	p := &mockOIDCProvider{t: t, key: key, codes: map[string]mockOIDCAuthorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]any{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   b64.EncodeToString(key.N.Bytes()),
+				"e":   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+// authorize approves the authorization request in authURL for a user with claims and returns the code the provider
+// would send to the callback.
+func (p *mockOIDCProvider) authorize(authURL string, claims map[string]any) (code, state string) {
+	u, err := url.Parse(authURL)
+	require.NoError(p.t, err)
+	query := u.Query()
+	require.Equal(p.t, "S256", query.Get("code_challenge_method"))
+
+	tokenClaims := map[string]any{
+		"iss":   p.server.URL,
+		"aud":   query.Get("client_id"),
+		"nonce": query.Get("nonce"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		tokenClaims[k] = v
+	}
+
+	code, err = genRandToken(16)
+	require.NoError(p.t, err)
+
+	p.mu.Lock()
+	p.codes[code] = mockOIDCAuthorization{codeChallenge: query.Get("code_challenge"), claims: tokenClaims}
+	p.mu.Unlock()
+
+	return code, query.Get("state")
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	p.mu.Lock()
+	authorization, ok := p.codes[req.PostForm.Get("code")]
+	delete(p.codes, req.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	verifierDigest := sha256.Sum256([]byte(req.PostForm.Get("code_verifier")))
+	if !ok || b64.EncodeToString(verifierDigest[:]) != authorization.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"error": "invalid_grant"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     p.sign(authorization.claims),
+	})
+}
+
+func (p *mockOIDCProvider) sign(claims map[string]any) string {
+	header, err := json.Marshal(map[string]any{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	require.NoError(p.t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(p.t, err)
+
+	signingInput := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	require.NoError(p.t, err)
+
+	return signingInput + "." + b64.EncodeToString(signature)
+}
+
+func TestOIDCUserName(t *testing.T) {
+	tests := []struct {
+		claims oidcClaims
+		name   string
+	}{
+		{oidcClaims{PreferredUsername: "jack", Email: "jack@example.com"}, "jack"},
+		{oidcClaims{Email: "jack.c@example.com"}, "jackc"},
+		{oidcClaims{PreferredUsername: "j.doe-2"}, "jdoe2"},
+		{oidcClaims{PreferredUsername: strings.Repeat("a", 40)}, strings.Repeat("a", 30)},
+		{oidcClaims{PreferredUsername: "..."}, "user"},
+	}
+
+	for i, tt := range tests {
+		require.Equalf(t, tt.name, oidcUserName(&tt.claims), "%d", i)
+	}
+}
+
+func TestOIDCHandlers(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := newUser()
+	user.Email.String, user.Email.Valid = "test@example.com", true
+	user.EmailVerified = true
+	SetPassword(user, "password")
+	userID, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	unverifiedUser := &data.User{
+		Name:  pgtype.Text{String: "unverified", Valid: true},
+		Email: pgtype.Text{String: "unverified@example.com", Valid: true},
+	}
+	SetPassword(unverifiedUser, "password")
+	_, err = data.CreateUser(ctx, pool, unverifiedUser)
+	require.NoError(t, err)
+
+	provider := newMockOIDCProvider(t)
+	newRouter := func(autoProvision bool) http.Handler {
+		oidcAuthenticator, err := NewOIDCAuthenticator(ctx, OIDCConfig{
+			Issuer:        provider.server.URL,
+			ClientID:      "tpr",
+			ClientSecret:  "secret",
+			RedirectURL:   "http://example.com/api/oidc/callback",
+			AutoProvision: autoProvision,
+		})
+		require.NoError(t, err)
+		return NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy, OIDC: oidcAuthenticator}, getLogger(t))
+	}
+	router := newRouter(false)
+
+	do := func(path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// login logs in at the provider as a user with claims and returns the response to the callback.
+	login := func(claims map[string]any) *httptest.ResponseRecorder {
+		w := do("/oidc/login", nil)
+		require.Equal(t, http.StatusFound, w.Code)
+		code, state := provider.authorize(w.Header().Get("Location"), claims)
+		return do("/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), w.Result().Cookies())
+	}
+
+	requireLoginError := func(w *httptest.ResponseRecorder) {
+		t.Helper()
+		require.Equal(t, http.StatusFound, w.Code)
+		require.True(t, strings.HasPrefix(w.Header().Get("Location"), "/oidc?error="), w.Header().Get("Location"))
+	}
+
+	// requireLoggedIn checks that w logged in and returns the name of the user.
+	requireLoggedIn := func(w *httptest.ResponseRecorder) string {
+		t.Helper()
+		require.Equal(t, http.StatusFound, w.Code)
+		require.Equal(t, "/oidc", w.Header().Get("Location"))
+
+		var sessionCookies []*http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == sessionCookieName {
+				sessionCookies = append(sessionCookies, c)
+			}
+		}
+		require.Len(t, sessionCookies, 1)
+
+		w = do("/account", sessionCookies)
+		require.Equal(t, http.StatusOK, w.Code)
+		var account struct {
+			Name string `json:"name"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &account)
+		require.NoError(t, err)
+		return account.Name
+	}
+
+	w := do("/oidc", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"name": "single sign-on"}`, w.Body.String())
+
+	w = login(map[string]any{"sub": "1", "email": "test@example.com", "email_verified": false})
+	requireLoginError(w)
+
+	w = login(map[string]any{"sub": "1", "email": "test@example.com", "email_verified": true})
+	require.Equal(t, "test", requireLoggedIn(w))
+
+	// Once linked the identity logs in even if the email address changes.
+	w = login(map[string]any{"sub": "1", "email": "other@example.com"})
+	require.Equal(t, "test", requireLoggedIn(w))
+
+	identityUser, err := data.SelectUserByOIDCIdentity(ctx, pool, provider.server.URL, "1")
+	require.NoError(t, err)
+	require.Equal(t, userID, identityUser.ID.Int32)
+
+	w = login(map[string]any{"sub": "2", "email": "new@example.com", "email_verified": true, "preferred_username": "new.user"})
+	requireLoginError(w)
+
+	// Only an address the account has confirmed links it.
+	w = login(map[string]any{"sub": "4", "email": "unverified@example.com", "email_verified": true})
+	requireLoginError(w)
+
+	// The state must match the cookie set by the login.
+	w = do("/oidc/login", nil)
+	code, _ := provider.authorize(w.Header().Get("Location"), map[string]any{"sub": "1"})
+	w = do("/oidc/callback?"+url.Values{"code": {code}, "state": {"wrong"}}.Encode(), w.Result().Cookies())
+	requireLoginError(w)
+
+	// The PKCE verifier must match the challenge sent to the provider.
+	w = do("/oidc/login", nil)
+	code, state := provider.authorize(w.Header().Get("Location"), map[string]any{"sub": "1"})
+	cookies := w.Result().Cookies()
+	parts := strings.Split(cookies[0].Value, ".")
+	cookies[0].Value = parts[0] + "." + parts[1] + ".wrong"
+	w = do("/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), cookies)
+	requireLoginError(w)
+
+	// The nonce must match the cookie set by the login.
+	w = login(map[string]any{"sub": "1", "nonce": "wrong"})
+	requireLoginError(w)
+
+	w = do("/oidc/callback?error=access_denied", nil)
+	requireLoginError(w)
+
+	router = newRouter(true)
+	w = login(map[string]any{"sub": "2", "email": "new@example.com", "email_verified": true, "preferred_username": "new.user"})
+	require.Equal(t, "newuser", requireLoggedIn(w))
+
+	// An automatically created user whose name is taken gets a numeric suffix.
+	w = login(map[string]any{"sub": "3", "email": "test3@example.com", "email_verified": true, "preferred_username": "Test"})
+	require.Equal(t, "Test2", requireLoggedIn(w))
+
+	w = login(map[string]any{"sub": "5", "email": "test5@example.com", "email_verified": true, "preferred_username": "TEST"})
+	require.Equal(t, "TEST3", requireLoggedIn(w))
+
+	router = NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	w = do("/oidc/login", nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,134 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+)
+
+// ProxyAuthConfig configures trusting an authenticating reverse proxy to identify users.
+type ProxyAuthConfig struct {
+	// Header is the request header in which the proxy sends the name of the authenticated user, e.g. X-Remote-User.
+	Header string
+
+	// TrustedProxies are the networks the header is accepted from. It is ignored on requests from anywhere else.
+	TrustedProxies []netip.Prefix
+}
+
+// remoteUser returns the user name the proxy sent with req. ok is false if proxy authentication is disabled, req is
+// not from a trusted proxy, or the header is missing.
+func (c *ProxyAuthConfig) remoteUser(req *http.Request) (name string, ok bool) {
+	if c == nil {
+		return "", false
+	}
+
+	name = req.Header.Get(c.Header)
+	if name == "" {
+		return "", false
+	}
+
+	ip := remoteIP(req).Unmap()
+	for _, prefix := range c.TrustedProxies {
+		if prefix.Contains(ip) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+var proxyUserNameRegexp = regexp.MustCompile(`\A[a-zA-Z0-9]{1,30}\z`)
+
+// getUserFromProxy returns the user named name and a session for that user. The request's session is used if it
+// belongs to the user. Otherwise the cookies of the user's latest session from the same user agent, or else of a new
+// session, are set so the CSRF protection of sessions applies to proxy authenticated requests as well. Reusing sessions
+// keeps clients that do not store cookies, such as feed readers, from creating a session on every request. Since a
+// request without a session cannot already have its CSRF token, only requests that do not change state can get one.
+func getUserFromProxy(w http.ResponseWriter, req *http.Request, env *environment, name string) (*data.User, []byte) {
+	if !proxyUserNameRegexp.MatchString(name) {
+		env.logger.Warn("Proxy sent invalid user name", "name", name)
+		return nil, nil
+	}
+
+	if user, sessionID := getUserFromSessionID(req, env); user != nil && user.Name.String == name {
+		return user, sessionID
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return nil, nil
+	}
+
+	user, err := findOrCreateProxyUser(req, env, name)
+	if err != nil {
+		env.logger.Error("findOrCreateProxyUser failed", "name", name, "error", err)
+		return nil, nil
+	}
+	if user.Disabled {
+		env.logger.Warn("Proxy sent disabled user", "name", name)
+		return nil, nil
+	}
+
+	now := time.Now()
+	idleCutoff, absoluteCutoff := env.sessionPolicy.Cutoffs(now)
+	userAgent := newStringFallback(req.UserAgent())
+	sessionID, err := data.SelectLatestSessionIDByUserAgent(context.Background(), env.pool, user.ID.Int32, userAgent, idleCutoff, absoluteCutoff)
+	switch {
+	case err == nil:
+		data.TouchSession(context.Background(), env.pool, sessionID, now, userAgent, remoteIP(req))
+	case errors.Is(err, pgx.ErrNoRows):
+		sessionID, err = createSession(req, env, user.ID.Int32)
+		if err != nil {
+			env.logger.Error("createSession failed", "error", err)
+			return nil, nil
+		}
+
+		auditLog(req, env, "proxy_login", user.ID.Int32, nil)
+	default:
+		env.logger.Error("SelectLatestSessionIDByUserAgent failed", "error", err)
+		return nil, nil
+	}
+
+	setSessionCookies(w, env, sessionID)
+	return user, sessionID
+}
+
+// findOrCreateProxyUser returns the user named name. A user is created the first time the proxy sends a name. The
+// user gets a random password which can be changed with a password reset.
+func findOrCreateProxyUser(req *http.Request, env *environment, name string) (*data.User, error) {
+	user, err := data.SelectUserByName(context.Background(), env.pool, name)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return user, err
+	}
+
+	user = &data.User{Name: pgtype.Text{String: name, Valid: true}}
+	password, err := genRandToken(32)
+	if err != nil {
+		return nil, err
+	}
+	if err := SetPassword(user, password); err != nil {
+		return nil, err
+	}
+
+	_, err = data.CreateUser(context.Background(), env.pool, user)
+	if err != nil {
+		var dupErr data.DuplicationError
+		if errors.As(err, &dupErr) {
+			// A concurrent request created the user first.
+			return data.SelectUserByName(context.Background(), env.pool, name)
+		}
+		return nil, err
+	}
+
+	auditLog(req, env, "proxy_user_created", user.ID.Int32, nil)
+
+	return user, nil
+}
@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyAuthConfigRemoteUser(t *testing.T) {
+	config := &ProxyAuthConfig{
+		Header:         "X-Remote-User",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32"), netip.MustParsePrefix("10.0.0.0/8")},
+	}
+
+	tests := []struct {
+		config     *ProxyAuthConfig
+		remoteAddr string
+		header     string
+		name       string
+		ok         bool
+	}{
+		{config, "127.0.0.1:1234", "jack", "jack", true},
+		{config, "10.1.2.3:1234", "jack", "jack", true},
+		{config, "[::ffff:10.1.2.3]:1234", "jack", "jack", true},
+		{config, "192.0.2.1:1234", "jack", "", false},
+		{config, "[::1]:1234", "jack", "", false},
+		{config, "127.0.0.1:1234", "", "", false},
+		{nil, "127.0.0.1:1234", "jack", "", false},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			req.Header.Set("X-Remote-User", tt.header)
+		}
+
+		name, ok := tt.config.remoteUser(req)
+		require.Equalf(t, tt.ok, ok, "%d", i)
+		require.Equalf(t, tt.name, name, "%d", i)
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := newUser()
+	SetPassword(user, "password")
+	userID, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	router := NewAPIHandler(pool, nil, nil, HTTPConfig{
+		SessionPolicy: DefaultSessionPolicy,
+		ProxyAuth: &ProxyAuthConfig{
+			Header:         "X-Remote-User",
+			TrustedProxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+	}, getLogger(t))
+	do := func(method, remoteAddr, remoteUser string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com/account", nil)
+		req.RemoteAddr = remoteAddr
+		if remoteUser != "" {
+			req.Header.Set("X-Remote-User", remoteUser)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "192.0.2.1:1234", "test", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"name":"test"`)
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 2, "session created")
+
+	w = do("GET", "192.0.2.1:1234", "test", cookies)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, w.Result().Cookies(), "session reused")
+
+	// Clients that do not store cookies get the same session back.
+	w = do("GET", "192.0.2.1:1234", "test", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, w.Result().Cookies(), 2)
+	require.Equal(t, cookies[0].Value, w.Result().Cookies()[0].Value)
+
+	sessions, err := data.SelectActiveSessionsByUserID(ctx, pool, userID, pgtype.Timestamptz{}, pgtype.Timestamptz{})
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+
+	var logins int
+	err = pool.QueryRow(ctx, `select count(*) from audit_log where user_id=$1 and event='proxy_login'`, userID).Scan(&logins)
+	require.NoError(t, err)
+	require.Equal(t, 1, logins)
+
+	// Requests that change state need the CSRF token of an existing session.
+	w = do("PATCH", "192.0.2.1:1234", "test", nil)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	w = do("PATCH", "192.0.2.1:1234", "test", cookies)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	w = do("GET", "198.51.100.1:1234", "test", nil)
+	require.Equal(t, http.StatusForbidden, w.Code, "untrusted proxy")
+
+	w = do("GET", "192.0.2.1:1234", "bad name", nil)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	// A new user is created on first sight and the session of the previous user is not used.
+	w = do("GET", "192.0.2.1:1234", "other", cookies)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"name":"other"`)
+	require.Len(t, w.Result().Cookies(), 2)
+
+	other, err := data.SelectUserByName(ctx, pool, "other")
+	require.NoError(t, err)
+	require.NotEqual(t, userID, other.ID.Int32)
+
+	// Without the header the session works as usual.
+	w = do("GET", "198.51.100.1:1234", "", cookies)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"name":"test"`)
+}
@@ -0,0 +1,170 @@
+// Package pwhash hashes passwords into PHC string format (https://github.com/P-H-C/phc-string-format) so the algorithm
+// and parameters are stored with each hash and can be upgraded over time.
+//
+// New hashes use argon2id. scrypt hashes are verified so passwords hashed before argon2id was adopted remain valid.
+package pwhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrInvalidHash is returned when a hash is not in a recognized format.
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// Argon2idParams are the cost parameters for argon2id.
+type Argon2idParams struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultParams are used for new hashes. Hashes made with other parameters or algorithms need rehashing. These are
+// the OWASP recommended minimums.
+var DefaultParams = Argon2idParams{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+var b64 = base64.RawStdEncoding
+
+// Hash hashes password with argon2id and DefaultParams.
+func Hash(password string) (string, error) {
+	return HashWithParams(password, DefaultParams)
+}
+
+// HashWithParams hashes password with argon2id and params.
+func HashWithParams(password string, params Argon2idParams) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.Memory,
+		params.Iterations,
+		params.Parallelism,
+		b64.EncodeToString(salt),
+		b64.EncodeToString(key),
+	), nil
+}
+
+// EncodeScrypt returns the PHC string for a scrypt key derived with cost parameter N = 2^ln.
+func EncodeScrypt(ln, r, p int, salt, key []byte) string {
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", ln, r, p, b64.EncodeToString(salt), b64.EncodeToString(key))
+}
+
+// decoded is a parsed PHC string.
+type decoded struct {
+	algorithm string
+	version   int
+	params    string
+	salt      []byte
+	key       []byte
+}
+
+func decode(hash string) (*decoded, error) {
+	// "$argon2id$v=19$m=...$salt$key" splits into "", "argon2id", "v=19", "m=...", "salt", "key". The version is
+	// optional.
+	fields := strings.Split(hash, "$")
+	if len(fields) < 5 || fields[0] != "" {
+		return nil, ErrInvalidHash
+	}
+
+	d := &decoded{algorithm: fields[1]}
+	fields = fields[2:]
+	if strings.HasPrefix(fields[0], "v=") {
+		if _, err := fmt.Sscanf(fields[0], "v=%d", &d.version); err != nil {
+			return nil, ErrInvalidHash
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 3 {
+		return nil, ErrInvalidHash
+	}
+
+	var err error
+	d.params = fields[0]
+	if d.salt, err = b64.DecodeString(fields[1]); err != nil {
+		return nil, ErrInvalidHash
+	}
+	if d.key, err = b64.DecodeString(fields[2]); err != nil {
+		return nil, ErrInvalidHash
+	}
+
+	return d, nil
+}
+
+func (d *decoded) argon2idParams() (Argon2idParams, error) {
+	var params Argon2idParams
+	if d.algorithm != "argon2id" || d.version != argon2.Version {
+		return params, ErrInvalidHash
+	}
+	if _, err := fmt.Sscanf(d.params, "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, ErrInvalidHash
+	}
+	params.SaltLength = uint32(len(d.salt))
+	params.KeyLength = uint32(len(d.key))
+	return params, nil
+}
+
+// Verify reports whether password matches hash. The comparison takes constant time.
+func Verify(hash, password string) (bool, error) {
+	d, err := decode(hash)
+	if err != nil {
+		return false, err
+	}
+
+	var key []byte
+	switch d.algorithm {
+	case "argon2id":
+		params, err := d.argon2idParams()
+		if err != nil {
+			return false, err
+		}
+		key = argon2.IDKey([]byte(password), d.salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	case "scrypt":
+		var ln, r, p int
+		if _, err := fmt.Sscanf(d.params, "ln=%d,r=%d,p=%d", &ln, &r, &p); err != nil || ln < 1 || ln > 30 {
+			return false, ErrInvalidHash
+		}
+		key, err = scrypt.Key([]byte(password), d.salt, 1<<ln, r, p, len(d.key))
+		if err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidHash, d.algorithm)
+	}
+
+	return subtle.ConstantTimeCompare(key, d.key) == 1, nil
+}
+
+// NeedsRehash reports whether hash was made with an algorithm or parameters other than argon2id with DefaultParams.
+func NeedsRehash(hash string) bool {
+	d, err := decode(hash)
+	if err != nil {
+		return true
+	}
+
+	params, err := d.argon2idParams()
+	if err != nil {
+		return true
+	}
+
+	return params != DefaultParams
+}
@@ -0,0 +1,78 @@
+package pwhash_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jackc/tpr/backend/pwhash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	hash, err := pwhash.Hash("password")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"), hash)
+
+	ok, err := pwhash.Verify(hash, "password")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = pwhash.Verify(hash, "wrong")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.False(t, pwhash.NeedsRehash(hash))
+
+	otherHash, err := pwhash.Hash("password")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, otherHash, "salt must be random")
+}
+
+func TestVerifyScrypt(t *testing.T) {
+	// The format existing digests are migrated to: scrypt N=16384, r=8, p=1 with an 8 byte salt.
+	hash := "$scrypt$ln=14,r=8,p=1$AQIDBAUGBwg$Sfrz3OPJ2csk8HrJk0Vpmp7DC23Bd+rQMnAAYs3lEgY"
+
+	ok, err := pwhash.Verify(hash, "password")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = pwhash.Verify(hash, "wrong")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.True(t, pwhash.NeedsRehash(hash))
+
+	require.Equal(t, hash, pwhash.EncodeScrypt(14, 8, 1, []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{
+		0x49, 0xfa, 0xf3, 0xdc, 0xe3, 0xc9, 0xd9, 0xcb, 0x24, 0xf0, 0x7a, 0xc9, 0x93, 0x45, 0x69, 0x9a,
+		0x9e, 0xc3, 0x0b, 0x6d, 0xc1, 0x77, 0xea, 0xd0, 0x32, 0x70, 0x00, 0x62, 0xcd, 0xe5, 0x12, 0x06,
+	}))
+}
+
+func TestNeedsRehashOutdatedParams(t *testing.T) {
+	params := pwhash.DefaultParams
+	params.Iterations = 1
+	hash, err := pwhash.HashWithParams("password", params)
+	require.NoError(t, err)
+
+	ok, err := pwhash.Verify(hash, "password")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.True(t, pwhash.NeedsRehash(hash))
+}
+
+func TestVerifyInvalidHash(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"digest",
+		"$argon2id$v=19$m=19456,t=2,p=1$salt",
+		"$argon2id$v=18$m=19456,t=2,p=1$AQIDBAUGBwg$AQIDBAUGBwg",
+		"$bcrypt$AQIDBAUGBwg$AQIDBAUGBwg$AQIDBAUGBwg",
+		"$scrypt$ln=14,r=8,p=1$not base64!$AQIDBAUGBwg",
+	} {
+		ok, err := pwhash.Verify(hash, "password")
+		require.ErrorIsf(t, err, pwhash.ErrInvalidHash, "%q", hash)
+		require.False(t, ok)
+		require.True(t, pwhash.NeedsRehash(hash))
+	}
+}
@@ -0,0 +1,54 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+type refreshLimiterKey struct {
+	userID int32
+	feedID int32
+}
+
+// refreshLimiter limits how often a user may manually refresh a feed.
+type refreshLimiter struct {
+	interval time.Duration
+
+	mutex        sync.Mutex
+	refreshTimes map[refreshLimiterKey]time.Time
+}
+
+func newRefreshLimiter(interval time.Duration) *refreshLimiter {
+	return &refreshLimiter{
+		interval:     interval,
+		refreshTimes: make(map[refreshLimiterKey]time.Time),
+	}
+}
+
+// allow reports whether userID may refresh feedID at now. If not, it returns how long until the refresh is allowed.
+// Refreshes only count once they are recorded with record.
+func (l *refreshLimiter) allow(userID, feedID int32, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for k, t := range l.refreshTimes {
+		if now.Sub(t) >= l.interval {
+			delete(l.refreshTimes, k)
+		}
+	}
+
+	key := refreshLimiterKey{userID: userID, feedID: feedID}
+	if t, ok := l.refreshTimes[key]; ok {
+		return false, l.interval - now.Sub(t)
+	}
+
+	return true, 0
+}
+
+// record counts a refresh of feedID by userID at now.
+func (l *refreshLimiter) record(userID, feedID int32, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.refreshTimes[refreshLimiterKey{userID: userID, feedID: feedID}] = now
+}
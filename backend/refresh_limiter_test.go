@@ -0,0 +1,34 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshLimiter(t *testing.T) {
+	limiter := newRefreshLimiter(time.Minute)
+	now := time.Now()
+
+	allowed, _ := limiter.allow(1, 1, now)
+	require.True(t, allowed)
+
+	// Refreshes that were not recorded do not count
+	allowed, _ = limiter.allow(1, 1, now)
+	require.True(t, allowed)
+	limiter.record(1, 1, now)
+
+	allowed, retryAfter := limiter.allow(1, 1, now.Add(20*time.Second))
+	require.False(t, allowed)
+	require.Equal(t, 40*time.Second, retryAfter)
+
+	// Other users and other feeds are limited independently
+	allowed, _ = limiter.allow(2, 1, now.Add(20*time.Second))
+	require.True(t, allowed)
+	allowed, _ = limiter.allow(1, 2, now.Add(20*time.Second))
+	require.True(t, allowed)
+
+	allowed, _ = limiter.allow(1, 1, now.Add(time.Minute))
+	require.True(t, allowed)
+}
@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// SessionPolicy is how long sessions last.
+type SessionPolicy struct {
+	// IdleLifetime is how long a session may go unused before it expires. 0 disables idle expiration.
+	IdleLifetime time.Duration
+
+	// AbsoluteLifetime is how long a session lasts regardless of use. 0 disables absolute expiration.
+	AbsoluteLifetime time.Duration
+}
+
+// DefaultSessionPolicy is the SessionPolicy used when none is configured.
+var DefaultSessionPolicy = SessionPolicy{
+	IdleLifetime:     30 * 24 * time.Hour,
+	AbsoluteLifetime: 365 * 24 * time.Hour,
+}
+
+// Cutoffs returns the last seen time and start time before which a session has expired at now. A cutoff is null when
+// that kind of expiration is disabled.
+func (p SessionPolicy) Cutoffs(now time.Time) (idleCutoff, absoluteCutoff pgtype.Timestamptz) {
+	return lifetimeCutoff(now, p.IdleLifetime), lifetimeCutoff(now, p.AbsoluteLifetime)
+}
+
+// lifetimeCutoff returns the time before which something with lifetime has expired or null if lifetime is 0.
+func lifetimeCutoff(now time.Time, lifetime time.Duration) pgtype.Timestamptz {
+	if lifetime <= 0 {
+		return pgtype.Timestamptz{}
+	}
+	return pgtype.Timestamptz{Time: now.Add(-lifetime), Valid: true}
+}
+
+const (
+	sessionCookieName = "sessionId"
+	csrfCookieName    = "csrfToken"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// sessionIDFromRequest returns the session ID from the X-Authentication header or, if there is no header, the session
+// cookie. fromCookie reports whether the cookie was used.
+func sessionIDFromRequest(req *http.Request) (sessionID []byte, fromCookie bool) {
+	token := req.Header.Get("X-Authentication")
+	if token == "" {
+		cookie, err := req.Cookie(sessionCookieName)
+		if err != nil {
+			return nil, false
+		}
+		token = cookie.Value
+		fromCookie = true
+	}
+
+	sessionID, err := hex.DecodeString(token)
+	if err != nil {
+		return nil, false
+	}
+
+	return sessionID, fromCookie
+}
+
+// csrfToken returns the CSRF token for sessionID. It is derived from the session ID so it does not need to be stored
+// and cannot be produced without knowing the session ID.
+func csrfToken(sessionID []byte) string {
+	mac := hmac.New(sha256.New, sessionID)
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCSRF reports whether req may act on behalf of the session with sessionID. A browser sends cookies with requests
+// made from other sites so requests authenticated by cookie that change state must include the CSRF token in the
+// X-CSRF-Token header. Another site can neither read the token nor set the header.
+func checkCSRF(req *http.Request, sessionID []byte) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	if _, fromCookie := sessionIDFromRequest(req); !fromCookie {
+		return true
+	}
+
+	return hmac.Equal([]byte(req.Header.Get(csrfHeaderName)), []byte(csrfToken(sessionID)))
+}
+
+// setSessionCookies sets the HttpOnly session cookie and the CSRF token cookie. The CSRF token cookie is readable by
+// JavaScript so the client can copy it into the X-CSRF-Token header.
+func setSessionCookies(w http.ResponseWriter, env *environment, sessionID []byte) {
+	var maxAge int
+	if env.sessionPolicy.AbsoluteLifetime > 0 {
+		maxAge = int(env.sessionPolicy.AbsoluteLifetime / time.Second)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    hex.EncodeToString(sessionID),
+		Path:     "/api",
+		MaxAge:   maxAge,
+		Secure:   env.secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken(sessionID),
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   env.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearSessionCookies removes the cookies set by setSessionCookies.
+func clearSessionCookies(w http.ResponseWriter, env *environment) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "logged out", Path: "/api", MaxAge: -1, Secure: env.secureCookies, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookieName, Value: "logged out", Path: "/", MaxAge: -1, Secure: env.secureCookies, SameSite: http.SameSiteLaxMode})
+}
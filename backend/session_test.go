@@ -0,0 +1,46 @@
+package backend
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	sessionID := []byte("session id")
+	token := csrfToken(sessionID)
+	require.NotEqual(t, token, csrfToken([]byte("other session id")))
+
+	tests := []struct {
+		descr    string
+		method   string
+		header   bool
+		cookie   bool
+		csrf     string
+		expected bool
+	}{
+		{descr: "GET with cookie", method: "GET", cookie: true, expected: true},
+		{descr: "POST with header", method: "POST", header: true, expected: true},
+		{descr: "POST with cookie and token", method: "POST", cookie: true, csrf: token, expected: true},
+		{descr: "POST with cookie and no token", method: "POST", cookie: true, expected: false},
+		{descr: "DELETE with cookie and wrong token", method: "DELETE", cookie: true, csrf: csrfToken([]byte("other session id")), expected: false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://example.com/", nil)
+		if tt.header {
+			req.Header.Set("X-Authentication", hex.EncodeToString(sessionID))
+		}
+		if tt.cookie {
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: hex.EncodeToString(sessionID)})
+		}
+		if tt.csrf != "" {
+			req.Header.Set(csrfHeaderName, tt.csrf)
+		}
+
+		require.Equalf(t, tt.expected, checkCSRF(req, sessionID), tt.descr)
+	}
+}
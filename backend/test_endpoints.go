@@ -2,7 +2,6 @@ package backend
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -12,8 +11,8 @@ import (
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgxutil"
+	"github.com/jackc/tpr/backend/pwhash"
 	log "gopkg.in/inconshreveable/log15.v2"
-	"golang.org/x/crypto/scrypt"
 )
 
 var counter atomic.Int64
@@ -60,21 +59,14 @@ func RegisterTestEndpoints(r chi.Router, pool *pgxpool.Pool, logger log.Logger)
 
 		// Handle password hashing (from testdata.CreateUser)
 		if password, ok := attrs["password"]; ok {
-			salt := make([]byte, 8)
-			if _, err := rand.Read(salt); err != nil {
-				http.Error(w, fmt.Sprintf("Failed to generate salt: %v", err), 500)
-				return
-			}
-
-			digest, err := scrypt.Key([]byte(fmt.Sprint(password)), salt, 16384, 8, 1, 32)
+			hash, err := pwhash.Hash(fmt.Sprint(password))
 			if err != nil {
 				http.Error(w, fmt.Sprintf("Failed to hash password: %v", err), 500)
 				return
 			}
 
 			delete(attrs, "password")
-			attrs["password_digest"] = digest
-			attrs["password_salt"] = salt
+			attrs["password_hash"] = hash
 		}
 
 		// Set default name if not provided
@@ -5,8 +5,20 @@ type testPasswordResetMail struct {
 	token string
 }
 
+type testEmailVerificationMail struct {
+	to    string
+	token string
+}
+
+type testDigestMail struct {
+	to     string
+	digest *Digest
+}
+
 type testMailer struct {
-	sentPasswordResetMails []testPasswordResetMail
+	sentPasswordResetMails     []testPasswordResetMail
+	sentEmailVerificationMails []testEmailVerificationMail
+	sentDigestMails            []testDigestMail
 }
 
 func (m *testMailer) SendPasswordResetMail(to, token string) error {
@@ -14,3 +26,15 @@ func (m *testMailer) SendPasswordResetMail(to, token string) error {
 	m.sentPasswordResetMails = append(m.sentPasswordResetMails, e)
 	return nil
 }
+
+func (m *testMailer) SendEmailVerificationMail(to, token string) error {
+	e := testEmailVerificationMail{to: to, token: token}
+	m.sentEmailVerificationMails = append(m.sentEmailVerificationMails, e)
+	return nil
+}
+
+func (m *testMailer) SendDigestMail(to string, digest *Digest) error {
+	e := testDigestMail{to: to, digest: digest}
+	m.sentDigestMails = append(m.sentDigestMails, e)
+	return nil
+}
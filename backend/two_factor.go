@@ -0,0 +1,164 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/tpr/backend/data"
+)
+
+// TOTP parameters. These are the defaults of RFC 6238 and the only ones all authenticator apps support.
+const (
+	totpPeriod     = 30 * time.Second
+	totpDigits     = 6
+	totpSecretSize = 20
+
+	// totpSkew is the number of steps before and after the current one that are accepted to allow for clock drift.
+	totpSkew = 1
+)
+
+const (
+	recoveryCodeCount = 10
+	totpIssuer        = "The Pithy Reader"
+)
+
+func genTOTPSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// encodeTOTPSecret encodes secret the way authenticator apps expect it to be entered.
+func encodeTOTPSecret(secret []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// totpURI returns the otpauth URI that authenticator apps scan as a QR code to add an account.
+func totpURI(name string, secret []byte) string {
+	label := url.PathEscape(totpIssuer + ":" + name)
+	params := url.Values{}
+	params.Set("secret", encodeTOTPSecret(secret))
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// totpCode returns the code for secret at step as defined by RFC 4226 and RFC 6238.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range totpDigits {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the step of the code for secret that matches code if any step within totpSkew of now does.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// genRecoveryCodes returns recoveryCodeCount new recovery codes and their digests.
+func genRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodeCount)
+	digests := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		token, err := genRandToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = token[:5] + "-" + token[5:]
+		digests[i] = tokenDigest(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, digests, nil
+}
+
+// normalizeRecoveryCode returns the form of code that is stored with tokenDigest. Dashes, spaces, and case are ignored
+// since users may type them however they were written down.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// verifySecondFactor reports whether code or, if it is empty, recoveryCode is a valid second factor for cred's user. An
+// accepted code is used up.
+func verifySecondFactor(req *http.Request, env *environment, cred *data.TOTPCredential, code, recoveryCode string) (bool, error) {
+	var err error
+	if code != "" {
+		step, ok := matchTOTP(cred.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		err = data.UseTOTPStep(context.Background(), env.pool, cred.UserID, step)
+	} else if recoveryCode != "" {
+		err = data.UseRecoveryCode(context.Background(), env.pool, cred.UserID, tokenDigest(normalizeRecoveryCode(recoveryCode)))
+		if err == nil {
+			auditLog(req, env, "recovery_code_used", cred.UserID, nil)
+		}
+	} else {
+		return false, nil
+	}
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// selectEnabledTOTPCredential returns userID's TOTP credential if two-factor authentication is enabled and nil
+// otherwise.
+func selectEnabledTOTPCredential(env *environment, userID int32) (*data.TOTPCredential, error) {
+	cred, err := data.SelectTOTPCredential(context.Background(), env.pool, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !cred.Enabled() {
+		return nil, nil
+	}
+	return cred, nil
+}
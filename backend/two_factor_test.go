@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238 Appendix B truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.code, totpCode(secret, totpStep(time.Unix(tt.unix, 0))), tt.unix)
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+	current := totpStep(now)
+
+	step, ok := matchTOTP(secret, totpCode(secret, current), now)
+	require.True(t, ok)
+	require.Equal(t, current, step)
+
+	step, ok = matchTOTP(secret, totpCode(secret, current-1), now)
+	require.True(t, ok)
+	require.Equal(t, current-1, step)
+
+	_, ok = matchTOTP(secret, "081 804", now)
+	require.True(t, ok)
+
+	_, ok = matchTOTP(secret, totpCode(secret, current+2), now)
+	require.False(t, ok)
+
+	_, ok = matchTOTP(secret, "", now)
+	require.False(t, ok)
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	codes, digests, err := genRecoveryCodes()
+	require.NoError(t, err)
+	require.Len(t, codes, recoveryCodeCount)
+	require.Len(t, digests, recoveryCodeCount)
+
+	require.Equal(t, normalizeRecoveryCode("abcde-12345"), normalizeRecoveryCode("ABCDE 12345"))
+	require.Equal(t, normalizeRecoveryCode("abcde-12345"), normalizeRecoveryCode("abcde12345"))
+	require.NotEqual(t, normalizeRecoveryCode("abcde-12345"), normalizeRecoveryCode("abcde-12346"))
+}
@@ -0,0 +1,448 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/tpr/backend/data"
+)
+
+// webAuthnCeremonyLifetime is how long a client has to finish a registration or login after beginning it.
+const webAuthnCeremonyLifetime = 5 * time.Minute
+
+// NewWebAuthn returns the WebAuthn relying party for passkeys bound to rpID, usually the domain name of the server, and
+// used from origins such as https://tpr.example.com. Passkeys must be discoverable so users can log in without a user
+// name, and must verify the user with a PIN or biometric so they can stand in for the password and any second factor.
+func NewWebAuthn(rpID string, origins []string) (*webauthn.WebAuthn, error) {
+	requireResidentKey := true
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: totpIssuer,
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			RequireResidentKey: &requireResidentKey,
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationRequired,
+		},
+	})
+}
+
+// webAuthnUser adapts a user and their registered credentials to webauthn.User.
+type webAuthnUser struct {
+	user        *data.User
+	handle      []byte
+	stored      []*data.WebAuthnCredential
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte                         { return u.handle }
+func (u *webAuthnUser) WebAuthnName() string                       { return u.user.Name.String }
+func (u *webAuthnUser) WebAuthnDisplayName() string                { return u.user.Name.String }
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+func loadWebAuthnUser(env *environment, user *data.User, handle []byte) (*webAuthnUser, error) {
+	stored, err := data.SelectWebAuthnCredentialsByUserID(context.Background(), env.pool, user.ID.Int32)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &webAuthnUser{user: user, handle: handle, stored: stored, credentials: make([]webauthn.Credential, len(stored))}
+	for i, c := range stored {
+		if err := json.Unmarshal(c.Credential, &u.credentials[i]); err != nil {
+			return nil, fmt.Errorf("credential %d: %w", c.ID, err)
+		}
+	}
+
+	return u, nil
+}
+
+// beginWebAuthnCeremony stores sessionData and writes options for the client along with the ID it must finish the
+// ceremony with.
+func beginWebAuthnCeremony(w http.ResponseWriter, env *environment, userID pgtype.Int4, sessionData *webauthn.SessionData, options any) {
+	ceremonyID := make([]byte, 16)
+	if _, err := rand.Read(ceremonyID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("rand.Read failed", "error", err)
+		return
+	}
+
+	sessionJSON, err := json.Marshal(sessionData)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("json.Marshal failed", "error", err)
+		return
+	}
+
+	err = data.InsertWebAuthnCeremony(context.Background(), env.pool, ceremonyID, userID, sessionJSON, time.Now().Add(webAuthnCeremonyLifetime))
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("InsertWebAuthnCeremony failed", "error", err)
+		return
+	}
+
+	var response struct {
+		CeremonyID string `json:"ceremonyID"`
+		Options    any    `json:"options"`
+	}
+
+	response.CeremonyID = hex.EncodeToString(ceremonyID)
+	response.Options = options
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// finishWebAuthnCeremony returns the user ID and session data of the ceremony with ceremonyID. It writes an error
+// response and returns false if the ceremony does not exist or has expired.
+func finishWebAuthnCeremony(w http.ResponseWriter, env *environment, ceremonyID string) (pgtype.Int4, *webauthn.SessionData, bool) {
+	id, err := hex.DecodeString(ceremonyID)
+	if err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Unknown or expired ceremonyID")
+		return pgtype.Int4{}, nil, false
+	}
+
+	userID, sessionJSON, err := data.DeleteWebAuthnCeremony(context.Background(), env.pool, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.WriteHeader(422)
+			fmt.Fprintln(w, "Unknown or expired ceremonyID")
+			return pgtype.Int4{}, nil, false
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("DeleteWebAuthnCeremony failed", "error", err)
+		return pgtype.Int4{}, nil, false
+	}
+
+	sessionData := &webauthn.SessionData{}
+	if err := json.Unmarshal(sessionJSON, sessionData); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("json.Unmarshal failed", "error", err)
+		return pgtype.Int4{}, nil, false
+	}
+
+	return userID, sessionData, true
+}
+
+// webAuthnRegistrationLoginWindow is how long after logging in a passkey can be registered without the password.
+const webAuthnRegistrationLoginWindow = 10 * time.Minute
+
+// BeginWebAuthnRegistrationHandler starts registering a passkey for the user. The request must include the password
+// unless the session started within webAuthnRegistrationLoginWindow. Users created by single sign-on or proxy
+// authentication never see their random password so they add a passkey right after logging in. The client passes the
+// options to navigator.credentials.create() and sends the result to FinishWebAuthnRegistrationHandler.
+func BeginWebAuthnRegistrationHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if request.Password != "" {
+		if !IsPassword(env.user, request.Password) {
+			w.WriteHeader(422)
+			fmt.Fprintln(w, "Bad password")
+			return
+		}
+	} else {
+		startTime, err := data.SelectSessionStartTime(context.Background(), env.pool, env.sessionID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("SelectSessionStartTime failed", "error", err)
+			return
+		}
+		if time.Since(startTime) > webAuthnRegistrationLoginWindow {
+			w.WriteHeader(422)
+			fmt.Fprintln(w, "Password required. Enter your password or log in again to add a passkey.")
+			return
+		}
+	}
+
+	handle := make([]byte, 32)
+	if _, err := rand.Read(handle); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("rand.Read failed", "error", err)
+		return
+	}
+
+	handle, err := data.SetWebAuthnUserHandle(context.Background(), env.pool, env.user.ID.Int32, handle)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SetWebAuthnUserHandle failed", "error", err)
+		return
+	}
+
+	user, err := loadWebAuthnUser(env, env.user, handle)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("loadWebAuthnUser failed", "error", err)
+		return
+	}
+
+	creation, sessionData, err := env.webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.credentials).CredentialDescriptors()),
+	)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("BeginRegistration failed", "error", err)
+		return
+	}
+
+	beginWebAuthnCeremony(w, env, env.user.ID, sessionData, creation)
+}
+
+type webAuthnCredentialJSON struct {
+	ID           int32              `json:"id"`
+	Name         string             `json:"name"`
+	CreationTime time.Time          `json:"creationTime"`
+	LastUsedTime pgtype.Timestamptz `json:"lastUsedTime"`
+}
+
+func newWebAuthnCredentialJSON(c *data.WebAuthnCredential) webAuthnCredentialJSON {
+	return webAuthnCredentialJSON{
+		ID:           c.ID,
+		Name:         c.Name,
+		CreationTime: c.CreationTime,
+		LastUsedTime: c.LastUsedTime,
+	}
+}
+
+// FinishWebAuthnRegistrationHandler verifies and stores the credential created by the authenticator under the name in
+// the request.
+func FinishWebAuthnRegistrationHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		CeremonyID string          `json:"ceremonyID"`
+		Name       string          `json:"name"`
+		Credential json.RawMessage `json:"credential"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	if request.Name == "" {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, `Request must include the attribute "name"`)
+		return
+	}
+
+	userID, sessionData, ok := finishWebAuthnCeremony(w, env, request.CeremonyID)
+	if !ok {
+		return
+	}
+	if userID != env.user.ID {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Unknown or expired ceremonyID")
+		return
+	}
+
+	user, err := loadWebAuthnUser(env, env.user, sessionData.UserID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("loadWebAuthnUser failed", "error", err)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(request.Credential)
+	if err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Bad credential: %v", err)
+		return
+	}
+
+	credential, err := env.webAuthn.CreateCredential(user, *sessionData, parsed)
+	if err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Bad credential: %v", err)
+		return
+	}
+
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("json.Marshal failed", "error", err)
+		return
+	}
+
+	stored := &data.WebAuthnCredential{
+		UserID:       env.user.ID.Int32,
+		Name:         request.Name,
+		CredentialID: credential.ID,
+		Credential:   credentialJSON,
+	}
+	if err := data.InsertWebAuthnCredential(context.Background(), env.pool, stored); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("InsertWebAuthnCredential failed", "error", err)
+		return
+	}
+
+	auditLog(req, env, "passkey_added", env.user.ID.Int32, map[string]any{"name": request.Name})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newWebAuthnCredentialJSON(stored))
+}
+
+// BeginWebAuthnLoginHandler starts logging in with a passkey. No user name is needed as the authenticator offers the
+// passkeys it has for this server. The client passes the options to navigator.credentials.get() and sends the result to
+// FinishWebAuthnLoginHandler. Each ceremony is stored until it expires, so ceremonies are rate limited per IP address.
+func BeginWebAuthnLoginHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	if !env.authRateLimiter.allow(w, req, env, data.AuthActionPasskeyLogin, "") {
+		return
+	}
+	if err := env.authRateLimiter.record(context.Background(), data.AuthActionPasskeyLogin, remoteIP(req), ""); err != nil {
+		env.logger.Error("authRateLimiter.record failed", "error", err)
+	}
+
+	assertion, sessionData, err := env.webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("BeginDiscoverableLogin failed", "error", err)
+		return
+	}
+
+	beginWebAuthnCeremony(w, env, pgtype.Int4{}, sessionData, assertion)
+}
+
+// FinishWebAuthnLoginHandler verifies the authenticator's assertion and creates a session the same way
+// CreateSessionHandler does.
+func FinishWebAuthnLoginHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	var request struct {
+		CeremonyID string          `json:"ceremonyID"`
+		Credential json.RawMessage `json:"credential"`
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintf(w, "Error decoding request: %v", err)
+		return
+	}
+
+	userID, sessionData, ok := finishWebAuthnCeremony(w, env, request.CeremonyID)
+	if !ok {
+		return
+	}
+	if userID.Valid {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Unknown or expired ceremonyID")
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(request.Credential)
+	if err != nil {
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Passkey login failed")
+		return
+	}
+
+	var user *webAuthnUser
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		u, err := data.SelectUserByWebAuthnUserHandle(context.Background(), env.pool, userHandle)
+		if err != nil {
+			return nil, err
+		}
+		user, err = loadWebAuthnUser(env, u, userHandle)
+		return user, err
+	}
+
+	_, credential, err := env.webAuthn.ValidatePasskeyLogin(findUser, *sessionData, parsed)
+	if err != nil {
+		env.logger.Warn("Passkey login failed", "error", err)
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Passkey login failed")
+		return
+	}
+
+	// A sign count that did not increase means the private key may have been copied out of the authenticator.
+	if credential.Authenticator.CloneWarning {
+		env.logger.Warn("Passkey login rejected by clone warning", "userID", user.user.ID.Int32)
+		w.WriteHeader(422)
+		fmt.Fprintln(w, "Passkey login failed")
+		return
+	}
+
+	for _, stored := range user.stored {
+		if string(stored.CredentialID) != string(credential.ID) {
+			continue
+		}
+
+		credentialJSON, err := json.Marshal(credential)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("json.Marshal failed", "error", err)
+			return
+		}
+
+		err = data.UpdateWebAuthnCredentialUse(context.Background(), env.pool, stored.ID, credentialJSON, time.Now())
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("UpdateWebAuthnCredentialUse failed", "error", err)
+			return
+		}
+	}
+
+	if user.user.Disabled {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "Account is disabled")
+		return
+	}
+
+	writeNewSession(w, req, env, user.user, http.StatusCreated)
+}
+
+func GetWebAuthnCredentialsHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	credentials, err := data.SelectWebAuthnCredentialsByUserID(context.Background(), env.pool, env.user.ID.Int32)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectWebAuthnCredentialsByUserID failed", "error", err)
+		return
+	}
+
+	response := make([]webAuthnCredentialJSON, len(credentials))
+	for i, c := range credentials {
+		response[i] = newWebAuthnCredentialJSON(c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func DeleteWebAuthnCredentialHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	id, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 32)
+	if err != nil {
+		// If not an integer it clearly can't be found
+		http.NotFound(w, req)
+		return
+	}
+
+	err = data.DeleteWebAuthnCredential(context.Background(), env.pool, env.user.ID.Int32, int32(id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("DeleteWebAuthnCredential failed", "error", err)
+		return
+	}
+
+	auditLog(req, env, "passkey_removed", env.user.ID.Int32, nil)
+}
@@ -0,0 +1,273 @@
+package backend
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+// softAuthenticator is a software WebAuthn authenticator that creates a single P-256 passkey with "none" attestation
+// and always verifies the user.
+type softAuthenticator struct {
+	rpID         string
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, rpID, origin string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	credentialID := make([]byte, 16)
+	_, err = rand.Read(credentialID)
+	require.NoError(t, err)
+
+	return &softAuthenticator{rpID: rpID, origin: origin, key: key, credentialID: credentialID}
+}
+
+const (
+	authDataFlagUserPresent      = 0x01
+	authDataFlagUserVerified     = 0x04
+	authDataFlagAttestedCredData = 0x40
+)
+
+var b64 = base64.RawURLEncoding
+
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	buf := append(rpIDHash[:], flags|authDataFlagUserPresent|authDataFlagUserVerified)
+	return binary.BigEndian.AppendUint32(buf, a.signCount)
+}
+
+func (a *softAuthenticator) clientDataJSON(t *testing.T, typ, challenge string) []byte {
+	clientData, err := json.Marshal(map[string]any{"type": typ, "challenge": challenge, "origin": a.origin, "crossOrigin": false})
+	require.NoError(t, err)
+	return clientData
+}
+
+// create responds to the PublicKeyCredentialCreationOptions in options like navigator.credentials.create().
+func (a *softAuthenticator) create(t *testing.T, options json.RawMessage) json.RawMessage {
+	var creation struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	err := json.Unmarshal(options, &creation)
+	require.NoError(t, err)
+
+	a.userHandle, err = b64.DecodeString(creation.PublicKey.User.ID)
+	require.NoError(t, err)
+
+	pub, err := a.key.PublicKey.ECDH()
+	require.NoError(t, err)
+	point := pub.Bytes()
+	coseKey, err := cbor.Marshal(map[int]any{1: 2, 3: -7, -1: 1, -2: point[1:33], -3: point[33:]})
+	require.NoError(t, err)
+
+	authData := a.authData(authDataFlagAttestedCredData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, coseKey...)
+
+	attestationObject, err := cbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": authData})
+	require.NoError(t, err)
+
+	credential, err := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64.EncodeToString(a.clientDataJSON(t, "webauthn.create", creation.PublicKey.Challenge)),
+			"attestationObject": b64.EncodeToString(attestationObject),
+		},
+	})
+	require.NoError(t, err)
+	return credential
+}
+
+// get responds to the PublicKeyCredentialRequestOptions in options like navigator.credentials.get().
+func (a *softAuthenticator) get(t *testing.T, options json.RawMessage) json.RawMessage {
+	var assertion struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	err := json.Unmarshal(options, &assertion)
+	require.NoError(t, err)
+
+	a.signCount++
+	authData := a.authData(0)
+	clientData := a.clientDataJSON(t, "webauthn.get", assertion.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+
+	credential, err := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(signature),
+			"userHandle":        b64.EncodeToString(a.userHandle),
+		},
+	})
+	require.NoError(t, err)
+	return credential
+}
+
+func TestWebAuthnHandlers(t *testing.T) {
+	pool := newConnPool(t)
+	ctx := context.Background()
+
+	user := newUser()
+	SetPassword(user, "password")
+	userID, err := data.CreateUser(ctx, pool, user)
+	require.NoError(t, err)
+
+	err = data.InsertSession(ctx, pool, &data.Session{ID: []byte("session"), UserID: userID})
+	require.NoError(t, err)
+	sessionHeader := http.Header{"X-Authentication": []string{hex.EncodeToString([]byte("session"))}}
+
+	webAuthn, err := NewWebAuthn("tpr.example.com", []string{"https://tpr.example.com"})
+	require.NoError(t, err)
+
+	router := NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy, WebAuthn: webAuthn}, getLogger(t))
+	do := func(method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	type ceremony struct {
+		CeremonyID string          `json:"ceremonyID"`
+		Options    json.RawMessage `json:"options"`
+	}
+	begin := func(path string, header http.Header, body string) ceremony {
+		w := do("POST", path, header, body)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var c ceremony
+		err := json.Unmarshal(w.Body.Bytes(), &c)
+		require.NoError(t, err)
+		return c
+	}
+	finish := func(path string, header http.Header, c ceremony, credential json.RawMessage) *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]any{"ceremonyID": c.CeremonyID, "name": "laptop", "credential": credential})
+		require.NoError(t, err)
+		return do("POST", path, header, string(body))
+	}
+
+	authenticator := newSoftAuthenticator(t, "tpr.example.com", "https://tpr.example.com")
+
+	w := do("POST", "/webauthn/registration/begin", sessionHeader, `{"password": "wrong"}`)
+	require.Equal(t, 422, w.Code)
+
+	w = do("POST", "/webauthn/registration/begin", nil, `{"password": "password"}`)
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	// The password is not needed shortly after logging in.
+	begin("/webauthn/registration/begin", sessionHeader, `{}`)
+
+	_, err = pool.Exec(ctx, `update sessions set start_time=now() - interval '1 hour' where id=$1`, []byte("session"))
+	require.NoError(t, err)
+	w = do("POST", "/webauthn/registration/begin", sessionHeader, `{}`)
+	require.Equal(t, 422, w.Code)
+
+	c := begin("/webauthn/registration/begin", sessionHeader, `{"password": "password"}`)
+	credential := authenticator.create(t, c.Options)
+	w = finish("/webauthn/registration/finish", sessionHeader, c, credential)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = finish("/webauthn/registration/finish", sessionHeader, c, credential)
+	require.Equal(t, 422, w.Code, "ceremony already finished")
+
+	w = do("GET", "/account/passkeys", sessionHeader, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var passkeys []map[string]any
+	err = json.Unmarshal(w.Body.Bytes(), &passkeys)
+	require.NoError(t, err)
+	require.Len(t, passkeys, 1)
+	require.Equal(t, "laptop", passkeys[0]["name"])
+	require.Nil(t, passkeys[0]["lastUsedTime"])
+
+	c = begin("/webauthn/login/begin", nil, "")
+	assertion := authenticator.get(t, c.Options)
+	w = finish("/webauthn/login/finish", nil, c, assertion)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var session struct {
+		Name      string `json:"name"`
+		SessionID string `json:"sessionID"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &session)
+	require.NoError(t, err)
+	require.Equal(t, "test", session.Name)
+	require.Len(t, w.Result().Cookies(), 2)
+
+	w = do("GET", "/account", http.Header{"X-Authentication": []string{session.SessionID}}, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = finish("/webauthn/login/finish", nil, c, assertion)
+	require.Equal(t, 422, w.Code, "replayed assertion")
+
+	// A registration ceremony cannot be used to log in.
+	c = begin("/webauthn/registration/begin", sessionHeader, `{"password": "password"}`)
+	w = finish("/webauthn/login/finish", nil, c, authenticator.get(t, c.Options))
+	require.Equal(t, 422, w.Code)
+
+	c = begin("/webauthn/login/begin", nil, "")
+	assertion = authenticator.get(t, c.Options)
+	assertion = []byte(strings.Replace(string(assertion), `"signature":"`, `"signature":"AA`, 1))
+	w = finish("/webauthn/login/finish", nil, c, assertion)
+	require.Equal(t, 422, w.Code, "bad signature")
+
+	// A sign count that goes backwards suggests a cloned authenticator.
+	authenticator.signCount = 0
+	c = begin("/webauthn/login/begin", nil, "")
+	w = finish("/webauthn/login/finish", nil, c, authenticator.get(t, c.Options))
+	require.Equal(t, 422, w.Code, "clone warning")
+
+	w = do("GET", "/account/passkeys", sessionHeader, "")
+	err = json.Unmarshal(w.Body.Bytes(), &passkeys)
+	require.NoError(t, err)
+	require.NotNil(t, passkeys[0]["lastUsedTime"])
+
+	w = do("DELETE", fmt.Sprintf("/account/passkeys/%v", passkeys[0]["id"]), sessionHeader, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	authenticator.signCount = 10
+	c = begin("/webauthn/login/begin", nil, "")
+	w = finish("/webauthn/login/finish", nil, c, authenticator.get(t, c.Options))
+	require.Equal(t, 422, w.Code, "deleted passkey")
+
+	router = NewAPIHandler(pool, nil, nil, HTTPConfig{SessionPolicy: DefaultSessionPolicy}, getLogger(t))
+	w = do("POST", "/webauthn/login/begin", nil, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,392 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/tpr/backend/data"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+const (
+	// webSubLeaseSeconds is the lease requested from hubs. Hubs may grant a different lease.
+	webSubLeaseSeconds = 10 * 24 * 60 * 60
+
+	// webSubPollInterval is how often feeds with an active WebSub subscription are polled in case a push was missed.
+	webSubPollInterval = 6 * time.Hour
+
+	// webSubRequestRetryInterval is how long to wait for a hub to verify a subscription request before sending another.
+	webSubRequestRetryInterval = time.Hour
+)
+
+// parseLinkHeader extracts the hub and self URLs from an HTTP Link header.
+func parseLinkHeader(header string) (hubURL, selfURL string) {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		target = target[1 : len(target)-1]
+
+		for _, param := range parts[1:] {
+			name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.ToLower(strings.TrimSpace(name)) != "rel" {
+				continue
+			}
+
+			for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+				switch strings.ToLower(rel) {
+				case "hub":
+					if hubURL == "" {
+						hubURL = target
+					}
+				case "self":
+					if selfURL == "" {
+						selfURL = target
+					}
+				}
+			}
+		}
+	}
+
+	return hubURL, selfURL
+}
+
+type xmlLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+// findHubLinks returns the first hub and self URLs in links.
+func findHubLinks(links []xmlLink) (hubURL, selfURL string) {
+	for _, l := range links {
+		switch strings.ToLower(l.Rel) {
+		case "hub":
+			if hubURL == "" {
+				hubURL = l.Href
+			}
+		case "self":
+			if selfURL == "" {
+				selfURL = l.Href
+			}
+		}
+	}
+
+	return hubURL, selfURL
+}
+
+// webSubCallbackURL returns the URL hubs call for sub. The callback token in the URL authenticates the hub since
+// verification requests are not signed.
+func (u *FeedUpdater) webSubCallbackURL(sub *data.WebSubSubscription) string {
+	return strings.TrimRight(u.WebSubRootURL, "/") + "/websub/" + strconv.FormatInt(int64(sub.FeedID), 10) + "/" + sub.CallbackToken
+}
+
+// ensureWebSubSubscription subscribes to the hub advertised by feed if WebSub is enabled and there is not already an
+// active or pending subscription.
+func (u *FeedUpdater) ensureWebSubSubscription(feedID int32, feedURL string, hubURL, selfURL string) {
+	if u.WebSubRootURL == "" || hubURL == "" {
+		return
+	}
+
+	topicURL := selfURL
+	if topicURL == "" {
+		topicURL = feedURL
+	}
+
+	now := time.Now()
+	sub, err := data.SelectWebSubSubscriptionByFeedID(context.Background(), u.pool, feedID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		u.logger.Error("SelectWebSubSubscriptionByFeedID failed", "feedID", feedID, "error", err)
+		return
+	}
+
+	if sub != nil && sub.HubURL == hubURL && sub.TopicURL == topicURL {
+		// Renewal is handled by RenewWebSubSubscriptions.
+		if sub.LeaseExpirationTime.Valid && sub.LeaseExpirationTime.Time.After(now) {
+			return
+		}
+		if sub.SubscribeRequestTime.Valid && now.Sub(sub.SubscribeRequestTime.Time) < webSubRequestRetryInterval {
+			return
+		}
+	} else {
+		secret, err := genRandToken(32)
+		if err != nil {
+			u.logger.Error("genRandToken failed", "error", err)
+			return
+		}
+		callbackToken, err := genRandToken(32)
+		if err != nil {
+			u.logger.Error("genRandToken failed", "error", err)
+			return
+		}
+		sub = &data.WebSubSubscription{FeedID: feedID, HubURL: hubURL, TopicURL: topicURL, Secret: secret, CallbackToken: callbackToken}
+	}
+
+	sub.SubscribeRequestTime = pgtype.Timestamptz{Time: now, Valid: true}
+	err = data.UpsertWebSubSubscriptionRequest(context.Background(), u.pool, sub)
+	if err != nil {
+		u.logger.Error("UpsertWebSubSubscriptionRequest failed", "feedID", feedID, "error", err)
+		return
+	}
+
+	err = u.requestWebSubSubscription(sub)
+	if err != nil {
+		u.logger.Error("requestWebSubSubscription failed", "feedID", feedID, "hub", hubURL, "error", err)
+	}
+}
+
+// requestWebSubSubscription sends a subscription request to the hub. The hub verifies the request asynchronously by
+// calling the callback URL.
+func (u *FeedUpdater) requestWebSubSubscription(sub *data.WebSubSubscription) error {
+	if err := validateFeedURL(sub.HubURL); err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {sub.TopicURL},
+		"hub.callback":      {u.webSubCallbackURL(sub)},
+		"hub.secret":        {sub.Secret},
+		"hub.lease_seconds": {strconv.Itoa(webSubLeaseSeconds)},
+	}
+
+	resp, err := u.client.PostForm(sub.HubURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Bad HTTP response: %s", resp.Status)
+	}
+
+	u.logger.Info("requestWebSubSubscription succeeded", "feedID", sub.FeedID, "hub", sub.HubURL, "topic", sub.TopicURL)
+	return nil
+}
+
+// RenewWebSubSubscriptions renews subscriptions that are near the end of their lease.
+func (u *FeedUpdater) RenewWebSubSubscriptions() {
+	if u.WebSubRootURL == "" {
+		return
+	}
+
+	subs, err := data.ClaimWebSubSubscriptionsForRenewal(context.Background(), u.pool, time.Now(), u.maxConcurrentFeedFetches)
+	if err != nil {
+		u.logger.Error("ClaimWebSubSubscriptionsForRenewal failed", "error", err)
+		return
+	}
+
+	for _, sub := range subs {
+		err := u.requestWebSubSubscription(sub)
+		if err != nil {
+			u.logger.Error("requestWebSubSubscription failed", "feedID", sub.FeedID, "hub", sub.HubURL, "error", err)
+		}
+	}
+}
+
+// newSignatureHash returns the HMAC for an X-Hub-Signature header value of the form method=signature.
+func newSignatureHash(header, secret string) (hash.Hash, []byte, error) {
+	method, signature, found := strings.Cut(header, "=")
+	if !found {
+		return nil, nil, errors.New("malformed signature")
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed signature: %v", err)
+	}
+
+	var h func() hash.Hash
+	switch method {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha384":
+		h = sha512.New384
+	case "sha512":
+		h = sha512.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported signature method: %s", method)
+	}
+
+	return hmac.New(h, []byte(secret)), expected, nil
+}
+
+func NewWebSubHandler(pool *pgxpool.Pool, feedUpdater *FeedUpdater, logger log.Logger) chi.Router {
+	router := chi.NewRouter()
+
+	env := &environment{
+		pool:        pool,
+		logger:      logger,
+		feedUpdater: feedUpdater,
+	}
+
+	router.Method("GET", "/{feedID}/{token}", EnvHandler(env, WebSubVerifyHandler))
+	router.Method("POST", "/{feedID}/{token}", EnvHandler(env, WebSubContentHandler))
+
+	return router
+}
+
+// selectWebSubSubscription returns the subscription for the feed ID and callback token in the URL. It returns
+// pgx.ErrNoRows if there is no subscription or the token does not match.
+func selectWebSubSubscription(req *http.Request, env *environment) (*data.WebSubSubscription, error) {
+	feedID, err := strconv.ParseInt(chi.URLParam(req, "feedID"), 10, 32)
+	if err != nil {
+		return nil, pgx.ErrNoRows
+	}
+
+	sub, err := data.SelectWebSubSubscriptionByFeedID(context.Background(), env.pool, int32(feedID))
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(chi.URLParam(req, "token")), []byte(sub.CallbackToken)) != 1 {
+		return nil, pgx.ErrNoRows
+	}
+
+	return sub, nil
+}
+
+// WebSubVerifyHandler handles a hub's verification of intent for a subscription request. A subscription is only
+// verified while a subscription request is pending so a lease cannot be extended without one.
+func WebSubVerifyHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	query := req.URL.Query()
+	mode := query.Get("hub.mode")
+	topic := query.Get("hub.topic")
+
+	sub, err := selectWebSubSubscription(req, env)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectWebSubSubscriptionByFeedID failed", "error", err)
+		return
+	}
+
+	switch mode {
+	case "subscribe":
+		if sub == nil || sub.TopicURL != topic {
+			http.NotFound(w, req)
+			return
+		}
+
+		leaseSeconds, err := strconv.ParseInt(query.Get("hub.lease_seconds"), 10, 32)
+		if err != nil || leaseSeconds <= 0 {
+			w.WriteHeader(422)
+			fmt.Fprint(w, "Request must include a valid hub.lease_seconds")
+			return
+		}
+
+		now := time.Now()
+		err = data.VerifyWebSubSubscription(context.Background(), env.pool, sub.FeedID, int32(leaseSeconds), now, now.Add(-webSubRequestRetryInterval))
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				http.NotFound(w, req)
+				return
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			env.logger.Error("VerifyWebSubSubscription failed", "error", err)
+			return
+		}
+		env.logger.Info("WebSub subscription verified", "feedID", sub.FeedID, "topic", topic, "leaseSeconds", leaseSeconds)
+	case "unsubscribe":
+		// Subscriptions are only ever dropped by deleting them so only confirm unsubscribing from unknown subscriptions.
+		if sub != nil {
+			http.NotFound(w, req)
+			return
+		}
+	case "denied":
+		if sub != nil && sub.TopicURL == topic {
+			err = data.DeleteWebSubSubscription(context.Background(), env.pool, sub.FeedID)
+			if err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				env.logger.Error("DeleteWebSubSubscription failed", "error", err)
+				return
+			}
+		}
+		env.logger.Warn("WebSub subscription denied", "feedID", chi.URLParam(req, "feedID"), "topic", topic, "reason", query.Get("hub.reason"))
+		return
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, query.Get("hub.challenge"))
+}
+
+// WebSubContentHandler handles content distributed by a hub. Content with a missing or invalid signature is
+// acknowledged but ignored as required by the WebSub specification.
+func WebSubContentHandler(w http.ResponseWriter, req *http.Request, env *environment) {
+	sub, err := selectWebSubSubscription(req, env)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// 410 tells the hub the subscription no longer exists.
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectWebSubSubscriptionByFeedID failed", "error", err)
+		return
+	}
+
+	mac, expectedMAC, err := newSignatureHash(req.Header.Get("X-Hub-Signature"), sub.Secret)
+	if err != nil {
+		env.logger.Warn("WebSub content rejected", "feedID", sub.FeedID, "error", err)
+		return
+	}
+
+	// Parse while computing the signature so the body is not buffered. Nothing is saved until the signature is verified.
+	body := &limitedReader{r: req.Body, max: env.feedUpdater.MaxBodySize}
+	feed, parseErr := parseFeed(io.TeeReader(body, mac))
+	if _, err := io.Copy(mac, body); err != nil && parseErr == nil {
+		parseErr = err
+	}
+
+	if !hmac.Equal(mac.Sum(nil), expectedMAC) {
+		env.logger.Warn("WebSub content rejected", "feedID", sub.FeedID, "error", "signature mismatch")
+		return
+	}
+
+	if parseErr != nil {
+		env.logger.Warn("WebSub content could not be parsed", "feedID", sub.FeedID, "error", parseErr)
+		return
+	}
+	// Hubs may only distribute new items so items missing from the content are not assumed to have left the feed.
+	feed.Partial = true
+
+	// Pushed content has no ETag of its own. Keep the one from the last fetch so polling still gets conditional requests.
+	storedFeed, err := data.SelectFeedByPK(context.Background(), env.pool, sub.FeedID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("SelectFeedByPK failed", "feedID", sub.FeedID, "error", err)
+		return
+	}
+
+	newItemCount, err := data.UpdateFeedWithFetchSuccess(context.Background(), env.pool, sub.FeedID, feed, storedFeed.ETag, time.Now())
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		env.logger.Error("UpdateFeedWithFetchSuccess failed", "feedID", sub.FeedID, "error", err)
+		return
+	}
+
+	env.logger.Info("WebSub content received", "feedID", sub.FeedID, "newItemCount", newItemCount)
+}
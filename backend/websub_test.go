@@ -0,0 +1,272 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/tpr/backend/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLinkHeader(t *testing.T) {
+	tests := []struct {
+		header  string
+		hubURL  string
+		selfURL string
+	}{
+		{"", "", ""},
+		{`<https://hub.example.com/>; rel="hub"`, "https://hub.example.com/", ""},
+		{`<https://hub.example.com/>; rel="hub", <https://example.com/feed>; rel="self"`, "https://hub.example.com/", "https://example.com/feed"},
+		{`<https://example.com/feed>; rel=self,<https://hub.example.com/>;rel=hub`, "https://hub.example.com/", "https://example.com/feed"},
+		{`<https://example.com/feed>; rel="self hub"`, "https://example.com/feed", "https://example.com/feed"},
+		{`<https://example.com/next>; rel="next"`, "", ""},
+		{`https://hub.example.com/; rel="hub"`, "", ""},
+	}
+
+	for i, tt := range tests {
+		hubURL, selfURL := parseLinkHeader(tt.header)
+		require.Equalf(t, tt.hubURL, hubURL, "%d", i)
+		require.Equalf(t, tt.selfURL, selfURL, "%d", i)
+	}
+}
+
+func TestParseFeedHubLinks(t *testing.T) {
+	rss := `<?xml version='1.0' encoding='UTF-8'?>
+<rss xmlns:atom="http://www.w3.org/2005/Atom">
+  <channel>
+    <title>News</title>
+    <link>http://example.org/</link>
+    <atom:link rel="hub" href="https://hub.example.com/" />
+    <atom:link rel="self" href="http://example.org/rss" />
+    <item>
+      <title>Snow Storm</title>
+      <link>http://example.org/snow-storm</link>
+    </item>
+  </channel>
+</rss>`
+
+	feed, err := parseFeed(bytes.NewReader([]byte(rss)))
+	require.NoError(t, err)
+	require.Equal(t, "https://hub.example.com/", feed.HubURL)
+	require.Equal(t, "http://example.org/rss", feed.SelfURL)
+	require.Equal(t, "http://example.org/snow-storm", feed.Items[0].URL)
+
+	atom := `<?xml version='1.0' encoding='UTF-8'?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>News</title>
+  <link rel="alternate" href="http://example.org/" />
+  <link rel="hub" href="https://hub.example.com/" />
+  <link rel="self" href="http://example.org/atom" />
+  <entry>
+    <title>Snow Storm</title>
+    <link href="http://example.org/snow-storm" />
+  </entry>
+</feed>`
+
+	feed, err = parseFeed(bytes.NewReader([]byte(atom)))
+	require.NoError(t, err)
+	require.Equal(t, "https://hub.example.com/", feed.HubURL)
+	require.Equal(t, "http://example.org/atom", feed.SelfURL)
+	require.Equal(t, "http://example.org/snow-storm", feed.Items[0].URL)
+}
+
+func TestNewSignatureHash(t *testing.T) {
+	body := []byte("content")
+
+	for _, method := range []string{"sha1", "sha256", "sha384", "sha512"} {
+		mac, _, err := newSignatureHash(method+"=00", "secret")
+		require.NoError(t, err, method)
+		mac.Write(body)
+		signature := method + "=" + hex.EncodeToString(mac.Sum(nil))
+
+		mac, expected, err := newSignatureHash(signature, "secret")
+		require.NoError(t, err, method)
+		mac.Write(body)
+		require.True(t, hmac.Equal(mac.Sum(nil), expected), method)
+
+		mac, expected, err = newSignatureHash(signature, "wrong")
+		require.NoError(t, err, method)
+		mac.Write(body)
+		require.False(t, hmac.Equal(mac.Sum(nil), expected), method)
+	}
+
+	for _, header := range []string{"", "sha256", "md5=00", "sha256=xyz"} {
+		_, _, err := newSignatureHash(header, "secret")
+		require.Error(t, err, header)
+	}
+}
+
+func signWebSubContent(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebSub(t *testing.T) {
+	pool := newConnPool(t)
+	logger := getLogger(t)
+
+	feedUpdater := newTestFeedUpdater(pool, logger)
+
+	webSubServer := httptest.NewServer(NewWebSubHandler(pool, feedUpdater, logger))
+	defer webSubServer.Close()
+	feedUpdater.WebSubRootURL = webSubServer.URL
+
+	subscribeRequests := make(chan url.Values, 1)
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		subscribeRequests <- r.PostForm
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hub.Close()
+
+	feedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `<`+hub.URL+`>; rel="hub"`)
+		w.Write([]byte(`<?xml version='1.0' encoding='UTF-8'?>
+<rss>
+  <channel>
+    <title>News</title>
+    <item>
+      <title>Snow Storm</title>
+      <link>http://example.org/snow-storm</link>
+    </item>
+  </channel>
+</rss>`))
+	}))
+	defer feedServer.Close()
+
+	userID, err := data.CreateUser(context.Background(), pool, newUser())
+	require.NoError(t, err)
+
+	err = data.InsertSubscription(context.Background(), pool, userID, feedServer.URL)
+	require.NoError(t, err)
+
+	feed, err := data.SelectFeedByURL(context.Background(), pool, feedServer.URL)
+	require.NoError(t, err)
+
+	result := feedUpdater.RefreshFeed(*feed)
+	require.Equal(t, FeedRefreshSuccess, result.Status)
+
+	var form url.Values
+	select {
+	case form = <-subscribeRequests:
+	default:
+		t.Fatal("hub did not receive subscription request")
+	}
+	require.Equal(t, "subscribe", form.Get("hub.mode"))
+	require.Equal(t, feedServer.URL, form.Get("hub.topic"))
+	callbackURL := form.Get("hub.callback")
+	require.Regexp(t, `\A`+regexp.QuoteMeta(webSubServer.URL+"/websub/"+strconv.FormatInt(int64(feed.ID), 10)+"/")+`[0-9a-f]{64}\z`, callbackURL)
+	secret := form.Get("hub.secret")
+	require.NotEmpty(t, secret)
+
+	// A second refresh does not resend a pending request.
+	result = feedUpdater.RefreshFeed(*feed)
+	require.Equal(t, FeedRefreshSuccess, result.Status)
+	require.Len(t, subscribeRequests, 0)
+
+	verifyURL := func(callbackURL, mode, topic string) (int, string) {
+		query := url.Values{
+			"hub.mode":          {mode},
+			"hub.topic":         {topic},
+			"hub.challenge":     {"challenge-123"},
+			"hub.lease_seconds": {"3600"},
+		}
+		resp, err := http.Get(callbackURL + "?" + query.Encode())
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	verify := func(mode, topic string) (int, string) {
+		return verifyURL(callbackURL, mode, topic)
+	}
+
+	status, _ := verify("subscribe", "http://example.org/other")
+	require.Equal(t, http.StatusNotFound, status)
+
+	wrongTokenURL := callbackURL[:strings.LastIndexByte(callbackURL, '/')+1] + strings.Repeat("0", 64)
+	status, _ = verifyURL(wrongTokenURL, "subscribe", feedServer.URL)
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, body := verify("subscribe", feedServer.URL)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "challenge-123", body)
+
+	sub, err := data.SelectWebSubSubscriptionByFeedID(context.Background(), pool, feed.ID)
+	require.NoError(t, err)
+	require.True(t, sub.LeaseExpirationTime.Valid)
+
+	// A verification without a pending subscription request cannot extend the lease.
+	status, _ = verify("subscribe", feedServer.URL)
+	require.Equal(t, http.StatusNotFound, status)
+
+	_, err = pool.Exec(context.Background(), `update feeds set etag='"v1"' where id=$1`, feed.ID)
+	require.NoError(t, err)
+
+	countItems := func() int {
+		var n int
+		err := pool.QueryRow(context.Background(), "select count(*) from items where feed_id=$1", feed.ID).Scan(&n)
+		require.NoError(t, err)
+		return n
+	}
+	require.Equal(t, 1, countItems())
+
+	content := []byte(`<?xml version='1.0' encoding='UTF-8'?>
+<rss>
+  <channel>
+    <title>News</title>
+    <item>
+      <title>Blizzard</title>
+      <link>http://example.org/blizzard</link>
+    </item>
+  </channel>
+</rss>`)
+
+	push := func(url, signature string) int {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(content))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/rss+xml")
+		req.Header.Set("X-Hub-Signature", signature)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Content with an invalid signature is acknowledged but ignored.
+	status = push(callbackURL, signWebSubContent("wrong", content))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 1, countItems())
+
+	status = push(callbackURL, signWebSubContent(secret, content))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 2, countItems())
+
+	feed, err = data.SelectFeedByPK(context.Background(), pool, feed.ID)
+	require.NoError(t, err)
+	require.Equal(t, `"v1"`, feed.ETag.String, "pushed content keeps the ETag of the last fetch")
+
+	status = push(wrongTokenURL, signWebSubContent(secret, content))
+	require.Equal(t, http.StatusGone, status)
+
+	status = push(webSubServer.URL+"/websub/0/"+strings.Repeat("0", 64), signWebSubContent(secret, content))
+	require.Equal(t, http.StatusGone, status)
+
+	status, _ = verify("denied", feedServer.URL)
+	require.Equal(t, http.StatusOK, status)
+	_, err = data.SelectWebSubSubscriptionByFeedID(context.Background(), pool, feed.ID)
+	require.Error(t, err)
+}
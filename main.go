@@ -4,13 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
 	"net/smtp"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	log15adapter "github.com/jackc/pgx-log15"
-	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgx/v5/tracelog"
 	"github.com/jackc/tpr/backend"
@@ -54,6 +59,76 @@ func main() {
 			},
 			Action: ResetPassword,
 		},
+		{
+			Name:        "disable-two-factor",
+			Usage:       "disable a user's two-factor authentication",
+			Description: "disable two-factor authentication and delete recovery codes for a user who has lost both",
+			ArgsUsage:   "<username>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "tpr.conf", Usage: "path to config file"},
+			},
+			Action: DisableTwoFactor,
+		},
+		{
+			Name:        "set-admin",
+			Usage:       "grant or revoke a user's administrator role",
+			Description: "grant a user the administrator role -- use this to create the first administrator",
+			ArgsUsage:   "<username>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "tpr.conf", Usage: "path to config file"},
+				cli.BoolFlag{Name: "revoke", Usage: "revoke the administrator role instead"},
+			},
+			Action: SetAdmin,
+		},
+		{
+			Name:        "update-feeds",
+			Usage:       "run the feed updater",
+			Description: "run the feed updater as a dedicated process -- multiple processes may run concurrently",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "tpr.conf", Usage: "path to config file"},
+				cli.BoolFlag{Name: "once", Usage: "refresh stale feeds once and exit"},
+			},
+			Action: UpdateFeeds,
+		},
+		{
+			Name:        "refresh-feed",
+			Usage:       "refresh a feed now",
+			Description: "refresh a feed identified by URL or ID immediately",
+			ArgsUsage:   "<url|id>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "tpr.conf", Usage: "path to config file"},
+			},
+			Action: RefreshFeed,
+		},
+		{
+			Name:        "prune",
+			Usage:       "delete old items",
+			Description: "delete items according to the retention policy in the [retention] section of the config file",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "tpr.conf", Usage: "path to config file"},
+				cli.BoolFlag{Name: "dry-run, n", Usage: "report what would be deleted without deleting anything"},
+			},
+			Action: Prune,
+		},
+		{
+			Name:        "send-digests",
+			Usage:       "send due email digests",
+			Description: "mail digests of unread items to users whose digest is due",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "tpr.conf", Usage: "path to config file"},
+			},
+			Action: SendDigests,
+		},
+		{
+			Name:        "maintenance",
+			Usage:       "run maintenance",
+			Description: "expire sessions, delete unsubscribed feeds, purge completed password resets, and prune items",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "config, c", Value: "tpr.conf", Usage: "path to config file"},
+				cli.BoolFlag{Name: "dry-run, n", Usage: "report what would be removed without removing anything"},
+			},
+			Action: Maintain,
+		},
 	}
 
 	app.Run(os.Args)
@@ -145,6 +220,73 @@ func loadHTTPConfig(c *cli.Context, conf ini.File) (backend.HTTPConfig, error) {
 	config.ListenPort = c.String("port")
 	config.StaticURL = c.String("static-url")
 
+	var err error
+	config.SessionPolicy, err = loadSessionPolicy(conf)
+	if err != nil {
+		return config, err
+	}
+
+	if secureCookies, _ := conf.Get("server", "secure_cookies"); secureCookies == "true" {
+		config.SecureCookies = true
+	}
+
+	if d, ok, err := parseDuration(conf, "mail", "password_reset_lifetime_minutes", time.Minute); err != nil {
+		return config, err
+	} else if ok {
+		config.PasswordResetLifetime = d
+	}
+
+	if rpID, ok := conf.Get("webauthn", "rp_id"); ok {
+		var origins []string
+		if s, ok := conf.Get("webauthn", "origins"); ok {
+			for _, origin := range strings.Split(s, ",") {
+				origins = append(origins, strings.TrimSpace(origin))
+			}
+		}
+
+		config.WebAuthn, err = backend.NewWebAuthn(rpID, origins)
+		if err != nil {
+			return config, fmt.Errorf("Bad webauthn: %v", err)
+		}
+	}
+
+	if issuer, ok := conf.Get("oidc", "issuer"); ok {
+		oidcConfig := backend.OIDCConfig{Issuer: issuer}
+		oidcConfig.ClientID, _ = conf.Get("oidc", "client_id")
+		oidcConfig.ClientSecret, _ = conf.Get("oidc", "client_secret")
+		oidcConfig.RedirectURL, _ = conf.Get("oidc", "redirect_url")
+		oidcConfig.Name, _ = conf.Get("oidc", "name")
+		if autoProvision, _ := conf.Get("oidc", "auto_provision"); autoProvision == "true" {
+			oidcConfig.AutoProvision = true
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		config.OIDC, err = backend.NewOIDCAuthenticator(ctx, oidcConfig)
+		cancel()
+		if err != nil {
+			return config, fmt.Errorf("Bad oidc: %v", err)
+		}
+	}
+
+	if header, ok := conf.Get("proxy_auth", "header"); ok {
+		proxyAuth := &backend.ProxyAuthConfig{Header: header}
+		s, _ := conf.Get("proxy_auth", "trusted_proxies")
+		for _, cidr := range strings.Split(s, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return config, fmt.Errorf("Bad proxy_auth trusted_proxies: %v", err)
+			}
+			proxyAuth.TrustedProxies = append(proxyAuth.TrustedProxies, prefix)
+		}
+		if len(proxyAuth.TrustedProxies) == 0 {
+			return config, errors.New("Missing proxy_auth trusted_proxies")
+		}
+		config.ProxyAuth = proxyAuth
+	}
+
 	var ok bool
 	if !c.IsSet("address") {
 		if config.ListenAddress, ok = conf.Get("server", "address"); !ok {
@@ -163,17 +305,13 @@ func loadHTTPConfig(c *cli.Context, conf ini.File) (backend.HTTPConfig, error) {
 
 func newMailer(conf ini.File, logger log.Logger) (backend.Mailer, error) {
 	mailConf := conf.Section("mail")
-	if len(mailConf) == 0 {
-		return nil, nil
-	}
 
-	smtpAddr, ok := mailConf["smtp_server"]
+	transportName, ok := mailConf["transport"]
 	if !ok {
-		return nil, errors.New("Missing mail -- smtp_server")
-	}
-	smtpPort, _ := mailConf["port"]
-	if smtpPort == "" {
-		smtpPort = "587"
+		if _, ok := mailConf["smtp_server"]; !ok {
+			return nil, nil
+		}
+		transportName = "smtp"
 	}
 
 	fromAddr, ok := mailConf["from_address"]
@@ -186,24 +324,199 @@ func newMailer(conf ini.File, logger log.Logger) (backend.Mailer, error) {
 		return nil, errors.New("Missing mail -- root_url")
 	}
 
-	username, _ := mailConf["username"]
-	password, _ := mailConf["password"]
+	templates, err := backend.LoadMailTemplates(mailConf["templates_dir"])
+	if err != nil {
+		return nil, fmt.Errorf("Bad mail -- templates_dir: %v", err)
+	}
+
+	var transport backend.MailTransport
+	switch transportName {
+	case "smtp":
+		smtpAddr, ok := mailConf["smtp_server"]
+		if !ok {
+			return nil, errors.New("Missing mail -- smtp_server")
+		}
+
+		tlsMode := backend.SMTPTLSMode(mailConf["tls"])
+		switch tlsMode {
+		case "":
+			tlsMode = backend.SMTPTLSStartTLS
+			if mailConf["port"] == "465" {
+				tlsMode = backend.SMTPTLSImplicit
+			}
+		case backend.SMTPTLSStartTLS, backend.SMTPTLSImplicit, backend.SMTPTLSNone:
+		default:
+			return nil, fmt.Errorf("Bad mail -- tls: %s", tlsMode)
+		}
 
-	auth := smtp.PlainAuth("", username, password, smtpAddr)
+		smtpPort, _ := mailConf["port"]
+		if smtpPort == "" {
+			smtpPort = "587"
+			if tlsMode == backend.SMTPTLSImplicit {
+				smtpPort = "465"
+			}
+		}
 
-	logger = logger.New("module", "mail")
+		smtpTransport := &backend.SMTPTransport{
+			Addr: net.JoinHostPort(smtpAddr, smtpPort),
+			TLS:  tlsMode,
+		}
+		if username, ok := mailConf["username"]; ok {
+			smtpTransport.Auth = smtp.PlainAuth("", username, mailConf["password"], smtpAddr)
+		}
+		transport = smtpTransport
+	case "sendmail":
+		sendmailPath, ok := mailConf["sendmail_path"]
+		if !ok {
+			sendmailPath = "/usr/sbin/sendmail"
+		}
+		transport = &backend.SendmailTransport{Path: sendmailPath}
+	case "maildir":
+		dir, ok := mailConf["maildir"]
+		if !ok {
+			return nil, errors.New("Missing mail -- maildir")
+		}
+		transport = &backend.MaildirTransport{Dir: dir}
+	default:
+		return nil, fmt.Errorf("Bad mail -- transport: %s", transportName)
+	}
 
-	mailer := &backend.SMTPMailer{
-		ServerAddr: smtpAddr + ":" + smtpPort,
-		Auth:       auth,
-		From:       fromAddr,
-		RootURL:    rootURL,
-		Logger:     logger,
+	mailer := &backend.TemplateMailer{
+		From:      fromAddr,
+		RootURL:   rootURL,
+		Templates: templates,
+		Transport: transport,
+		Logger:    logger.New("module", "mail"),
 	}
 
 	return mailer, nil
 }
 
+func newFeedUpdater(conf ini.File, pool *pgxpool.Pool, logger log.Logger) (*backend.FeedUpdater, error) {
+	feedUpdater := backend.NewFeedUpdater(pool, logger.New("module", "feedUpdater"))
+
+	if s, ok := conf.Get("feed_updater", "fetch_history_size"); ok {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad feed_updater -- fetch_history_size: %v", err)
+		}
+		feedUpdater.FetchHistorySize = int(n)
+	}
+
+	if s, ok := conf.Get("feed_updater", "max_body_size"); ok {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad feed_updater -- max_body_size: %v", err)
+		}
+		feedUpdater.MaxBodySize = n
+	}
+
+	if s, ok := conf.Get("feed_updater", "allowed_networks"); ok {
+		networks, err := backend.ParseNetworks(s)
+		if err != nil {
+			return nil, fmt.Errorf("Bad feed_updater -- allowed_networks: %v", err)
+		}
+		feedUpdater.AllowedNetworks = networks
+	}
+
+	if s, ok := conf.Get("feed_updater", "blocked_networks"); ok {
+		networks, err := backend.ParseNetworks(s)
+		if err != nil {
+			return nil, fmt.Errorf("Bad feed_updater -- blocked_networks: %v", err)
+		}
+		feedUpdater.BlockedNetworks = networks
+	}
+
+	if s, ok := conf.Get("websub", "root_url"); ok {
+		if _, err := url.Parse(s); err != nil {
+			return nil, fmt.Errorf("Bad websub -- root_url: %v", err)
+		}
+		feedUpdater.WebSubRootURL = s
+	}
+
+	return feedUpdater, nil
+}
+
+func newItemPruner(conf ini.File, pool *pgxpool.Pool, logger log.Logger) (*backend.ItemPruner, error) {
+	itemPruner := backend.NewItemPruner(pool, logger.New("module", "itemPruner"))
+
+	if s, ok := conf.Get("retention", "max_items_per_feed"); ok {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Bad retention -- max_items_per_feed: %s", s)
+		}
+		itemPruner.Policy.MaxItemsPerFeed = int(n)
+	}
+
+	if d, ok, err := parseDays(conf, "retention", "max_age_days"); err != nil {
+		return nil, err
+	} else if ok {
+		itemPruner.Policy.MaxAge = d
+	}
+
+	return itemPruner, nil
+}
+
+// parseDays parses the number of days in the config file key in section into a duration.
+func parseDays(conf ini.File, section, key string) (time.Duration, bool, error) {
+	return parseDuration(conf, section, key, 24*time.Hour)
+}
+
+// parseDuration parses the number of units in the config file key in section into a duration.
+func parseDuration(conf ini.File, section, key string, unit time.Duration) (time.Duration, bool, error) {
+	s, ok := conf.Get(section, key)
+	if !ok {
+		return 0, false, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || n < 0 {
+		return 0, false, fmt.Errorf("Bad %s -- %s: %s", section, key, s)
+	}
+
+	return time.Duration(n) * unit, true, nil
+}
+
+func loadSessionPolicy(conf ini.File) (backend.SessionPolicy, error) {
+	policy := backend.DefaultSessionPolicy
+
+	if d, ok, err := parseDays(conf, "sessions", "idle_lifetime_days"); err != nil {
+		return policy, err
+	} else if ok {
+		policy.IdleLifetime = d
+	}
+
+	if d, ok, err := parseDays(conf, "sessions", "absolute_lifetime_days"); err != nil {
+		return policy, err
+	} else if ok {
+		policy.AbsoluteLifetime = d
+	}
+
+	return policy, nil
+}
+
+func newMaintenance(conf ini.File, pool *pgxpool.Pool, logger log.Logger) (*backend.Maintenance, error) {
+	itemPruner, err := newItemPruner(conf, pool, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance := backend.NewMaintenance(pool, itemPruner, logger.New("module", "maintenance"))
+
+	maintenance.SessionPolicy, err = loadSessionPolicy(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if d, ok, err := parseDays(conf, "maintenance", "password_reset_retention_days"); err != nil {
+		return nil, err
+	} else if ok {
+		maintenance.PasswordResetRetention = d
+	}
+
+	return maintenance, nil
+}
+
 func Serve(c *cli.Context) {
 	conf, err := loadConfig(c.String("config"))
 	if err != nil {
@@ -235,10 +548,29 @@ func Serve(c *cli.Context) {
 		os.Exit(1)
 	}
 
-	feedUpdater := backend.NewFeedUpdater(pool, logger.New("module", "feedUpdater"))
-	go feedUpdater.KeepFeedsFresh()
+	feedUpdater, err := newFeedUpdater(conf, pool, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if inServer, _ := conf.Get("feed_updater", "in_server"); inServer != "false" {
+		go feedUpdater.KeepFeedsFresh()
+	}
+
+	maintenance, err := newMaintenance(conf, pool, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if inServer, _ := conf.Get("maintenance", "in_server"); inServer != "false" {
+		go maintenance.KeepMaintaining()
+	}
+
+	if inServer, _ := conf.Get("digests", "in_server"); mailer != nil && inServer != "false" {
+		go backend.NewDigestSender(pool, mailer, logger.New("module", "digests")).KeepSending()
+	}
 
-	server, err := backend.NewAppServer(httpConfig, pool, mailer, logger)
+	server, err := backend.NewAppServer(httpConfig, pool, mailer, feedUpdater, logger)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Could not create web server: %v\n", err)
 		os.Exit(1)
@@ -289,10 +621,22 @@ func ResetPassword(c *cli.Context) {
 		os.Exit(1)
 	}
 
-	update := &data.User{Name: pgtype.Text{String: name, Valid: true}}
-	backend.SetPassword(update, password)
+	err = backend.SetPassword(user, password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	err = data.UpdateUser(context.Background(), pool, user.ID.Int32, update)
+	err = pgx.BeginFunc(context.Background(), pool, func(tx pgx.Tx) error {
+		err := data.UpdateUser(context.Background(), tx, user.ID.Int32, user)
+		if err != nil {
+			return err
+		}
+
+		// Whoever knew the old password may still be signed in.
+		_, err = data.DeleteSessionsByUserID(context.Background(), tx, user.ID.Int32, nil)
+		return err
+	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -301,3 +645,337 @@ func ResetPassword(c *cli.Context) {
 	fmt.Println("User:", name)
 	fmt.Println("Password:", password)
 }
+
+func DisableTwoFactor(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		os.Exit(1)
+	}
+
+	name := c.Args()[0]
+
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	pool, err := newPool(conf, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	user, err := data.SelectUserByName(context.Background(), pool, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = data.DeleteTwoFactor(context.Background(), pool, user.ID.Int32)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = data.InsertAuditLogEntry(context.Background(), pool, &data.AuditLogEntry{
+		Event:     "two_factor_disabled",
+		UserID:    user.ID,
+		Details:   map[string]any{"by": "admin"},
+		EventTime: time.Now(),
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Two-factor authentication disabled for", name)
+}
+
+func SetAdmin(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		os.Exit(1)
+	}
+
+	name := c.Args()[0]
+	isAdmin := !c.Bool("revoke")
+
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	pool, err := newPool(conf, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	user, err := data.SelectUserByName(context.Background(), pool, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = data.UpdateUserAdmin(context.Background(), pool, user.ID.Int32, isAdmin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	event := "admin_role_revoked"
+	if isAdmin {
+		event = "admin_role_granted"
+	}
+	err = data.InsertAuditLogEntry(context.Background(), pool, &data.AuditLogEntry{
+		Event:     event,
+		UserID:    user.ID,
+		Details:   map[string]any{"userID": user.ID.Int32, "by": "admin"},
+		EventTime: time.Now(),
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if isAdmin {
+		fmt.Println("Administrator role granted to", name)
+	} else {
+		fmt.Println("Administrator role revoked from", name)
+	}
+}
+
+func UpdateFeeds(c *cli.Context) {
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	pool, err := newPool(conf, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	feedUpdater, err := newFeedUpdater(conf, pool, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if c.Bool("once") {
+		feedUpdater.RefreshStaleFeeds()
+		return
+	}
+
+	feedUpdater.KeepFeedsFresh()
+}
+
+func RefreshFeed(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		os.Exit(1)
+	}
+
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	pool, err := newPool(conf, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var feed *data.Feed
+	if id, parseErr := strconv.ParseInt(c.Args()[0], 10, 32); parseErr == nil {
+		feed, err = data.SelectFeedByPK(context.Background(), pool, int32(id))
+	} else {
+		feed, err = data.SelectFeedByURL(context.Background(), pool, c.Args()[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	feedUpdater, err := newFeedUpdater(conf, pool, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	result, err := feedUpdater.RefreshFeedNow(*feed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Feed:", feed.URL)
+	fmt.Println("Status:", result.Status)
+	fmt.Println("New items:", result.NewItemCount)
+	if result.Error != "" {
+		fmt.Println("Error:", result.Error)
+		os.Exit(1)
+	}
+}
+
+func Prune(c *cli.Context) {
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	pool, err := newPool(conf, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	itemPruner, err := newItemPruner(conf, pool, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !itemPruner.Policy.Enabled() {
+		fmt.Fprintln(os.Stderr, "No retention policy is configured. Set max_items_per_feed or max_age_days in the [retention] section.")
+		os.Exit(1)
+	}
+
+	dryRun := c.Bool("dry-run")
+	prunedFeeds, err := itemPruner.Prune(dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var itemCount int64
+	for _, pf := range prunedFeeds {
+		fmt.Printf("%d\t%s\n", pf.ItemCount, pf.FeedURL)
+		itemCount += pf.ItemCount
+	}
+
+	if dryRun {
+		fmt.Printf("Would delete %d items from %d feeds\n", itemCount, len(prunedFeeds))
+	} else {
+		fmt.Printf("Deleted %d items from %d feeds\n", itemCount, len(prunedFeeds))
+	}
+}
+
+func Maintain(c *cli.Context) {
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	pool, err := newPool(conf, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	maintenance, err := newMaintenance(conf, pool, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	dryRun := c.Bool("dry-run")
+	report, err := maintenance.Run(dryRun)
+
+	if dryRun {
+		fmt.Println("Would remove:")
+	} else {
+		fmt.Println("Removed:")
+	}
+	fmt.Println("Expired sessions:", report.ExpiredSessionCount)
+	fmt.Println("Unsubscribed feeds:", report.OrphanedFeedCount)
+	fmt.Println("Old password resets:", report.PasswordResetCount)
+	fmt.Println("Old email verifications:", report.EmailVerificationCount)
+	fmt.Println("Expired authentication attempts:", report.AuthAttemptCount)
+	fmt.Println("Pruned items:", report.PrunedItemCount())
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func SendDigests(c *cli.Context) {
+	conf, err := loadConfig(c.String("config"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := newLogger(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	pool, err := newPool(conf, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	mailer, err := newMailer(conf, logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if mailer == nil {
+		fmt.Fprintln(os.Stderr, "Mail is not configured")
+		os.Exit(1)
+	}
+
+	digestSender := backend.NewDigestSender(pool, mailer, logger.New("module", "digests"))
+	n, err := digestSender.Run()
+	fmt.Println("Sent digests:", n)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,7 @@
+alter table feeds add column claim_expiration_time timestamptz;
+
+comment on column feeds.claim_expiration_time is 'a feed updater process has claimed this feed for fetching until this time';
+
+---- create above / drop below ----
+
+alter table feeds drop column claim_expiration_time;
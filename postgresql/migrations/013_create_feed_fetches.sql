@@ -0,0 +1,20 @@
+create table feed_fetches(
+  id bigserial primary key,
+  feed_id integer not null references feeds on delete cascade,
+  fetch_time timestamptz not null,
+  http_status integer,
+  duration_ms integer not null,
+  byte_count integer,
+  etag_hit boolean not null default false,
+  new_item_count integer,
+  error varchar
+);
+
+create index on feed_fetches (feed_id, fetch_time);
+
+grant select, insert, update, delete on feed_fetches to {{.app_user}};
+grant usage on sequence feed_fetches_id_seq to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table feed_fetches;
@@ -0,0 +1,20 @@
+create table websub_subscriptions(
+  feed_id integer primary key references feeds on delete cascade,
+  hub_url varchar not null,
+  topic_url varchar not null,
+  secret varchar not null,
+  callback_token varchar not null,
+  subscribe_request_time timestamptz,
+  lease_seconds integer,
+  verification_time timestamptz,
+  lease_expiration_time timestamptz
+);
+
+comment on table websub_subscriptions is 'WebSub (PubSubHubbub) subscriptions to hubs that push feed updates';
+comment on column websub_subscriptions.callback_token is 'Unguessable part of the callback URL that authenticates hub requests';
+
+grant select, insert, update, delete on websub_subscriptions to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table websub_subscriptions;
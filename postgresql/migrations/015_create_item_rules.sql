@@ -0,0 +1,58 @@
+alter table items
+  add column author varchar,
+  add column content text;
+
+create table starred_items(
+  user_id integer not null references users on delete cascade,
+  item_id integer not null references items on delete cascade,
+  creation_time timestamptz not null default now(),
+  primary key(user_id, item_id)
+);
+
+create index on starred_items (item_id);
+
+grant select, insert, update, delete on starred_items to {{.app_user}};
+
+create table item_tags(
+  user_id integer not null references users on delete cascade,
+  item_id integer not null references items on delete cascade,
+  tag varchar not null,
+  primary key(user_id, item_id, tag)
+);
+
+create index on item_tags (item_id);
+
+grant select, insert, update, delete on item_tags to {{.app_user}};
+
+create table item_rules(
+  id serial primary key,
+  user_id integer not null references users on delete cascade,
+  name varchar not null,
+  feed_id integer references feeds on delete cascade,
+  field varchar not null check (field in ('title', 'content', 'title_or_content', 'author')),
+  match_type varchar not null check (match_type in ('keywords', 'regex')),
+  pattern varchar not null,
+  regex varchar not null,
+  action varchar not null check (action in ('skip_unread', 'star', 'tag')),
+  tag varchar,
+  creation_time timestamptz not null default now(),
+  check ((action = 'tag') = (tag is not null))
+);
+
+create index on item_rules (user_id);
+
+comment on column item_rules.feed_id is 'null matches items from all feeds';
+comment on column item_rules.regex is 'case insensitive PostgreSQL regular expression built from match_type and pattern';
+
+grant select, insert, update, delete on item_rules to {{.app_user}};
+grant usage on sequence item_rules_id_seq to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table item_rules;
+drop table item_tags;
+drop table starred_items;
+
+alter table items
+  drop column author,
+  drop column content;
@@ -0,0 +1,11 @@
+alter table items add column in_feed_document boolean not null default true;
+
+comment on column items.in_feed_document is 'item was in the most recently fetched feed document so pruning it would cause it to be inserted again';
+
+create index on unread_items (item_id);
+
+---- create above / drop below ----
+
+drop index unread_items_item_id_idx;
+
+alter table items drop column in_feed_document;
@@ -0,0 +1,5 @@
+alter table sessions add column last_seen_time timestamptz not null default now();
+
+---- create above / drop below ----
+
+alter table sessions drop column last_seen_time;
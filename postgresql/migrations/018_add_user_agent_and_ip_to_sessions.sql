@@ -0,0 +1,16 @@
+alter table sessions
+  add column user_agent varchar,
+  add column ip inet;
+
+create index on sessions (user_id);
+
+comment on column sessions.user_agent is 'user agent of the most recent request';
+comment on column sessions.ip is 'IP address of the most recent request';
+
+---- create above / drop below ----
+
+drop index sessions_user_id_idx;
+
+alter table sessions
+  drop column user_agent,
+  drop column ip;
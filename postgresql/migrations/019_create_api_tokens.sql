@@ -0,0 +1,20 @@
+create table api_tokens(
+  id serial primary key,
+  user_id integer not null references users on delete cascade,
+  name varchar not null check (name <> ''),
+  token_digest bytea not null unique,
+  scope varchar not null check (scope in ('read_only', 'read_write')),
+  creation_time timestamptz not null default now(),
+  last_used_time timestamptz
+);
+
+create index on api_tokens (user_id);
+
+comment on column api_tokens.token_digest is 'SHA-256 digest of the token. The token itself is only shown when it is created.';
+
+grant select, insert, update, delete on api_tokens to {{.app_user}};
+grant usage on sequence api_tokens_id_seq to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table api_tokens;
@@ -0,0 +1,7 @@
+alter table users add column fever_api_key_digest bytea unique;
+
+comment on column users.fever_api_key_digest is 'SHA-256 digest of the Fever API key, md5(name:password), or null if the Fever API is disabled';
+
+---- create above / drop below ----
+
+alter table users drop column fever_api_key_digest;
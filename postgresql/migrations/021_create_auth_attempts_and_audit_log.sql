@@ -0,0 +1,35 @@
+create table auth_attempts(
+  id bigserial primary key,
+  action varchar not null check (action in ('login', 'password_reset', 'fever')),
+  ip inet,
+  account varchar not null,
+  attempt_time timestamptz not null default now()
+);
+
+create index on auth_attempts (action, ip, attempt_time);
+create index on auth_attempts (action, account, attempt_time);
+
+comment on table auth_attempts is 'Attempts that count toward rate limits: failed logins, password reset requests, and unknown Fever API keys';
+comment on column auth_attempts.account is 'lower case user name or email the attempt was for';
+
+grant select, insert, update, delete on auth_attempts to {{.app_user}};
+grant usage on sequence auth_attempts_id_seq to {{.app_user}};
+
+create table audit_log(
+  id bigserial primary key,
+  event varchar not null,
+  user_id integer references users on delete set null,
+  ip inet,
+  details jsonb not null default '{}',
+  event_time timestamptz not null default now()
+);
+
+create index on audit_log (event_time);
+
+grant select, insert on audit_log to {{.app_user}};
+grant usage on sequence audit_log_id_seq to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table audit_log;
+drop table auth_attempts;
@@ -0,0 +1,38 @@
+-- Passwords were hashed with scrypt N=16384, r=8, p=1 into separate digest and salt columns. Convert them to PHC
+-- strings so the algorithm and parameters are stored with each hash. PHC uses base64 without padding.
+alter table users add column password_hash varchar;
+
+update users
+set password_hash = '$scrypt$ln=14,r=8,p=1$'
+  || rtrim(encode(password_salt, 'base64'), '=')
+  || '$'
+  || rtrim(encode(password_digest, 'base64'), '=');
+
+alter table users
+  alter column password_hash set not null,
+  drop column password_digest,
+  drop column password_salt;
+
+comment on column users.password_hash is 'PHC string format password hash';
+
+---- create above / drop below ----
+
+-- Only scrypt hashes can be converted back. Users with other hashes must reset their password.
+alter table users
+  add column password_digest bytea,
+  add column password_salt bytea;
+
+update users
+set password_salt = decode(rpad(split_part(password_hash, '$', 4), (length(split_part(password_hash, '$', 4)) + 3) / 4 * 4, '='), 'base64'),
+  password_digest = decode(rpad(split_part(password_hash, '$', 5), (length(split_part(password_hash, '$', 5)) + 3) / 4 * 4, '='), 'base64')
+where password_hash like '$scrypt$ln=14,r=8,p=1$%';
+
+update users
+set password_salt = '',
+  password_digest = ''
+where password_digest is null;
+
+alter table users
+  alter column password_digest set not null,
+  alter column password_salt set not null,
+  drop column password_hash;
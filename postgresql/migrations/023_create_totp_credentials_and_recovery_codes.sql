@@ -0,0 +1,30 @@
+create table totp_credentials(
+  user_id integer primary key references users on delete cascade,
+  secret bytea not null,
+  creation_time timestamptz not null default now(),
+  confirmation_time timestamptz,
+  last_used_step bigint
+);
+
+comment on table totp_credentials is 'TOTP secrets for two-factor authentication. A secret is pending until confirmed with a code.';
+comment on column totp_credentials.last_used_step is 'time step of the last accepted code so codes cannot be replayed';
+
+grant select, insert, update, delete on totp_credentials to {{.app_user}};
+
+create table recovery_codes(
+  id serial primary key,
+  user_id integer not null references users on delete cascade,
+  code_digest bytea not null,
+  used_time timestamptz,
+  unique (user_id, code_digest)
+);
+
+comment on column recovery_codes.code_digest is 'SHA-256 digest of the recovery code. The codes are only shown when they are generated.';
+
+grant select, insert, update, delete on recovery_codes to {{.app_user}};
+grant usage on sequence recovery_codes_id_seq to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table recovery_codes;
+drop table totp_credentials;
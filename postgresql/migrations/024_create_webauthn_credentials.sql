@@ -0,0 +1,45 @@
+alter table users add column webauthn_user_handle bytea unique;
+
+comment on column users.webauthn_user_handle is 'random WebAuthn user handle that passkeys return to identify the user';
+
+create table webauthn_credentials(
+  id serial primary key,
+  user_id integer not null references users on delete cascade,
+  name varchar not null check (name <> ''),
+  credential_id bytea not null unique,
+  credential jsonb not null,
+  creation_time timestamptz not null default now(),
+  last_used_time timestamptz
+);
+
+create index on webauthn_credentials (user_id);
+
+comment on column webauthn_credentials.credential is 'public key, sign count, and flags of the credential as stored by go-webauthn';
+
+grant select, insert, update, delete on webauthn_credentials to {{.app_user}};
+grant usage on sequence webauthn_credentials_id_seq to {{.app_user}};
+
+create table webauthn_ceremonies(
+  id bytea primary key,
+  user_id integer references users on delete cascade,
+  session_data jsonb not null,
+  expiration_time timestamptz not null
+);
+
+comment on table webauthn_ceremonies is 'challenges of WebAuthn registrations and logins that have begun but not finished';
+
+grant select, insert, update, delete on webauthn_ceremonies to {{.app_user}};
+
+-- Starting a passkey login is rate limited per IP address.
+alter table auth_attempts drop constraint auth_attempts_action_check;
+alter table auth_attempts add constraint auth_attempts_action_check check (action in ('login', 'password_reset', 'fever', 'passkey_login'));
+
+---- create above / drop below ----
+
+delete from auth_attempts where action = 'passkey_login';
+alter table auth_attempts drop constraint auth_attempts_action_check;
+alter table auth_attempts add constraint auth_attempts_action_check check (action in ('login', 'password_reset', 'fever'));
+
+drop table webauthn_ceremonies;
+drop table webauthn_credentials;
+alter table users drop column webauthn_user_handle;
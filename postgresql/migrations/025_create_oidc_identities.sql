@@ -0,0 +1,18 @@
+create table oidc_identities(
+  issuer varchar not null,
+  subject varchar not null,
+  user_id integer not null references users on delete cascade,
+  creation_time timestamptz not null default now(),
+  last_login_time timestamptz,
+  primary key (issuer, subject)
+);
+
+create index on oidc_identities (user_id);
+
+comment on table oidc_identities is 'Accounts at OpenID Connect providers linked to users';
+
+grant select, insert, update, delete on oidc_identities to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table oidc_identities;
@@ -0,0 +1,37 @@
+alter table users add column email_verified boolean not null default false;
+
+-- Addresses entered before verification existed have been receiving password reset mail so they are treated as
+-- verified.
+update users set email_verified = true where email is not null;
+
+comment on column users.email_verified is 'True once the owner of email has confirmed it';
+
+create table email_verifications(
+  token_digest bytea primary key,
+  user_id integer not null references users on delete cascade,
+  email varchar not null,
+  request_ip inet,
+  request_time timestamptz not null,
+  completion_ip inet,
+  completion_time timestamptz,
+  check((completion_ip is null) = (completion_time is null))
+);
+
+create index on email_verifications (user_id);
+
+comment on table email_verifications is 'Confirmations of email addresses sent to users. Addresses take effect when confirmed.';
+comment on column email_verifications.token_digest is 'SHA-256 digest of the token sent in the verification mail';
+
+grant select, insert, update, delete on email_verifications to {{.app_user}};
+
+alter table auth_attempts drop constraint auth_attempts_action_check;
+alter table auth_attempts add constraint auth_attempts_action_check check (action in ('login', 'password_reset', 'email_verification', 'fever', 'passkey_login'));
+
+---- create above / drop below ----
+
+delete from auth_attempts where action = 'email_verification';
+alter table auth_attempts drop constraint auth_attempts_action_check;
+alter table auth_attempts add constraint auth_attempts_action_check check (action in ('login', 'password_reset', 'fever', 'passkey_login'));
+
+drop table email_verifications;
+alter table users drop column email_verified;
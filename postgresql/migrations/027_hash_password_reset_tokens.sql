@@ -0,0 +1,19 @@
+-- Outstanding tokens keep working since the digest of the token in the mail is looked up.
+alter table password_resets add column token_digest bytea;
+update password_resets set token_digest = sha256(convert_to(token, 'UTF8'));
+alter table password_resets drop column token;
+alter table password_resets alter column token_digest set not null;
+alter table password_resets add primary key (token_digest);
+
+create index on password_resets (user_id);
+
+comment on column password_resets.token_digest is 'SHA-256 digest of the token sent in the password reset mail';
+
+---- create above / drop below ----
+
+-- The tokens cannot be recovered from their digests so outstanding password resets stop working.
+alter table password_resets add column token varchar;
+update password_resets set token = encode(token_digest, 'hex');
+alter table password_resets drop column token_digest;
+alter table password_resets alter column token set not null;
+alter table password_resets add primary key (token);
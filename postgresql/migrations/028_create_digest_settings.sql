@@ -0,0 +1,26 @@
+create table digest_settings(
+  user_id integer primary key references users on delete cascade,
+  frequency varchar not null check (frequency in ('daily', 'weekly')),
+  weekday smallint not null default 1 check (weekday between 0 and 6),
+  hour smallint not null check (hour between 0 and 23),
+  time_zone varchar not null default 'UTC',
+  max_items integer not null check (max_items between 1 and 500),
+  feed_ids integer[],
+  mark_read boolean not null default false,
+  next_send_time timestamptz not null,
+  last_send_time timestamptz
+);
+
+create index on digest_settings (next_send_time);
+
+comment on table digest_settings is 'Users who receive an email digest of their unread items';
+comment on column digest_settings.weekday is 'Day of the week weekly digests are sent. 0 is Sunday.';
+comment on column digest_settings.hour is 'Hour of the day in time_zone digests are sent';
+comment on column digest_settings.feed_ids is 'Feeds included in the digest. null includes all subscribed feeds.';
+comment on column digest_settings.mark_read is 'Mark the items in a digest read when it is sent';
+
+grant select, insert, update, delete on digest_settings to {{.app_user}};
+
+---- create above / drop below ----
+
+drop table digest_settings;
@@ -0,0 +1,21 @@
+alter table users
+  add column is_admin boolean not null default false,
+  add column disabled boolean not null default false;
+
+comment on column users.is_admin is 'Administrators can manage all users and view the health of all feeds';
+comment on column users.disabled is 'Disabled users cannot log in or use existing sessions and API tokens';
+
+-- Deleting a user deletes their password resets like the rest of their data.
+alter table password_resets
+  drop constraint password_resets_user_id_fkey,
+  add constraint password_resets_user_id_fkey foreign key (user_id) references users on delete cascade;
+
+---- create above / drop below ----
+
+alter table password_resets
+  drop constraint password_resets_user_id_fkey,
+  add constraint password_resets_user_id_fkey foreign key (user_id) references users;
+
+alter table users
+  drop column disabled,
+  drop column is_admin;
@@ -1,22 +1,29 @@
-import { writable, get } from 'svelte/store';
+import { writable } from 'svelte/store';
 import { session } from './session.js';
 
 export const ajaxPending = writable(0);
 
+// The session is sent in an HttpOnly cookie. Requests that change state must also send the CSRF token which the server
+// sets in a cookie that scripts can read.
+function csrfToken() {
+	if (typeof document === 'undefined') return null;
+	const cookie = document.cookie.split('; ').find(c => c.startsWith('csrfToken='));
+	return cookie ? cookie.substring('csrfToken='.length) : null;
+}
+
 class APIClient {
 	async request(url, method = 'GET', options = {}) {
 		ajaxPending.update(n => n + 1);
 
 		try {
-			const currentSession = get(session);
 			const headers = {
 				'Content-Type': 'application/json',
 				...options.headers
 			};
 
-			// Add auth header if session exists
-			if (currentSession.id) {
-				headers['X-Authentication'] = currentSession.id;
+			const token = csrfToken();
+			if (token && method !== 'GET') {
+				headers['X-CSRF-Token'] = token;
 			}
 
 			// Don't set Content-Type for FormData (browser will set it with boundary)
@@ -36,7 +43,7 @@ class APIClient {
 				: await response.text();
 
 			// Handle session expiration
-			if (response.status === 403 && data === 'Bad or missing X-Authentication header') {
+			if (response.status === 403 && data === 'Bad or missing session') {
 				session.clear();
 				if (typeof window !== 'undefined') {
 					window.location.href = '/login';
@@ -67,6 +74,10 @@ class APIClient {
 		return this.request(url, 'PATCH', { body: JSON.stringify(data) });
 	}
 
+	async put(url, data) {
+		return this.request(url, 'PUT', { body: JSON.stringify(data) });
+	}
+
 	async delete(url) {
 		return this.request(url, 'DELETE');
 	}
@@ -77,8 +88,7 @@ class APIClient {
 	}
 
 	async logout() {
-		const currentSession = get(session);
-		return this.delete(`/api/sessions/${currentSession.id}`);
+		return this.delete('/api/sessions/current');
 	}
 
 	async register(registration) {
@@ -93,6 +103,40 @@ class APIClient {
 		return this.post('/api/reset_password', reset);
 	}
 
+	async verifyEmail(token) {
+		return this.post('/api/verify_email', { token });
+	}
+
+	// Passkeys. The options from the server are in the JSON form browsers parse with PublicKeyCredential and credentials
+	// are sent back with toJSON().
+	async passkeyLogin() {
+		const { ceremonyID, options } = await this.post('/api/webauthn/login/begin', {});
+		const credential = await navigator.credentials.get({
+			publicKey: PublicKeyCredential.parseRequestOptionsFromJSON(options.publicKey)
+		});
+		return this.post('/api/webauthn/login/finish', { ceremonyID, credential: credential.toJSON() });
+	}
+
+	async addPasskey(password, name) {
+		const { ceremonyID, options } = await this.post('/api/webauthn/registration/begin', { password });
+		const credential = await navigator.credentials.create({
+			publicKey: PublicKeyCredential.parseCreationOptionsFromJSON(options.publicKey)
+		});
+		return this.post('/api/webauthn/registration/finish', { ceremonyID, name, credential: credential.toJSON() });
+	}
+
+	// Single sign-on. The login itself is a redirect to /api/oidc/login. This fails if single sign-on is not configured.
+	async getOIDC() {
+		return this.get('/api/oidc');
+	}
+
+	// Behind an authenticating reverse proxy the user is already logged in. This returns the account if so and null
+	// otherwise. It bypasses request() so a missing session does not redirect to the login page.
+	async getProxyAccount() {
+		const response = await fetch('/api/account');
+		return response.ok ? response.json() : null;
+	}
+
 	// Account endpoints
 	async getAccount() {
 		return this.get('/api/account');
@@ -102,6 +146,18 @@ class APIClient {
 		return this.patch('/api/account', update);
 	}
 
+	async resendEmailVerification() {
+		return this.post('/api/account/email_verification', {});
+	}
+
+	async getDigest() {
+		return this.get('/api/account/digest');
+	}
+
+	async updateDigest(digest) {
+		return this.put('/api/account/digest', digest);
+	}
+
 	// Feed endpoints
 	async getFeeds() {
 		const data = await this.get('/api/feeds');
@@ -146,6 +202,12 @@ class APIClient {
 		return this.post('/api/items/unread/mark_multiple_read', { itemIDs });
 	}
 
+	// Server-sent events of changes to unread items. EventSource cannot send headers so this relies on the session
+	// cookie.
+	events() {
+		return new EventSource('/api/events');
+	}
+
 	async getArchivedItems() {
 		const data = await this.get('/api/items/archived');
 		// Convert Unix timestamps to Date objects
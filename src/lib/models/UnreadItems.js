@@ -18,6 +18,42 @@ export default class UnreadItems {
 		this.changed.update((n) => n + 1);
 	}
 
+	// Keeps items current with changes made by feed updates and other tabs. Returns a function that stops listening.
+	listen() {
+		const events = api.events();
+		events.addEventListener('items_created', () => this.fetchNew());
+		events.addEventListener('resync', () => this.fetchNew());
+		events.addEventListener('items_read', (e) => this.removeRead(JSON.parse(e.data).itemIDs));
+		return () => events.close();
+	}
+
+	// Adds unread items that are not already loaded without disturbing the existing items.
+	async fetchNew() {
+		const data = await api.getUnreadItems();
+		const loadedIDs = new Set(this.items.map((i) => i.id));
+		const newItems = data
+			.filter((record) => !loadedIDs.has(record.id))
+			.map((record) => {
+				const model = new Item();
+				Object.assign(model, record);
+				return model;
+			});
+		if (newItems.length > 0) {
+			this.items = [...this.items, ...newItems];
+			this.changed.update((n) => n + 1);
+		}
+	}
+
+	// Removes items that were marked read elsewhere. Items read in this tab stay until the list is refreshed.
+	removeRead(itemIDs) {
+		const readIDs = new Set(itemIDs);
+		const items = this.items.filter((i) => i.isRead || !readIDs.has(i.id));
+		if (items.length !== this.items.length) {
+			this.items = items;
+			this.changed.update((n) => n + 1);
+		}
+	}
+
 	async markAllRead() {
 		const itemIDs = this.items.map((i) => i.id);
 		await api.markAllRead(itemIDs);
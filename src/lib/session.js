@@ -1,8 +1,9 @@
 import { writable } from 'svelte/store';
 
 function createSession() {
-	// Load initial session from localStorage
-	let initialSession = { id: null, name: null };
+	// Load initial session from localStorage. The session ID itself is kept in an HttpOnly cookie that scripts cannot
+	// read.
+	let initialSession = { name: null };
 	if (typeof localStorage !== 'undefined') {
 		const stored = localStorage.getItem('session');
 		if (stored) {
@@ -37,7 +38,7 @@ function createSession() {
 			if (typeof localStorage !== 'undefined') {
 				localStorage.clear();
 			}
-			set({ id: null, name: null });
+			set({ name: null });
 		},
 		isAuthenticated: () => {
 			if (typeof localStorage === 'undefined') return false;
@@ -45,7 +46,7 @@ function createSession() {
 			if (!stored) return false;
 			try {
 				const session = JSON.parse(stored);
-				return !!session.id;
+				return !!session.name;
 			} catch (e) {
 				return false;
 			}
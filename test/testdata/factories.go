@@ -2,7 +2,7 @@ package testdata
 
 import (
 	"context"
-	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"sync/atomic"
 	"testing"
@@ -11,9 +11,8 @@ import (
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgxutil"
-	"github.com/jackc/tpr/backend/data"
+	"github.com/jackc/tpr/backend/pwhash"
 	"github.com/stretchr/testify/require"
-	"golang.org/x/crypto/scrypt"
 )
 
 var counter atomic.Int64
@@ -24,30 +23,11 @@ type DB interface {
 }
 
 func CreateUser(t testing.TB, db DB, ctx context.Context, attrs map[string]any) map[string]any {
-	setPassword := func(u *data.User, password string) error {
-		salt := make([]byte, 8)
-		_, err := rand.Read(salt)
-		if err != nil {
-			return err
-		}
-
-		digest, err := scrypt.Key([]byte(password), salt, 16384, 8, 1, 32)
-		if err != nil {
-			return err
-		}
-
-		u.PasswordDigest = digest
-		u.PasswordSalt = salt
-
-		return nil
-	}
-
 	if password, ok := attrs["password"]; ok {
-		du := &data.User{}
-		setPassword(du, fmt.Sprint(password))
+		hash, err := pwhash.Hash(fmt.Sprint(password))
+		require.NoError(t, err)
 		delete(attrs, "password")
-		attrs["password_digest"] = du.PasswordDigest
-		attrs["password_salt"] = du.PasswordSalt
+		attrs["password_hash"] = hash
 	}
 
 	if _, ok := attrs["name"]; !ok {
@@ -102,9 +82,15 @@ func CreateItem(t testing.TB, db DB, ctx context.Context, attrs map[string]any)
 func CreatePasswordReset(t testing.TB, db DB, ctx context.Context, attrs map[string]any) map[string]any {
 	n := counter.Add(1)
 
-	if _, ok := attrs["token"]; !ok {
-		attrs["token"] = fmt.Sprintf("token%v", n)
+	// Only the digest of the token is stored.
+	token, ok := attrs["token"]
+	if !ok {
+		token = fmt.Sprintf("token%v", n)
 	}
+	delete(attrs, "token")
+	digest := sha256.Sum256([]byte(fmt.Sprint(token)))
+	attrs["token_digest"] = digest[:]
+
 	if _, ok := attrs["title"]; !ok {
 		attrs["email"] = fmt.Sprintf("user%v@example.com", n)
 	}